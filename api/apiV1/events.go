@@ -0,0 +1,80 @@
+package apiV1
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// how often a comment is sent down an idle event stream, so that it isn't closed by anything in between
+var eventKeepAlive = 15 * time.Second
+
+// writes a single server-sent event
+func writeServerEvent(w http.ResponseWriter, id string, event string, data []byte) {
+	fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", id, event, data)
+}
+
+func writeChangeEvent(w http.ResponseWriter, event state.Event) {
+	data, _ := json.Marshal(event)
+	writeServerEvent(w, event.ID(), "change", data)
+}
+
+// EventStream closure returning http handler that streams the changes to the state as server-sent events
+// a client resumes after the last event it saw with the Last-Event-ID header, or the after query parameter,
+// if those events are no longer held, were from before the daemon restarted, or neither is given,
+// the stream starts with a state event holding the whole state
+func EventStream(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			failResponse(w, http.StatusInternalServerError, "streaming isn't supported")
+			return
+		}
+		after := r.Header.Get("Last-Event-ID")
+		if after == "" {
+			after = r.URL.Query().Get("after")
+		}
+		var boot string
+		var sequence uint64
+		if after != "" {
+			var err error
+			boot, sequence, err = state.ParseEventID(after)
+			if err != nil {
+				failResponse(w, http.StatusBadRequest, "invalid event id: "+after)
+				return
+			}
+		}
+		sub := store.Subscribe(boot, sequence)
+		defer sub.Cancel()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		if sub.State != nil {
+			writeServerEvent(w, state.EventID(sub.Boot, sub.Sequence), "state", sub.State)
+		}
+		for _, event := range sub.Backlog {
+			writeChangeEvent(w, event)
+		}
+		flusher.Flush()
+		keepAlive := time.NewTicker(eventKeepAlive)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case event, ok := <-sub.Events:
+				if !ok {
+					// the client fell too far behind, it can reconnect and resume from where it got to
+					return
+				}
+				writeChangeEvent(w, event)
+			case <-keepAlive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+			case <-r.Context().Done():
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
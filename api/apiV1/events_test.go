@@ -0,0 +1,107 @@
+package apiV1
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+type serverEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// reads the next event from a stream, skipping comments
+func readServerEvent(reader *bufio.Reader) (serverEvent, error) {
+	var event serverEvent
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return event, err
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event.event != "":
+			return event, nil
+		case strings.HasPrefix(line, "id: "):
+			event.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeName("sim")
+	server := httptest.NewServer(http.HandlerFunc(EventStream(store)))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	assert.NoError(err)
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+	reader := bufio.NewReader(resp.Body)
+	event, err := readServerEvent(reader)
+	assert.NoError(err)
+	assert.Equal("state", event.event)
+	boot, sequence, err := state.ParseEventID(event.id)
+	assert.NoError(err)
+	assert.NotEmpty(boot)
+	assert.Equal(uint64(1), sequence)
+	assert.Contains(event.data, `"codeName":"sim"`)
+
+	store.SetCodeName("other")
+	event, err = readServerEvent(reader)
+	assert.NoError(err)
+	assert.Equal("change", event.event)
+	assert.Equal(boot+"-2", event.id)
+	var change state.Event
+	assert.NoError(json.Unmarshal([]byte(event.data), &change))
+	assert.Equal("codeName", change.Field)
+	assert.Equal(`"other"`, string(change.New))
+	resp.Body.Close()
+
+	// a reconnecting client gets what it missed
+	store.SetCodeName("third")
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Last-Event-ID", boot+"-2")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	defer resp.Body.Close()
+	event, err = readServerEvent(bufio.NewReader(resp.Body))
+	assert.NoError(err)
+	assert.Equal("change", event.event)
+	assert.Equal(boot+"-3", event.id)
+	assert.Contains(event.data, `"new":"third"`)
+
+	// one from before the daemon restarted gets the whole state
+	req.Header.Set("Last-Event-ID", "earlier-2")
+	resp, err = http.DefaultClient.Do(req)
+	assert.NoError(err)
+	defer resp.Body.Close()
+	event, err = readServerEvent(bufio.NewReader(resp.Body))
+	assert.NoError(err)
+	assert.Equal("state", event.event)
+	assert.Equal(boot+"-3", event.id)
+	assert.Contains(event.data, `"codeName":"third"`)
+}
+
+func TestEventStreamBadSequence(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	req, _ := http.NewRequest("GET", "/events/stream?after=latest", nil)
+	rr := httptest.NewRecorder()
+	EventStream(store)(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+	assert.Contains(rr.Body.String(), "invalid event id")
+}
@@ -0,0 +1,54 @@
+package apiV1
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/files"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+type fetchFilesStruct struct {
+	Files []files.FetchRequest `json:"files"`
+}
+
+// FetchFiles closure returning http handler that has the daemon download files from urls into /hpcaas/files
+// the downloads happen in the background, their progress is reported under fetches in the state
+func FetchFiles(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	schema := getJSONValidator(&fetchFilesStruct{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = validatePOSTRequest(body, schema)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var requestStruct = &fetchFilesStruct{}
+		err = json.Unmarshal(body, requestStruct)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if len(requestStruct.Files) == 0 {
+			failResponse(w, http.StatusBadRequest, "No files to fetch")
+			return
+		}
+		fetches, err := files.Fetch(store, requestStruct.Files)
+		if err == files.ErrFetchInProgress {
+			failResponse(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		jsonResponse(w, "success", map[string]interface{}{
+			"fetches": fetches,
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package apiV1
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchFiles(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "files")
+	defer os.RemoveAll(dir)
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FilesDirectory: dir})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	body := `{"files": [{"url": "` + server.URL + `/input.dat", "sha256": "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"}]}`
+	req, _ := http.NewRequest("POST", "/fetch/", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+	FetchFiles(store)(rr, req)
+	assert.Equal(http.StatusAccepted, rr.Code)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.GetFetches()["input.dat"].Status != state.FetchDoneStatus && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "input.dat"))
+	assert.Equal([]byte("0123456789"), contents)
+
+	req, _ = http.NewRequest("POST", "/fetch/", bytes.NewReader([]byte(`{"files": [{"url": "file:///etc/passwd"}]}`)))
+	rr = httptest.NewRecorder()
+	FetchFiles(store)(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+}
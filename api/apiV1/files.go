@@ -0,0 +1,85 @@
+package apiV1
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/files"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// CodeParameterFile receives one or more files as multipart/form-data and places each at /hpcaas/files/<name>
+// every file is streamed to disk as it arrives, and only moved into place once the whole request has been received
+func CodeParameterFile(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		conf, _ := store.GetDaemonConfiguration()
+		var staged []*files.Staged
+		// anything that wasn't committed is thrown away
+		defer func() {
+			for _, s := range staged {
+				s.Discard()
+			}
+		}()
+		var total int64
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				failResponse(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			// form fields that aren't files are ignored
+			if part.FileName() == "" {
+				part.Close()
+				continue
+			}
+			name, err := files.SanitiseName(part.FileName())
+			if err != nil {
+				failResponse(w, http.StatusBadRequest, err.Error()+": "+part.FileName())
+				return
+			}
+			limit := conf.FilesMaxFileSize
+			if conf.FilesMaxUploadSize > 0 {
+				remaining := conf.FilesMaxUploadSize - total
+				if remaining <= 0 {
+					failResponse(w, http.StatusRequestEntityTooLarge, "Upload is larger than allowed")
+					return
+				}
+				if limit <= 0 || remaining < limit {
+					limit = remaining
+				}
+			}
+			s, err := files.Stage(store, name, part, limit)
+			part.Close()
+			if err == files.ErrTooLarge {
+				failResponse(w, http.StatusRequestEntityTooLarge, err.Error()+": "+name)
+				return
+			} else if err != nil {
+				failResponse(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			staged = append(staged, s)
+			total += s.Size
+		}
+		if len(staged) == 0 {
+			failResponse(w, http.StatusBadRequest, "No files were sent")
+			return
+		}
+		for _, s := range staged {
+			if err := s.Commit(); err != nil {
+				failResponse(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"files": staged,
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package apiV1
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// build a multipart body with a file part for each name
+func multipartFiles(t *testing.T, contents map[string]string) (*bytes.Buffer, string) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	mw.WriteField("comment", "not a file")
+	for name, data := range contents {
+		part, err := mw.CreateFormFile("file", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write([]byte(data))
+	}
+	mw.Close()
+	return body, mw.FormDataContentType()
+}
+
+func postFiles(t *testing.T, store state.Store, contents map[string]string) *httptest.ResponseRecorder {
+	body, contentType := multipartFiles(t, contents)
+	req, _ := http.NewRequest("POST", "/code-parameter-file/", body)
+	req.Header.Set("Content-Type", contentType)
+	rr := httptest.NewRecorder()
+	CodeParameterFile(store)(rr, req)
+	return rr
+}
+
+func TestCodeParameterFile(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "files")
+	defer os.RemoveAll(dir)
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FilesDirectory: dir})
+
+	rr := postFiles(t, store, map[string]string{"input.dat": "0123456789", "../mesh.msh": "mesh"})
+	assert.Equal(http.StatusOK, rr.Code)
+	var resp struct {
+		Status string
+		Data   struct {
+			Files []struct {
+				Name   string
+				Size   int64
+				SHA256 string
+			}
+		}
+	}
+	assert.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal("success", resp.Status)
+	assert.Len(resp.Data.Files, 2)
+	for _, file := range resp.Data.Files {
+		if file.Name == "input.dat" {
+			assert.Equal("84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", file.SHA256)
+		}
+	}
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "input.dat"))
+	assert.Equal([]byte("0123456789"), contents)
+	contents, _ = ioutil.ReadFile(filepath.Join(dir, "mesh.msh"))
+	assert.Equal([]byte("mesh"), contents)
+	_, ok := store.GetFiles()["mesh.msh"]
+	assert.True(ok)
+}
+
+func TestCodeParameterFileLimits(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "files")
+	defer os.RemoveAll(dir)
+	store.SetDaemonConfiguration(state.DaemonConfiguration{
+		FilesDirectory:     dir,
+		FilesMaxFileSize:   10,
+		FilesMaxUploadSize: 15,
+	})
+
+	rr := postFiles(t, store, map[string]string{"big.dat": "01234567890"})
+	assert.Equal(http.StatusRequestEntityTooLarge, rr.Code)
+
+	// each file is small enough, but not together
+	rr = postFiles(t, store, map[string]string{"a.dat": "0123456789", "b.dat": "0123456789"})
+	assert.Equal(http.StatusRequestEntityTooLarge, rr.Code)
+	// nothing from a failed request is kept
+	entries, _ := ioutil.ReadDir(dir)
+	for _, entry := range entries {
+		assert.Equal(".incoming", entry.Name())
+	}
+	incoming, _ := ioutil.ReadDir(filepath.Join(dir, ".incoming"))
+	assert.Len(incoming, 0)
+
+	rr = postFiles(t, store, map[string]string{"..": "nope"})
+	assert.Equal(http.StatusBadRequest, rr.Code)
+
+	rr = postFiles(t, store, map[string]string{})
+	assert.Equal(http.StatusBadRequest, rr.Code)
+
+	req, _ := http.NewRequest("POST", "/code-parameter-file/", bytes.NewReader([]byte("{}")))
+	req.Header.Set("Content-Type", "application/json")
+	rr = httptest.NewRecorder()
+	CodeParameterFile(store)(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+}
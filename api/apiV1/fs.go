@@ -0,0 +1,149 @@
+package apiV1
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/gorilla/mux"
+	"github.com/mrmagooey/hpcaas-container-daemon/files"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// turn an error from the file management api into a response
+func fsFail(w http.ResponseWriter, err error) {
+	switch {
+	case err == files.ErrNoRoot:
+		failResponse(w, http.StatusNotFound, err.Error())
+	case err == files.ErrOutsideRoot, err == files.ErrSymlink, err == files.ErrReadOnly, err == files.ErrIsRoot, err == files.ErrNotRegular:
+		failResponse(w, http.StatusForbidden, err.Error())
+	case err == files.ErrTooLarge:
+		failResponse(w, http.StatusRequestEntityTooLarge, err.Error())
+	case os.IsNotExist(err):
+		failResponse(w, http.StatusNotFound, "no such file or directory")
+	case os.IsExist(err):
+		failResponse(w, http.StatusConflict, "already exists")
+	default:
+		failResponse(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// the root and path of the request
+func fsTarget(store state.Store, r *http.Request) (files.Root, string, error) {
+	vars := mux.Vars(r)
+	root, err := files.GetRoot(store, vars["root"])
+	return root, vars["path"], err
+}
+
+// FileRoots lists the roots that the file management api can reach
+func FileRoots(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, "success", map[string]interface{}{
+			"roots": files.Roots(store),
+		})
+	}
+}
+
+// FileRootGet lists a directory or downloads a file within a root
+// with ?stat=true the file or directory is described instead
+func FileRootGet(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root, relPath, err := fsTarget(store, r)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		entry, err := files.StatInRoot(root, relPath)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		if r.URL.Query().Get("stat") == "true" {
+			jsonResponse(w, "success", map[string]interface{}{
+				"entry": entry,
+			})
+			return
+		}
+		if entry.Type == "directory" {
+			entries, err := files.ListInRoot(root, relPath)
+			if err != nil {
+				fsFail(w, err)
+				return
+			}
+			jsonResponse(w, "success", map[string]interface{}{
+				"entries": entries,
+			})
+			return
+		}
+		// only regular files are downloaded, opening e.g. a fifo could block
+		if entry.Type != "file" {
+			fsFail(w, files.ErrNotRegular)
+			return
+		}
+		f, info, err := files.OpenInRoot(root, relPath)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		defer f.Close()
+		w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	}
+}
+
+// FileRootPut uploads the request body to a file within a root, replacing any file already there
+func FileRootPut(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root, relPath, err := fsTarget(store, r)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		conf, _ := store.GetDaemonConfiguration()
+		entry, err := files.WriteInRoot(root, relPath, r.Body, conf.FilesMaxFileSize)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"entry": entry,
+		})
+	}
+}
+
+// FileRootMkdir creates a directory, and any parents, within a root
+func FileRootMkdir(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root, relPath, err := fsTarget(store, r)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		entry, err := files.MkdirInRoot(root, relPath)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"entry": entry,
+		})
+	}
+}
+
+// FileRootDelete deletes a file, symlink or empty directory within a root
+func FileRootDelete(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		root, relPath, err := fsTarget(store, r)
+		if err != nil {
+			fsFail(w, err)
+			return
+		}
+		if err := files.RemoveInRoot(root, relPath); err != nil {
+			fsFail(w, err)
+			return
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"message": "deleted",
+		})
+	}
+}
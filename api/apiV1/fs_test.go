@@ -0,0 +1,86 @@
+package apiV1
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func fsRouter(store state.Store) *mux.Router {
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/fs/").HandlerFunc(FileRoots(store))
+	r.Methods("GET").Path("/fs/{root}/{path:.*}").HandlerFunc(FileRootGet(store))
+	r.Methods("PUT").Path("/fs/{root}/{path:.+}").HandlerFunc(FileRootPut(store))
+	r.Methods("POST").Path("/fs/{root}/{path:.+}").HandlerFunc(FileRootMkdir(store))
+	r.Methods("DELETE").Path("/fs/{root}/{path:.+}").HandlerFunc(FileRootDelete(store))
+	return r
+}
+
+func fsRequest(store state.Store, method string, url string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	rr := httptest.NewRecorder()
+	fsRouter(store).ServeHTTP(rr, req)
+	return rr
+}
+
+func TestFileManagement(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "fs")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "rw"), 0755)
+	os.MkdirAll(filepath.Join(dir, "ro"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "ro", "code.log"), []byte("0123456789"), 0644)
+	os.Symlink("/etc/passwd", filepath.Join(dir, "ro", "passwd"))
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FileRoots: map[string]state.FileRoot{
+		"scratch": {Path: filepath.Join(dir, "rw"), Access: "rw"},
+		"logs":    {Path: filepath.Join(dir, "ro"), Access: "ro"},
+	}})
+
+	rr := fsRequest(store, "GET", "/fs/", nil)
+	assert.Contains(rr.Body.String(), `"name":"scratch"`)
+
+	rr = fsRequest(store, "GET", "/fs/logs/", nil)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Contains(rr.Body.String(), `"path":"code.log"`)
+	assert.Contains(rr.Body.String(), `"type":"symlink"`)
+
+	rr = fsRequest(store, "GET", "/fs/logs/code.log?stat=true", nil)
+	assert.Contains(rr.Body.String(), `"size":10`)
+
+	req, _ := http.NewRequest("GET", "/fs/logs/code.log", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rr = httptest.NewRecorder()
+	fsRouter(store).ServeHTTP(rr, req)
+	assert.Equal(http.StatusPartialContent, rr.Code)
+	assert.Equal("234", rr.Body.String())
+
+	assert.Equal(http.StatusForbidden, fsRequest(store, "GET", "/fs/logs/passwd", nil).Code)
+	// nothing is writing to the fifo, it is refused rather than waited on
+	syscall.Mkfifo(filepath.Join(dir, "ro", "pipe"), 0644)
+	assert.Equal(http.StatusForbidden, fsRequest(store, "GET", "/fs/logs/pipe", nil).Code)
+	// the router redirects to the cleaned path, which isn't within any root
+	assert.NotEqual(http.StatusOK, fsRequest(store, "GET", "/fs/logs/../../etc/passwd", nil).Code)
+	assert.Equal(http.StatusForbidden, fsRequest(store, "PUT", "/fs/logs/new.txt", []byte("x")).Code)
+	assert.Equal(http.StatusForbidden, fsRequest(store, "DELETE", "/fs/logs/code.log", nil).Code)
+	assert.Equal(http.StatusNotFound, fsRequest(store, "GET", "/fs/nope/", nil).Code)
+	assert.Equal(http.StatusNotFound, fsRequest(store, "GET", "/fs/logs/missing", nil).Code)
+
+	assert.Equal(http.StatusOK, fsRequest(store, "POST", "/fs/scratch/inputs", nil).Code)
+	rr = fsRequest(store, "PUT", "/fs/scratch/inputs/deck.in", []byte("steps=1"))
+	assert.Equal(http.StatusOK, rr.Code)
+	written, _ := ioutil.ReadFile(filepath.Join(dir, "rw", "inputs", "deck.in"))
+	assert.Equal("steps=1", string(written))
+	assert.Equal(http.StatusOK, fsRequest(store, "DELETE", "/fs/scratch/inputs/deck.in", nil).Code)
+	_, err := os.Stat(filepath.Join(dir, "rw", "inputs", "deck.in"))
+	assert.True(os.IsNotExist(err))
+}
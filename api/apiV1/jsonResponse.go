@@ -21,3 +21,11 @@ func jsonResponse(w http.ResponseWriter, status string, data map[string]interfac
 
 	w.Write(respBytes)
 }
+
+// write a json failure along with a http status code
+func failResponse(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	jsonResponse(w, "fail", map[string]interface{}{
+		"message": message,
+	})
+}
@@ -0,0 +1,126 @@
+package apiV1
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/container"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// the ETag of a version of the code params
+func paramsETag(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// ifMatch returns whether a version of the params matches the request's If-Match header
+// nil is returned if the header is missing or *, in which case any version will do
+// a header that can't be a version never matches
+func ifMatch(r *http.Request) func(uint64) bool {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return nil
+	}
+	var versions []uint64
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(tag), "W/"), `"`)
+		if v, err := strconv.ParseUint(tag, 10, 64); err == nil {
+			versions = append(versions, v)
+		}
+	}
+	return func(current uint64) bool {
+		for _, v := range versions {
+			if v == current {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// the If-Match header didn't match the current version of the params
+func paramsPreconditionFailed(w http.ResponseWriter, version uint64) {
+	w.Header().Set("ETag", paramsETag(version))
+	failResponse(w, http.StatusPreconditionFailed, "code parameters have changed")
+}
+
+// GetCodeParams returns the code params with their version, which is also the ETag
+func GetCodeParams(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, version := store.GetVersionedCodeParams()
+		w.Header().Set("ETag", paramsETag(version))
+		jsonResponse(w, "success", map[string]interface{}{
+			"codeParameters": params,
+			"version":        version,
+		})
+	}
+}
+
+// writeVersionedParams changes the params with change, checks them against the code's schema and saves them,
+// params the schema marks immutable can't be changed while the code is running
+// honouring the request's If-Match header and setting the ETag of the new version
+// if they are changed by someone else in the meantime, without an If-Match the write is tried again, otherwise it fails
+// ok is false if a response has already been written
+func writeVersionedParams(store state.Store, w http.ResponseWriter, r *http.Request, change func(state.CodeParams) state.CodeParams) (uint64, bool) {
+	matches := ifMatch(r)
+	codeName, _ := store.GetCodeName()
+	for {
+		current, version := store.GetVersionedCodeParams()
+		if matches != nil && !matches(version) {
+			paramsPreconditionFailed(w, version)
+			return 0, false
+		}
+		params, err := container.ValidateCodeParams(codeName, change(current), false)
+		if err == nil {
+			err = container.CheckImmutableParams(store, codeName, current, params)
+		}
+		if paramErrors, ok := err.(container.ParamErrors); ok {
+			paramsFail(w, paramErrors)
+			return 0, false
+		} else if err != nil {
+			jsonResponse(w, "error", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return 0, false
+		}
+		newVersion, err := store.SetVersionedCodeParams(params, version)
+		if err == state.ErrParamsVersionMismatch {
+			continue
+		}
+		// write to disk, unless a newer version has been saved in the meantime, whose writer writes that instead
+		if err := container.WriteCodeParams(store, params, newVersion); err != nil {
+			jsonResponse(w, "error", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return 0, false
+		}
+		w.Header().Set("ETag", paramsETag(newVersion))
+		return newVersion, true
+	}
+}
+
+// PatchCodeParams merges the params in the body over the existing params, as a json merge patch,
+// so a null removes a param and objects are merged
+func PatchCodeParams(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var patch state.CodeParams
+		if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		version, ok := writeVersionedParams(store, w, r, func(current state.CodeParams) state.CodeParams {
+			return state.MergeCodeParams(current, patch)
+		})
+		if !ok {
+			return
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"message": "parameter accepted",
+			"version": version,
+		})
+	}
+}
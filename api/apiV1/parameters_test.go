@@ -0,0 +1,79 @@
+package apiV1
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetTypedCodeParams(state.CodeParams{"steps": json.Number("10")})
+	_, version := store.GetVersionedCodeParams()
+	req, _ := http.NewRequest("GET", "/code-parameters/", nil)
+	rr := httptest.NewRecorder()
+	GetCodeParams(store)(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(paramsETag(version), rr.Header().Get("ETag"))
+	var resp struct {
+		Data struct {
+			CodeParameters map[string]interface{}
+			Version        uint64
+		}
+	}
+	json.Unmarshal(rr.Body.Bytes(), &resp)
+	assert.Equal(map[string]interface{}{"steps": float64(10)}, resp.Data.CodeParameters)
+	assert.Equal(version, resp.Data.Version)
+}
+
+func patchParams(store state.Store, body string, ifMatch string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PATCH", "/code-parameters/", bytes.NewReader([]byte(body)))
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	rr := httptest.NewRecorder()
+	PatchCodeParams(store)(rr, req)
+	return rr
+}
+
+func TestPatchCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeName("")
+	store.SetTypedCodeParams(state.CodeParams{"steps": json.Number("10"), "name": "run", "grid": map[string]interface{}{"nx": json.Number("64")}})
+	_, version := store.GetVersionedCodeParams()
+
+	rr := patchParams(store, `{"steps": 20, "name": null, "grid": {"ny": 32}}`, "")
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(paramsETag(version+1), rr.Header().Get("ETag"))
+	assert.JSONEq(`{"status":"success","data":{"message":"parameter accepted","version":`+strconv.FormatUint(version+1, 10)+`}}`, rr.Body.String())
+	params, _ := store.GetTypedCodeParams()
+	written, _ := json.Marshal(params)
+	assert.JSONEq(`{"steps": 20, "grid": {"nx": 64, "ny": 32}}`, string(written))
+	strings, _ := store.GetCodeParams()
+	assert.Equal(map[string]string{"steps": "20", "grid": `{"nx":64,"ny":32}`}, strings)
+
+	// the write is based on an old version, so is refused
+	rr = patchParams(store, `{"steps": 30}`, paramsETag(version))
+	assert.Equal(http.StatusPreconditionFailed, rr.Code)
+	assert.Equal(paramsETag(version+1), rr.Header().Get("ETag"))
+	params, _ = store.GetTypedCodeParams()
+	assert.Equal(json.Number("20"), params["steps"])
+
+	// any of a list of tags, or *, will do
+	rr = patchParams(store, `{"steps": 30}`, `"1000", `+paramsETag(version+1))
+	assert.Equal(http.StatusOK, rr.Code)
+	rr = patchParams(store, `{"steps": 40}`, "*")
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal(paramsETag(version+3), rr.Header().Get("ETag"))
+
+	rr = patchParams(store, `[1, 2]`, "")
+	assert.Contains(rr.Body.String(), "fail")
+}
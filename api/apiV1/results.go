@@ -0,0 +1,82 @@
+package apiV1
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/gorilla/mux"
+	"github.com/mrmagooey/hpcaas-container-daemon/results"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// turn an error from resolving a results path into a response
+func resultsPathFail(w http.ResponseWriter, err error) {
+	if err == results.ErrOutsideResults {
+		failResponse(w, http.StatusForbidden, err.Error())
+	} else if os.IsNotExist(err) {
+		failResponse(w, http.StatusNotFound, "no such results file")
+	} else {
+		failResponse(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// Results lists every file in the results directory along with its size and checksum
+func Results(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files, err := results.ListFiles(store, "")
+		if err != nil {
+			resultsPathFail(w, err)
+			return
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"files": files,
+		})
+	}
+}
+
+// ResultFile downloads a single file from the results directory, honouring Range and conditional headers
+// if the path is a directory its files are listed instead, or with ?archive=tar a tar of the directory is streamed
+func ResultFile(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		relPath := mux.Vars(r)["path"]
+		fullPath, err := results.ResolvePath(store, relPath)
+		if err != nil {
+			resultsPathFail(w, err)
+			return
+		}
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			resultsPathFail(w, err)
+			return
+		}
+		if info.IsDir() {
+			if r.URL.Query().Get("archive") == "tar" {
+				w.Header().Set("Content-Type", "application/x-tar")
+				w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base("/"+relPath)+".tar"))
+				// the headers have gone by the time anything can fail, all we can do is cut the stream short
+				results.WriteTar(w, fullPath)
+				return
+			}
+			files, err := results.ListFiles(store, relPath)
+			if err != nil {
+				resultsPathFail(w, err)
+				return
+			}
+			jsonResponse(w, "success", map[string]interface{}{
+				"files": files,
+			})
+			return
+		}
+		f, err := os.Open(fullPath)
+		if err != nil {
+			resultsPathFail(w, err)
+			return
+		}
+		defer f.Close()
+		// cheap to compute, and changes whenever the file does
+		w.Header().Set("ETag", fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size()))
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	}
+}
@@ -0,0 +1,141 @@
+package apiV1
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// a store of its own, with a results directory holding a file and a nested file
+func setupResultsDir(t *testing.T) (state.Store, string) {
+	dir, err := ioutil.TempDir("", "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "out.txt"), []byte("0123456789"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "nested.txt"), []byte("nested"), 0644)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetDaemonConfiguration(state.DaemonConfiguration{ResultsDirectory: dir})
+	return store, dir
+}
+
+func resultsRouter(store state.Store) *mux.Router {
+	r := mux.NewRouter()
+	r.Methods("GET").Path("/results/").HandlerFunc(Results(store))
+	r.Methods("GET").Path("/results/{path:.+}").HandlerFunc(ResultFile(store))
+	return r
+}
+
+func TestResultsList(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupResultsDir(t)
+	defer os.RemoveAll(dir)
+	req, _ := http.NewRequest("GET", "/results/", nil)
+	rr := httptest.NewRecorder()
+	resultsRouter(store).ServeHTTP(rr, req)
+	var resp struct {
+		Status string
+		Data   struct {
+			Files []struct {
+				Path   string
+				Size   int64
+				SHA256 string
+			}
+		}
+	}
+	assert.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal("success", resp.Status)
+	if assert.Len(resp.Data.Files, 2) {
+		assert.Equal("out.txt", resp.Data.Files[0].Path)
+		assert.Equal(int64(10), resp.Data.Files[0].Size)
+		assert.Equal("84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", resp.Data.Files[0].SHA256)
+		assert.Equal("sub/nested.txt", resp.Data.Files[1].Path)
+	}
+}
+
+func TestResultFileDownload(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupResultsDir(t)
+	defer os.RemoveAll(dir)
+	router := resultsRouter(store)
+
+	req, _ := http.NewRequest("GET", "/results/out.txt", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("0123456789", rr.Body.String())
+	etag := rr.Header().Get("ETag")
+	assert.NotEmpty(etag)
+
+	// range
+	req, _ = http.NewRequest("GET", "/results/out.txt", nil)
+	req.Header.Set("Range", "bytes=2-4")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusPartialContent, rr.Code)
+	assert.Equal("234", rr.Body.String())
+
+	// conditional
+	req, _ = http.NewRequest("GET", "/results/out.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusNotModified, rr.Code)
+
+	req, _ = http.NewRequest("GET", "/results/missing.txt", nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusNotFound, rr.Code)
+}
+
+func TestResultFileTraversal(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupResultsDir(t)
+	defer os.RemoveAll(dir)
+	outside, _ := ioutil.TempFile("", "secret")
+	outside.Close()
+	defer os.Remove(outside.Name())
+	os.Symlink(outside.Name(), filepath.Join(dir, "escape"))
+
+	// the router is bypassed so that the path isn't cleaned first
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"path": "../../../etc/passwd"})
+	rr := httptest.NewRecorder()
+	ResultFile(store)(rr, req)
+	assert.Equal(http.StatusNotFound, rr.Code)
+
+	req, _ = http.NewRequest("GET", "/results/escape", nil)
+	rr = httptest.NewRecorder()
+	resultsRouter(store).ServeHTTP(rr, req)
+	assert.Equal(http.StatusForbidden, rr.Code)
+}
+
+func TestResultDirectoryTar(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupResultsDir(t)
+	defer os.RemoveAll(dir)
+	req, _ := http.NewRequest("GET", "/results/sub?archive=tar", nil)
+	rr := httptest.NewRecorder()
+	resultsRouter(store).ServeHTTP(rr, req)
+	assert.Equal("application/x-tar", rr.Header().Get("Content-Type"))
+	tr := tar.NewReader(rr.Body)
+	header, err := tr.Next()
+	if assert.NoError(err) {
+		assert.Equal("nested.txt", header.Name)
+		contents, _ := ioutil.ReadAll(tr)
+		assert.Equal("nested", string(contents))
+	}
+	_, err = tr.Next()
+	assert.Equal(io.EOF, err)
+}
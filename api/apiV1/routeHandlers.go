@@ -11,7 +11,10 @@ import (
 	"github.com/alecthomas/jsonschema"
 	"github.com/mrmagooey/hpcaas-common"
 	"github.com/mrmagooey/hpcaas-container-daemon/container"
+	"github.com/mrmagooey/hpcaas-container-daemon/files"
+	"github.com/mrmagooey/hpcaas-container-daemon/results"
 	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/mrmagooey/hpcaas-container-daemon/webhooks"
 	"github.com/xeipuuv/gojsonschema"
 )
 
@@ -54,11 +57,22 @@ func Heartbeat(w http.ResponseWriter, r *http.Request) {
 }
 
 type setCodeParamsStruct struct {
-	CodeParameters map[string]string
+	// values can be any json type, string only clients are unaffected
+	CodeParameters state.CodeParams `json:"codeParameters"`
+}
+
+// report the problems with each parameter
+func paramsFail(w http.ResponseWriter, paramErrors container.ParamErrors) {
+	jsonResponse(w, "fail", map[string]interface{}{
+		"message": "invalid code parameters",
+		"errors":  paramErrors,
+	})
 }
 
 // SetCodeParams returns a closure that handles http requests
-func SetCodeParams() func(w http.ResponseWriter, r *http.Request) {
+// the params are checked against the schema shipped with the code, if there is one
+// the write honours If-Match, as with PatchCodeParams
+func SetCodeParams(store state.Store) func(w http.ResponseWriter, r *http.Request) {
 	schema := getJSONValidator(&setCodeParamsStruct{})
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -76,26 +90,18 @@ func SetCodeParams() func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		var jsonRequest = &setCodeParamsStruct{}
-		json.Unmarshal(body, jsonRequest)
-		if err != nil {
-			jsonResponse(w, "error", map[string]interface{}{
-				"message": err.Error(),
-			})
-			return
-		}
-		err = state.SetCodeParams(jsonRequest.CodeParameters)
+		err = json.Unmarshal(body, jsonRequest)
 		if err != nil {
 			jsonResponse(w, "error", map[string]interface{}{
 				"message": err.Error(),
 			})
 			return
 		}
-		// write to disk
-		err = container.WriteCodeParams(jsonRequest.CodeParameters)
-		if err != nil {
-			jsonResponse(w, "error", map[string]interface{}{
-				"message": err.Error(),
-			})
+		// replaces every param, honouring If-Match
+		_, ok := writeVersionedParams(store, w, r, func(state.CodeParams) state.CodeParams {
+			return jsonRequest.CodeParameters
+		})
+		if !ok {
 			return
 		}
 		jsonResponse(w, "success", map[string]interface{}{
@@ -109,7 +115,7 @@ type setCodeNameStruct struct {
 }
 
 // SetCodeName closure returning http handler that sets the code name
-func SetCodeName() func(w http.ResponseWriter, r *http.Request) {
+func SetCodeName(store state.Store) func(w http.ResponseWriter, r *http.Request) {
 	schema := getJSONValidator(&setCodeNameStruct{})
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -128,7 +134,7 @@ func SetCodeName() func(w http.ResponseWriter, r *http.Request) {
 		var responseStruct = &setCodeNameStruct{}
 		json.Unmarshal(body, responseStruct)
 		// send to state
-		state.SetCodeName(responseStruct.CodeName)
+		store.SetCodeName(responseStruct.CodeName)
 		if err != nil {
 			jsonResponse(w, "fail", map[string]interface{}{
 				"message": "name failed to set",
@@ -146,7 +152,7 @@ type setCodeStateStruct struct {
 }
 
 // SetCodeState closure returning http handler that sets the code state
-func SetCodeState() func(w http.ResponseWriter, r *http.Request) {
+func SetCodeState(store state.Store) func(w http.ResponseWriter, r *http.Request) {
 	schema := getJSONValidator(&setCodeStateStruct{})
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -161,14 +167,17 @@ func SetCodeState() func(w http.ResponseWriter, r *http.Request) {
 			jsonResponse(w, "fail", map[string]interface{}{
 				"message": err.Error(),
 			})
+			return
 		}
 		var responseStruct = &setCodeStateStruct{}
 		json.Unmarshal(body, responseStruct)
-		// send to state
-		state.SetCodeStatus(common.CodeStatus(responseStruct.CodeStatus))
+		// send to state, which refuses transitions that aren't allowed, or that only the daemon can make
+		err = store.Update(func(d *state.DaemonState) error {
+			return d.RequestCodeStatus(common.CodeStatus(responseStruct.CodeStatus), "set by api request")
+		})
 		if err != nil {
-			jsonResponse(w, "error", map[string]interface{}{
-				"message": "state failed to set",
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
 			})
 			return
 		}
@@ -184,7 +193,7 @@ type commandSchemaStruct struct {
 
 // Command closure that returning http handler that gives a command to the daemon
 // this is responsible for starting and killing code
-func Command() func(w http.ResponseWriter, r *http.Request) {
+func Command(store state.Store) func(w http.ResponseWriter, r *http.Request) {
 	schema := getJSONValidator(&commandSchemaStruct{})
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -210,8 +219,14 @@ func Command() func(w http.ResponseWriter, r *http.Request) {
 		}
 		// the json schema should ensure that these are the only possibilities
 		if responseStruct.Command == "start" {
-			err = container.ExecuteCode()
-			if err != nil {
+			err = container.ExecuteCode(store)
+			if paramErrors, ok := err.(container.ParamErrors); ok {
+				paramsFail(w, paramErrors)
+				return
+			} else if templateErrors, ok := err.(container.TemplateErrors); ok {
+				templatesFail(w, templateErrors)
+				return
+			} else if err != nil {
 				jsonResponse(w, "error", map[string]interface{}{
 					"message": err.Error(),
 				})
@@ -222,7 +237,7 @@ func Command() func(w http.ResponseWriter, r *http.Request) {
 			})
 			return
 		} else if responseStruct.Command == "kill" {
-			err = container.KillCode()
+			err = container.KillCode(store)
 			if err != nil {
 				jsonResponse(w, "error", map[string]interface{}{
 					"message": err.Error(),
@@ -247,7 +262,7 @@ type setSSHAddressesSchemaStruct struct {
 }
 
 // SetSSHAddresses closure that returns http handler responsible for setting ssh addresses of other containers
-func SetSSHAddresses() func(w http.ResponseWriter, r *http.Request) {
+func SetSSHAddresses(store state.Store) func(w http.ResponseWriter, r *http.Request) {
 	schema := getJSONValidator(&setSSHAddressesSchemaStruct{})
 	return func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -276,7 +291,7 @@ func SetSSHAddresses() func(w http.ResponseWriter, r *http.Request) {
 		// 	sshAddresses[intKey] = val.(string)
 		// }
 		// // update state
-		stateErr := state.SetSSHAddresses(responseStruct.SSHAddresses)
+		stateErr := store.SetSSHAddresses(responseStruct.SSHAddresses)
 		if stateErr != nil {
 			jsonResponse(w, "fail", map[string]interface{}{
 				"message": err.Error(),
@@ -284,7 +299,7 @@ func SetSSHAddresses() func(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		// use the ssh addresses to generate a .ssh/config file
-		writeErr := container.WriteSSHConfig()
+		writeErr := container.WriteSSHConfig(store)
 		// the json schema should ensure that these are the only possibilities
 		if writeErr != nil {
 			jsonResponse(w, "fail", map[string]interface{}{
@@ -297,3 +312,101 @@ func SetSSHAddresses() func(w http.ResponseWriter, r *http.Request) {
 		})
 	}
 }
+
+type setDaemonConfigurationStruct struct {
+	DaemonParameters json.RawMessage `json:"daemonParameters"`
+}
+
+// SetDaemonConfiguration closure returning http handler that updates the daemon configuration
+// only recognised configuration items are applied, the rest are ignored
+func SetDaemonConfiguration(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	schema := getJSONValidator(&setDaemonConfigurationStruct{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		err = validatePOSTRequest(body, schema)
+		if err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		var requestStruct = &setDaemonConfigurationStruct{}
+		err = json.Unmarshal(body, requestStruct)
+		if err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		// merge the new items over the top of the existing configuration
+		conf, _ := store.GetDaemonConfiguration()
+		if len(requestStruct.DaemonParameters) > 0 {
+			err = json.Unmarshal(requestStruct.DaemonParameters, &conf)
+			if err != nil {
+				jsonResponse(w, "fail", map[string]interface{}{
+					"message": err.Error(),
+				})
+				return
+			}
+		}
+		if err := results.RulesFromConfig(conf).Validate(); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := results.CheckRetention(conf); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := container.CheckParamFormats(conf.CodeParamFormats); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := container.CheckParamsNotify(conf.CodeParamsNotify); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := files.CheckRoots(conf.FileRoots); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := webhooks.CheckWebhooks(conf.Webhooks); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if err := state.CheckBackend(conf.StateBackend); err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		// the state moves to the new backend before the configuration that selects it is saved
+		if err := store.SelectBackend(conf.StateBackend); err != nil {
+			jsonResponse(w, "error", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		store.SetDaemonConfiguration(conf)
+		jsonResponse(w, "success", map[string]interface{}{
+			"message": "daemon configuration accepted",
+		})
+	}
+}
@@ -3,6 +3,7 @@ package apiV1
 import (
 	"bytes"
 	"fmt"
+	"github.com/mrmagooey/hpcaas-common"
 	"github.com/mrmagooey/hpcaas-container-daemon/state"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
@@ -18,7 +19,7 @@ func init() {
 }
 
 func TestSetCodeParameters(t *testing.T) {
-	state.InitState()
+	store := state.NewStore(state.NewMemoryBackend())
 	assert := assert.New(t)
 	var jsonStr = []byte(`{"codeParameters":{"foo":"bar", "hello":"value", "myParam": "1"}}`)
 	req, err := http.NewRequest("POST", "/", bytes.NewBuffer(jsonStr))
@@ -26,20 +27,21 @@ func TestSetCodeParameters(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(SetCodeParams())
+	handler := http.HandlerFunc(SetCodeParams(store))
 	handler.ServeHTTP(rr, req)
 	assert.Equal(rr.Code, http.StatusOK)
 	// Check the response body is what we expect.
 	expected := `{"status":"success","data":{"message":"parameter accepted"}}`
 	assert.JSONEq(expected, rr.Body.String())
 	// check that the internal state has been updated
-	assert.Equal("bar", state.GetCodeParams()["foo"])
-	assert.Equal("value", state.GetCodeParams()["hello"])
-	assert.Equal("1", state.GetCodeParams()["myParam"])
+	codeParams, _ := store.GetCodeParams()
+	assert.Equal("bar", codeParams["foo"])
+	assert.Equal("value", codeParams["hello"])
+	assert.Equal("1", codeParams["myParam"])
 }
 
 func TestSetCodeName(t *testing.T) {
-	state.InitState()
+	store := state.NewStore(state.NewMemoryBackend())
 	assert := assert.New(t)
 	var jsonStr = []byte(`{"codeName": "blah"}`)
 	req, err := http.NewRequest("POST", "/", bytes.NewBuffer(jsonStr))
@@ -47,59 +49,99 @@ func TestSetCodeName(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(SetCodeName())
+	handler := http.HandlerFunc(SetCodeName(store))
 	handler.ServeHTTP(rr, req)
 	assert.Equal(rr.Code, http.StatusOK)
 	// Check the response body is what we expect.
 	expected := `{"status":"success","data":{"message":"name accepted"}}`
 	assert.JSONEq(expected, rr.Body.String())
 	// check that the internal state has been updated
-	assert.Equal("blah", state.GetCodeName())
+	codeName, _ := store.GetCodeName()
+	assert.Equal("blah", codeName)
 }
 
 func TestSetCodeState(t *testing.T) {
-	state.InitState()
+	store := state.NewStore(state.NewMemoryBackend())
 	assert := assert.New(t)
-	codeState := state.CodeMissingState
-	var jsonBytes = []byte(fmt.Sprintf(`{"codeState": %d}`, int(codeState)))
+	store.SetCodeStatus(common.CodeMissingStatus, "test")
+	// a code that has finished can be reset
+	codeStatus := common.CodeWaitingStatus
+	var jsonBytes = []byte(fmt.Sprintf(`{"codeStatus": %d}`, int(codeStatus)))
 	req, err := http.NewRequest("POST", "/", bytes.NewBuffer(jsonBytes))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(SetCodeState())
+	handler := http.HandlerFunc(SetCodeState(store))
 	handler.ServeHTTP(rr, req)
 	assert.Equal(rr.Code, http.StatusOK)
 	// Check the response body is what we expect.
 	expected := `{"status":"success","data":{"message":"state accepted"}}`
 	assert.JSONEq(expected, rr.Body.String())
 	// check that the internal state has been updated
-	assert.Equal(codeState, state.GetCodeState())
+	status, _ := store.GetCodeStatus()
+	assert.Equal(codeStatus, status)
+
+	// but only the daemon can say the code is running
+	req, _ = http.NewRequest("POST", "/", bytes.NewBuffer([]byte(fmt.Sprintf(`{"codeStatus": %d}`, int(common.CodeRunningStatus)))))
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.JSONEq(`{"status":"fail","data":{"message":"The code status can only be reset to Waiting, Running is set by the daemon"}}`, rr.Body.String())
+	status, _ = store.GetCodeStatus()
+	assert.Equal(common.CodeWaitingStatus, status)
+}
+
+// running the code and writing its ssh config use the container's fixed paths, which only exist inside the container
+func requireContainer(t *testing.T) {
+	if _, err := os.Stat("/hpcaas/code"); err != nil {
+		t.Skip("Not running in the container: " + err.Error())
+	}
+}
+
+func command(store state.Store, command string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", "/", bytes.NewBufferString(`{"command": "`+command+`"}`))
+	rr := httptest.NewRecorder()
+	Command(store)(rr, req)
+	return rr
 }
 
 func TestCommand(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
+	store := state.NewStore(state.NewMemoryBackend())
+	// nothing to kill
+	assert.JSONEq(`{"status":"error","data":{"message":"No PID in state, cannot kill code"}}`, command(store, "kill").Body.String())
+	// nothing to run
+	store.SetCodeName("not_installed")
+	store.SetCodeArguments([]string{})
+	store.SetTypedCodeParams(state.CodeParams{})
+	assert.JSONEq(`{"status":"error","data":{"message":"Code executable is missing"}}`, command(store, "start").Body.String())
+	status, _ := store.GetCodeStatus()
+	assert.Equal(common.CodeMissingStatus, status)
+
+	requireContainer(t)
+	store = state.NewStore(state.NewMemoryBackend())
 	if err := os.Symlink("/bin/sleep", "/hpcaas/code/sleep"); err != nil {
 		t.Error(err)
 	}
 	defer os.Remove("/hpcaas/code/sleep")
-	state.SetCodeName("sleep")
-	state.SetCodeArguments([]string{"10"})
+	store.SetCodeName("sleep")
+	store.SetCodeArguments([]string{"10"})
+	store.SetTypedCodeParams(state.CodeParams{})
 	var jsonBytes = []byte(`{"command": "start"}`)
 	req, err := http.NewRequest("POST", "/", bytes.NewBuffer(jsonBytes))
 	if err != nil {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(Command())
+	handler := http.HandlerFunc(Command(store))
 	handler.ServeHTTP(rr, req)
 	assert.Equal(rr.Code, http.StatusOK)
 	// Check the response body is what we expect.
 	expected := `{"status":"success","data":{"message":"code started"}}`
 	assert.JSONEq(expected, rr.Body.String())
 	// check that the internal state has been updated
-	assert.Equal(state.CodeRunningState, state.GetCodeState())
+	status, _ = store.GetCodeStatus()
+	assert.Equal(common.CodeRunningStatus, status)
 
 	// kill the code
 	jsonBytes = []byte(`{"command": "kill"}`)
@@ -108,18 +150,21 @@ func TestCommand(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr = httptest.NewRecorder()
-	handler = http.HandlerFunc(Command())
+	handler = http.HandlerFunc(Command(store))
 	handler.ServeHTTP(rr, req)
 	assert.Equal(rr.Code, http.StatusOK)
 	// Check the response body is what we expect.
 	expected = `{"status":"success","data":{"message":"code killed"}}`
 	assert.JSONEq(expected, rr.Body.String())
-	// check that the internal state has been updated
-	assert.Equal(state.CodeKilledState, state.GetCodeState())
+	// check that the internal state has been updated, it is stopped once the exit has been seen
+	status, _ = store.GetCodeStatus()
+	assert.Contains([]common.CodeStatus{common.CodeKilledStatus, common.CodeStoppedStatus}, status)
 }
 
 func TestSetSSHAddrs(t *testing.T) {
-	state.InitState()
+	// the addresses are always written to the ssh config
+	requireContainer(t)
+	store := state.NewStore(state.NewMemoryBackend())
 	assert := assert.New(t)
 	var jsonBytes = []byte(`{"sshAddresses": {"1":"127.0.0.1:8230", "2": "127.0.0.1:9809"}}`)
 	req, err := http.NewRequest("POST", "/", bytes.NewBuffer(jsonBytes))
@@ -127,21 +172,21 @@ func TestSetSSHAddrs(t *testing.T) {
 		t.Fatal(err)
 	}
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(SetSSHAddresses())
+	handler := http.HandlerFunc(SetSSHAddresses(store))
 	handler.ServeHTTP(rr, req)
 	assert.Equal(rr.Code, http.StatusOK)
 	// Check the response body is what we expect.
 	expected := `{"status":"success","data":{"message":"ssh addresses updated"}}`
 	assert.JSONEq(expected, rr.Body.String())
 	// check that the internal state has been updated
-	assert.Equal(state.ContainerAddresses{
+	addrs, _ := store.GetSSHAddresses()
+	assert.Equal(common.ContainerAddresses{
 		1: "127.0.0.1:8230",
 		2: "127.0.0.1:9809",
-	}, state.GetSSHAddresses())
+	}, addrs)
 }
 
 func TestHeartbeat(t *testing.T) {
-	state.InitState()
 	assert := assert.New(t)
 	req, err := http.NewRequest("GET", "/", nil)
 	if err != nil {
@@ -0,0 +1,49 @@
+package apiV1
+
+import (
+	"net/http"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/container"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// report the problems with each template
+func templatesFail(w http.ResponseWriter, templateErrors container.TemplateErrors) {
+	jsonResponse(w, "fail", map[string]interface{}{
+		"message": "couldn't render templates",
+		"errors":  templateErrors,
+	})
+}
+
+// PreviewTemplates renders the templates with the current parameters and returns the output,
+// without writing anything or starting the code
+func PreviewTemplates(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		params, _ := store.GetTypedCodeParams()
+		codeName, _ := store.GetCodeName()
+		// fill in defaults, as they would be when the code is started
+		validated, err := container.ValidateCodeParams(codeName, params, false)
+		if paramErrors, ok := err.(container.ParamErrors); ok {
+			paramsFail(w, paramErrors)
+			return
+		} else if err != nil {
+			jsonResponse(w, "error", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		rendered, err := container.PreviewTemplates(store, container.NewTemplateData(store, validated))
+		if templateErrors, ok := err.(container.TemplateErrors); ok {
+			templatesFail(w, templateErrors)
+			return
+		} else if err != nil {
+			jsonResponse(w, "error", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"templates": rendered,
+		})
+	}
+}
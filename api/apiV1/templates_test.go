@@ -0,0 +1,24 @@
+package apiV1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreviewTemplates(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeName("")
+	store.SetTypedCodeParams(state.CodeParams{"steps": json.Number("10")})
+	// the real templates directory won't exist, so nothing is rendered
+	req, _ := http.NewRequest("GET", "/templates/preview/", nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(PreviewTemplates(store)).ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.JSONEq(`{"status":"success","data":{"templates":[]}}`, rr.Body.String())
+}
@@ -5,21 +5,97 @@ import (
 	"net/http"
 
 	common "github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/container"
 	"github.com/mrmagooey/hpcaas-container-daemon/state"
 )
 
 // Update take state in json format and update daemon state
-func Update(w http.ResponseWriter, r *http.Request) {
-	newState := &common.DaemonState{}
-	err := json.NewDecoder(r.Body).Decode(newState)
-	if err != nil {
-		jsonResponse(w, "fail", map[string]interface{}{
-			"message": err.Error(),
+// codeParams may have values of any json type, they are kept apart from the common state which only holds strings
+func Update(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var fields map[string]json.RawMessage
+		err := json.NewDecoder(r.Body).Decode(&fields)
+		if err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		var codeParams state.CodeParams
+		rawParams, hasParams := fields["codeParams"]
+		if hasParams {
+			if err := json.Unmarshal(rawParams, &codeParams); err != nil {
+				jsonResponse(w, "fail", map[string]interface{}{
+					"message": err.Error(),
+				})
+				return
+			}
+			delete(fields, "codeParams")
+		}
+		rest, _ := json.Marshal(fields)
+		newState := &common.DaemonState{}
+		err = json.Unmarshal(rest, newState)
+		if err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if codeParams != nil {
+			// the params are checked against the schema of the code they are for, which may be in this update
+			codeName, _ := store.GetCodeName()
+			if newState.CodeName != nil {
+				codeName = *newState.CodeName
+			}
+			codeParams, err = container.ValidateCodeParams(codeName, codeParams, false)
+			if err == nil {
+				current, _ := store.GetTypedCodeParams()
+				err = container.CheckImmutableParams(store, codeName, current, codeParams)
+			}
+			if paramErrors, ok := err.(container.ParamErrors); ok {
+				paramsFail(w, paramErrors)
+				return
+			} else if err != nil {
+				jsonResponse(w, "error", map[string]interface{}{
+					"message": err.Error(),
+				})
+				return
+			}
+		}
+		// the state and the params change together, or not at all
+		var version uint64
+		err = store.Update(func(d *state.DaemonState) error {
+			if newState.CodeStatus != nil {
+				if err := d.RequestCodeStatus(*newState.CodeStatus, "set by update"); err != nil {
+					return err
+				}
+			}
+			if err := d.SetDaemonState(*newState); err != nil {
+				return err
+			}
+			if codeParams != nil {
+				d.SetTypedCodeParams(codeParams)
+				version = d.CodeParamsVersion
+			}
+			return nil
+		})
+		if err != nil {
+			jsonResponse(w, "fail", map[string]interface{}{
+				"message": err.Error(),
+			})
+			return
+		}
+		if codeParams != nil {
+			// a running code picks up the new params from the files, once they are in the state
+			if err := container.WriteCodeParams(store, codeParams, version); err != nil {
+				jsonResponse(w, "error", map[string]interface{}{
+					"message": err.Error(),
+				})
+				return
+			}
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"message": "daemon updated",
 		})
 	}
-	state.SetDaemonState(*newState)
-	jsonResponse(w, "success", map[string]interface{}{
-		"message": "daemon updated",
-	})
-
 }
@@ -0,0 +1,127 @@
+package apiV1
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateTypedCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	body := `{"codeName": "mycode", "codeParams": {"steps": 100, "restart": true, "name": "run"}}`
+	req, _ := http.NewRequest("POST", "/update/", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+	Update(store)(rr, req)
+	assert.JSONEq(`{"status":"success","data":{"message":"daemon updated"}}`, rr.Body.String())
+
+	codeName, _ := store.GetCodeName()
+	assert.Equal("mycode", codeName)
+	typed, _ := store.GetTypedCodeParams()
+	assert.Equal(json.Number("100"), typed["steps"])
+	assert.Equal(true, typed["restart"])
+	strings, _ := store.GetCodeParams()
+	assert.Equal(map[string]string{"steps": "100", "restart": "true", "name": "run"}, strings)
+
+	// string only clients are unaffected
+	req, _ = http.NewRequest("POST", "/update/", bytes.NewReader([]byte(`{"codeParams": {"foo": "bar"}}`)))
+	rr = httptest.NewRecorder()
+	Update(store)(rr, req)
+	strings, _ = store.GetCodeParams()
+	assert.Equal(map[string]string{"foo": "bar"}, strings)
+
+	req, _ = http.NewRequest("POST", "/update/", bytes.NewReader([]byte(`{"codeParams": [1, 2]}`)))
+	rr = httptest.NewRecorder()
+	Update(store)(rr, req)
+	assert.Contains(rr.Body.String(), "fail")
+}
+
+func TestUpdateCodeStatusTransition(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	store.SetCodeStatus(common.CodeRunningStatus, "test")
+
+	// a running code can't be put back to waiting
+	req, _ := http.NewRequest("POST", "/update/", bytes.NewReader([]byte(`{"codeName": "mycode", "codeStatus": 0}`)))
+	rr := httptest.NewRecorder()
+	Update(store)(rr, req)
+	assert.JSONEq(`{"status":"fail","data":{"message":"The code status can't change from Running to Waiting"}}`, rr.Body.String())
+	_, ok := store.GetCodeName()
+	assert.False(ok)
+
+	// and leaving the status out keeps it
+	req, _ = http.NewRequest("POST", "/update/", bytes.NewReader([]byte(`{"codeName": "mycode"}`)))
+	rr = httptest.NewRecorder()
+	Update(store)(rr, req)
+	status, _ := store.GetCodeStatus()
+	assert.Equal(common.CodeRunningStatus, status)
+
+	// only the daemon can say the code has stopped
+	req, _ = http.NewRequest("POST", "/update/", bytes.NewReader([]byte(`{"codeStatus": 2}`)))
+	rr = httptest.NewRecorder()
+	Update(store)(rr, req)
+	assert.JSONEq(`{"status":"fail","data":{"message":"The code status can only be reset to Waiting, Stopped is set by the daemon"}}`, rr.Body.String())
+	status, _ = store.GetCodeStatus()
+	assert.Equal(common.CodeRunningStatus, status)
+
+	// once it has, a client can reset it, and send the status it already has
+	store.SetCodeStatus(common.CodeStoppedStatus, "test")
+	req, _ = http.NewRequest("POST", "/update/", bytes.NewReader([]byte(`{"codeStatus": 2}`)))
+	rr = httptest.NewRecorder()
+	Update(store)(rr, req)
+	assert.Contains(rr.Body.String(), "success")
+	req, _ = http.NewRequest("POST", "/update/", bytes.NewReader([]byte(`{"codeStatus": 0}`)))
+	rr = httptest.NewRecorder()
+	Update(store)(rr, req)
+	status, _ = store.GetCodeStatus()
+	assert.Equal(common.CodeWaitingStatus, status)
+	transitions := store.GetTransitions()
+	assert.Equal("set by update", transitions[len(transitions)-1].Cause)
+}
+
+func TestUpdateIsOneChange(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetTypedCodeParams(state.CodeParams{"steps": json.Number("1")})
+	_, version := store.GetVersionedCodeParams()
+	sub := store.Subscribe("", 0)
+	defer sub.Cancel()
+
+	body := `{"codeName": "mycode", "codeParams": {"steps": 2}}`
+	req, _ := http.NewRequest("POST", "/update/", bytes.NewReader([]byte(body)))
+	rr := httptest.NewRecorder()
+	Update(store)(rr, req)
+	assert.Contains(rr.Body.String(), "success")
+	// the name and params are published together, as a single change to the state
+	changed := map[string]bool{}
+	first := <-sub.Events
+	changed[first.Field] = true
+	for len(sub.Events) > 0 {
+		event := <-sub.Events
+		assert.Equal(first.Time, event.Time, event.Field)
+		changed[event.Field] = true
+	}
+	assert.True(changed["codeName"])
+	assert.True(changed["typedCodeParams"])
+	params, newVersion := store.GetVersionedCodeParams()
+	assert.Equal(state.CodeParams{"steps": json.Number("2")}, params)
+	assert.True(newVersion > version)
+
+	// a change that can't be made leaves the params as they were too
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	store.SetCodeStatus(common.CodeRunningStatus, "test")
+	body = `{"codeStatus": 0, "codeParams": {"steps": 3}}`
+	req, _ = http.NewRequest("POST", "/update/", bytes.NewReader([]byte(body)))
+	rr = httptest.NewRecorder()
+	Update(store)(rr, req)
+	assert.Contains(rr.Body.String(), "fail")
+	params, _ = store.GetTypedCodeParams()
+	assert.Equal(state.CodeParams{"steps": json.Number("2")}, params)
+}
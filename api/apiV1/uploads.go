@@ -0,0 +1,166 @@
+package apiV1
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mrmagooey/hpcaas-container-daemon/files"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// the content type of a chunk, as in tus
+var chunkContentType = "application/offset+octet-stream"
+
+// turn an error from the files package into a response
+func uploadFail(w http.ResponseWriter, err error) {
+	switch err {
+	case files.ErrNoUpload:
+		failResponse(w, http.StatusNotFound, err.Error())
+	case files.ErrBadName:
+		failResponse(w, http.StatusBadRequest, err.Error())
+	case files.ErrWrongOffset, files.ErrIncomplete:
+		failResponse(w, http.StatusConflict, err.Error())
+	case files.ErrTooLarge:
+		failResponse(w, http.StatusRequestEntityTooLarge, err.Error())
+	case files.ErrChecksumMismatch:
+		failResponse(w, http.StatusUnprocessableEntity, err.Error())
+	default:
+		failResponse(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// describe the progress of an upload in the response headers
+func setUploadHeaders(w http.ResponseWriter, upload state.UploadState) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Size, 10))
+	w.Header().Set("Upload-Expires", upload.Expires.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+type createUploadStruct struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// CreateUpload closure returning http handler that starts a resumable upload of a file
+func CreateUpload(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	schema := getJSONValidator(&createUploadStruct{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = validatePOSTRequest(body, schema)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var requestStruct = &createUploadStruct{}
+		err = json.Unmarshal(body, requestStruct)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		upload, err := files.CreateUpload(store, requestStruct.Name, requestStruct.Size)
+		if err != nil {
+			uploadFail(w, err)
+			return
+		}
+		setUploadHeaders(w, upload)
+		w.Header().Set("Location", "/v1/uploads/"+upload.ID+"/")
+		w.WriteHeader(http.StatusCreated)
+		jsonResponse(w, "success", map[string]interface{}{
+			"upload": upload,
+		})
+	}
+}
+
+// UploadOffset reports how much of an upload has been received, in the Upload-Offset header
+func UploadOffset(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upload, err := files.GetUpload(store, mux.Vars(r)["id"])
+		if err != nil {
+			uploadFail(w, err)
+			return
+		}
+		setUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// UploadChunk writes the body of the request into an upload, at the offset given by the Upload-Offset header
+func UploadChunk(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != chunkContentType {
+			failResponse(w, http.StatusUnsupportedMediaType, "Chunks must be sent as "+chunkContentType)
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			failResponse(w, http.StatusBadRequest, "Missing or invalid Upload-Offset header")
+			return
+		}
+		upload, err := files.WriteChunk(store, mux.Vars(r)["id"], offset, r.Body)
+		if err != nil {
+			if err != files.ErrNoUpload {
+				// lets the client carry on from wherever the upload got to
+				setUploadHeaders(w, upload)
+			}
+			uploadFail(w, err)
+			return
+		}
+		setUploadHeaders(w, upload)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+type finaliseUploadStruct struct {
+	SHA256 string `json:"sha256"`
+}
+
+// FinaliseUpload closure returning http handler that verifies a completed upload against its checksum,
+// and moves it into /hpcaas/files
+func FinaliseUpload(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	schema := getJSONValidator(&finaliseUploadStruct{})
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		err = validatePOSTRequest(body, schema)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		var requestStruct = &finaliseUploadStruct{}
+		err = json.Unmarshal(body, requestStruct)
+		if err != nil {
+			failResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		file, err := files.FinaliseUpload(store, mux.Vars(r)["id"], requestStruct.SHA256)
+		if err != nil {
+			uploadFail(w, err)
+			return
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"file": file,
+		})
+	}
+}
+
+// AbortUpload abandons an upload
+func AbortUpload(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := files.AbortUpload(store, mux.Vars(r)["id"]); err != nil {
+			uploadFail(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,138 @@
+package apiV1
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func uploadsRouter(store state.Store) *mux.Router {
+	r := mux.NewRouter()
+	r.Methods("POST").Path("/uploads/").HandlerFunc(CreateUpload(store))
+	r.Methods("HEAD").Path("/uploads/{id}/").HandlerFunc(UploadOffset(store))
+	r.Methods("PATCH").Path("/uploads/{id}/").HandlerFunc(UploadChunk(store))
+	r.Methods("DELETE").Path("/uploads/{id}/").HandlerFunc(AbortUpload(store))
+	r.Methods("POST").Path("/uploads/{id}/finalise/").HandlerFunc(FinaliseUpload(store))
+	return r
+}
+
+func sendChunk(router *mux.Router, location string, offset string, chunk string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PATCH", location, bytes.NewReader([]byte(chunk)))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", offset)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestResumableUploadAPI(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "files")
+	defer os.RemoveAll(dir)
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FilesDirectory: dir})
+	router := uploadsRouter(store)
+
+	req, _ := http.NewRequest("POST", "/uploads/", bytes.NewReader([]byte(`{"name": "mesh.msh", "size": 10}`)))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusCreated, rr.Code)
+	location := rr.Header().Get("Location")
+	if !assert.NotEmpty(location) {
+		return
+	}
+	location = location[len("/v1"):]
+
+	rr = sendChunk(router, location, "0", "01234")
+	assert.Equal(http.StatusNoContent, rr.Code)
+	assert.Equal("5", rr.Header().Get("Upload-Offset"))
+
+	// repeating a chunk that has already been received is a conflict
+	rr = sendChunk(router, location, "0", "01234")
+	assert.Equal(http.StatusConflict, rr.Code)
+	assert.Equal("5", rr.Header().Get("Upload-Offset"))
+
+	req, _ = http.NewRequest("HEAD", location, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	assert.Equal("5", rr.Header().Get("Upload-Offset"))
+	assert.Equal("10", rr.Header().Get("Upload-Length"))
+
+	rr = sendChunk(router, location, "5", "56789")
+	assert.Equal(http.StatusNoContent, rr.Code)
+
+	req, _ = http.NewRequest("POST", location+"finalise/", bytes.NewReader([]byte(`{"sha256": "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"}`)))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusOK, rr.Code)
+	var resp struct {
+		Status string
+		Data   struct {
+			File struct {
+				Name string
+				Size int64
+			}
+		}
+	}
+	assert.NoError(json.Unmarshal(rr.Body.Bytes(), &resp))
+	assert.Equal("mesh.msh", resp.Data.File.Name)
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "mesh.msh"))
+	assert.Equal([]byte("0123456789"), contents)
+
+	// the upload is gone once finalised
+	req, _ = http.NewRequest("HEAD", location, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusNotFound, rr.Code)
+}
+
+func TestResumableUploadAPIErrors(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "files")
+	defer os.RemoveAll(dir)
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FilesDirectory: dir})
+	router := uploadsRouter(store)
+
+	req, _ := http.NewRequest("POST", "/uploads/", bytes.NewReader([]byte(`{"name": "..", "size": 10}`)))
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+
+	req, _ = http.NewRequest("POST", "/uploads/", bytes.NewReader([]byte(`{"name": "a.dat", "size": 10}`)))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	location := rr.Header().Get("Location")[len("/v1"):]
+
+	req, _ = http.NewRequest("PATCH", location, bytes.NewReader([]byte("0123")))
+	req.Header.Set("Upload-Offset", "0")
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusUnsupportedMediaType, rr.Code)
+
+	rr = sendChunk(router, location, "nope", "0123")
+	assert.Equal(http.StatusBadRequest, rr.Code)
+
+	req, _ = http.NewRequest("POST", location+"finalise/", bytes.NewReader([]byte(`{"sha256": "00"}`)))
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusConflict, rr.Code)
+
+	req, _ = http.NewRequest("DELETE", location, nil)
+	rr = httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	assert.Equal(http.StatusNoContent, rr.Code)
+
+	rr = sendChunk(router, location, "0", "0123")
+	assert.Equal(http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,39 @@
+package apiV1
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// WebhookDeliveries closure returning http handler that lists the webhook deliveries, oldest first,
+// both those still queued and the log of those that have finished
+// they can be narrowed down with the event and status query parameters
+func WebhookDeliveries(store state.Store) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		event := r.URL.Query().Get("event")
+		status := -1
+		if s := r.URL.Query().Get("status"); s != "" {
+			var err error
+			status, err = strconv.Atoi(s)
+			if err != nil {
+				failResponse(w, http.StatusBadRequest, "invalid status: "+s)
+				return
+			}
+		}
+		deliveries := []state.WebhookDelivery{}
+		for _, delivery := range store.GetWebhookDeliveries() {
+			if event != "" && delivery.Event != event {
+				continue
+			}
+			if status >= 0 && int(delivery.Status) != status {
+				continue
+			}
+			deliveries = append(deliveries, delivery)
+		}
+		jsonResponse(w, "success", map[string]interface{}{
+			"deliveries": deliveries,
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package apiV1
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookDeliveries(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	now := time.Now()
+	store.SetWebhookDelivery(state.WebhookDelivery{ID: "a", Event: "code.started", Status: state.WebhookDeliveredStatus, Created: now})
+	store.SetWebhookDelivery(state.WebhookDelivery{ID: "b", Event: "code.exited", Status: state.WebhookPendingStatus, Created: now.Add(time.Second)})
+	store.SetWebhookDelivery(state.WebhookDelivery{ID: "c", Event: "code.exited", Status: state.WebhookFailedStatus, Created: now.Add(2 * time.Second)})
+
+	list := func(query string) []string {
+		req, _ := http.NewRequest("GET", "/webhooks/deliveries/"+query, nil)
+		rr := httptest.NewRecorder()
+		WebhookDeliveries(store)(rr, req)
+		var response struct {
+			Data struct {
+				Deliveries []state.WebhookDelivery `json:"deliveries"`
+			} `json:"data"`
+		}
+		json.Unmarshal(rr.Body.Bytes(), &response)
+		var ids []string
+		for _, delivery := range response.Data.Deliveries {
+			ids = append(ids, delivery.ID)
+		}
+		return ids
+	}
+	assert.Equal([]string{"a", "b", "c"}, list(""))
+	assert.Equal([]string{"b", "c"}, list("?event=code.exited"))
+	assert.Equal([]string{"c"}, list("?event=code.exited&status=2"))
+
+	req, _ := http.NewRequest("GET", "/webhooks/deliveries/?status=failed", nil)
+	rr := httptest.NewRecorder()
+	WebhookDeliveries(store)(rr, req)
+	assert.Equal(http.StatusBadRequest, rr.Code)
+}
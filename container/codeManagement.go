@@ -1,11 +1,14 @@
 package container
 
 import (
-	"bytes"
 	"errors"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -18,68 +21,117 @@ import (
 // will return error if there is a problem creating the subprocess
 // otherwise will spawn a goroutine that watches the subprocess
 // check that we aren't already running
-func ExecuteCode() error {
-	if status, ok := state.GetCodeStatus(); ok && status != common.CodeWaitingStatus {
-		return errors.New("Code already started")
+func ExecuteCode(store state.Store) error {
+	if status, ok := store.GetCodeStatus(); ok && status != common.CodeWaitingStatus {
+		switch status {
+		case common.CodeRunningStatus, common.CodeKilledStatus, common.CodeFailedToKillStatus:
+			return errors.New("Code already started")
+		}
+		// a finished run is never restarted by accident, the status has to be reset first
+		return errors.New("Code has finished as " + state.CodeStatusName(status) + ", set its status to Waiting to run it again")
+	}
+	// the code can't run without its inputs
+	if unfinished := store.UnfinishedFetches(); len(unfinished) > 0 {
+		return errors.New("Files have not been fetched: " + strings.Join(unfinished, ", "))
 	}
 	// get hpcaas code info from state
-	codeName, ok := state.GetCodeName()
+	codeName, ok := store.GetCodeName()
 	if !ok {
 		return errors.New("No Code Name Set")
 	}
-	codeArgs, ok := state.GetCodeArguments()
+	codeArgs, ok := store.GetCodeArguments()
 	if !ok {
 		return errors.New("No Code Arguments")
 	}
-	codePath := "/hpcaas/code/" + codeName
+	codePath := filepath.Join(codeDirectory, codeName)
 	if _, err := os.Stat(codePath); err != nil {
-		state.SetCodeStatus(common.CodeMissingStatus)
+		store.SetCodeStatus(common.CodeMissingStatus, "executable "+codePath+" is missing")
 		return errors.New("Code executable is missing")
 	}
 	cmd := exec.Command(codePath, codeArgs...)
 	// get the environment variables
-	codeParams, ok := state.GetCodeParams()
+	typedParams, ok := store.GetTypedCodeParams()
 	if !ok {
 		return errors.New("No Code parameters")
 	}
+	validated, paramErr := ValidateCodeParams(codeName, typedParams, true)
+	if paramErr != nil {
+		return paramErr
+	}
+	// defaults have been filled in
+	if !reflect.DeepEqual(validated, typedParams) {
+		var version uint64
+		store.Update(func(d *state.DaemonState) error {
+			d.SetTypedCodeParams(validated)
+			version = d.CodeParamsVersion
+			return nil
+		})
+		if paramErr := WriteCodeParams(store, validated, version); paramErr != nil {
+			return paramErr
+		}
+	}
+	// render the input decks with the final params
+	if _, templateErr := RenderTemplates(store, NewTemplateData(store, validated)); templateErr != nil {
+		return templateErr
+	}
+	codeParams, _ := store.GetCodeParams()
 	var envVars []string
 	for key, val := range codeParams {
 		envVars = append(envVars, key+"="+val)
 	}
 	cmd.Env = envVars
-	// attach buffers to stderr stdout
-	var out bytes.Buffer
-	var err bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &err
-	// start the code
-	state.SetCodeStartedMethod(common.StartedByDaemonStatus)
-	state.SetCodeStatus(common.CodeRunningStatus)
-	if err := cmd.Start(); err != nil {
-		state.SetCodeStatus(common.CodeFailedToStartStatus)
+	// claim the code, only one start can get past here
+	claimErr := store.Update(func(d *state.DaemonState) error {
+		if status, ok := d.GetCodeStatus(); ok && status != common.CodeWaitingStatus {
+			return errors.New("Code already started")
+		}
+		return d.StartRun(common.StartedByDaemonStatus)
+	})
+	if claimErr != nil {
+		return claimErr
+	}
+	// start the code, its output goes to the log files
+	if err := startWithLogs(cmd); err != nil {
+		startErr := err
+		store.Update(func(d *state.DaemonState) error {
+			d.EndRun(nil)
+			return d.SetCodeStatus(common.CodeFailedToStartStatus, startErr.Error())
+		})
 		return errors.New("The code has failed to start")
 	}
-	state.SetCodePID(cmd.Process.Pid)
+	// the process is recorded so that it can be found again if the daemon restarts
+	identity := trackableIdentity(cmd.Process.Pid)
+	store.Update(func(d *state.DaemonState) error {
+		d.TrackProcess(identity)
+		return nil
+	})
 	// start two goroutines, one to watch the running code
 	// the other to listen for a kill signal
-	go watchCmd(cmd, &out, &err)
+	go watchCmd(store, cmd)
 	return nil
 }
 
 // KillCode send the kill signal
-func KillCode() error {
-	if s, ok := state.GetCodeStatus(); ok && s != common.CodeRunningStatus {
-		return errors.New("No process currently running")
-	}
-	state.SetCodeStatus(common.CodeKilledStatus)
-	pid, ok := state.GetCodePID()
-	if !ok {
-		return errors.New("No PID in state, cannot kill code")
+func KillCode(store state.Store) error {
+	var pid int
+	err := store.Update(func(d *state.DaemonState) error {
+		if status, ok := d.GetCodeStatus(); ok && status != common.CodeRunningStatus {
+			return errors.New("No process currently running")
+		}
+		if d.CodePID == nil {
+			return errors.New("No PID in state, cannot kill code")
+		}
+		pid = *d.CodePID
+		return d.SetCodeStatus(common.CodeKilledStatus, "kill requested")
+	})
+	if err != nil {
+		return err
 	}
 	proc, err := os.FindProcess(pid)
 	if err != nil {
 		log.Println(err.Error())
-		state.SetCodeStatus(common.CodeFailedToKillStatus)
+		killFailed(store, err)
+		return nil
 	}
 	// extra check that the process is running
 	err = proc.Signal(syscall.Signal(0))
@@ -93,33 +145,53 @@ func KillCode() error {
 	err = proc.Signal(syscall.SIGTERM)
 	if err != nil {
 		log.Println(err.Error())
-		state.SetCodeStatus(common.CodeFailedToKillStatus)
+		killFailed(store, err)
 	}
 	return nil
 }
 
-// The hpc code may start as a result of an ssh session starting it,
+// the code couldn't be killed, unless it has finished in the meantime
+func killFailed(store state.Store, killErr error) {
+	store.Update(func(d *state.DaemonState) error {
+		if status, ok := d.GetCodeStatus(); ok && status == common.CodeKilledStatus {
+			return d.SetCodeStatus(common.CodeFailedToKillStatus, killErr.Error())
+		}
+		return nil
+	})
+}
+
+// WatchForExternalStart handles the hpc code starting as a result of an ssh session starting it,
 // rather than the daemon starting it (e.g. an MPI initiated start).
 // This will watch the container process list for new processes
 // and if one starts that matches the code at /hpcaas/code/<codename>
 // this will start the watchCmd and update the daemons state to reflect this new process.
-// This will be started in init() as a goroutine
-func findProcess() {
+// This is started as a goroutine by main
+func WatchForExternalStart(store state.Store) {
 	for {
-		if codeStatus, ok := state.GetCodeStatus(); ok && codeStatus == common.CodeWaitingStatus {
+		if codeStatus, ok := store.GetCodeStatus(); ok && codeStatus == common.CodeWaitingStatus {
 			procs, _ := ps.Processes()
 			for _, psProc := range procs {
-				codeName, ok := state.GetCodeName()
+				codeName, ok := store.GetCodeName()
 				if !ok {
 					break
 				}
 				if psProc.Executable() == codeName {
-					pid := psProc.Pid()
-					proc, _ := os.FindProcess(pid)
-					state.SetCodeStatus(common.CodeRunningStatus)
-					state.SetCodeStartedMethod(common.StartedExternallyStatus)
-					state.SetCodePID(pid)
-					go watchProc(proc)
+					identity := trackableIdentity(psProc.Pid())
+					// the daemon may have started the code itself in the meantime
+					err := store.Update(func(d *state.DaemonState) error {
+						if status, ok := d.GetCodeStatus(); !ok || status != common.CodeWaitingStatus {
+							return errors.New("Code already started")
+						}
+						if err := d.StartRun(common.StartedExternallyStatus); err != nil {
+							return err
+						}
+						d.TrackProcess(identity)
+						return nil
+					})
+					if err != nil {
+						break
+					}
+					go watchProc(store, identity)
 				}
 			}
 
@@ -128,13 +200,27 @@ func findProcess() {
 	}
 }
 
-func watchProc(proc *os.Process) {
+// watches a process that the daemon isn't the parent of, either because it was started externally,
+// or because it was started before the daemon restarted
+func watchProc(store state.Store, identity state.ProcessIdentity) {
 	for {
-		time.Sleep(1 * time.Second)
-		err := proc.Signal(syscall.Signal(0))
-		if err != nil {
+		time.Sleep(watchInterval)
+		if !processRunning(identity) {
 			// process has died, need to update things
-			state.SetCodeStatus(common.CodeStoppedStatus)
+			var codeStatus common.CodeStatus
+			store.Update(func(d *state.DaemonState) error {
+				// the exit is recorded even if the status can't change
+				if err := d.SetCodeStatus(common.CodeStoppedStatus, "process exited"); err != nil {
+					log.Println(err.Error())
+				}
+				// we aren't the parent so there is no way of knowing the exit code
+				d.EndRun(nil)
+				collectLogs(d)
+				codeStatus, _ = d.GetCodeStatus()
+				return nil
+			})
+			runExitHooks(codeStatus)
+			return
 		}
 	}
 }
@@ -143,33 +229,63 @@ func watchProc(proc *os.Process) {
 // blocks until the HPC code finishes
 // https://stackoverflow.com/questions/10385551/get-exit-code-go
 // http://www.darrencoxall.com/golang/executing-commands-in-go/
-func watchCmd(cmd *exec.Cmd, out *bytes.Buffer, err *bytes.Buffer) {
+func watchCmd(store state.Store, cmd *exec.Cmd) {
+	var exitCode *int
 	// block on calling the code
-	if err := cmd.Wait(); err != nil {
-		// the code has died
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			// there is a return code
-			if _, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				// if we killed the code don't change the state to error
-				if codeStatus, ok := state.GetCodeStatus(); ok && codeStatus != common.CodeKilledStatus {
-					state.SetCodeStatus(common.CodeErrorStatus)
-					log.Println(err.Error())
-				}
-			}
-		} else {
-			// the code has died, but there is no return code (?)
-			if codeStatus, ok := state.GetCodeStatus(); ok && codeStatus != common.CodeKilledStatus {
-				state.SetCodeStatus(common.CodeErrorStatus)
-			}
+	waitErr := cmd.Wait()
+	if exiterr, ok := waitErr.(*exec.ExitError); ok {
+		// there is a return code
+		if status, ok := exiterr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			code := status.ExitStatus()
+			exitCode = &code
 		}
-	} else {
+		log.Println(waitErr.Error())
+	} else if waitErr == nil {
 		// the code has finished with a return code of 0
-		state.SetCodeStatus(common.CodeStoppedStatus)
+		code := 0
+		exitCode = &code
 	}
-	state.SetCodeStdout(out.String())
-	state.SetCodeStderr(err.String())
+	// the status, run and output all change together
+	var codeStatus common.CodeStatus
+	store.Update(func(d *state.DaemonState) error {
+		// the exit is recorded even if the status can't change
+		var statusErr error
+		if waitErr == nil {
+			statusErr = d.SetCodeStatus(common.CodeStoppedStatus, "exited with code 0")
+		} else if status, ok := d.GetCodeStatus(); ok && status == common.CodeKilledStatus {
+			// if we killed the code it has stopped rather than failed
+			statusErr = d.SetCodeStatus(common.CodeStoppedStatus, "killed, "+waitErr.Error())
+		} else {
+			statusErr = d.SetCodeStatus(common.CodeErrorStatus, waitErr.Error())
+		}
+		if statusErr != nil {
+			log.Println(statusErr.Error())
+		}
+		d.EndRun(exitCode)
+		collectLogs(d)
+		codeStatus, _ = d.GetCodeStatus()
+		return nil
+	})
+	runExitHooks(codeStatus)
 }
 
-func init() {
-	go findProcess()
+var exitHooks []func(common.CodeStatus)
+var exitHooksMut = sync.Mutex{}
+
+// AddExitHook registers a function that will be called once the code has finished,
+// hooks are given the final code status and are run in the order they were added
+func AddExitHook(hook func(common.CodeStatus)) {
+	exitHooksMut.Lock()
+	defer exitHooksMut.Unlock()
+	exitHooks = append(exitHooks, hook)
+}
+
+func runExitHooks(codeStatus common.CodeStatus) {
+	exitHooksMut.Lock()
+	hooks := make([]func(common.CodeStatus), len(exitHooks))
+	copy(hooks, exitHooks)
+	exitHooksMut.Unlock()
+	for _, hook := range hooks {
+		hook(codeStatus)
+	}
 }
@@ -4,11 +4,13 @@ import "testing"
 import "os"
 import "github.com/stretchr/testify/assert"
 import "time"
+import "github.com/mrmagooey/hpcaas-common"
 import "github.com/mrmagooey/hpcaas-container-daemon/state"
 import "errors"
 import "fmt"
+import "io/ioutil"
 import "os/exec"
-import "bytes"
+import "path/filepath"
 
 func TestParent(t *testing.T) {
 	fmt.Println("")
@@ -16,105 +18,144 @@ func TestParent(t *testing.T) {
 	t.Run("_testStdout", _testStdout)
 	t.Run("_testExecuteSleep", _testExecuteSleep)
 	t.Run("_testCodeAlreadyStarted", _testCodeAlreadyStarted)
+	t.Run("_testRestartAfterFinish", _testRestartAfterFinish)
 	t.Run("_testCodeMissing", _testCodeMissing)
 	t.Run("_testEnvVars", _testEnvVars)
 	t.Run("_testKillCode", _testKillCode)
+	t.Run("_testResetBeforeKilledCodeExits", _testResetBeforeKilledCodeExits)
 	t.Run("_testCodeStartsThenReturnsError", _testCodeStartsThenReturnsError)
 	t.Run("_testCodeFailToStart", _testCodeFailToStart)
 	t.Run("_testCodeStartedExternally", _testCodeStartedExternally)
 }
 
+// a store set up to run target as the code called name, from a code directory of its own
+func setupCode(t *testing.T, target string, name string, args ...string) (state.Store, string) {
+	store, dir := setupSleeper(t)
+	if target != "" {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.SetCodeName(name)
+	store.SetCodeArguments(args)
+	return store, dir
+}
+
+func codeStatus(store state.Store) common.CodeStatus {
+	status, _ := store.GetCodeStatus()
+	return status
+}
+
+// waits for the code to have finished running
+func waitForExit(store state.Store, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if run, ok := store.GetRunState(); ok && run.EndTime != nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
 // test that a binary can be successfully started
 func _testExecuteLs(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	os.Symlink("/bin/ls", "/hpcaas/code/myls")
-	defer os.Remove("/hpcaas/code/myls")
-	state.SetCodeName("myls")
-	assert.Equal(state.CodeWaitingState, state.GetCodeState())
-	err := ExecuteCode()
+	store, dir := setupCode(t, "/bin/ls", "myls")
+	defer resetSleeper(dir)
+	assert.Equal(common.CodeWaitingStatus, codeStatus(store))
+	err := ExecuteCode(store)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	time.Sleep(100 * time.Millisecond)
-	assert.Equal(state.CodeStoppedState, state.GetCodeState())
+	waitForExit(store, time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
 }
 
 // test that we can read stdout
 func _testStdout(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	if err := os.Symlink("/bin/echo", "/hpcaas/code/myecho"); err != nil {
-		t.Error(err)
-	}
-	defer os.Remove("/hpcaas/code/myecho")
-	state.SetCodeName("myecho")
-	state.SetCodeArguments([]string{"hello"})
-	if err := ExecuteCode(); err != nil {
+	store, dir := setupCode(t, "/bin/echo", "myecho", "hello")
+	defer resetSleeper(dir)
+	if err := ExecuteCode(store); err != nil {
 		t.Error(err)
 	}
-	time.Sleep(1 * time.Second)
-	assert.Equal("hello\n", state.GetCodeStdout())
+	waitForExit(store, time.Second)
+	stdout, _ := store.GetCodeStdout()
+	assert.Equal("hello\n", stdout)
 }
 
 // test that long running processes are tracked
 func _testExecuteSleep(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	if err := os.Symlink("/bin/sleep", "/hpcaas/code/mysleep"); err != nil {
-		t.Error(err)
-	}
-	defer os.Remove("/hpcaas/code/mysleep")
-	state.SetCodeName("mysleep")
-	state.SetCodeArguments([]string{"1"})
-	assert.Equal(state.CodeWaitingState, state.GetCodeState())
-	err := ExecuteCode()
+	store, dir := setupCode(t, "/bin/sleep", "mysleep", "1")
+	defer resetSleeper(dir)
+	assert.Equal(common.CodeWaitingStatus, codeStatus(store))
+	err := ExecuteCode(store)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	assert.Equal(state.CodeRunningState, state.GetCodeState())
-	time.Sleep(2 * time.Second)
-	assert.Equal(state.CodeStoppedState, state.GetCodeState())
+	assert.Equal(common.CodeRunningStatus, codeStatus(store))
+	waitForExit(store, 3*time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
 }
 
 // test that only one binary can be running at one time
 func _testCodeAlreadyStarted(t *testing.T) {
-	// test that a started binary can have its return
 	assert := assert.New(t)
-	state.InitState()
-	// reset code state from any other tests
-	if err := os.Symlink("/bin/sleep", "/hpcaas/code/mysleep"); err != nil {
-		t.Error(err)
-	}
-	defer os.Remove("/hpcaas/code/mysleep")
-	state.SetCodeName("mysleep")
-	state.SetCodeArguments([]string{"1"})
-	assert.Equal(state.CodeWaitingState, state.GetCodeState())
-	err := ExecuteCode()
+	store, dir := setupCode(t, "/bin/sleep", "mysleep", "1")
+	defer resetSleeper(dir)
+	assert.Equal(common.CodeWaitingStatus, codeStatus(store))
+	err := ExecuteCode(store)
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	assert.Equal(state.CodeRunningState, state.GetCodeState())
-	err = ExecuteCode()
+	assert.Equal(common.CodeRunningStatus, codeStatus(store))
+	err = ExecuteCode(store)
 	if assert.Error(err) {
 		assert.Equal(errors.New("Code already started"), err)
 	}
 	// need to wait for sleep 1 to complete
-	time.Sleep(2 * time.Second)
-	assert.Equal(state.CodeStoppedState, state.GetCodeState())
+	waitForExit(store, 3*time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
+}
+
+// test that a finished code has to be reset before it runs again
+func _testRestartAfterFinish(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupCode(t, "/bin/echo", "myecho", "hello")
+	defer resetSleeper(dir)
+	if err := ExecuteCode(store); err != nil {
+		t.Error(err)
+		return
+	}
+	waitForExit(store, time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
+	err := ExecuteCode(store)
+	if assert.Error(err) {
+		assert.Equal("Code has finished as Stopped, set its status to Waiting to run it again", err.Error())
+	}
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
+
+	assert.NoError(store.SetCodeStatus(common.CodeWaitingStatus, "reset"))
+	if err := ExecuteCode(store); err != nil {
+		t.Error(err)
+		return
+	}
+	waitForExit(store, time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
 }
 
 // test that missing code raises an error
 func _testCodeMissing(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	state.SetCodeName("does_not_exist")
-	assert.Equal(state.CodeWaitingState, state.GetCodeState())
-	err := ExecuteCode()
-	assert.Equal(state.CodeMissingState, state.GetCodeState())
+	store, dir := setupCode(t, "", "does_not_exist")
+	defer resetSleeper(dir)
+	assert.Equal(common.CodeWaitingStatus, codeStatus(store))
+	err := ExecuteCode(store)
+	assert.Equal(common.CodeMissingStatus, codeStatus(store))
 	if assert.Error(err) {
 		assert.Equal(errors.New("Code executable is missing"), err)
 	}
@@ -123,112 +164,127 @@ func _testCodeMissing(t *testing.T) {
 // test that we can give environment variables to our binaries
 func _testEnvVars(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	if err := os.Symlink("/usr/bin/env", "/hpcaas/code/myenv"); err != nil {
-		t.Error(err)
-	}
-	defer os.Remove("/hpcaas/code/myenv")
-	state.SetCodeName("myenv")
-	state.SetCodeParams(map[string]string{
+	store, dir := setupCode(t, "/usr/bin/env", "myenv")
+	defer resetSleeper(dir)
+	store.SetTypedCodeParams(state.CodeParams{
 		"hello": "world",
 	})
-	if err := ExecuteCode(); err != nil {
+	if err := ExecuteCode(store); err != nil {
 		t.Error(err)
 	}
-	time.Sleep(50 * time.Millisecond)
-	assert.Equal(state.CodeStoppedState, state.GetCodeState())
-	assert.Equal("hello=world\n", state.GetCodeStdout())
+	waitForExit(store, time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
+	stdout, _ := store.GetCodeStdout()
+	assert.Equal("hello=world\n", stdout)
 }
 
 // test that we can kill a running binary
 func _testKillCode(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	// reset code state from any other tests
-	if err := os.Symlink("/bin/sleep", "/hpcaas/code/mysleep"); err != nil {
-		t.Error(err)
-	}
-	defer os.Remove("/hpcaas/code/mysleep")
-	state.SetCodeName("mysleep")
-	state.SetCodeArguments([]string{"1000"})
-
-	assert.Equal(state.CodeWaitingState, state.GetCodeState())
-	err := ExecuteCode()
+	store, dir := setupCode(t, "/bin/sleep", "mysleep", "1000")
+	defer resetSleeper(dir)
+	assert.Equal(common.CodeWaitingStatus, codeStatus(store))
+	err := ExecuteCode(store)
 	if err != nil {
 		t.Error(err)
 	}
-	// wait till it starts
-	time.Sleep(100 * time.Millisecond)
-	assert.Equal(state.CodeRunningState, state.GetCodeState())
+	assert.Equal(common.CodeRunningStatus, codeStatus(store))
 	// kill it
-	if err := KillCode(); err != nil {
+	if err := KillCode(store); err != nil {
 		t.Error(err)
 		return
 	}
-	// TODO parse the process tree to check that we are actually killing the process
 	// wait till it dies
-	time.Sleep(100 * time.Millisecond)
-	assert.Equal(state.CodeKilledState, state.GetCodeState())
+	waitForExit(store, time.Second)
+	run, _ := store.GetRunState()
+	assert.NotNil(run.EndTime)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
+	transitions := store.GetTransitions()
+	assert.Equal("Killed", transitions[len(transitions)-1].From)
 }
 
-func _testCodeStartsThenReturnsError(t *testing.T) {
-	// test that a started binary can have its return
+// test that a killed code can't be reset, and so started again, until its process has exited
+func _testResetBeforeKilledCodeExits(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	// reset code state from any other tests
-	if err := os.Symlink("/bin/bash", "/hpcaas/code/bash"); err != nil {
+	store, dir := setupCode(t, "", "stubborn")
+	defer resetSleeper(dir)
+	// the code ignores the kill and carries on for a while
+	ioutil.WriteFile(filepath.Join(dir, "stubborn"), []byte("#!/bin/sh\ntrap '' TERM\nsleep 1\n"), 0755)
+	if err := ExecuteCode(store); err != nil {
 		t.Error(err)
+		return
 	}
-	defer os.Remove("/hpcaas/code/bash")
-	state.SetCodeName("bash")
-	state.SetCodeArguments([]string{"-c \"sleep 1 && exit 1\""})
-	assert.Equal(state.CodeWaitingState, state.GetCodeState())
-	err := ExecuteCode()
+	firstRun, _ := store.GetRunState()
+	assert.NoError(KillCode(store))
+	assert.Equal(common.CodeKilledStatus, codeStatus(store))
+	assert.EqualError(store.SetCodeStatus(common.CodeWaitingStatus, "reset"), "The code status can't change from Killed to Waiting")
+	assert.Error(ExecuteCode(store))
+
+	// once it has exited the code can be reset and started again
+	waitForExit(store, 3*time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
+	assert.NoError(store.SetCodeStatus(common.CodeWaitingStatus, "reset"))
+	if err := ExecuteCode(store); err != nil {
+		t.Error(err)
+		return
+	}
+	secondRun, _ := store.GetRunState()
+	assert.NotEqual(firstRun.ID, secondRun.ID)
+	assert.Nil(secondRun.EndTime)
+	waitForExit(store, 3*time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
+}
+
+func _testCodeStartsThenReturnsError(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupCode(t, "/bin/bash", "bash", "-c", "sleep 1 && exit 1")
+	defer resetSleeper(dir)
+	assert.Equal(common.CodeWaitingStatus, codeStatus(store))
+	err := ExecuteCode(store)
 	if err != nil {
 		t.Error(err)
 	}
-	assert.Equal(state.CodeRunningState, state.GetCodeState())
+	assert.Equal(common.CodeRunningStatus, codeStatus(store))
 	// wait till it errors out
-	time.Sleep(1 * time.Second)
-	assert.Equal(state.CodeErrorState, state.GetCodeState())
+	waitForExit(store, 3*time.Second)
+	assert.Equal(common.CodeErrorStatus, codeStatus(store))
+	run, _ := store.GetRunState()
+	if assert.NotNil(run.ExitCode) {
+		assert.Equal(1, *run.ExitCode)
+	}
 }
 
 func _testCodeFailToStart(t *testing.T) {
-	// test that a started binary can have its return
 	assert := assert.New(t)
-	state.InitState()
-	// reset code state from any other tests
-	if err := os.Symlink("/bin/bash", "/hpcaas/code/bash"); err != nil {
-		t.Error(err)
-	}
-	defer os.Remove("/hpcaas/code/bash")
-	state.SetCodeName("bash")
-	// make binary unusable
-	os.Chmod("/hpcaas/code/bash", 0x000)
-	// make it usable again after the test has finished
-	defer os.Chmod("/hpcaas/code/bash", 0x755)
-	err := ExecuteCode()
+	store, dir := setupCode(t, "", "unusable")
+	defer resetSleeper(dir)
+	// the code exists but isn't executable
+	ioutil.WriteFile(filepath.Join(dir, "unusable"), []byte("#!/bin/sh\n"), 0644)
+	err := ExecuteCode(store)
 	assert.Error(err)
-	assert.Equal(state.CodeFailedToStartState, state.GetCodeState())
+	assert.Equal(common.CodeFailedToStartStatus, codeStatus(store))
 }
 
 // test that an externally started binary can be managed
 func _testCodeStartedExternally(t *testing.T) {
-	// test that a started binary can have its return
 	assert := assert.New(t)
-	state.InitState()
-	// start a command that will disown and be inherited by the root process
-	cmd := exec.Command("bash", "-c", "sleep 3 & disown")
-	var out bytes.Buffer
-	var err bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &err
-	cmd.Start()
-	state.SetCodeName("sleep")
-	time.Sleep(2 * time.Second)
+	store, dir := setupCode(t, "/bin/sleep", "extsleep")
+	defer resetSleeper(dir)
+	go WatchForExternalStart(store)
+	// start the code the way mpirun would, without the daemon
+	cmd := exec.Command(filepath.Join(dir, "extsleep"), "2")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go cmd.Wait()
+	deadline := time.Now().Add(3 * time.Second)
+	for codeStatus(store) == common.CodeWaitingStatus && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
 	// the daemon should pick up that there is a sleep command running
-	assert.Equal(state.CodeRunningState, state.GetCodeState())
-	time.Sleep(4 * time.Second)
+	assert.Equal(common.CodeRunningStatus, codeStatus(store))
+	assert.Equal(common.StartedExternallyStatus, *store.Snapshot().CodeStartedStatus)
 	// the daemon should pick up that the sleep command has stopped
-	assert.Equal(state.CodeStoppedState, state.GetCodeState())
+	waitForExit(store, 5*time.Second)
+	assert.Equal(common.CodeStoppedStatus, codeStatus(store))
 }
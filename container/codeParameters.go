@@ -3,36 +3,126 @@ package container
 import "encoding/json"
 import "io/ioutil"
 import "bytes"
+import "errors"
 import "fmt"
+import "os"
+import "path/filepath"
+import "sort"
+import "strings"
 import "sync"
 
+import "github.com/mrmagooey/hpcaas-container-daemon/state"
+
 var parameterJSONPath = "/hpcaas/runtime/parameters.json"
 var parameterPath = "/hpcaas/runtime/parameters"
 
 // var writeCodeParamsChan = make(chan codeParamRequest)
 var writeCodeMut = sync.Mutex{}
 
-// WriteCodeParams write the params to disk
-// does so by sending the values over the channel to the
-// disk writing goroutine
-func WriteCodeParams(params map[string]string) error {
+// WriteCodeParams write the params to disk, version is the version of the params that was committed to the state
+// the json file keeps the json types of the values, the newline separated file has them serialised as by state.ParamString
+// any extra formats configured for the code are written alongside them
+// each file is replaced atomically, so a running code never reads a partly written file,
+// and a running code is then told that its params have changed
+// params that have been replaced in the state by the time they are written are left for the newer version's writer
+func WriteCodeParams(store state.Store, params state.CodeParams, version uint64) error {
+	written, err := writeCodeParamFiles(store, params, version)
+	if err != nil || !written {
+		return err
+	}
+	// the code is told the version whose files have just been written
+	if codeRunning(store) {
+		go notifyParamsChanged(store, version)
+	}
+	return nil
+}
+
+// writes the files unless version is no longer the current version, returning whether they were written
+func writeCodeParamFiles(store state.Store, params state.CodeParams, version uint64) (bool, error) {
 	writeCodeMut.Lock()
 	defer writeCodeMut.Unlock()
+	// the files always follow the state, so a slower writer of an older version can't overwrite a newer one
+	if _, current := store.GetVersionedCodeParams(); current != version {
+		return false, nil
+	}
 	// write json
 	newJSON, err := json.Marshal(params)
 	if err != nil {
-		return err
+		return false, err
 	}
-	err = ioutil.WriteFile(parameterJSONPath, newJSON, 0777)
+	err = writeFileAtomic(parameterJSONPath, newJSON, 0777)
 	if err != nil {
-		return err
+		return false, err
 	}
 	// write newline separated file
+	var keys []string
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 	var buffer bytes.Buffer
-	for k, v := range params {
-		envLine := fmt.Sprintf("%s=%v\n", k, v)
+	for _, k := range keys {
+		envLine := fmt.Sprintf("%s=%v\n", k, flatParamString(params[k]))
 		buffer.WriteString(envLine)
 	}
-	err = ioutil.WriteFile(parameterPath, buffer.Bytes(), 0777)
-	return err
+	err = writeFileAtomic(parameterPath, buffer.Bytes(), 0777)
+	if err != nil {
+		return false, err
+	}
+	return true, writeParamFormats(store, params)
+}
+
+// write the parameters in each of the formats configured for the current code
+func writeParamFormats(store state.Store, params state.CodeParams) error {
+	conf, _ := store.GetDaemonConfiguration()
+	codeName, _ := store.GetCodeName()
+	for _, format := range conf.CodeParamFormats[codeName] {
+		writer, ok := getParamWriter(format)
+		if !ok {
+			return errors.New("Unknown parameter file format: " + format)
+		}
+		var buffer bytes.Buffer
+		if err := writer.Write(&buffer, params); err != nil {
+			return fmt.Errorf("Couldn't write %s parameters: %v", format, err)
+		}
+		path := filepath.Join(filepath.Dir(parameterPath), writer.FileName())
+		if err := writeFileAtomic(path, buffer.Bytes(), 0777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write to a temporary file alongside path, then rename it over path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// a string with a newline in it would break the newline separated file, so it is written json quoted instead
+func flatParamString(value interface{}) string {
+	s := state.ParamString(value)
+	if _, isString := value.(string); isString && strings.Contains(s, "\n") {
+		quoted, _ := json.Marshal(s)
+		return string(quoted)
+	}
+	return s
 }
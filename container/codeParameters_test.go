@@ -1,12 +1,23 @@
 package container
 
+import "encoding/json"
 import "io/ioutil"
+import "os"
+import "path/filepath"
+import "github.com/mrmagooey/hpcaas-container-daemon/state"
 import "github.com/stretchr/testify/assert"
 import "testing"
 
+// writes params as the current version of the store's params
+func writeCurrentParams(store state.Store, params state.CodeParams) error {
+	_, version := store.GetVersionedCodeParams()
+	return WriteCodeParams(store, params, version)
+}
+
 func testWriteCodeParams(t *testing.T) {
 	assert := assert.New(t)
-	WriteCodeParams(map[string]string{
+	store := state.NewStore(state.NewMemoryBackend())
+	writeCurrentParams(store, map[string]interface{}{
 		"hello":     "world",
 		"foo":       "bar",
 		"something": "1",
@@ -20,3 +31,49 @@ func testWriteCodeParams(t *testing.T) {
 	assert.Contains(envs, "foo=bar\n")
 	assert.Contains(envs, "something=1\n")
 }
+
+func TestWriteTypedCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "parameters")
+	defer os.RemoveAll(dir)
+	defer func(jsonPath, path string) { parameterJSONPath, parameterPath = jsonPath, path }(parameterJSONPath, parameterPath)
+	parameterJSONPath = filepath.Join(dir, "parameters.json")
+	parameterPath = filepath.Join(dir, "parameters")
+
+	var params state.CodeParams
+	json.Unmarshal([]byte(`{"steps": 100, "dt": 0.5, "restart": true, "species": ["H", "He"], "title": "two\nlines", "name": "run"}`), &params)
+	assert.NoError(writeCurrentParams(store, params))
+	written, err := ioutil.ReadFile(parameterJSONPath)
+	assert.NoError(err)
+	assert.JSONEq(`{"steps": 100, "dt": 0.5, "restart": true, "species": ["H", "He"], "title": "two\nlines", "name": "run"}`, string(written))
+	flat, err := ioutil.ReadFile(parameterPath)
+	assert.NoError(err)
+	assert.Equal("dt=0.5\nname=run\nrestart=true\nspecies=[\"H\",\"He\"]\nsteps=100\ntitle=\"two\\nlines\"\n", string(flat))
+}
+
+func TestWriteStaleCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "parameters")
+	defer os.RemoveAll(dir)
+	defer func(jsonPath, path string) { parameterJSONPath, parameterPath = jsonPath, path }(parameterJSONPath, parameterPath)
+	parameterJSONPath = filepath.Join(dir, "parameters.json")
+	parameterPath = filepath.Join(dir, "parameters")
+
+	// two writers save their params, and the second writes its files first
+	first := state.CodeParams{"steps": json.Number("5")}
+	_, version := store.GetVersionedCodeParams()
+	firstVersion, err := store.SetVersionedCodeParams(first, version)
+	assert.NoError(err)
+	second := state.CodeParams{"steps": json.Number("6")}
+	secondVersion, err := store.SetVersionedCodeParams(second, firstVersion)
+	assert.NoError(err)
+	assert.NoError(WriteCodeParams(store, second, secondVersion))
+
+	// the first writer's files would be older than the state, so they aren't written
+	assert.NoError(WriteCodeParams(store, first, firstVersion))
+	written, err := ioutil.ReadFile(parameterJSONPath)
+	assert.NoError(err)
+	assert.JSONEq(`{"steps": 6}`, string(written))
+}
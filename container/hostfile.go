@@ -16,10 +16,10 @@ var hostFileMutex = sync.Mutex{}
 
 // WriteHostFile write the MPI style hostfile to disk
 // pull information from the state
-func WriteHostFile() error {
+func WriteHostFile(store state.Store) error {
 	hostFileMutex.Lock()
 	defer hostFileMutex.Unlock()
-	addrs, ok := state.GetSSHAddresses()
+	addrs, ok := store.GetSSHAddresses()
 	if !ok {
 		return errors.New("No SSH Addresses in state")
 	}
@@ -1,18 +1,27 @@
 package container
 
 import "io/ioutil"
+import "os"
+import "path/filepath"
 import "github.com/stretchr/testify/assert"
 import "testing"
 
+import "github.com/mrmagooey/hpcaas-common"
 import "github.com/mrmagooey/hpcaas-container-daemon/state"
 
 func TestWriteHostFile(t *testing.T) {
 	assert := assert.New(t)
-	state.SetSSHAddresses(state.ContainerAddresses{
+	dir, err := ioutil.TempDir("", "hostfile")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	defer func(path string) { hostFilePath = path }(hostFilePath)
+	hostFilePath = filepath.Join(dir, "hostfile")
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetSSHAddresses(common.ContainerAddresses{
 		1: "127.0.0.1:8000",
 		2: "127.0.0.1:8002",
 	})
-	WriteHostFile()
+	assert.NoError(WriteHostFile(store))
 	contents, err := ioutil.ReadFile(hostFilePath)
 	assert.NoError(err)
 	assert.Contains(
@@ -0,0 +1,412 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// ParamWriter writes the code parameters in a file format that a code understands
+// writers are registered with RegisterParamWriter, and chosen per code with the codeParamFormats daemon configuration
+type ParamWriter interface {
+	// FileName is the name of the file, within /hpcaas/runtime, that the parameters are written to
+	FileName() string
+	// Write the parameters, failing if any of them can't be represented in the format
+	Write(w io.Writer, params state.CodeParams) error
+}
+
+var paramWriters = map[string]ParamWriter{
+	"namelist": namelistWriter{},
+	"ini":      iniWriter{},
+	"yaml":     yamlWriter{},
+	"toml":     tomlWriter{},
+	"shell":    shellWriter{},
+}
+var paramWritersMut = sync.RWMutex{}
+
+// RegisterParamWriter makes a format available to codes, replacing any writer already registered for it
+func RegisterParamWriter(format string, writer ParamWriter) {
+	paramWritersMut.Lock()
+	defer paramWritersMut.Unlock()
+	paramWriters[format] = writer
+}
+
+func getParamWriter(format string) (ParamWriter, bool) {
+	paramWritersMut.RLock()
+	defer paramWritersMut.RUnlock()
+	writer, ok := paramWriters[format]
+	return writer, ok
+}
+
+// CheckParamFormats returns an error if any of the formats, keyed by code name, has no writer
+func CheckParamFormats(formats map[string][]string) error {
+	for _, codeFormats := range formats {
+		for _, format := range codeFormats {
+			if _, ok := getParamWriter(format); !ok {
+				return errors.New("Unknown parameter file format: " + format)
+			}
+		}
+	}
+	return nil
+}
+
+func sortedParamKeys(params map[string]interface{}) []string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// json encoding, without go's escaping of <, > and &
+func compactJSON(value interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buf.String(), "\n"), nil
+}
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// namelistWriter writes a fortran namelist to parameters.nml
+// top level values go in the &parameters group, and each top level object becomes a group of its own
+// objects within a group are written as derived type components, e.g. grid%nx = 64
+type namelistWriter struct{}
+
+func (namelistWriter) FileName() string {
+	return "parameters.nml"
+}
+
+func (n namelistWriter) Write(w io.Writer, params state.CodeParams) error {
+	var scalars []string
+	var groups []string
+	for _, k := range sortedParamKeys(params) {
+		if !identifierRegexp.MatchString(k) {
+			return errors.New("Parameter name can't be used in a namelist: " + k)
+		}
+		if _, ok := params[k].(map[string]interface{}); ok {
+			groups = append(groups, k)
+		} else {
+			scalars = append(scalars, k)
+		}
+	}
+	var buf bytes.Buffer
+	if len(scalars) > 0 {
+		buf.WriteString("&parameters\n")
+		for _, k := range scalars {
+			if err := n.writeItem(&buf, k, params[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("/\n")
+	}
+	for _, group := range groups {
+		buf.WriteString("&" + group + "\n")
+		members := params[group].(map[string]interface{})
+		for _, k := range sortedParamKeys(members) {
+			if !identifierRegexp.MatchString(k) {
+				return errors.New("Parameter name can't be used in a namelist: " + group + "." + k)
+			}
+			if err := n.writeItem(&buf, k, members[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("/\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (n namelistWriter) writeItem(buf *bytes.Buffer, name string, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		// fortran has no null, the variable keeps whatever value the code gave it
+		return nil
+	case map[string]interface{}:
+		for _, k := range sortedParamKeys(v) {
+			if !identifierRegexp.MatchString(k) {
+				return errors.New("Parameter name can't be used in a namelist: " + name + "%" + k)
+			}
+			if err := n.writeItem(buf, name+"%"+k, v[k]); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			s, err := n.value(item)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			values = append(values, s)
+		}
+		fmt.Fprintf(buf, "  %s = %s\n", name, strings.Join(values, ", "))
+		return nil
+	}
+	s, err := n.value(value)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	fmt.Fprintf(buf, "  %s = %s\n", name, s)
+	return nil
+}
+
+func (namelistWriter) value(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		// a fortran character constant can't hold a newline
+		if strings.ContainsAny(v, "\r\n") {
+			return "", errors.New("strings containing newlines can't be written to a namelist")
+		}
+		return "'" + strings.Replace(v, "'", "''", -1) + "'", nil
+	case bool:
+		if v {
+			return ".true.", nil
+		}
+		return ".false.", nil
+	case json.Number, float64, int, int64:
+		return fmt.Sprint(v), nil
+	}
+	return "", errors.New("only numbers, strings and booleans can be written as namelist values")
+}
+
+// iniWriter writes parameters.ini
+// top level values are written before any section, and each object becomes a section, nested objects as [outer.inner]
+// strings are double quoted, with backslash escapes, whenever they would otherwise be misread
+type iniWriter struct{}
+
+func (iniWriter) FileName() string {
+	return "parameters.ini"
+}
+
+var iniKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_.\-]+$`)
+
+func (i iniWriter) Write(w io.Writer, params state.CodeParams) error {
+	var buf bytes.Buffer
+	if err := i.writeSection(&buf, "", params); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (i iniWriter) writeSection(buf *bytes.Buffer, section string, params map[string]interface{}) error {
+	var subsections []string
+	for _, k := range sortedParamKeys(params) {
+		if !iniKeyRegexp.MatchString(k) {
+			return errors.New("Parameter name can't be used in an ini file: " + k)
+		}
+		value := params[k]
+		if _, ok := value.(map[string]interface{}); ok {
+			subsections = append(subsections, k)
+			continue
+		}
+		s, err := i.value(value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "%s = %s\n", k, s)
+	}
+	for _, k := range subsections {
+		name := k
+		if section != "" {
+			name = section + "." + k
+		}
+		fmt.Fprintf(buf, "\n[%s]\n", name)
+		if err := i.writeSection(buf, name, params[k].(map[string]interface{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// characters that would end or change the meaning of an unquoted ini value
+var iniSpecial = "\"'=;#\\\r\n\t[]"
+
+func (iniWriter) value(value interface{}) (string, error) {
+	s, isString := value.(string)
+	if !isString {
+		return compactJSON(value)
+	}
+	if s != "" && !strings.ContainsAny(s, iniSpecial) && strings.TrimSpace(s) == s {
+		return s, nil
+	}
+	r := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n", "\r", "\\r", "\t", "\\t")
+	return "\"" + r.Replace(s) + "\"", nil
+}
+
+// yamlWriter writes parameters.yaml
+// objects are written as block mappings, everything else as json, which is valid yaml
+type yamlWriter struct{}
+
+func (yamlWriter) FileName() string {
+	return "parameters.yaml"
+}
+
+func (y yamlWriter) Write(w io.Writer, params state.CodeParams) error {
+	var buf bytes.Buffer
+	if err := y.writeMapping(&buf, "", params); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (y yamlWriter) writeMapping(buf *bytes.Buffer, indent string, params map[string]interface{}) error {
+	for _, k := range sortedParamKeys(params) {
+		// keys are always quoted, so that e.g. "on" or "1" stay strings
+		key, err := compactJSON(k)
+		if err != nil {
+			return err
+		}
+		if nested, ok := params[k].(map[string]interface{}); ok && len(nested) > 0 {
+			fmt.Fprintf(buf, "%s%s:\n", indent, key)
+			if err := y.writeMapping(buf, indent+"  ", nested); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := compactJSON(params[k])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(buf, "%s%s: %s\n", indent, key, value)
+	}
+	return nil
+}
+
+// tomlWriter writes parameters.toml
+// objects become tables, objects within arrays become inline tables, and nulls are left out as toml has no null
+type tomlWriter struct{}
+
+func (tomlWriter) FileName() string {
+	return "parameters.toml"
+}
+
+var tomlBareKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9_\-]+$`)
+
+func (t tomlWriter) Write(w io.Writer, params state.CodeParams) error {
+	var buf bytes.Buffer
+	if err := t.writeTable(&buf, "", params); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func (tomlWriter) key(k string) (string, error) {
+	if tomlBareKeyRegexp.MatchString(k) {
+		return k, nil
+	}
+	// a toml basic string has the same escapes as json
+	return compactJSON(k)
+}
+
+func (t tomlWriter) writeTable(buf *bytes.Buffer, table string, params map[string]interface{}) error {
+	var tables []string
+	for _, k := range sortedParamKeys(params) {
+		key, err := t.key(k)
+		if err != nil {
+			return err
+		}
+		switch v := params[k].(type) {
+		case nil:
+			continue
+		case map[string]interface{}:
+			tables = append(tables, k)
+			continue
+		default:
+			value, err := t.value(v)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(buf, "%s = %s\n", key, value)
+		}
+	}
+	for _, k := range tables {
+		key, err := t.key(k)
+		if err != nil {
+			return err
+		}
+		name := key
+		if table != "" {
+			name = table + "." + key
+		}
+		fmt.Fprintf(buf, "\n[%s]\n", name)
+		if err := t.writeTable(buf, name, params[k].(map[string]interface{})); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t tomlWriter) value(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", errors.New("toml can't represent null")
+	case []interface{}:
+		var items []string
+		for _, item := range v {
+			s, err := t.value(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case map[string]interface{}:
+		var items []string
+		for _, k := range sortedParamKeys(v) {
+			if v[k] == nil {
+				continue
+			}
+			key, err := t.key(k)
+			if err != nil {
+				return "", err
+			}
+			s, err := t.value(v[k])
+			if err != nil {
+				return "", err
+			}
+			items = append(items, key+" = "+s)
+		}
+		return "{" + strings.Join(items, ", ") + "}", nil
+	}
+	// strings, numbers and booleans are written the same as json
+	return compactJSON(value)
+}
+
+// shellWriter writes parameters.sh, which can be sourced by a shell script
+// every value is single quoted, and serialised as for the environment
+type shellWriter struct{}
+
+func (shellWriter) FileName() string {
+	return "parameters.sh"
+}
+
+func (shellWriter) Write(w io.Writer, params state.CodeParams) error {
+	var buf bytes.Buffer
+	for _, k := range sortedParamKeys(params) {
+		if !identifierRegexp.MatchString(k) {
+			return errors.New("Parameter name isn't a valid shell variable name: " + k)
+		}
+		// the only thing that can't appear within single quotes is a single quote
+		quoted := "'" + strings.Replace(state.ParamString(params[k]), "'", `'\''`, -1) + "'"
+		fmt.Fprintf(&buf, "export %s=%s\n", k, quoted)
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
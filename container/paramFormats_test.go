@@ -0,0 +1,125 @@
+package container
+
+import "bytes"
+import "encoding/json"
+import "io"
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "github.com/mrmagooey/hpcaas-container-daemon/state"
+import "github.com/stretchr/testify/assert"
+import "testing"
+
+func formatParams(s string) state.CodeParams {
+	var params state.CodeParams
+	json.Unmarshal([]byte(s), &params)
+	return params
+}
+
+func writeFormat(writer ParamWriter, params state.CodeParams) (string, error) {
+	var buf bytes.Buffer
+	err := writer.Write(&buf, params)
+	return buf.String(), err
+}
+
+func TestNamelistWriter(t *testing.T) {
+	assert := assert.New(t)
+	out, err := writeFormat(namelistWriter{}, formatParams(`{"steps": 100, "dt": 1e-3, "restart": false, "title": "it's a=b", "species": ["H", "He"], "grid": {"nx": 64, "size": {"x": 1.5}}, "unset": null}`))
+	assert.NoError(err)
+	assert.Equal("&parameters\n  dt = 1e-3\n  restart = .false.\n  species = 'H', 'He'\n  steps = 100\n  title = 'it''s a=b'\n/\n&grid\n  nx = 64\n  size%x = 1.5\n/\n", out)
+
+	_, err = writeFormat(namelistWriter{}, formatParams(`{"title": "two\nlines"}`))
+	assert.Error(err)
+	_, err = writeFormat(namelistWriter{}, formatParams(`{"bad-name": 1}`))
+	assert.Error(err)
+	_, err = writeFormat(namelistWriter{}, formatParams(`{"list": [{"a": 1}]}`))
+	assert.Error(err)
+}
+
+func TestIniWriter(t *testing.T) {
+	assert := assert.New(t)
+	out, err := writeFormat(iniWriter{}, formatParams(`{"name": "run", "expr": "a=b", "quote": "say \"hi\"", "title": "two\nlines", "padded": " x", "on": true, "list": [1, 2], "grid": {"nx": 64, "size": {"x": 1.5}}}`))
+	assert.NoError(err)
+	assert.Equal("expr = \"a=b\"\nlist = [1,2]\nname = run\non = true\npadded = \" x\"\nquote = \"say \\\"hi\\\"\"\ntitle = \"two\\nlines\"\n\n[grid]\nnx = 64\n\n[grid.size]\nx = 1.5\n", out)
+
+	_, err = writeFormat(iniWriter{}, formatParams(`{"a=b": 1}`))
+	assert.Error(err)
+}
+
+func TestYAMLWriter(t *testing.T) {
+	assert := assert.New(t)
+	out, err := writeFormat(yamlWriter{}, formatParams(`{"name": "no", "title": "two\nlines: 'x'", "steps": 100, "list": ["a", 1], "grid": {"nx": 64}, "empty": {}, "unset": null}`))
+	assert.NoError(err)
+	assert.Equal("\"empty\": {}\n\"grid\":\n  \"nx\": 64\n\"list\": [\"a\",1]\n\"name\": \"no\"\n\"steps\": 100\n\"title\": \"two\\nlines: 'x'\"\n\"unset\": null\n", out)
+}
+
+func TestTOMLWriter(t *testing.T) {
+	assert := assert.New(t)
+	out, err := writeFormat(tomlWriter{}, formatParams(`{"name": "say \"hi\"\n", "a=b": 1, "steps": 100, "points": [{"x": 1, "y": null}], "grid": {"nx": 64, "size": {"x": 1.5}}, "unset": null}`))
+	assert.NoError(err)
+	assert.Equal("\"a=b\" = 1\nname = \"say \\\"hi\\\"\\n\"\npoints = [{x = 1}]\nsteps = 100\n\n[grid]\nnx = 64\n\n[grid.size]\nx = 1.5\n", out)
+
+	_, err = writeFormat(tomlWriter{}, formatParams(`{"list": [1, null]}`))
+	assert.Error(err)
+}
+
+func TestShellWriter(t *testing.T) {
+	assert := assert.New(t)
+	out, err := writeFormat(shellWriter{}, formatParams(`{"name": "it's $HOME", "title": "two\nlines", "expr": "a=b", "steps": 100, "list": ["a"]}`))
+	assert.NoError(err)
+	assert.Equal("export expr='a=b'\nexport list='[\"a\"]'\nexport name='it'\\''s $HOME'\nexport steps='100'\nexport title='two\nlines'\n", out)
+
+	_, err = writeFormat(shellWriter{}, formatParams(`{"not-a-var": 1}`))
+	assert.Error(err)
+}
+
+type upperWriter struct{}
+
+func (upperWriter) FileName() string {
+	return "parameters.upper"
+}
+
+func (upperWriter) Write(w io.Writer, params state.CodeParams) error {
+	for _, k := range sortedParamKeys(params) {
+		io.WriteString(w, k+"\n")
+	}
+	return nil
+}
+
+func TestWriteConfiguredParamFormats(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "parameters")
+	defer os.RemoveAll(dir)
+	defer func(jsonPath, path string) { parameterJSONPath, parameterPath = jsonPath, path }(parameterJSONPath, parameterPath)
+	parameterJSONPath = filepath.Join(dir, "parameters.json")
+	parameterPath = filepath.Join(dir, "parameters")
+	RegisterParamWriter("upper", upperWriter{})
+	defer func() {
+		paramWritersMut.Lock()
+		delete(paramWriters, "upper")
+		paramWritersMut.Unlock()
+	}()
+
+	assert.Error(CheckParamFormats(map[string][]string{"legacy": {"yaml", "nope"}}))
+	assert.NoError(CheckParamFormats(map[string][]string{"legacy": {"namelist", "upper"}}))
+	store.SetCodeName("legacy")
+	store.SetDaemonConfiguration(state.DaemonConfiguration{CodeParamFormats: map[string][]string{
+		"legacy": {"namelist", "upper"},
+		"other":  {"yaml"},
+	}})
+
+	assert.NoError(writeCurrentParams(store, formatParams(`{"steps": 100}`)))
+	namelist, err := ioutil.ReadFile(filepath.Join(dir, "parameters.nml"))
+	assert.NoError(err)
+	assert.Equal("&parameters\n  steps = 100\n/\n", string(namelist))
+	upper, err := ioutil.ReadFile(filepath.Join(dir, "parameters.upper"))
+	assert.NoError(err)
+	assert.Equal("steps\n", string(upper))
+	// only the formats configured for the current code are written
+	_, err = os.Stat(filepath.Join(dir, "parameters.yaml"))
+	assert.True(os.IsNotExist(err))
+
+	// a value the format can't represent fails the write
+	assert.Error(writeCurrentParams(store, formatParams(`{"title": "two\nlines"}`)))
+}
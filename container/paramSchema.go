@@ -0,0 +1,121 @@
+package container
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// where the code, and anything shipped with it, lives
+var codeDirectory = "/hpcaas/code"
+
+// ParamError is a problem with a single code parameter
+type ParamError struct {
+	// dotted path of the parameter, e.g. grid.nx
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ParamErrors are all the problems found with a set of code parameters
+type ParamErrors []ParamError
+
+func (p ParamErrors) Error() string {
+	var messages []string
+	for _, e := range p {
+		messages = append(messages, e.Field+": "+e.Message)
+	}
+	return "Invalid code parameters: " + strings.Join(messages, "; ")
+}
+
+// the code can describe its parameters with a json schema at /hpcaas/code/<code name>.params.schema.json
+func codeParamSchemaPath(codeName string) string {
+	return filepath.Join(codeDirectory, codeName+".params.schema.json")
+}
+
+// ValidateCodeParams checks params against the json schema shipped with the named code, if there is one,
+// returning the params with any defaults from the schema applied
+// params can be sent a few at a time, so missing required params are only an error if requireAll is set
+// invalid params are reported as ParamErrors
+func ValidateCodeParams(codeName string, params state.CodeParams, requireAll bool) (state.CodeParams, error) {
+	if codeName == "" {
+		return params, nil
+	}
+	schemaBytes, err := ioutil.ReadFile(codeParamSchemaPath(codeName))
+	if os.IsNotExist(err) {
+		return params, nil
+	}
+	if err != nil {
+		return params, err
+	}
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(schemaBytes))
+	if err != nil {
+		return params, err
+	}
+	// the schema is also read as plain json for its defaults
+	decoder := json.NewDecoder(bytes.NewReader(schemaBytes))
+	decoder.UseNumber()
+	var rawSchema map[string]interface{}
+	if err := decoder.Decode(&rawSchema); err != nil {
+		return params, err
+	}
+
+	withDefaults := make(map[string]interface{}, len(params))
+	for k, v := range params {
+		withDefaults[k] = v
+	}
+	applyParamDefaults(rawSchema, withDefaults)
+	paramBytes, err := json.Marshal(withDefaults)
+	if err != nil {
+		return params, err
+	}
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(paramBytes))
+	if err != nil {
+		return params, err
+	}
+	var paramErrors ParamErrors
+	for _, e := range result.Errors() {
+		field := e.Field()
+		if e.Type() == "required" {
+			if !requireAll {
+				continue
+			}
+			// the error is reported against the parent, rather than the missing param
+			property, _ := e.Details()["property"].(string)
+			if field == "(root)" {
+				field = property
+			} else {
+				field += "." + property
+			}
+		}
+		paramErrors = append(paramErrors, ParamError{Field: field, Message: e.Description()})
+	}
+	if len(paramErrors) > 0 {
+		return params, paramErrors
+	}
+	return withDefaults, nil
+}
+
+// fill in any missing params that the schema has a default for, including within nested objects
+func applyParamDefaults(schema map[string]interface{}, params map[string]interface{}) {
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, p := range properties {
+		property, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if _, set := params[name]; !set {
+			if def, ok := property["default"]; ok {
+				params[name] = def
+			}
+		}
+		if nested, ok := params[name].(map[string]interface{}); ok {
+			applyParamDefaults(property, nested)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package container
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+var testParamSchema = `{
+	"type": "object",
+	"properties": {
+		"steps": {"type": "integer", "minimum": 1},
+		"dt": {"type": "number", "default": 0.01},
+		"method": {"type": "string", "enum": ["euler", "rk4"], "default": "rk4"},
+		"grid": {
+			"type": "object",
+			"properties": {
+				"nx": {"type": "integer", "default": 64},
+				"ny": {"type": "integer"}
+			},
+			"required": ["ny"]
+		}
+	},
+	"required": ["steps", "grid"]
+}`
+
+func setupParamSchema(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeDirectory = dir
+	ioutil.WriteFile(filepath.Join(dir, "sim.params.schema.json"), []byte(testParamSchema), 0644)
+	return dir
+}
+
+func testParams(t *testing.T, s string) state.CodeParams {
+	var params state.CodeParams
+	if err := json.Unmarshal([]byte(s), &params); err != nil {
+		t.Fatal(err)
+	}
+	return params
+}
+
+func TestValidateCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	defer func(dir string) { codeDirectory = dir }(codeDirectory)
+	dir := setupParamSchema(t)
+	defer os.RemoveAll(dir)
+
+	params, err := ValidateCodeParams("sim", testParams(t, `{"steps": 10, "grid": {"ny": 32}}`), true)
+	assert.NoError(err)
+	assert.Equal(json.Number("0.01"), params["dt"])
+	assert.Equal("rk4", params["method"])
+	assert.Equal(map[string]interface{}{"nx": json.Number("64"), "ny": json.Number("32")}, params["grid"])
+
+	// values that were sent aren't replaced by defaults
+	params, err = ValidateCodeParams("sim", testParams(t, `{"steps": 10, "dt": 0.5, "grid": {"ny": 32}}`), true)
+	assert.NoError(err)
+	assert.Equal(json.Number("0.5"), params["dt"])
+
+	_, err = ValidateCodeParams("sim", testParams(t, `{"steps": 0, "method": "guess", "grid": {"ny": "wide"}}`), true)
+	paramErrors, ok := err.(ParamErrors)
+	if assert.True(ok) {
+		fields := map[string]bool{}
+		for _, e := range paramErrors {
+			fields[e.Field] = true
+			assert.NotEmpty(e.Message)
+		}
+		assert.Equal(map[string]bool{"steps": true, "method": true, "grid.ny": true}, fields)
+	}
+
+	// missing params are only an error when they all have to be there
+	_, err = ValidateCodeParams("sim", testParams(t, `{"grid": {}}`), false)
+	assert.NoError(err)
+	_, err = ValidateCodeParams("sim", testParams(t, `{"grid": {}}`), true)
+	paramErrors, ok = err.(ParamErrors)
+	if assert.True(ok) && assert.Len(paramErrors, 2) {
+		fields := []string{paramErrors[0].Field, paramErrors[1].Field}
+		assert.Contains(fields, "steps")
+		assert.Contains(fields, "grid.ny")
+	}
+
+	// codes without a schema accept anything
+	params, err = ValidateCodeParams("other", testParams(t, `{"anything": "goes"}`), true)
+	assert.NoError(err)
+	assert.Equal(state.CodeParams{"anything": "goes"}, params)
+
+	ioutil.WriteFile(filepath.Join(dir, "broken.params.schema.json"), []byte("{"), 0644)
+	_, err = ValidateCodeParams("broken", testParams(t, `{}`), true)
+	assert.Error(err)
+	_, ok = err.(ParamErrors)
+	assert.False(ok)
+}
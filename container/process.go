@@ -0,0 +1,162 @@
+package container
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// where the kernel's information about each process is read from
+var procDirectory = "/proc"
+
+// the code's stdout and stderr are written to files here rather than to the daemon,
+// so that the code can carry on, and its output is kept, if the daemon stops
+var codeLogDirectory = "/hpcaas/daemon"
+
+// how often a process that the daemon isn't the parent of is checked on
+var watchInterval = 1 * time.Second
+
+// errProcessExited is returned for a process that has exited but not yet been waited for by its parent
+var errProcessExited = errors.New("Process has exited")
+
+func codeLogPaths() (string, string) {
+	return filepath.Join(codeLogDirectory, "code.stdout"), filepath.Join(codeLogDirectory, "code.stderr")
+}
+
+// starts cmd with its stdout and stderr written to the code's log files, replacing those of the last run
+func startWithLogs(cmd *exec.Cmd) error {
+	stdoutPath, stderrPath := codeLogPaths()
+	stdout, err := os.OpenFile(stdoutPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer stdout.Close()
+	stderr, err := os.OpenFile(stderrPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer stderr.Close()
+	// the code has its own copies of the files once it has started
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Start()
+}
+
+// copies the log files of a code the daemon started into its stdout and stderr
+// there are no log files for a code that was started externally
+func collectLogs(d *state.DaemonState) {
+	if d.CodeStartedStatus == nil || *d.CodeStartedStatus != common.StartedByDaemonStatus {
+		return
+	}
+	stdoutPath, stderrPath := codeLogPaths()
+	if out, err := ioutil.ReadFile(stdoutPath); err == nil {
+		stdout := string(out)
+		d.CodeStdout = &stdout
+	} else {
+		log.Println("Couldn't read the code's stdout: " + err.Error())
+	}
+	if out, err := ioutil.ReadFile(stderrPath); err == nil {
+		stderr := string(out)
+		d.CodeStderr = &stderr
+	} else {
+		log.Println("Couldn't read the code's stderr: " + err.Error())
+	}
+}
+
+// identifies the process with pid, returning an error if there is no such process, or it has exited
+// as much of the identity as could be read is returned along with any error
+func processIdentity(pid int) (state.ProcessIdentity, error) {
+	identity := state.ProcessIdentity{PID: pid}
+	dir := filepath.Join(procDirectory, strconv.Itoa(pid))
+	stat, err := ioutil.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return identity, err
+	}
+	// the command name is in brackets, and may itself contain spaces or brackets
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return identity, errors.New("Unreadable process stat: " + string(stat))
+	}
+	// the fields after the command name start from the third, the state is the third and the start time the twenty second
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return identity, errors.New("Unreadable process stat: " + string(stat))
+	}
+	identity.StartTime, err = strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return identity, err
+	}
+	// a zombie, or a process that is being reaped
+	if fields[0] == "Z" || fields[0] == "X" {
+		return identity, errProcessExited
+	}
+	// it may not be possible to read the executable, e.g. of a process run as another user
+	identity.Executable, err = os.Readlink(filepath.Join(dir, "exe"))
+	return identity, err
+}
+
+// whether the process is still running, and hasn't been replaced by another with the same pid
+// the executable is only compared if it could be read, both when the process was identified and now
+func processRunning(identity state.ProcessIdentity) bool {
+	current, err := processIdentity(identity.PID)
+	if err == errProcessExited || current.StartTime == 0 || current.StartTime != identity.StartTime {
+		return false
+	}
+	return identity.Executable == "" || current.Executable == "" || current.Executable == identity.Executable
+}
+
+// identifies the process with pid, as far as it can be, an error is only logged as the process is still worth tracking
+func trackableIdentity(pid int) state.ProcessIdentity {
+	identity, err := processIdentity(pid)
+	if err != nil {
+		log.Println("Couldn't identify process " + strconv.Itoa(pid) + ": " + err.Error())
+	}
+	return identity
+}
+
+// ReattachCode picks up the code if it was still running when the daemon last stopped,
+// as long as its process is the one that was started, and isn't another process that has been given the same pid.
+// The code's output carries on being written to its log files, and is collected once it exits.
+// Otherwise the code is marked as lost.
+// This is called by main once the state has been rehydrated
+func ReattachCode(store state.Store) {
+	snapshot := store.Snapshot()
+	status, ok := snapshot.GetCodeStatus()
+	if !ok || (status != common.CodeRunningStatus && status != common.CodeKilledStatus && status != common.CodeFailedToKillStatus) {
+		return
+	}
+	var cause string
+	if snapshot.Run == nil || snapshot.Run.Process == nil {
+		cause = "no process was recorded for the code"
+	} else if identity := *snapshot.Run.Process; processRunning(identity) {
+		log.Println("Reattached to the code, pid " + strconv.Itoa(identity.PID))
+		go watchProc(store, identity)
+		return
+	} else if current, err := processIdentity(identity.PID); current.StartTime != 0 && err != errProcessExited {
+		cause = "pid " + strconv.Itoa(identity.PID) + " is now a different process"
+	} else {
+		cause = "pid " + strconv.Itoa(identity.PID) + " had gone when the daemon restarted"
+	}
+	log.Println("The code has been lost, " + cause)
+	var codeStatus common.CodeStatus
+	store.Update(func(d *state.DaemonState) error {
+		if err := d.SetCodeStatus(state.CodeLostStatus, cause); err != nil {
+			log.Println(err.Error())
+		}
+		d.EndRun(nil)
+		collectLogs(d)
+		codeStatus, _ = d.GetCodeStatus()
+		return nil
+	})
+	runExitHooks(codeStatus)
+}
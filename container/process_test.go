@@ -0,0 +1,203 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// a store whose code was started by the daemon as process, before the daemon restarted
+func setupReattach(t *testing.T, process state.ProcessIdentity) (state.Store, string) {
+	dir, err := ioutil.TempDir("", "reattach")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeLogDirectory = dir
+	stdout, _ := codeLogPaths()
+	ioutil.WriteFile(stdout, []byte("step 1\n"), 0600)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	store.Update(func(d *state.DaemonState) error {
+		if err := d.StartRun(common.StartedByDaemonStatus); err != nil {
+			return err
+		}
+		d.TrackProcess(process)
+		return nil
+	})
+	return store, dir
+}
+
+func resetReattach(dir string) {
+	os.RemoveAll(dir)
+	codeLogDirectory = "/hpcaas/daemon"
+}
+
+func startSleep(t *testing.T) *exec.Cmd {
+	cmd := exec.Command("sleep", "10")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestProcessIdentity(t *testing.T) {
+	assert := assert.New(t)
+	cmd := startSleep(t)
+	identity, err := processIdentity(cmd.Process.Pid)
+	assert.NoError(err)
+	assert.Equal(cmd.Process.Pid, identity.PID)
+	assert.NotEqual(uint64(0), identity.StartTime)
+	assert.NotEmpty(identity.Executable)
+	assert.True(processRunning(identity))
+
+	// a later process given the same pid starts at a different time
+	reused := identity
+	reused.StartTime++
+	assert.False(processRunning(reused))
+
+	cmd.Process.Kill()
+	cmd.Wait()
+	assert.False(processRunning(identity))
+}
+
+func TestReattachRunningCode(t *testing.T) {
+	assert := assert.New(t)
+	defer func(interval time.Duration) { watchInterval = interval }(watchInterval)
+	watchInterval = 10 * time.Millisecond
+	cmd := startSleep(t)
+	defer cmd.Process.Kill()
+	store, dir := setupReattach(t, trackableIdentity(cmd.Process.Pid))
+	defer resetReattach(dir)
+
+	ReattachCode(store)
+	status, _ := store.GetCodeStatus()
+	assert.Equal(common.CodeRunningStatus, status)
+
+	// once it exits its output is collected from the log files
+	cmd.Process.Kill()
+	cmd.Wait()
+	deadline := time.Now().Add(2 * time.Second)
+	for status == common.CodeRunningStatus && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		status, _ = store.GetCodeStatus()
+	}
+	assert.Equal(common.CodeStoppedStatus, status)
+	stdout, _ := store.GetCodeStdout()
+	assert.Equal("step 1\n", stdout)
+}
+
+func TestReattachLostCode(t *testing.T) {
+	assert := assert.New(t)
+	cmd := startSleep(t)
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	// the pid has been given to another process
+	identity := trackableIdentity(cmd.Process.Pid)
+	identity.StartTime++
+	store, dir := setupReattach(t, identity)
+	defer resetReattach(dir)
+
+	ReattachCode(store)
+	status, _ := store.GetCodeStatus()
+	assert.Equal(state.CodeLostStatus, status)
+	transitions := store.GetTransitions()
+	last := transitions[len(transitions)-1]
+	assert.Equal("Lost", last.To)
+	assert.Contains(last.Cause, "different process")
+	run, _ := store.GetRunState()
+	assert.NotNil(run.EndTime)
+	assert.Nil(run.ExitCode)
+	stdout, _ := store.GetCodeStdout()
+	assert.Equal("step 1\n", stdout)
+
+	// a lost code can be reset to wait for the next start
+	assert.NoError(store.SetCodeStatus(common.CodeWaitingStatus, "reset"))
+}
+
+func TestCollectLogsOnlyForDaemonStarts(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "logs")
+	assert.NoError(err)
+	defer resetReattach(dir)
+	codeLogDirectory = dir
+	ioutil.WriteFile(filepath.Join(dir, "code.stdout"), []byte("old run"), 0600)
+	external := common.StartedExternallyStatus
+	d := &state.DaemonState{}
+	d.CodeStartedStatus = &external
+	collectLogs(d)
+	assert.Nil(d.CodeStdout)
+}
+
+// a /proc with a single process, whose stat has the state and start time given
+func setupProc(t *testing.T, pid int, processState string, startTime string) string {
+	dir, err := ioutil.TempDir("", "proc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	procDirectory = dir
+	processDir := filepath.Join(dir, strconv.Itoa(pid))
+	os.Mkdir(processDir, 0700)
+	stat := strconv.Itoa(pid) + " (my code) " + processState + " 1 1 1 0 -1 4194560 100 0 0 0 0 0 0 0 20 0 1 0 " + startTime + " 1000 100"
+	ioutil.WriteFile(filepath.Join(processDir, "stat"), []byte(stat), 0600)
+	return dir
+}
+
+func resetProc(dir string) {
+	os.RemoveAll(dir)
+	procDirectory = "/proc"
+}
+
+func TestPartialIdentity(t *testing.T) {
+	assert := assert.New(t)
+	// the executable of the process can't be read
+	dir := setupProc(t, 42, "S", "1234")
+	defer resetProc(dir)
+	identity, err := processIdentity(42)
+	assert.Error(err)
+	assert.Equal(uint64(1234), identity.StartTime)
+	assert.Empty(identity.Executable)
+
+	// it is still the same process, whether or not its executable was read when it was first identified
+	assert.True(processRunning(identity))
+	assert.True(processRunning(state.ProcessIdentity{PID: 42, StartTime: 1234, Executable: "/bin/sim"}))
+	assert.False(processRunning(state.ProcessIdentity{PID: 42, StartTime: 1235}))
+
+	// once it has been read the executable has to match
+	os.Symlink("/bin/sim", filepath.Join(dir, "42", "exe"))
+	assert.True(processRunning(state.ProcessIdentity{PID: 42, StartTime: 1234, Executable: "/bin/sim"}))
+	assert.False(processRunning(state.ProcessIdentity{PID: 42, StartTime: 1234, Executable: "/bin/other"}))
+}
+
+func TestZombieNotRunning(t *testing.T) {
+	assert := assert.New(t)
+	dir := setupProc(t, 42, "Z", "1234")
+	defer resetProc(dir)
+	identity, err := processIdentity(42)
+	assert.Equal(errProcessExited, err)
+	assert.False(processRunning(identity))
+	assert.False(processRunning(state.ProcessIdentity{PID: 42, StartTime: 1234}))
+}
+
+func TestExitedChildNotRunning(t *testing.T) {
+	assert := assert.New(t)
+	cmd := startSleep(t)
+	identity := trackableIdentity(cmd.Process.Pid)
+	defer cmd.Wait()
+	cmd.Process.Kill()
+	// until it is waited for the killed sleep is a zombie
+	deadline := time.Now().Add(2 * time.Second)
+	for processRunning(identity) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(processRunning(identity))
+}
@@ -18,10 +18,10 @@ var sshAuthorizedKeys = "/root/.ssh/authorized_keys"
 var writeConfigMut = sync.Mutex{}
 
 // WriteSSHConfig is intended to be used as a goroutine and writes ssh config to the filesystem
-func WriteSSHConfig() error {
+func WriteSSHConfig(store state.Store) error {
 	writeConfigMut.Lock()
 	defer writeConfigMut.Unlock()
-	sshAddresses, ok := state.GetSSHAddresses()
+	sshAddresses, ok := store.GetSSHAddresses()
 	if !ok {
 		return errors.New("No SSH Addresses, cannot write ssh config")
 	}
@@ -49,10 +49,10 @@ func WriteSSHConfig() error {
 var writePubKeyMut = sync.Mutex{}
 
 // WritePublicKey writes pub key to authorized keys
-func WritePublicKey() error {
+func WritePublicKey(store state.Store) error {
 	writePubKeyMut.Lock()
 	defer writePubKeyMut.Unlock()
-	publicKey, ok := state.GetSSHPublicKey()
+	publicKey, ok := store.GetSSHPublicKey()
 	if !ok {
 		return errors.New("No public key in state")
 	}
@@ -63,10 +63,10 @@ func WritePublicKey() error {
 var writePrivKeyMut = sync.Mutex{}
 
 // WritePrivateKey writes private key to disk
-func WritePrivateKey() error {
+func WritePrivateKey(store state.Store) error {
 	writePrivKeyMut.Lock()
 	defer writePrivKeyMut.Unlock()
-	privateKey, ok := state.GetSSHPrivateKey()
+	privateKey, ok := store.GetSSHPrivateKey()
 	if !ok {
 		return errors.New("No private key in state")
 	}
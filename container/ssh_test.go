@@ -10,22 +10,45 @@ import "encoding/pem"
 import "bytes"
 import "os"
 import "golang.org/x/crypto/ssh"
+import "path/filepath"
+import "github.com/mrmagooey/hpcaas-common"
 import "github.com/mrmagooey/hpcaas-container-daemon/state"
 
+// points the ssh files at a directory of their own
+func setupSSHDirectory(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshConfigFileLocation = filepath.Join(dir, "config")
+	sshPrivateKeyLocation = filepath.Join(dir, "private_key")
+	sshAuthorizedKeys = filepath.Join(dir, "authorized_keys")
+	return dir
+}
+
+func resetSSHDirectory(dir string) {
+	os.RemoveAll(dir)
+	sshConfigFileLocation = "/root/.ssh/config"
+	sshPrivateKeyLocation = "/root/.ssh/private_key"
+	sshAuthorizedKeys = "/root/.ssh/authorized_keys"
+}
+
 func TestWriteSSHConfig(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
-	testAddrs := state.ContainerAddresses{
+	dir := setupSSHDirectory(t)
+	defer resetSSHDirectory(dir)
+	store := state.NewStore(state.NewMemoryBackend())
+	testAddrs := common.ContainerAddresses{
 		1: "127.0.0.1:8000",
 		2: "127.0.0.1:8001",
 		3: "127.0.0.1:8002",
 		4: "127.0.0.1:8003",
 		5: "127.0.0.1:8004",
 	}
-	state.SetSSHAddresses(testAddrs)
-	err := WriteSSHConfig()
+	store.SetSSHAddresses(testAddrs)
+	err := WriteSSHConfig(store)
 	assert.NoError(err)
-	conf, err := ioutil.ReadFile("/root/.ssh/config")
+	conf, err := ioutil.ReadFile(sshConfigFileLocation)
 	confString := string(conf)
 	assert.Contains(confString, "Host *\n")
 	assert.Contains(confString, "Host container_1\n    Hostname 127.0.0.1\n    Port 8000")
@@ -33,7 +56,9 @@ func TestWriteSSHConfig(t *testing.T) {
 
 func TestWriteSSHPrivateKey(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
+	dir := setupSSHDirectory(t)
+	defer resetSSHDirectory(dir)
+	store := state.NewStore(state.NewMemoryBackend())
 	// generate a valid private key
 	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
@@ -44,16 +69,17 @@ func TestWriteSSHPrivateKey(t *testing.T) {
 	if err := pem.Encode(&privateKeyBuf, privateKeyPEM); err != nil {
 		t.Error(err)
 	}
-	state.SetSSHPrivateKey(privateKeyBuf.String())
-	WritePrivateKey()
-	conf, err := ioutil.ReadFile("/root/.ssh/private_key")
+	store.SetSSHPrivateKey(privateKeyBuf.String())
+	WritePrivateKey(store)
+	conf, err := ioutil.ReadFile(sshPrivateKeyLocation)
 	assert.Equal(privateKeyBuf.String(), string(conf))
-	os.Remove("/root/.ssh/private_key")
 }
 
 func TestWriteSSHPublicKey(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
+	dir := setupSSHDirectory(t)
+	defer resetSSHDirectory(dir)
+	store := state.NewStore(state.NewMemoryBackend())
 	// generate a valid private key
 	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
 	if err != nil {
@@ -66,11 +92,10 @@ func TestWriteSSHPublicKey(t *testing.T) {
 	}
 
 	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
-	state.SetSSHPublicKey(string(ssh.MarshalAuthorizedKey(publicKey)))
-	WritePublicKey()
+	store.SetSSHPublicKey(string(ssh.MarshalAuthorizedKey(publicKey)))
+	WritePublicKey(store)
 	priv, err := ioutil.ReadFile(sshAuthorizedKeys)
 	assert.Equal(string(priv), string(ssh.MarshalAuthorizedKey(publicKey)))
-	os.Remove(sshAuthorizedKeys)
 }
 
 // func MakeSSHKeyPair() (string, string) {
@@ -0,0 +1,205 @@
+package container
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// the code writes the version of the params it has read here, after being signalled
+var parameterAckPath = "/hpcaas/runtime/parameters.ack"
+
+// the code listens here for notifications, when notified by socket
+var parameterSocketPath = "/hpcaas/runtime/parameters.sock"
+
+// how often the acknowledgement file is checked
+var ackPollInterval = 100 * time.Millisecond
+
+const defaultParamsAckTimeout = 30
+
+// NotifySocket tells the code that its params have changed with a message on its socket
+const NotifySocket = "socket"
+
+// signals the code can be told with, SIGINT isn't one as it is how a code is interrupted
+var notifySignals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// steeringMessage is sent to the code over its socket, and the code replies with the version it has read
+type steeringMessage struct {
+	Version uint64 `json:"version"`
+}
+
+// CheckParamsNotify returns an error if the code can't be notified by method
+func CheckParamsNotify(method string) error {
+	if _, ok := notifySignals[method]; ok || method == "" || method == NotifySocket {
+		return nil
+	}
+	return errors.New("Unknown code parameters notification: " + method)
+}
+
+func codeRunning(store state.Store) bool {
+	status, ok := store.GetCodeStatus()
+	return ok && status == common.CodeRunningStatus
+}
+
+// CheckImmutableParams returns ParamErrors for any params marked immutable in the code's schema
+// that updated would change, provided the code is running
+func CheckImmutableParams(store state.Store, codeName string, current state.CodeParams, updated state.CodeParams) error {
+	if codeName == "" || !codeRunning(store) {
+		return nil
+	}
+	schemaBytes, err := ioutil.ReadFile(codeParamSchemaPath(codeName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(schemaBytes))
+	decoder.UseNumber()
+	var rawSchema map[string]interface{}
+	if err := decoder.Decode(&rawSchema); err != nil {
+		return err
+	}
+	var paramErrors ParamErrors
+	for _, field := range immutableParams(rawSchema, "") {
+		before, _ := paramAtPath(current, field)
+		after, _ := paramAtPath(updated, field)
+		if !reflect.DeepEqual(before, after) {
+			paramErrors = append(paramErrors, ParamError{Field: field, Message: "Can't be changed while the code is running"})
+		}
+	}
+	if len(paramErrors) > 0 {
+		return paramErrors
+	}
+	return nil
+}
+
+// the dotted paths of the properties that the schema marks with "immutable": true
+func immutableParams(schema map[string]interface{}, prefix string) []string {
+	var fields []string
+	properties, _ := schema["properties"].(map[string]interface{})
+	for name, p := range properties {
+		property, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if immutable, _ := property["immutable"].(bool); immutable {
+			fields = append(fields, prefix+name)
+			continue
+		}
+		fields = append(fields, immutableParams(property, prefix+name+".")...)
+	}
+	return fields
+}
+
+func paramAtPath(params map[string]interface{}, field string) (interface{}, bool) {
+	var value interface{} = params
+	for _, part := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// tell the running code that its params have changed to version, as configured by codeParamsNotify,
+// and record whether it acknowledges them
+func notifyParamsChanged(store state.Store, version uint64) {
+	conf, _ := store.GetDaemonConfiguration()
+	if conf.CodeParamsNotify == "" {
+		return
+	}
+	timeout := time.Duration(conf.CodeParamsAckTimeout) * time.Second
+	if conf.CodeParamsAckTimeout <= 0 {
+		timeout = defaultParamsAckTimeout * time.Second
+	}
+	store.SetSteering(state.SteeringState{
+		Version:  version,
+		Method:   conf.CodeParamsNotify,
+		Notified: time.Now(),
+	})
+	var err error
+	if conf.CodeParamsNotify == NotifySocket {
+		err = notifyBySocket(store, version, timeout)
+	} else {
+		err = notifyBySignal(store, conf.CodeParamsNotify, version, timeout)
+	}
+	if err != nil {
+		store.SteeringFailed(version, err.Error())
+	}
+}
+
+// send the signal, then wait for the code to write the version it has read to the acknowledgement file
+func notifyBySignal(store state.Store, signalName string, version uint64, timeout time.Duration) error {
+	sig, ok := notifySignals[signalName]
+	if !ok {
+		return errors.New("Unknown code parameters notification: " + signalName)
+	}
+	pid, ok := store.GetCodePID()
+	if !ok {
+		return errors.New("No PID in state, cannot notify code")
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	if err := proc.Signal(sig); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if ack, err := ioutil.ReadFile(parameterAckPath); err == nil {
+			acked, err := strconv.ParseUint(strings.TrimSpace(string(ack)), 10, 64)
+			if err == nil && acked >= version {
+				store.AcknowledgeSteering(acked)
+				return nil
+			}
+		}
+		time.Sleep(ackPollInterval)
+	}
+	return errors.New("The code didn't acknowledge the parameters")
+}
+
+// send the version to the code's socket, the code replies with the version it has read
+func notifyBySocket(store state.Store, version uint64, timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", parameterSocketPath, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	message, _ := json.Marshal(steeringMessage{Version: version})
+	if _, err := conn.Write(append(message, '\n')); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return errors.New("The code didn't acknowledge the parameters")
+	}
+	var ack steeringMessage
+	if err := json.Unmarshal(reply, &ack); err != nil || ack.Version < version {
+		return errors.New("The code didn't acknowledge the parameters")
+	}
+	store.AcknowledgeSteering(ack.Version)
+	return nil
+}
@@ -0,0 +1,182 @@
+package container
+
+import "bufio"
+import "encoding/json"
+import "io/ioutil"
+import "net"
+import "os"
+import "os/signal"
+import "path/filepath"
+import "sort"
+import "strconv"
+import "syscall"
+import "time"
+import "github.com/mrmagooey/hpcaas-common"
+import "github.com/mrmagooey/hpcaas-container-daemon/state"
+import "github.com/stretchr/testify/assert"
+import "testing"
+
+func setupSteering(t *testing.T, store state.Store, notify string) string {
+	dir, err := ioutil.TempDir("", "steering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parameterJSONPath = filepath.Join(dir, "parameters.json")
+	parameterPath = filepath.Join(dir, "parameters")
+	parameterAckPath = filepath.Join(dir, "parameters.ack")
+	parameterSocketPath = filepath.Join(dir, "parameters.sock")
+	ackPollInterval = 10 * time.Millisecond
+	store.SetCodeName("")
+	store.SetDaemonConfiguration(state.DaemonConfiguration{CodeParamsNotify: notify, CodeParamsAckTimeout: 2})
+	store.SetCodePID(os.Getpid())
+	store.SetCodeStatus(common.CodeRunningStatus, "test")
+	return dir
+}
+
+func resetSteering(dir string) {
+	os.RemoveAll(dir)
+	parameterJSONPath = "/hpcaas/runtime/parameters.json"
+	parameterPath = "/hpcaas/runtime/parameters"
+	parameterAckPath = "/hpcaas/runtime/parameters.ack"
+	parameterSocketPath = "/hpcaas/runtime/parameters.sock"
+	ackPollInterval = 100 * time.Millisecond
+}
+
+func waitForSteering(store state.Store, check func(state.SteeringState) bool) (state.SteeringState, bool) {
+	for i := 0; i < 200; i++ {
+		if steering, ok := store.GetSteering(); ok && check(steering) {
+			return steering, true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	steering, _ := store.GetSteering()
+	return steering, false
+}
+
+func TestSteeringBySignal(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir := setupSteering(t, store, "SIGUSR1")
+	defer resetSteering(dir)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	defer signal.Stop(signals)
+
+	store.SetTypedCodeParams(state.CodeParams{"outputEvery": json.Number("10")})
+	params, version := store.GetVersionedCodeParams()
+	assert.NoError(WriteCodeParams(store, params, version))
+	select {
+	case <-signals:
+	case <-time.After(2 * time.Second):
+		t.Fatal("code wasn't signalled")
+	}
+	written, _ := ioutil.ReadFile(parameterJSONPath)
+	assert.JSONEq(`{"outputEvery": 10}`, string(written))
+	// the code acknowledges by writing the version it has read
+	ioutil.WriteFile(parameterAckPath, []byte("0"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	steering, _ := store.GetSteering()
+	assert.Nil(steering.Acknowledged)
+	ioutil.WriteFile(parameterAckPath, []byte(strconv.FormatUint(version, 10)+"\n"), 0644)
+	steering, ok := waitForSteering(store, func(s state.SteeringState) bool { return s.Acknowledged != nil })
+	assert.True(ok)
+	assert.Equal(version, steering.Version)
+	assert.Equal("SIGUSR1", steering.Method)
+	assert.Empty(steering.Error)
+}
+
+func TestSteeringBySocket(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir := setupSteering(t, store, NotifySocket)
+	defer resetSteering(dir)
+	listener, err := net.Listen("unix", parameterSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	received := make(chan steeringMessage, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadBytes('\n')
+		var message steeringMessage
+		json.Unmarshal(line, &message)
+		received <- message
+		conn.Write(line)
+	}()
+
+	store.SetTypedCodeParams(state.CodeParams{"outputEvery": json.Number("20")})
+	params, version := store.GetVersionedCodeParams()
+	assert.NoError(WriteCodeParams(store, params, version))
+	select {
+	case message := <-received:
+		assert.Equal(version, message.Version)
+	case <-time.After(2 * time.Second):
+		t.Fatal("code wasn't notified")
+	}
+	steering, ok := waitForSteering(store, func(s state.SteeringState) bool { return s.Acknowledged != nil })
+	assert.True(ok)
+	assert.Equal(version, steering.Version)
+}
+
+func TestSteeringNotAcknowledged(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	// nothing is listening on the socket
+	dir := setupSteering(t, store, NotifySocket)
+	defer resetSteering(dir)
+	store.SetTypedCodeParams(state.CodeParams{"outputEvery": json.Number("30")})
+	params, version := store.GetVersionedCodeParams()
+	assert.NoError(WriteCodeParams(store, params, version))
+	steering, ok := waitForSteering(store, func(s state.SteeringState) bool { return s.Error != "" })
+	assert.True(ok)
+	assert.Nil(steering.Acknowledged)
+}
+
+func TestImmutableParams(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "code")
+	defer os.RemoveAll(dir)
+	defer func(d string) { codeDirectory = d }(codeDirectory)
+	codeDirectory = dir
+	ioutil.WriteFile(codeParamSchemaPath("sim"), []byte(`{
+		"type": "object",
+		"properties": {
+			"gridSize": {"type": "integer", "immutable": true},
+			"outputEvery": {"type": "integer"},
+			"mesh": {"type": "object", "properties": {"file": {"type": "string", "immutable": true}, "refine": {"type": "boolean"}}}
+		}
+	}`), 0644)
+	current := formatParams(`{"gridSize": 64, "outputEvery": 10, "mesh": {"file": "a.msh", "refine": false}}`)
+
+	// anything can change before the code is running
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	assert.NoError(CheckImmutableParams(store, "sim", current, formatParams(`{"gridSize": 128}`)))
+
+	store.SetCodeStatus(common.CodeRunningStatus, "test")
+	assert.NoError(CheckImmutableParams(store, "sim", current, formatParams(`{"gridSize": 64, "outputEvery": 5, "mesh": {"file": "a.msh", "refine": true}}`)))
+	err := CheckImmutableParams(store, "sim", current, formatParams(`{"gridSize": 128, "outputEvery": 5, "mesh": {"refine": true}}`))
+	paramErrors, ok := err.(ParamErrors)
+	assert.True(ok)
+	var fields []string
+	for _, e := range paramErrors {
+		fields = append(fields, e.Field)
+	}
+	sort.Strings(fields)
+	assert.Equal([]string{"gridSize", "mesh.file"}, fields)
+}
+
+func TestCheckParamsNotify(t *testing.T) {
+	assert := assert.New(t)
+	for _, method := range []string{"", NotifySocket, "SIGHUP", "SIGUSR1", "SIGUSR2"} {
+		assert.NoError(CheckParamsNotify(method), method)
+	}
+	// would interrupt the code rather than steer it
+	assert.Error(CheckParamsNotify("SIGINT"))
+	assert.Error(CheckParamsNotify("SIGKILL"))
+}
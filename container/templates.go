@@ -0,0 +1,185 @@
+package container
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// where the image ships templates of the code's input decks
+var templateDirectory = "/hpcaas/templates"
+
+// rendered templates go here, unless a destination is configured for them
+var templateOutputDirectory = "/hpcaas/runtime"
+
+const templateSuffix = ".tmpl"
+
+// TemplateHost is a single container taking part in the run
+type TemplateHost struct {
+	Rank    int
+	Name    string
+	Address string
+}
+
+// TemplateData is what templates are rendered with
+type TemplateData struct {
+	CodeName  string
+	Arguments []string
+	Params    state.CodeParams
+	// rank of this container, and the number of containers taking part
+	Rank      int
+	WorldSize int
+	// every container, ordered by rank
+	Hosts []TemplateHost
+}
+
+// RenderedTemplate is the output of a single template
+type RenderedTemplate struct {
+	Template    string `json:"template"`
+	Destination string `json:"destination"`
+	Output      string `json:"output"`
+}
+
+// TemplateError is a problem with a single template
+type TemplateError struct {
+	Template string `json:"template"`
+	Message  string `json:"message"`
+}
+
+// TemplateErrors are all the problems found rendering the templates
+type TemplateErrors []TemplateError
+
+func (t TemplateErrors) Error() string {
+	var messages []string
+	for _, e := range t {
+		messages = append(messages, e.Template+": "+e.Message)
+	}
+	return "Couldn't render templates: " + strings.Join(messages, "; ")
+}
+
+var templateFuncs = template.FuncMap{
+	"json": compactJSON,
+	"join": strings.Join,
+}
+
+// NewTemplateData gathers the current state of the daemon for rendering, using the given params
+func NewTemplateData(store state.Store, params state.CodeParams) TemplateData {
+	codeName, _ := store.GetCodeName()
+	codeArgs, _ := store.GetCodeArguments()
+	conf, _ := store.GetDaemonConfiguration()
+	addrs, _ := store.GetSSHAddresses()
+	var ranks []int
+	for rank := range addrs {
+		ranks = append(ranks, rank)
+	}
+	sort.Ints(ranks)
+	hosts := []TemplateHost{}
+	for _, rank := range ranks {
+		hosts = append(hosts, TemplateHost{
+			Rank:    rank,
+			Name:    generateContainerName(rank),
+			Address: addrs[rank],
+		})
+	}
+	worldSize := len(hosts)
+	if worldSize == 0 {
+		// running on its own
+		worldSize = 1
+	}
+	if params == nil {
+		params = state.CodeParams{}
+	}
+	return TemplateData{
+		CodeName:  codeName,
+		Arguments: codeArgs,
+		Params:    params,
+		Rank:      conf.Rank,
+		WorldSize: worldSize,
+		Hosts:     hosts,
+	}
+}
+
+// the destination of a template, configured by templateDestinations, otherwise the runtime directory
+// relative destinations are within the runtime directory
+func templateDestination(name string, destinations map[string]string) string {
+	dest, ok := destinations[name]
+	if !ok || dest == "" {
+		dest = strings.TrimSuffix(name, templateSuffix)
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(templateOutputDirectory, dest)
+	}
+	return filepath.Clean(dest)
+}
+
+// PreviewTemplates renders every template with data, without writing anything
+// problems with any of the templates are reported together as TemplateErrors
+func PreviewTemplates(store state.Store, data TemplateData) ([]RenderedTemplate, error) {
+	paths, err := filepath.Glob(filepath.Join(templateDirectory, "*"+templateSuffix))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	conf, _ := store.GetDaemonConfiguration()
+	rendered := []RenderedTemplate{}
+	var templateErrors TemplateErrors
+	for _, path := range paths {
+		name := filepath.Base(path)
+		output, err := renderTemplate(path, data)
+		if err != nil {
+			templateErrors = append(templateErrors, TemplateError{Template: name, Message: err.Error()})
+			continue
+		}
+		rendered = append(rendered, RenderedTemplate{
+			Template:    name,
+			Destination: templateDestination(name, conf.TemplateDestinations),
+			Output:      output,
+		})
+	}
+	if len(templateErrors) > 0 {
+		return nil, templateErrors
+	}
+	return rendered, nil
+}
+
+func renderTemplate(path string, data TemplateData) (string, error) {
+	text, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	// a parameter the template uses that hasn't been set is an error, rather than <no value>
+	tmpl, err := template.New(filepath.Base(path)).Funcs(templateFuncs).Option("missingkey=error").Parse(string(text))
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// RenderTemplates renders every template with data into its destination
+// nothing is written unless every template renders
+func RenderTemplates(store state.Store, data TemplateData) ([]RenderedTemplate, error) {
+	rendered, err := PreviewTemplates(store, data)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rendered {
+		if err := os.MkdirAll(filepath.Dir(r.Destination), 0755); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(r.Destination, []byte(r.Output), 0666); err != nil {
+			return nil, fmt.Errorf("Couldn't write %s: %v", r.Destination, err)
+		}
+	}
+	return rendered, nil
+}
@@ -0,0 +1,107 @@
+package container
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "github.com/mrmagooey/hpcaas-common"
+import "github.com/mrmagooey/hpcaas-container-daemon/state"
+import "github.com/stretchr/testify/assert"
+import "testing"
+
+func setupTemplates(t *testing.T, templates map[string]string) string {
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(dir, "templates"), 0755)
+	os.MkdirAll(filepath.Join(dir, "runtime"), 0755)
+	for name, text := range templates {
+		ioutil.WriteFile(filepath.Join(dir, "templates", name), []byte(text), 0644)
+	}
+	templateDirectory = filepath.Join(dir, "templates")
+	templateOutputDirectory = filepath.Join(dir, "runtime")
+	return dir
+}
+
+func resetTemplates(dir string) {
+	os.RemoveAll(dir)
+	templateDirectory = "/hpcaas/templates"
+	templateOutputDirectory = "/hpcaas/runtime"
+}
+
+func TestTemplateData(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeName("sim")
+	store.SetCodeArguments([]string{"-v"})
+	store.SetSSHAddresses(common.ContainerAddresses{2: "10.0.0.2:22", 1: "10.0.0.1:22"})
+	store.SetDaemonConfiguration(state.DaemonConfiguration{Rank: 1})
+	data := NewTemplateData(store, nil)
+	assert.Equal("sim", data.CodeName)
+	assert.Equal([]string{"-v"}, data.Arguments)
+	assert.Equal(state.CodeParams{}, data.Params)
+	assert.Equal(1, data.Rank)
+	assert.Equal(2, data.WorldSize)
+	assert.Equal([]TemplateHost{
+		{Rank: 1, Name: generateContainerName(1), Address: "10.0.0.1:22"},
+		{Rank: 2, Name: generateContainerName(2), Address: "10.0.0.2:22"},
+	}, data.Hosts)
+}
+
+func TestRenderTemplates(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir := setupTemplates(t, map[string]string{
+		"input.deck.tmpl": "steps {{.Params.steps}}\nranks {{.WorldSize}}\n{{range .Hosts}}{{.Name}}\n{{end}}",
+		"species.tmpl":    "{{json .Params.species}}",
+		"ignored.txt":     "not a template",
+	})
+	defer resetTemplates(dir)
+	store.SetDaemonConfiguration(state.DaemonConfiguration{TemplateDestinations: map[string]string{
+		"species.tmpl": filepath.Join(dir, "inputs", "species.json"),
+	}})
+	data := TemplateData{
+		Params:    formatParams(`{"steps": 100, "species": ["H", "He"]}`),
+		WorldSize: 1,
+		Hosts:     []TemplateHost{{Rank: 0, Name: "node_0"}},
+	}
+
+	// previewing doesn't write anything
+	rendered, err := PreviewTemplates(store, data)
+	assert.NoError(err)
+	assert.Equal([]RenderedTemplate{
+		{Template: "input.deck.tmpl", Destination: filepath.Join(dir, "runtime", "input.deck"), Output: "steps 100\nranks 1\nnode_0\n"},
+		{Template: "species.tmpl", Destination: filepath.Join(dir, "inputs", "species.json"), Output: `["H","He"]`},
+	}, rendered)
+	_, err = os.Stat(filepath.Join(dir, "runtime", "input.deck"))
+	assert.True(os.IsNotExist(err))
+
+	_, err = RenderTemplates(store, data)
+	assert.NoError(err)
+	deck, err := ioutil.ReadFile(filepath.Join(dir, "runtime", "input.deck"))
+	assert.NoError(err)
+	assert.Equal("steps 100\nranks 1\nnode_0\n", string(deck))
+	species, err := ioutil.ReadFile(filepath.Join(dir, "inputs", "species.json"))
+	assert.NoError(err)
+	assert.Equal(`["H","He"]`, string(species))
+}
+
+func TestRenderTemplatesErrors(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir := setupTemplates(t, map[string]string{
+		"good.tmpl":    "{{.Params.steps}}",
+		"missing.tmpl": "{{.Params.nope}}",
+		"syntax.tmpl":  "{{.Params.steps",
+	})
+	defer resetTemplates(dir)
+	_, err := RenderTemplates(store, TemplateData{Params: formatParams(`{"steps": 1}`)})
+	templateErrors, ok := err.(TemplateErrors)
+	assert.True(ok)
+	assert.Len(templateErrors, 2)
+	assert.Equal("missing.tmpl", templateErrors[0].Template)
+	assert.Equal("syntax.tmpl", templateErrors[1].Template)
+	// nothing is written unless every template renders
+	_, err = os.Stat(filepath.Join(dir, "runtime", "good"))
+	assert.True(os.IsNotExist(err))
+}
@@ -0,0 +1,103 @@
+package container
+
+import "io/ioutil"
+import "os"
+import "path/filepath"
+import "sync"
+import "time"
+import "github.com/mrmagooey/hpcaas-common"
+import "github.com/mrmagooey/hpcaas-container-daemon/state"
+import "github.com/stretchr/testify/assert"
+import "testing"
+
+// a store set up to run a code that sleeps for a few seconds
+func setupSleeper(t *testing.T) (state.Store, string) {
+	dir, err := ioutil.TempDir("", "transitions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	codeDirectory = dir
+	codeLogDirectory = dir
+	templateDirectory = filepath.Join(dir, "templates")
+	ioutil.WriteFile(filepath.Join(dir, "sleeper"), []byte("#!/bin/sh\nexec sleep 5\n"), 0755)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeName("sleeper")
+	store.SetCodeArguments([]string{})
+	store.SetTypedCodeParams(state.CodeParams{})
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	return store, dir
+}
+
+func resetSleeper(dir string) {
+	os.RemoveAll(dir)
+	codeDirectory = "/hpcaas/code"
+	codeLogDirectory = "/hpcaas/daemon"
+	templateDirectory = "/hpcaas/templates"
+}
+
+// run f in n goroutines at once, returning how many of them succeeded
+func concurrently(n int, f func() error) int {
+	var wg sync.WaitGroup
+	var mut sync.Mutex
+	succeeded := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if f() == nil {
+				mut.Lock()
+				succeeded++
+				mut.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return succeeded
+}
+
+func TestStartAndKillTransitions(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupSleeper(t)
+	defer resetSleeper(dir)
+
+	// only one of many simultaneous starts gets to run the code
+	assert.Equal(1, concurrently(10, func() error { return ExecuteCode(store) }))
+	snapshot := store.Snapshot()
+	status, _ := snapshot.GetCodeStatus()
+	assert.Equal(common.CodeRunningStatus, status)
+	assert.Equal(common.StartedByDaemonStatus, *snapshot.CodeStartedStatus)
+	assert.NotNil(snapshot.CodePID)
+	assert.NotNil(snapshot.Run)
+
+	// and only one kill gets to kill it
+	assert.Equal(1, concurrently(10, func() error { return KillCode(store) }))
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		snapshot = store.Snapshot()
+		if snapshot.Run.EndTime != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the exit is recorded all at once, and a killed code has stopped rather than failed
+	status, _ = snapshot.GetCodeStatus()
+	assert.Equal(common.CodeStoppedStatus, status)
+	assert.NotNil(snapshot.Run.EndTime)
+	assert.Nil(snapshot.Run.ExitCode)
+	assert.NotNil(snapshot.CodeStdout)
+	assert.Error(KillCode(store))
+}
+
+func TestStartFailure(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupSleeper(t)
+	defer resetSleeper(dir)
+	// the code exists but can't be executed
+	os.Chmod(filepath.Join(dir, "sleeper"), 0644)
+	assert.Error(ExecuteCode(store))
+	snapshot := store.Snapshot()
+	status, _ := snapshot.GetCodeStatus()
+	assert.Equal(common.CodeFailedToStartStatus, status)
+	assert.Nil(snapshot.CodePID)
+	assert.NotNil(snapshot.Run.EndTime)
+}
@@ -0,0 +1,194 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// the archives that can be extracted, recognised by the suffix of their name
+var archiveSuffixes = []string{".tar.gz", ".tgz", ".tar.zst", ".tar", ".zip"}
+
+// returns the archive suffix of name, or "" if it isn't an archive
+func archiveFormat(name string) string {
+	for _, suffix := range archiveSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return suffix
+		}
+	}
+	return ""
+}
+
+// extractArchive unpacks a staged archive into a directory of the files directory named after it,
+// e.g. mesh.tar.gz is extracted into mesh/, replacing anything already there
+// only regular files and directories are extracted, and nothing can be written outside of the directory
+func extractArchive(staged *Staged) error {
+	format := archiveFormat(staged.Name)
+	dirName := strings.TrimSuffix(staged.Name, format)
+	if format == "" || dirName == "" {
+		return errors.New("Don't know how to extract " + staged.Name)
+	}
+	incoming, err := incomingDirectory(staged.store)
+	if err != nil {
+		return err
+	}
+	tmpDir, err := ioutil.TempDir(incoming, "extract")
+	if err != nil {
+		return err
+	}
+	// does nothing once the directory has been moved into place
+	defer os.RemoveAll(tmpDir)
+	if format == ".zip" {
+		err = extractZip(staged.tempPath, tmpDir)
+	} else {
+		err = extractTar(staged.tempPath, format, tmpDir)
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpDir, 0777); err != nil {
+		return err
+	}
+	dest := filepath.Join(staged.dir, dirName)
+	// a directory can't be renamed over another, so the old one has to go first
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, dest); err != nil {
+		return err
+	}
+	staged.store.SetFile(state.FileState{
+		Name:     dirName,
+		Size:     staged.Size,
+		SHA256:   staged.SHA256,
+		Received: time.Now(),
+	})
+	return nil
+}
+
+func extractTar(archivePath string, format string, root string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	switch format {
+	case ".tar.gz", ".tgz":
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	case ".tar.zst":
+		decoder, err := zstd.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer decoder.Close()
+		r = decoder
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(root, header.Name)
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(root, header.Name, os.FileMode(header.Mode), tr)
+		}
+		// anything else, e.g. links and devices, is skipped
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractZip(archivePath string, root string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, entry := range zr.File {
+		mode := entry.Mode()
+		if mode.IsDir() {
+			err = extractDir(root, entry.Name)
+		} else if mode.IsRegular() {
+			var r io.ReadCloser
+			r, err = entry.Open()
+			if err == nil {
+				err = extractFile(root, entry.Name, mode, r)
+				r.Close()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// the entry's name cleaned against "/", which keeps it within root
+func cleanEntry(name string) string {
+	return path.Clean("/" + strings.Replace(name, "\\", "/", -1))
+}
+
+// where an archive entry should be written
+func entryPath(root string, name string) (string, error) {
+	cleaned := cleanEntry(name)
+	if cleaned == "/" {
+		return "", errors.New("Bad archive entry: " + name)
+	}
+	return filepath.Join(root, filepath.FromSlash(cleaned)), nil
+}
+
+func extractDir(root string, name string) error {
+	// the archive's top directory, e.g. the "./" that tar -C dir . starts with, is root itself
+	if cleanEntry(name) == "/" {
+		return nil
+	}
+	dir, err := entryPath(root, name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0777)
+}
+
+// files are world readable and writable, like any other file given to the code, keeping any executable bits
+func extractFile(root string, name string, mode os.FileMode, r io.Reader) error {
+	dest, err := entryPath(root, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm()|0666)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
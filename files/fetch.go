@@ -0,0 +1,317 @@
+package files
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+var defaultFetchConcurrency = 4
+var defaultFetchRetries = 3
+
+// delay before the first retry, doubled for each one after
+var fetchRetryDelay = 1 * time.Second
+
+// how often the progress of a download is written to the state
+var fetchProgressInterval = 500 * time.Millisecond
+
+var fetchClient = &http.Client{}
+
+// ErrFetchInProgress is returned when asked to fetch a file that is already being fetched
+var ErrFetchInProgress = errors.New("File is already being fetched")
+
+// FetchRequest asks for the file at URL to be downloaded into the files directory
+type FetchRequest struct {
+	URL string `json:"url"`
+	// name of the file in the files directory, defaults to the last part of the url
+	Name string `json:"name,omitempty"`
+	// checksum the file must have, it isn't checked if empty
+	SHA256 string `json:"sha256,omitempty"`
+	// if the file is an archive, extract it into a directory named after it
+	Extract bool `json:"extract,omitempty"`
+}
+
+// a failure that retrying won't fix
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+// Fetch checks the requests and starts downloading them in the background,
+// progress is reported in the state under the name of each file
+// nothing is fetched if any of the requests is invalid
+func Fetch(store state.Store, requests []FetchRequest) ([]state.FetchState, error) {
+	fetches, err := newFetches(store, requests)
+	if err != nil {
+		return nil, err
+	}
+	go fetchAll(store, fetches)
+	return fetches, nil
+}
+
+// validate the requests and record them as waiting
+func newFetches(store state.Store, requests []FetchRequest) ([]state.FetchState, error) {
+	seen := make(map[string]bool)
+	var fetches []state.FetchState
+	for _, request := range requests {
+		u, err := url.Parse(request.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, errors.New("Not an http(s) url: " + request.URL)
+		}
+		name := request.Name
+		if name == "" {
+			name = path.Base(u.Path)
+		}
+		name, err = SanitiseName(name)
+		if err != nil {
+			return nil, err
+		}
+		if request.Extract && archiveFormat(name) == "" {
+			return nil, errors.New("Don't know how to extract " + name)
+		}
+		if seen[name] {
+			return nil, errors.New("File is requested more than once: " + name)
+		}
+		seen[name] = true
+		fetches = append(fetches, state.FetchState{
+			URL:        request.URL,
+			Name:       name,
+			Status:     state.FetchWaitingStatus,
+			SHA256:     request.SHA256,
+			Extract:    request.Extract,
+			BytesTotal: -1,
+		})
+	}
+	// checked and recorded together, so that two requests for the same file can't both start it
+	err := store.Update(func(d *state.DaemonState) error {
+		for _, fetch := range fetches {
+			if existing, ok := d.Fetches[fetch.Name]; ok && fetchInProgress(existing) {
+				return ErrFetchInProgress
+			}
+		}
+		if d.Fetches == nil {
+			d.Fetches = make(map[string]state.FetchState)
+		}
+		for _, fetch := range fetches {
+			d.Fetches[fetch.Name] = fetch
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fetches, nil
+}
+
+func fetchInProgress(fetch state.FetchState) bool {
+	return fetch.Status == state.FetchWaitingStatus || fetch.Status == state.FetchDownloadingStatus
+}
+
+// FailInterruptedFetches marks the fetches that were waiting or downloading when the daemon stopped as failed,
+// nothing carries on with them after a restart, so they are left to be requested again.
+// This is called by main once the state has been rehydrated
+func FailInterruptedFetches(store state.Store) {
+	store.Update(func(d *state.DaemonState) error {
+		for name, fetch := range d.Fetches {
+			if fetchInProgress(fetch) {
+				log.Println("The fetch of " + fetch.URL + " was interrupted by the daemon restarting")
+				fetch.Status = state.FetchErrorStatus
+				fetch.Error = "Interrupted by the daemon restarting"
+				d.Fetches[name] = fetch
+			}
+		}
+		return nil
+	})
+}
+
+// fetch each file, a few at a time, returning once they have all finished
+func fetchAll(store state.Store, fetches []state.FetchState) {
+	conf, _ := store.GetDaemonConfiguration()
+	concurrency := defaultFetchConcurrency
+	if conf.FilesFetchConcurrency > 0 {
+		concurrency = conf.FilesFetchConcurrency
+	}
+	retries := defaultFetchRetries
+	if conf.FilesFetchRetries > 0 {
+		retries = conf.FilesFetchRetries
+	}
+	slots := make(chan struct{}, concurrency)
+	wg := sync.WaitGroup{}
+	for _, fetch := range fetches {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(fetch state.FetchState) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := fetchFile(store, fetch, retries); err != nil {
+				log.Println("Fetching " + fetch.URL + " failed: " + err.Error())
+			}
+		}(fetch)
+	}
+	wg.Wait()
+}
+
+// download a single file, retrying with backoff, then verify it and move it into place
+func fetchFile(store state.Store, fetch state.FetchState, retries int) error {
+	fetch.Status = state.FetchDownloadingStatus
+	store.SetFetch(fetch)
+	staged, err := downloadWithRetries(store, &fetch, retries)
+	if err == nil {
+		if fetch.Extract {
+			err = extractArchive(staged)
+		} else {
+			err = staged.Commit()
+		}
+		staged.Discard()
+	}
+	if err != nil {
+		fetch.Status = state.FetchErrorStatus
+		fetch.Error = err.Error()
+		store.SetFetch(fetch)
+		return err
+	}
+	fetch.Status = state.FetchDoneStatus
+	fetch.Error = ""
+	store.SetFetch(fetch)
+	return nil
+}
+
+func downloadWithRetries(store state.Store, fetch *state.FetchState, retries int) (*Staged, error) {
+	incoming, err := incomingDirectory(store)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(incoming, "fetch")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	staged := &Staged{Name: fetch.Name, dir: Directory(store), tempPath: f.Name(), store: store}
+	delay := fetchRetryDelay
+	for attempt := 0; ; attempt++ {
+		fetch.Attempts++
+		err = download(store, fetch, f)
+		if err == nil {
+			err = verify(fetch, staged)
+		}
+		if err == nil {
+			return staged, f.Close()
+		}
+		if _, ok := err.(permanentError); ok || attempt >= retries {
+			staged.Discard()
+			return nil, err
+		}
+		fetch.Error = err.Error()
+		store.SetFetch(*fetch)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// check the downloaded file against the expected checksum, a bad file has to be downloaded from scratch
+func verify(fetch *state.FetchState, staged *Staged) error {
+	sum, err := fileSHA256(staged.tempPath)
+	if err != nil {
+		return err
+	}
+	if fetch.SHA256 != "" && sum != fetch.SHA256 {
+		os.Truncate(staged.tempPath, 0)
+		return ErrChecksumMismatch
+	}
+	info, err := os.Stat(staged.tempPath)
+	if err != nil {
+		return err
+	}
+	staged.Size = info.Size()
+	staged.SHA256 = sum
+	return nil
+}
+
+// download the url into f, carrying on from the end of f if the server supports ranges
+func download(store state.Store, fetch *state.FetchState, f *os.File) error {
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("GET", fetch.URL, nil)
+	if err != nil {
+		return permanentError{err}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != offset {
+			return errors.New("Server sent the wrong range: " + resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode == http.StatusOK:
+		// the whole file, whatever was asked for
+		if offset > 0 {
+			if err := f.Truncate(0); err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			offset = 0
+		}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		return errors.New("Fetch failed with " + resp.Status)
+	default:
+		return permanentError{errors.New("Fetch failed with " + resp.Status)}
+	}
+	fetch.BytesReceived = offset
+	fetch.BytesTotal = -1
+	if resp.ContentLength >= 0 {
+		fetch.BytesTotal = offset + resp.ContentLength
+	}
+	store.SetFetch(*fetch)
+	_, err = io.Copy(f, &progressReader{r: resp.Body, fetch: fetch, store: store})
+	store.SetFetch(*fetch)
+	if err != nil {
+		return err
+	}
+	if fetch.BytesTotal >= 0 && fetch.BytesReceived != fetch.BytesTotal {
+		return errors.New("Fetch ended after " + strconv.FormatInt(fetch.BytesReceived, 10) + " bytes")
+	}
+	return nil
+}
+
+// counts the bytes read into the fetch state, writing it to the state every so often
+type progressReader struct {
+	r     io.Reader
+	fetch *state.FetchState
+	store state.Store
+	last  time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.fetch.BytesReceived += int64(n)
+	if time.Since(p.last) >= fetchProgressInterval {
+		p.last = time.Now()
+		p.store.SetFetch(*p.fetch)
+	}
+	return n, err
+}
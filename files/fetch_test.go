@@ -0,0 +1,302 @@
+package files
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// serves files by path, with range support,
+// the first failures requests are answered with a 503 and the first truncations are cut off half way through
+type testFetchServer struct {
+	mut         sync.Mutex
+	files       map[string][]byte
+	failures    int
+	truncations int
+	requests    int
+	ranges      []string
+}
+
+func (s *testFetchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	s.requests++
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	contents, ok := s.files[r.URL.Path]
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	truncate := !fail && s.truncations > 0 && r.Header.Get("Range") == ""
+	if truncate {
+		s.truncations--
+	}
+	s.mut.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if truncate {
+		// promise everything, send half, and drop the connection
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.Write(contents[:len(contents)/2])
+		return
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(contents))
+}
+
+func setupFetch(t *testing.T, files map[string][]byte) (state.Store, string, *testFetchServer, *httptest.Server) {
+	store, dir := setupFilesDir(t)
+	fetchRetryDelay = time.Millisecond
+	stub := &testFetchServer{files: files}
+	return store, dir, stub, httptest.NewServer(stub)
+}
+
+func TestFetch(t *testing.T) {
+	assert := assert.New(t)
+	store, dir, stub, server := setupFetch(t, map[string][]byte{
+		"/data/input.dat": testContents,
+		"/other":          []byte("other"),
+	})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+	stub.failures = 1
+
+	fetches, err := newFetches(store, []FetchRequest{
+		{URL: server.URL + "/data/input.dat", SHA256: testSHA256},
+		{URL: server.URL + "/other", Name: "renamed.txt"},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal([]string{"input.dat", "renamed.txt"}, store.UnfinishedFetches())
+	fetchAll(store, fetches)
+
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "input.dat"))
+	assert.Equal(testContents, contents)
+	contents, _ = ioutil.ReadFile(filepath.Join(dir, "renamed.txt"))
+	assert.Equal([]byte("other"), contents)
+	assert.Empty(store.UnfinishedFetches())
+	fetch := store.GetFetches()["input.dat"]
+	assert.Equal(state.FetchDoneStatus, fetch.Status)
+	assert.Equal(int64(10), fetch.BytesReceived)
+	assert.Equal(int64(10), fetch.BytesTotal)
+	_, ok := store.GetFiles()["renamed.txt"]
+	assert.True(ok)
+}
+
+func TestFetchResumes(t *testing.T) {
+	assert := assert.New(t)
+	store, dir, stub, server := setupFetch(t, map[string][]byte{"/input.dat": testContents})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+	stub.truncations = 1
+
+	fetches, _ := newFetches(store, []FetchRequest{{URL: server.URL + "/input.dat", SHA256: testSHA256}})
+	fetchAll(store, fetches)
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "input.dat"))
+	assert.Equal(testContents, contents)
+	assert.Equal([]string{"", "bytes=5-"}, stub.ranges)
+	assert.Equal(2, store.GetFetches()["input.dat"].Attempts)
+}
+
+func TestFetchFailures(t *testing.T) {
+	assert := assert.New(t)
+	store, dir, stub, server := setupFetch(t, map[string][]byte{"/input.dat": testContents})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	// wrong checksum, retried and then given up on
+	fetches, _ := newFetches(store, []FetchRequest{{URL: server.URL + "/input.dat", SHA256: "00"}})
+	fetchAll(store, fetches)
+	fetch := store.GetFetches()["input.dat"]
+	assert.Equal(state.FetchErrorStatus, fetch.Status)
+	assert.Equal(ErrChecksumMismatch.Error(), fetch.Error)
+	assert.Equal(defaultFetchRetries+1, fetch.Attempts)
+	_, err := os.Stat(filepath.Join(dir, "input.dat"))
+	assert.True(os.IsNotExist(err))
+	assert.Equal([]string{"input.dat"}, store.UnfinishedFetches())
+
+	// a 404 isn't retried
+	stub.requests = 0
+	fetches, _ = newFetches(store, []FetchRequest{{URL: server.URL + "/missing"}})
+	fetchAll(store, fetches)
+	assert.Equal(1, stub.requests)
+	assert.Equal(state.FetchErrorStatus, store.GetFetches()["missing"].Status)
+
+	_, err = newFetches(store, []FetchRequest{{URL: "ftp://example.com/file"}})
+	assert.Error(err)
+	_, err = newFetches(store, []FetchRequest{{URL: server.URL + "/"}})
+	assert.Error(err)
+	_, err = newFetches(store, []FetchRequest{{URL: server.URL + "/a", Name: "x"}, {URL: server.URL + "/b", Name: "x"}})
+	assert.Error(err)
+	_, err = newFetches(store, []FetchRequest{{URL: server.URL + "/input.dat", Extract: true}})
+	assert.Error(err)
+	store.SetFetch(state.FetchState{Name: "busy", Status: state.FetchDownloadingStatus})
+	_, err = newFetches(store, []FetchRequest{{URL: server.URL + "/busy"}})
+	assert.Equal(ErrFetchInProgress, err)
+}
+
+func TestFetchRequestedTwice(t *testing.T) {
+	assert := assert.New(t)
+	store, dir, _, server := setupFetch(t, map[string][]byte{"/input.dat": testContents})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	// only one of the requests made at the same time gets to fetch the file
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, err := newFetches(store, []FetchRequest{{URL: server.URL + "/input.dat"}})
+			errs <- err
+		}()
+	}
+	started := 0
+	for i := 0; i < 10; i++ {
+		if err := <-errs; err == nil {
+			started++
+		} else {
+			assert.Equal(ErrFetchInProgress, err)
+		}
+	}
+	assert.Equal(1, started)
+}
+
+func TestFailInterruptedFetches(t *testing.T) {
+	assert := assert.New(t)
+	store, dir, _, server := setupFetch(t, map[string][]byte{"/input.dat": testContents})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+	store.SetFetch(state.FetchState{Name: "waiting", Status: state.FetchWaitingStatus})
+	store.SetFetch(state.FetchState{Name: "input.dat", Status: state.FetchDownloadingStatus})
+	store.SetFetch(state.FetchState{Name: "done", Status: state.FetchDoneStatus})
+
+	// the daemon restarts part way through
+	FailInterruptedFetches(store)
+	fetches := store.GetFetches()
+	assert.Equal(state.FetchErrorStatus, fetches["waiting"].Status)
+	assert.Equal(state.FetchErrorStatus, fetches["input.dat"].Status)
+	assert.NotEmpty(fetches["input.dat"].Error)
+	assert.Equal(state.FetchDoneStatus, fetches["done"].Status)
+
+	// and they can be asked for again
+	again, err := newFetches(store, []FetchRequest{{URL: server.URL + "/input.dat"}})
+	if assert.NoError(err) {
+		fetchAll(store, again)
+	}
+	assert.Equal(state.FetchDoneStatus, store.GetFetches()["input.dat"].Status)
+}
+
+func tarGzip(t *testing.T, entries map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, contents := range entries {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(contents))
+	}
+	tw.WriteHeader(&tar.Header{Name: "link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink})
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+// an archive laid out the way tar -C dir . makes it, every entry under "./"
+func dotTarGzip(t *testing.T) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "./", Mode: 0755, Typeflag: tar.TypeDir})
+	tw.WriteHeader(&tar.Header{Name: "./mesh/", Mode: 0755, Typeflag: tar.TypeDir})
+	tw.WriteHeader(&tar.Header{Name: "./mesh/part1.msh", Mode: 0644, Size: 8, Typeflag: tar.TypeReg})
+	tw.Write([]byte("part one"))
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipped(t *testing.T, entries map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for name, contents := range entries {
+		w, _ := zw.Create(name)
+		w.Write([]byte(contents))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func TestFetchExtract(t *testing.T) {
+	assert := assert.New(t)
+	entries := map[string]string{
+		"mesh/part1.msh": "part one",
+		"../../escape":   "contained",
+		"/absolute/path": "contained too",
+		"mesh/sub/part2": "part two",
+	}
+	store, dir, _, server := setupFetch(t, map[string][]byte{
+		"/mesh.tar.gz": tarGzip(t, entries),
+		"/mesh.zip":    zipped(t, entries),
+	})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	for _, archive := range []string{"mesh.tar.gz", "mesh.zip"} {
+		fetches, err := newFetches(store, []FetchRequest{{URL: server.URL + "/" + archive, Extract: true}})
+		if !assert.NoError(err) {
+			continue
+		}
+		fetchAll(store, fetches)
+		assert.Equal(state.FetchDoneStatus, store.GetFetches()[archive].Status, archive)
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, "mesh", "mesh", "sub", "part2"))
+		assert.Equal([]byte("part two"), contents, archive)
+		contents, _ = ioutil.ReadFile(filepath.Join(dir, "mesh", "escape"))
+		assert.Equal([]byte("contained"), contents, archive)
+		contents, _ = ioutil.ReadFile(filepath.Join(dir, "mesh", "absolute", "path"))
+		assert.Equal([]byte("contained too"), contents, archive)
+		_, err = os.Lstat(filepath.Join(dir, "mesh", "link"))
+		assert.True(os.IsNotExist(err), archive)
+		// the archive itself isn't kept
+		_, err = os.Stat(filepath.Join(dir, archive))
+		assert.True(os.IsNotExist(err), archive)
+		_, ok := store.GetFiles()["mesh"]
+		assert.True(ok)
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(dir), "escape"))
+	assert.True(os.IsNotExist(err))
+	incoming, _ := ioutil.ReadDir(filepath.Join(dir, incomingDirectoryName))
+	assert.Len(incoming, 0)
+}
+
+func TestFetchExtractDotPrefix(t *testing.T) {
+	assert := assert.New(t)
+	store, dir, _, server := setupFetch(t, map[string][]byte{"/case.tar.gz": dotTarGzip(t)})
+	defer os.RemoveAll(dir)
+	defer server.Close()
+
+	fetches, err := newFetches(store, []FetchRequest{{URL: server.URL + "/case.tar.gz", Extract: true}})
+	if !assert.NoError(err) {
+		return
+	}
+	fetchAll(store, fetches)
+	fetch := store.GetFetches()["case.tar.gz"]
+	assert.Equal(state.FetchDoneStatus, fetch.Status, fetch.Error)
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "case", "mesh", "part1.msh"))
+	assert.Equal([]byte("part one"), contents)
+}
@@ -0,0 +1,160 @@
+package files
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+var defaultFilesDirectory = "/hpcaas/files"
+
+// files are written here first and then moved into place,
+// it's within the files directory so that the move is a rename on the same filesystem
+var incomingDirectoryName = ".incoming"
+
+// longest name allowed, the limit of most filesystems
+var maxNameLength = 255
+
+// ErrTooLarge is returned when a file is larger than the limit
+var ErrTooLarge = errors.New("File is larger than allowed")
+
+// ErrBadName is returned when a file name can't be made safe
+var ErrBadName = errors.New("Not a valid file name")
+
+// Directory returns where files sent to the daemon are placed, for the code to use
+func Directory(store state.Store) string {
+	if conf, ok := store.GetDaemonConfiguration(); ok && conf.FilesDirectory != "" {
+		return conf.FilesDirectory
+	}
+	return defaultFilesDirectory
+}
+
+// Path returns where the file of the given name is placed
+func Path(store state.Store, name string) string {
+	return filepath.Join(Directory(store), name)
+}
+
+// SanitiseName reduces a client supplied file name to something that is safe to create in the files directory,
+// any directories are dropped and characters other than letters, digits, '.', '-' and '_' are replaced with '_'
+// names that are empty, hidden or too long are refused
+func SanitiseName(name string) (string, error) {
+	// browsers on windows may send the full path
+	name = path.Base(strings.Replace(name, "\\", "/", -1))
+	if name == "/" {
+		return "", ErrBadName
+	}
+	cleaned := []byte(name)
+	for i, c := range cleaned {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			cleaned[i] = '_'
+		}
+	}
+	name = string(cleaned)
+	if name == "" || strings.HasPrefix(name, ".") || len(name) > maxNameLength {
+		return "", ErrBadName
+	}
+	return name, nil
+}
+
+// creates the incoming directory if need be
+func incomingDirectory(store state.Store) (string, error) {
+	incoming := filepath.Join(Directory(store), incomingDirectoryName)
+	return incoming, os.MkdirAll(incoming, 0700)
+}
+
+// Staged is a file that has been written to disk, but not yet moved into place
+type Staged struct {
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	SHA256   string `json:"sha256"`
+	dir      string
+	tempPath string
+	// where the file is recorded once it is committed
+	store state.Store
+}
+
+// Stage streams r to a temporary file, computing its checksum as it goes
+// fails with ErrTooLarge if r holds more than maxSize bytes, a maxSize of 0 or less is no limit
+func Stage(store state.Store, name string, r io.Reader, maxSize int64) (*Staged, error) {
+	incoming, err := incomingDirectory(store)
+	if err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(incoming, "upload")
+	if err != nil {
+		return nil, err
+	}
+	staged := &Staged{Name: name, dir: Directory(store), tempPath: f.Name(), store: store}
+	if maxSize > 0 {
+		// one more than allowed, to tell a file that is exactly the limit from one that is over
+		r = io.LimitReader(r, maxSize+1)
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = ErrTooLarge
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		staged.Discard()
+		return nil, err
+	}
+	staged.Size = n
+	staged.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return staged, nil
+}
+
+// Commit atomically moves the file into place, replacing any file of the same name,
+// and records it in the state
+func (s *Staged) Commit() error {
+	// the code should be able to do whatever it likes with the file
+	if err := os.Chmod(s.tempPath, 0666); err != nil {
+		return err
+	}
+	if err := os.Rename(s.tempPath, filepath.Join(s.dir, s.Name)); err != nil {
+		return err
+	}
+	s.tempPath = ""
+	s.store.SetFile(state.FileState{
+		Name:     s.Name,
+		Size:     s.Size,
+		SHA256:   s.SHA256,
+		Received: time.Now(),
+	})
+	return nil
+}
+
+// Discard removes the staged file, it does nothing once the file has been committed
+func (s *Staged) Discard() {
+	if s.tempPath != "" {
+		os.Remove(s.tempPath)
+	}
+}
+
+// hex encoded sha256 of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
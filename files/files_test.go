@@ -0,0 +1,90 @@
+package files
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// a store of its own, with the files kept in a new directory
+func setupFilesDir(t *testing.T) (state.Store, string) {
+	dir, err := ioutil.TempDir("", "files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FilesDirectory: dir})
+	return store, dir
+}
+
+func TestSanitiseName(t *testing.T) {
+	assert := assert.New(t)
+	cases := map[string]string{
+		"input.dat":                "input.dat",
+		"../../etc/passwd":         "passwd",
+		"C:\\Users\\me\\mesh.msh":  "mesh.msh",
+		"my input (final).txt":     "my_input__final_.txt",
+		"naïve.txt":                "na__ve.txt",
+		"semi;colon$(rm -rf).sh":   "semi_colon__rm_-rf_.sh",
+		"/absolute/path/to/config": "config",
+	}
+	for name, expected := range cases {
+		sanitised, err := SanitiseName(name)
+		assert.NoError(err, name)
+		assert.Equal(expected, sanitised, name)
+	}
+	for _, name := range []string{"", ".", "..", "/", ".hidden", "dir/..", string(bytes.Repeat([]byte("a"), 256))} {
+		_, err := SanitiseName(name)
+		assert.Equal(ErrBadName, err, name)
+	}
+}
+
+func TestStageAndCommit(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupFilesDir(t)
+	defer os.RemoveAll(dir)
+
+	staged, err := Stage(store, "input.dat", bytes.NewReader([]byte("0123456789")), 10)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(int64(10), staged.Size)
+	assert.Equal("84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882", staged.SHA256)
+	// not in place until committed
+	_, err = os.Stat(filepath.Join(dir, "input.dat"))
+	assert.True(os.IsNotExist(err))
+
+	assert.NoError(staged.Commit())
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "input.dat"))
+	assert.Equal([]byte("0123456789"), contents)
+	info, _ := os.Stat(filepath.Join(dir, "input.dat"))
+	assert.Equal(os.FileMode(0666), info.Mode().Perm())
+	recorded, ok := store.GetFiles()["input.dat"]
+	assert.True(ok)
+	assert.Equal(staged.SHA256, recorded.SHA256)
+	// nothing left behind
+	incoming, _ := ioutil.ReadDir(filepath.Join(dir, incomingDirectoryName))
+	assert.Len(incoming, 0)
+}
+
+func TestStageTooLarge(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupFilesDir(t)
+	defer os.RemoveAll(dir)
+
+	_, err := Stage(store, "input.dat", bytes.NewReader([]byte("0123456789")), 9)
+	assert.Equal(ErrTooLarge, err)
+	incoming, _ := ioutil.ReadDir(filepath.Join(dir, incomingDirectoryName))
+	assert.Len(incoming, 0)
+
+	staged, err := Stage(store, "input.dat", bytes.NewReader([]byte("0123456789")), 0)
+	assert.NoError(err)
+	staged.Discard()
+	incoming, _ = ioutil.ReadDir(filepath.Join(dir, incomingDirectoryName))
+	assert.Len(incoming, 0)
+}
@@ -0,0 +1,415 @@
+package files
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/results"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"golang.org/x/sys/unix"
+)
+
+// root access
+const (
+	// AccessReadOnly roots can be listed and downloaded from
+	AccessReadOnly = "ro"
+	// AccessReadWrite roots can also be uploaded to, and have files and directories created and deleted
+	AccessReadWrite = "rw"
+)
+
+var defaultRuntimeDirectory = "/hpcaas/runtime"
+
+// ErrNoRoot is returned for a root that hasn't been configured
+var ErrNoRoot = errors.New("No such root")
+
+// ErrOutsideRoot is returned when a path would escape its root
+var ErrOutsideRoot = errors.New("Path is outside of the root")
+
+// ErrSymlink is returned when a path goes through a symlink, symlinks are never followed
+var ErrSymlink = errors.New("Path contains a symlink")
+
+// ErrReadOnly is returned when changing a read only root
+var ErrReadOnly = errors.New("Root is read only")
+
+// ErrIsRoot is returned when deleting a root itself
+var ErrIsRoot = errors.New("Can't delete a root")
+
+// ErrNotRegular is returned when reading something other than a regular file, e.g. a fifo or device
+var ErrNotRegular = errors.New("Not a regular file")
+
+// Root is a directory that can be reached through the file management api
+type Root struct {
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Writable bool   `json:"writable"`
+}
+
+// Entry describes a single file or directory within a root
+type Entry struct {
+	Name string `json:"name"`
+	// slash separated, relative to the root
+	Path string `json:"path"`
+	// file, directory, symlink or other
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// Roots returns the configured roots, sorted by name
+// without any configuration the files directory is read-write, and the runtime and results directories read only
+func Roots(store state.Store) []Root {
+	conf, _ := store.GetDaemonConfiguration()
+	var roots []Root
+	if len(conf.FileRoots) == 0 {
+		roots = []Root{
+			{Name: "files", Path: Directory(store), Writable: true},
+			{Name: "results", Path: results.ResultsDirectory(store)},
+			{Name: "runtime", Path: defaultRuntimeDirectory},
+		}
+	}
+	for name, root := range conf.FileRoots {
+		roots = append(roots, Root{Name: name, Path: root.Path, Writable: root.Access == AccessReadWrite})
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+	return roots
+}
+
+// CheckRoots returns an error if any of the configured roots are unusable
+func CheckRoots(roots map[string]state.FileRoot) error {
+	for name, root := range roots {
+		if name == "" || strings.Contains(name, "/") {
+			return errors.New("Not a valid root name: " + name)
+		}
+		if !filepath.IsAbs(root.Path) {
+			return errors.New("Root path must be absolute: " + root.Path)
+		}
+		if root.Access != AccessReadOnly && root.Access != AccessReadWrite {
+			return errors.New("Root access must be ro or rw: " + root.Access)
+		}
+	}
+	return nil
+}
+
+// GetRoot returns the named root
+func GetRoot(store state.Store, name string) (Root, error) {
+	for _, root := range Roots(store) {
+		if root.Name == name {
+			return root, nil
+		}
+	}
+	return Root{}, ErrNoRoot
+}
+
+// the parts of a slash separated path relative to a root, a path that would leave the root is refused
+func splitInRoot(relPath string) ([]string, error) {
+	if strings.Contains(relPath, "\x00") {
+		return nil, ErrOutsideRoot
+	}
+	for _, part := range strings.Split(relPath, "/") {
+		if part == ".." {
+			return nil, ErrOutsideRoot
+		}
+	}
+	var parts []string
+	for _, part := range strings.Split(path.Clean("/"+relPath), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts, nil
+}
+
+// the error for opening name in dir, a part of the path that is a symlink is reported as such
+func walkError(dir *os.File, name string, err error) error {
+	if err == unix.ELOOP {
+		return ErrSymlink
+	}
+	if err == unix.ENOTDIR {
+		var st unix.Stat_t
+		if unix.Fstatat(int(dir.Fd()), name, &st, unix.AT_SYMLINK_NOFOLLOW) == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return ErrSymlink
+		}
+	}
+	return &os.PathError{Op: "open", Path: name, Err: err}
+}
+
+// opens name within dir with flags, never following a symlink
+func openAt(dir *os.File, name string, flags int, mode uint32) (*os.File, error) {
+	fd, err := unix.Openat(int(dir.Fd()), name, flags|unix.O_NOFOLLOW|unix.O_CLOEXEC, mode)
+	if err != nil {
+		return nil, walkError(dir, name, err)
+	}
+	return os.NewFile(uintptr(fd), name), nil
+}
+
+// openDirInRoot opens the directory at parts within the root, one part at a time,
+// each part is opened relative to the last without following symlinks,
+// so a part that is swapped for a symlink at any point is refused rather than followed
+// with create, any directories that are missing are created along the way
+func openDirInRoot(root Root, parts []string, create bool) (*os.File, error) {
+	dir, err := os.OpenFile(root.Path, os.O_RDONLY|unix.O_DIRECTORY, 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range parts {
+		if create {
+			if err := unix.Mkdirat(int(dir.Fd()), part, 0777); err != nil && err != unix.EEXIST {
+				dir.Close()
+				return nil, &os.PathError{Op: "mkdir", Path: part, Err: err}
+			}
+		}
+		next, err := openAt(dir, part, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+		dir.Close()
+		if err != nil {
+			return nil, err
+		}
+		dir = next
+	}
+	return dir, nil
+}
+
+// openParentInRoot opens the directory that the last part of relPath is in, returning it along with the last part,
+// which is empty for the root itself
+func openParentInRoot(root Root, relPath string) (*os.File, string, error) {
+	parts, err := splitInRoot(relPath)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(parts) == 0 {
+		dir, err := openDirInRoot(root, nil, false)
+		return dir, "", err
+	}
+	dir, err := openDirInRoot(root, parts[:len(parts)-1], false)
+	return dir, parts[len(parts)-1], err
+}
+
+// describes name within dir, a symlink is described rather than followed,
+// and nothing is opened for reading, so a fifo or device is never touched
+func statAt(dir *os.File, name string) (os.FileInfo, error) {
+	f, err := openAt(dir, name, unix.O_PATH, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Stat()
+}
+
+func entryFromInfo(relPath string, info os.FileInfo) Entry {
+	entryType := "other"
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		entryType = "symlink"
+	case info.IsDir():
+		entryType = "directory"
+	case info.Mode().IsRegular():
+		entryType = "file"
+	}
+	return Entry{
+		Name:    info.Name(),
+		Path:    strings.TrimPrefix(path.Clean("/"+relPath), "/"),
+		Type:    entryType,
+		Size:    info.Size(),
+		Mode:    info.Mode().String(),
+		ModTime: info.ModTime(),
+	}
+}
+
+// StatInRoot describes a single file or directory
+func StatInRoot(root Root, relPath string) (Entry, error) {
+	dir, name, err := openParentInRoot(root, relPath)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer dir.Close()
+	var info os.FileInfo
+	if name == "" {
+		info, err = dir.Stat()
+	} else {
+		info, err = statAt(dir, name)
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	return entryFromInfo(relPath, info), nil
+}
+
+// ListInRoot describes everything in a directory, symlinks are listed but never followed
+func ListInRoot(root Root, relDir string) ([]Entry, error) {
+	parts, err := splitInRoot(relDir)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := openDirInRoot(root, parts, false)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	entries := []Entry{}
+	for _, name := range names {
+		info, err := statAt(dir, name)
+		if os.IsNotExist(err) {
+			// removed since the directory was read
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entryFromInfo(path.Join(relDir, name), info))
+	}
+	return entries, nil
+}
+
+// OpenInRoot opens a regular file for reading
+// it is opened without blocking, so a fifo that has taken the file's place can't hold up the caller
+func OpenInRoot(root Root, relPath string) (*os.File, os.FileInfo, error) {
+	dir, name, err := openParentInRoot(root, relPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer dir.Close()
+	if name == "" {
+		return nil, nil, ErrNotRegular
+	}
+	f, err := openAt(dir, name, unix.O_RDONLY|unix.O_NONBLOCK|unix.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, ErrNotRegular
+	}
+	return f, info, nil
+}
+
+// a name for a temporary file that isn't already in use
+func tempName(prefix string) (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(random), nil
+}
+
+// WriteInRoot writes r to a file, replacing any file that is already there
+// the directory it is in must already exist, and the file is only moved into place once it has all been written
+// fails with ErrTooLarge if r holds more than maxSize bytes, a maxSize of 0 or less is no limit
+func WriteInRoot(root Root, relPath string, r io.Reader, maxSize int64) (Entry, error) {
+	if !root.Writable {
+		return Entry{}, ErrReadOnly
+	}
+	dir, name, err := openParentInRoot(root, relPath)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer dir.Close()
+	if name == "" {
+		return Entry{}, os.ErrExist
+	}
+	if info, err := statAt(dir, name); err == nil && info.IsDir() {
+		return Entry{}, os.ErrExist
+	} else if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return Entry{}, ErrSymlink
+	}
+	tmpName, err := tempName(".upload")
+	if err != nil {
+		return Entry{}, err
+	}
+	tmp, err := openAt(dir, tmpName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL, 0600)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer unix.Unlinkat(int(dir.Fd()), tmpName, 0)
+	if maxSize > 0 {
+		// one extra byte to tell a file of exactly maxSize from one that is too large
+		r = io.LimitReader(r, maxSize+1)
+	}
+	n, err := io.Copy(tmp, r)
+	if err == nil && maxSize > 0 && n > maxSize {
+		err = ErrTooLarge
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Chmod(0666)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	// a rename replaces whatever is at name, it never follows it
+	if err := unix.Renameat(int(dir.Fd()), tmpName, int(dir.Fd()), name); err != nil {
+		return Entry{}, &os.PathError{Op: "rename", Path: name, Err: err}
+	}
+	info, err := statAt(dir, name)
+	if err != nil {
+		return Entry{}, err
+	}
+	return entryFromInfo(relPath, info), nil
+}
+
+// MkdirInRoot creates a directory, along with any parents
+func MkdirInRoot(root Root, relPath string) (Entry, error) {
+	if !root.Writable {
+		return Entry{}, ErrReadOnly
+	}
+	parts, err := splitInRoot(relPath)
+	if err != nil {
+		return Entry{}, err
+	}
+	dir, err := openDirInRoot(root, parts, true)
+	if err != nil {
+		return Entry{}, err
+	}
+	defer dir.Close()
+	info, err := dir.Stat()
+	if err != nil {
+		return Entry{}, err
+	}
+	return entryFromInfo(relPath, info), nil
+}
+
+// RemoveInRoot deletes a file, symlink or empty directory
+// the symlink itself is removed, provided it is the last part of the path
+func RemoveInRoot(root Root, relPath string) error {
+	if !root.Writable {
+		return ErrReadOnly
+	}
+	dir, name, err := openParentInRoot(root, relPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if name == "" {
+		return ErrIsRoot
+	}
+	err = unix.Unlinkat(int(dir.Fd()), name, 0)
+	if err == unix.EISDIR {
+		err = unix.Unlinkat(int(dir.Fd()), name, unix.AT_REMOVEDIR)
+	}
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package files
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// a store with a read-write and a read only root, each with a file, a directory and symlinks that lead out of the root
+func setupRoots(t *testing.T) (state.Store, string) {
+	dir, err := ioutil.TempDir("", "roots")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, root := range []string{"rw", "ro"} {
+		os.MkdirAll(filepath.Join(dir, root, "sub"), 0755)
+		ioutil.WriteFile(filepath.Join(dir, root, "sub", "out.log"), []byte("log"), 0644)
+		os.Symlink("/etc", filepath.Join(dir, root, "etc"))
+		os.Symlink("/etc/passwd", filepath.Join(dir, root, "passwd"))
+	}
+	ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644)
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FileRoots: map[string]state.FileRoot{
+		"scratch": {Path: filepath.Join(dir, "rw"), Access: AccessReadWrite},
+		"logs":    {Path: filepath.Join(dir, "ro"), Access: AccessReadOnly},
+	}})
+	return store, dir
+}
+
+func TestRoots(t *testing.T) {
+	assert := assert.New(t)
+	defaults := state.NewStore(state.NewMemoryBackend())
+	defaults.SetDaemonConfiguration(state.DaemonConfiguration{FilesDirectory: "/data"})
+	assert.Equal([]Root{
+		{Name: "files", Path: "/data", Writable: true},
+		{Name: "results", Path: "/hpcaas/results"},
+		{Name: "runtime", Path: "/hpcaas/runtime"},
+	}, Roots(defaults))
+
+	store, dir := setupRoots(t)
+	defer os.RemoveAll(dir)
+	assert.Equal([]Root{
+		{Name: "logs", Path: filepath.Join(dir, "ro")},
+		{Name: "scratch", Path: filepath.Join(dir, "rw"), Writable: true},
+	}, Roots(store))
+	_, err := GetRoot(store, "files")
+	assert.Equal(ErrNoRoot, err)
+
+	assert.NoError(CheckRoots(map[string]state.FileRoot{"a": {Path: "/a", Access: "ro"}}))
+	assert.Error(CheckRoots(map[string]state.FileRoot{"a": {Path: "relative", Access: "ro"}}))
+	assert.Error(CheckRoots(map[string]state.FileRoot{"a": {Path: "/a", Access: "write"}}))
+	assert.Error(CheckRoots(map[string]state.FileRoot{"a/b": {Path: "/a", Access: "rw"}}))
+}
+
+func TestWalkInRoot(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupRoots(t)
+	defer os.RemoveAll(dir)
+	root, _ := GetRoot(store, "scratch")
+
+	entry, err := StatInRoot(root, "sub/out.log")
+	assert.NoError(err)
+	assert.Equal("file", entry.Type)
+	_, err = StatInRoot(root, "sub/new/file")
+	assert.True(os.IsNotExist(err))
+
+	for _, p := range []string{"../secret", "sub/../../secret", "sub/../../rw/sub", "a\x00b"} {
+		_, err = StatInRoot(root, p)
+		assert.Equal(ErrOutsideRoot, err, p)
+	}
+	for _, p := range []string{"etc/passwd", "etc/newfile", "etc/sub/newfile"} {
+		_, err = StatInRoot(root, p)
+		assert.Equal(ErrSymlink, err, p)
+	}
+	// a symlink at the end of the path is described, not followed
+	entry, err = StatInRoot(root, "passwd")
+	assert.NoError(err)
+	assert.Equal("symlink", entry.Type)
+}
+
+func TestSwappedForSymlink(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupRoots(t)
+	defer os.RemoveAll(dir)
+	root, _ := GetRoot(store, "scratch")
+	sub := filepath.Join(dir, "rw", "sub")
+
+	parent, name, err := openParentInRoot(root, "sub/out.log")
+	if !assert.NoError(err) {
+		return
+	}
+	defer parent.Close()
+	// the code swaps the directory for a symlink out of the root once the walk has got past it
+	os.Rename(sub, sub+".moved")
+	os.Symlink(dir, sub)
+	// what was walked to is still the directory within the root
+	info, err := statAt(parent, name)
+	if assert.NoError(err) {
+		assert.Equal(int64(3), info.Size())
+	}
+	// and walking again refuses the symlink
+	_, err = StatInRoot(root, "sub/secret")
+	assert.Equal(ErrSymlink, err)
+	_, err = WriteInRoot(root, "sub/secret", bytes.NewReader([]byte("x")), 0)
+	assert.Equal(ErrSymlink, err)
+	written, _ := ioutil.ReadFile(filepath.Join(dir, "secret"))
+	assert.Equal("secret", string(written))
+}
+
+func TestFifoInRoot(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupRoots(t)
+	defer os.RemoveAll(dir)
+	root, _ := GetRoot(store, "scratch")
+	if err := syscall.Mkfifo(filepath.Join(dir, "rw", "pipe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := StatInRoot(root, "pipe")
+	assert.NoError(err)
+	assert.Equal("other", entry.Type)
+	// nothing is writing to the fifo, opening it mustn't wait for something to
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := OpenInRoot(root, "pipe")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Equal(ErrNotRegular, err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("opening a fifo blocked")
+	}
+}
+
+func TestListAndStatInRoot(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupRoots(t)
+	defer os.RemoveAll(dir)
+	root, _ := GetRoot(store, "logs")
+
+	entries, err := ListInRoot(root, "")
+	assert.NoError(err)
+	types := map[string]string{}
+	for _, entry := range entries {
+		types[entry.Path] = entry.Type
+	}
+	assert.Equal(map[string]string{"etc": "symlink", "passwd": "symlink", "sub": "directory"}, types)
+
+	entry, err := StatInRoot(root, "/sub/out.log")
+	assert.NoError(err)
+	assert.Equal("sub/out.log", entry.Path)
+	assert.Equal("file", entry.Type)
+	assert.Equal(int64(3), entry.Size)
+
+	_, err = ListInRoot(root, "etc")
+	assert.Equal(ErrSymlink, err)
+	_, _, err = OpenInRoot(root, "passwd")
+	assert.Equal(ErrSymlink, err)
+	_, _, err = OpenInRoot(root, "sub")
+	assert.Error(err)
+}
+
+func TestChangesInRoot(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupRoots(t)
+	defer os.RemoveAll(dir)
+	rw, _ := GetRoot(store, "scratch")
+	ro, _ := GetRoot(store, "logs")
+
+	entry, err := WriteInRoot(rw, "sub/config.ini", bytes.NewReader([]byte("a=1")), 0)
+	assert.NoError(err)
+	assert.Equal(int64(3), entry.Size)
+	written, _ := ioutil.ReadFile(filepath.Join(dir, "rw", "sub", "config.ini"))
+	assert.Equal("a=1", string(written))
+	_, err = WriteInRoot(rw, "sub/config.ini", bytes.NewReader([]byte("a=12345")), 5)
+	assert.Equal(ErrTooLarge, err)
+	written, _ = ioutil.ReadFile(filepath.Join(dir, "rw", "sub", "config.ini"))
+	assert.Equal("a=1", string(written))
+	// nothing is written through a symlink
+	_, err = WriteInRoot(rw, "passwd", bytes.NewReader([]byte("x")), 0)
+	assert.Equal(ErrSymlink, err)
+	_, err = WriteInRoot(rw, "missing/file", bytes.NewReader([]byte("x")), 0)
+	assert.True(os.IsNotExist(err))
+	_, err = WriteInRoot(rw, "sub", bytes.NewReader([]byte("x")), 0)
+	assert.True(os.IsExist(err))
+
+	entry, err = MkdirInRoot(rw, "a/b")
+	assert.NoError(err)
+	assert.Equal("directory", entry.Type)
+	_, err = MkdirInRoot(rw, "etc/b")
+	assert.Equal(ErrSymlink, err)
+
+	assert.Error(RemoveInRoot(rw, "a"))
+	assert.NoError(RemoveInRoot(rw, "a/b"))
+	assert.NoError(RemoveInRoot(rw, "sub/config.ini"))
+	// the symlink is removed, not what it leads to
+	assert.NoError(RemoveInRoot(rw, "passwd"))
+	_, err = os.Stat("/etc/passwd")
+	assert.NoError(err)
+	assert.Equal(ErrSymlink, RemoveInRoot(rw, "etc/passwd"))
+	assert.Equal(ErrIsRoot, RemoveInRoot(rw, "/"))
+
+	// a read only root can't be changed
+	_, err = WriteInRoot(ro, "new", bytes.NewReader([]byte("x")), 0)
+	assert.Equal(ErrReadOnly, err)
+	_, err = MkdirInRoot(ro, "new")
+	assert.Equal(ErrReadOnly, err)
+	assert.Equal(ErrReadOnly, RemoveInRoot(ro, "sub/out.log"))
+}
@@ -0,0 +1,227 @@
+package files
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// how long an upload can go without receiving any data, unless configured otherwise
+var defaultUploadExpiry = 24 * time.Hour
+
+// how often ExpireUploads looks for abandoned uploads
+var expiryInterval = time.Minute
+
+// ErrNoUpload is returned for an upload that doesn't exist, or has expired
+var ErrNoUpload = errors.New("No such upload")
+
+// ErrWrongOffset is returned when a chunk doesn't start where the previous one finished
+var ErrWrongOffset = errors.New("Chunk does not start at the current offset of the upload")
+
+// ErrIncomplete is returned when finalising an upload that hasn't received all of its bytes
+var ErrIncomplete = errors.New("Upload is incomplete")
+
+// ErrChecksumMismatch is returned when the uploaded file doesn't match the checksum it was finalised with
+var ErrChecksumMismatch = errors.New("Uploaded file does not match its checksum")
+
+// one lock per upload, so that chunks of the same upload can't be written at once
+// a lock is dropped when its upload is removed
+var uploadLocks = make(map[string]*sync.Mutex)
+var uploadLocksMut = sync.Mutex{}
+
+func lockUpload(store state.Store, id string) func() {
+	uploadLocksMut.Lock()
+	lock, ok := uploadLocks[id]
+	if !ok {
+		lock = &sync.Mutex{}
+		uploadLocks[id] = lock
+	}
+	uploadLocksMut.Unlock()
+	lock.Lock()
+	return func() {
+		// an id that isn't an upload, e.g. a chunk sent after the upload was aborted, never reaches removeUpload
+		uploadLocksMut.Lock()
+		if _, ok := store.GetUpload(id); !ok {
+			delete(uploadLocks, id)
+		}
+		uploadLocksMut.Unlock()
+		lock.Unlock()
+	}
+}
+
+func uploadExpiry(store state.Store) time.Duration {
+	if conf, ok := store.GetDaemonConfiguration(); ok && conf.FilesUploadExpiry > 0 {
+		return time.Duration(conf.FilesUploadExpiry) * time.Second
+	}
+	return defaultUploadExpiry
+}
+
+// where the bytes of an upload are kept until it is finalised
+func uploadPath(store state.Store, id string) string {
+	return filepath.Join(Directory(store), incomingDirectoryName, id+".part")
+}
+
+// CreateUpload starts a resumable upload of a file of the given size
+func CreateUpload(store state.Store, name string, size int64) (state.UploadState, error) {
+	name, err := SanitiseName(name)
+	if err != nil {
+		return state.UploadState{}, err
+	}
+	if size < 0 {
+		return state.UploadState{}, errors.New("Upload size can't be negative")
+	}
+	if conf, _ := store.GetDaemonConfiguration(); conf.FilesMaxFileSize > 0 && size > conf.FilesMaxFileSize {
+		return state.UploadState{}, ErrTooLarge
+	}
+	idBytes := make([]byte, 16)
+	if _, err := rand.Read(idBytes); err != nil {
+		return state.UploadState{}, err
+	}
+	now := time.Now()
+	upload := state.UploadState{
+		ID:      hex.EncodeToString(idBytes),
+		Name:    name,
+		Size:    size,
+		Created: now,
+		Expires: now.Add(uploadExpiry(store)),
+	}
+	if err := os.MkdirAll(filepath.Dir(uploadPath(store, upload.ID)), 0700); err != nil {
+		return state.UploadState{}, err
+	}
+	f, err := os.OpenFile(uploadPath(store, upload.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return state.UploadState{}, err
+	}
+	f.Close()
+	store.SetUpload(upload)
+	return upload, nil
+}
+
+// GetUpload returns an upload that hasn't expired
+func GetUpload(store state.Store, id string) (state.UploadState, error) {
+	upload, ok := store.GetUpload(id)
+	if !ok || time.Now().After(upload.Expires) {
+		return state.UploadState{}, ErrNoUpload
+	}
+	return upload, nil
+}
+
+// WriteChunk appends the bytes read from r to the upload, which must currently be at offset,
+// returning the new offset
+// whatever is received before an error is kept, so a chunk that is cut short can be resumed from where it got to
+func WriteChunk(store state.Store, id string, offset int64, r io.Reader) (state.UploadState, error) {
+	defer lockUpload(store, id)()
+	upload, err := GetUpload(store, id)
+	if err != nil {
+		return upload, err
+	}
+	if offset != upload.Offset {
+		return upload, ErrWrongOffset
+	}
+	f, err := os.OpenFile(uploadPath(store, id), os.O_WRONLY, 0600)
+	if err != nil {
+		return upload, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return upload, err
+	}
+	// one more than remains, to notice a chunk that runs past the end of the file
+	n, err := io.Copy(f, io.LimitReader(r, upload.Size-offset+1))
+	if n > upload.Size-offset {
+		n = upload.Size - offset
+		f.Truncate(upload.Size)
+		if err == nil {
+			err = ErrTooLarge
+		}
+	}
+	// the bytes have to be on disk before the state says they've been received
+	if syncErr := f.Sync(); syncErr != nil {
+		return upload, syncErr
+	}
+	upload.Offset += n
+	upload.Expires = time.Now().Add(uploadExpiry(store))
+	store.SetUpload(upload)
+	return upload, err
+}
+
+// FinaliseUpload checks that the upload is complete and matches the checksum,
+// then moves it into the files directory
+// an upload that doesn't match the checksum is thrown away
+func FinaliseUpload(store state.Store, id string, checksum string) (*Staged, error) {
+	defer lockUpload(store, id)()
+	upload, err := GetUpload(store, id)
+	if err != nil {
+		return nil, err
+	}
+	if upload.Offset != upload.Size {
+		return nil, ErrIncomplete
+	}
+	sum, err := fileSHA256(uploadPath(store, id))
+	if err != nil {
+		return nil, err
+	}
+	if sum != checksum {
+		removeUpload(store, id)
+		return nil, ErrChecksumMismatch
+	}
+	staged := &Staged{
+		Name:     upload.Name,
+		Size:     upload.Size,
+		SHA256:   sum,
+		dir:      Directory(store),
+		tempPath: uploadPath(store, id),
+		store:    store,
+	}
+	if err := staged.Commit(); err != nil {
+		return nil, err
+	}
+	removeUpload(store, id)
+	return staged, nil
+}
+
+// AbortUpload abandons an upload, removing whatever has been received
+func AbortUpload(store state.Store, id string) error {
+	defer lockUpload(store, id)()
+	if _, err := GetUpload(store, id); err != nil {
+		return err
+	}
+	removeUpload(store, id)
+	return nil
+}
+
+func removeUpload(store state.Store, id string) {
+	os.Remove(uploadPath(store, id))
+	store.RemoveUpload(id)
+	uploadLocksMut.Lock()
+	delete(uploadLocks, id)
+	uploadLocksMut.Unlock()
+}
+
+// ExpireUploads periodically removes uploads that have expired
+// This is intended to be started from main as a goroutine, it never returns
+func ExpireUploads(store state.Store) {
+	for {
+		time.Sleep(expiryInterval)
+		removeExpiredUploads(store, time.Now())
+	}
+}
+
+func removeExpiredUploads(store state.Store, now time.Time) {
+	for id, upload := range store.GetUploads() {
+		if now.After(upload.Expires) {
+			unlock := lockUpload(store, id)
+			log.Println("Upload of " + upload.Name + " has expired")
+			removeUpload(store, id)
+			unlock()
+		}
+	}
+}
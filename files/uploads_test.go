@@ -0,0 +1,168 @@
+package files
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+var testContents = []byte("0123456789")
+var testSHA256 = "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+// a reader that fails part way through, like a dropped connection
+type brokenReader struct {
+	r io.Reader
+}
+
+func (b *brokenReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestResumableUpload(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupFilesDir(t)
+	defer os.RemoveAll(dir)
+
+	upload, err := CreateUpload(store, "../mesh.msh", int64(len(testContents)))
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("mesh.msh", upload.Name)
+	assert.Equal(int64(0), upload.Offset)
+
+	// the connection drops part way through the first chunk, what arrived is kept
+	upload, err = WriteChunk(store, upload.ID, 0, &brokenReader{bytes.NewReader(testContents[:4])})
+	assert.Error(err)
+	assert.Equal(int64(4), upload.Offset)
+	upload, _ = GetUpload(store, upload.ID)
+	assert.Equal(int64(4), upload.Offset)
+
+	_, err = WriteChunk(store, upload.ID, 2, bytes.NewReader(testContents[2:]))
+	assert.Equal(ErrWrongOffset, err)
+
+	_, err = FinaliseUpload(store, upload.ID, testSHA256)
+	assert.Equal(ErrIncomplete, err)
+
+	upload, err = WriteChunk(store, upload.ID, 4, bytes.NewReader(testContents[4:]))
+	assert.NoError(err)
+	assert.Equal(int64(10), upload.Offset)
+
+	file, err := FinaliseUpload(store, upload.ID, testSHA256)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal("mesh.msh", file.Name)
+	contents, _ := ioutil.ReadFile(filepath.Join(dir, "mesh.msh"))
+	assert.Equal(testContents, contents)
+	_, err = GetUpload(store, upload.ID)
+	assert.Equal(ErrNoUpload, err)
+	_, ok := store.GetFiles()["mesh.msh"]
+	assert.True(ok)
+	incoming, _ := ioutil.ReadDir(filepath.Join(dir, incomingDirectoryName))
+	assert.Len(incoming, 0)
+}
+
+func TestResumableUploadErrors(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupFilesDir(t)
+	defer os.RemoveAll(dir)
+
+	// too much data
+	upload, _ := CreateUpload(store, "a.dat", 5)
+	upload, err := WriteChunk(store, upload.ID, 0, bytes.NewReader(testContents))
+	assert.Equal(ErrTooLarge, err)
+	assert.Equal(int64(5), upload.Offset)
+	info, _ := os.Stat(uploadPath(store, upload.ID))
+	assert.Equal(int64(5), info.Size())
+
+	// wrong checksum throws the upload away
+	_, err = FinaliseUpload(store, upload.ID, testSHA256)
+	assert.Equal(ErrChecksumMismatch, err)
+	_, err = GetUpload(store, upload.ID)
+	assert.Equal(ErrNoUpload, err)
+	_, err = os.Stat(uploadPath(store, upload.ID))
+	assert.True(os.IsNotExist(err))
+
+	upload, _ = CreateUpload(store, "b.dat", 5)
+	assert.NoError(AbortUpload(store, upload.ID))
+	_, err = WriteChunk(store, upload.ID, 0, bytes.NewReader(testContents))
+	assert.Equal(ErrNoUpload, err)
+
+	_, err = CreateUpload(store, ".hidden", 5)
+	assert.Equal(ErrBadName, err)
+
+	store.SetDaemonConfiguration(state.DaemonConfiguration{FilesDirectory: dir, FilesMaxFileSize: 5})
+	_, err = CreateUpload(store, "c.dat", 6)
+	assert.Equal(ErrTooLarge, err)
+}
+
+func TestUploadExpiry(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupFilesDir(t)
+	defer os.RemoveAll(dir)
+
+	upload, _ := CreateUpload(store, "a.dat", 10)
+	assert.True(upload.Expires.After(time.Now().Add(23 * time.Hour)))
+	removeExpiredUploads(store, time.Now())
+	_, err := GetUpload(store, upload.ID)
+	assert.NoError(err)
+
+	removeExpiredUploads(store, time.Now().Add(25*time.Hour))
+	_, err = GetUpload(store, upload.ID)
+	assert.Equal(ErrNoUpload, err)
+	_, ok := store.GetUploads()[upload.ID]
+	assert.False(ok)
+	_, err = os.Stat(uploadPath(store, upload.ID))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestUploadLocksReleased(t *testing.T) {
+	assert := assert.New(t)
+	store, dir := setupFilesDir(t)
+	defer os.RemoveAll(dir)
+
+	finalised, _ := CreateUpload(store, "a.dat", int64(len(testContents)))
+	WriteChunk(store, finalised.ID, 0, bytes.NewReader(testContents))
+	_, err := FinaliseUpload(store, finalised.ID, testSHA256)
+	assert.NoError(err)
+
+	mismatched, _ := CreateUpload(store, "b.dat", 1)
+	WriteChunk(store, mismatched.ID, 0, bytes.NewReader([]byte("0")))
+	_, err = FinaliseUpload(store, mismatched.ID, testSHA256)
+	assert.Equal(ErrChecksumMismatch, err)
+
+	aborted, _ := CreateUpload(store, "c.dat", 5)
+	assert.NoError(AbortUpload(store, aborted.ID))
+	// sent after the upload has gone
+	_, err = WriteChunk(store, aborted.ID, 0, bytes.NewReader(testContents))
+	assert.Equal(ErrNoUpload, err)
+	assert.Equal(ErrNoUpload, AbortUpload(store, "unknown"))
+
+	expired, _ := CreateUpload(store, "d.dat", 5)
+	WriteChunk(store, expired.ID, 0, bytes.NewReader([]byte("01")))
+	removeExpiredUploads(store, time.Now().Add(25*time.Hour))
+
+	uploadLocksMut.Lock()
+	assert.Empty(uploadLocks)
+	uploadLocksMut.Unlock()
+
+	// an upload in progress keeps its lock
+	pending, _ := CreateUpload(store, "e.dat", 5)
+	WriteChunk(store, pending.ID, 0, bytes.NewReader([]byte("01")))
+	uploadLocksMut.Lock()
+	assert.Len(uploadLocks, 1)
+	uploadLocksMut.Unlock()
+	assert.NoError(AbortUpload(store, pending.ID))
+}
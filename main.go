@@ -10,7 +10,11 @@ import (
 	"path/filepath"
 	"runtime/debug"
 
+	"github.com/mrmagooey/hpcaas-container-daemon/container"
+	"github.com/mrmagooey/hpcaas-container-daemon/files"
+	"github.com/mrmagooey/hpcaas-container-daemon/results"
 	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/mrmagooey/hpcaas-container-daemon/webhooks"
 )
 
 // BaseDaemonDir the root of the daemon working dir
@@ -36,7 +40,7 @@ func init() {
 
 // run once at container startup
 // pull comm information out of environment variables and save to disk
-func setupTLSInfo() {
+func setupTLSInfo(store state.Store) {
 	tlsPublicCert, envErr := os.LookupEnv(daemonPublicCertEnvVar)
 	if !envErr {
 		log.Panicln("TLS certificate is missing from environment variables")
@@ -59,7 +63,7 @@ func setupTLSInfo() {
 		log.Panicln("Couldn't save tls server key to disk")
 	}
 
-	err = state.SetAuthorizationKey(authKey)
+	err = store.SetAuthorizationKey(authKey)
 	if err != nil {
 		log.Panicln("Couldn't add auth key to state")
 	}
@@ -67,7 +71,7 @@ func setupTLSInfo() {
 
 // check if this is the first time that the daemon has started up
 // if the daemon was previously running
-func daemonStartup() {
+func daemonStartup(store state.Store) {
 	if _, err := os.Stat(startupFile); err != nil {
 		// startup file doesn't exist, this is the first time the daemon has started
 		f, err := os.Create(startupFile)
@@ -80,12 +84,12 @@ func daemonStartup() {
 		}
 	} else {
 		// daemon has already started previously, rehydrate state from disk
-		state.RehydrateFromDisk()
+		store.RehydrateFromDisk()
 	}
 }
 
 // setup the tls information for the server
-func setupServer() *http.Server {
+func setupServer(store state.Store) *http.Server {
 	tlsConfig := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		CurvePreferences:         []tls.CurveID{tls.CurveP521, tls.CurveP384, tls.CurveP256},
@@ -97,8 +101,8 @@ func setupServer() *http.Server {
 			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
 		}}
-	routes := registerRoutes()
-	authRoutes := authMiddleware(routes)
+	routes := registerRoutes(store)
+	authRoutes := authMiddleware(store, routes)
 	server := &http.Server{
 		Addr:      ":443",
 		TLSConfig: tlsConfig,
@@ -116,16 +120,42 @@ func main() {
 		}
 	}()
 
-	daemonStartup()
+	// the state is kept by whichever backend was last selected by the daemon configuration
+	backend, err := state.OpenBackend()
+	if err != nil {
+		log.Panicln("Couldn't open the state backend: " + err.Error())
+	}
+	store := state.NewStore(backend)
+	daemonStartup(store)
 	log.Println("daemonStartup")
-	setupTLSInfo()
+	// lifecycle events from here on are posted to the configured webhooks
+	webhooks.Start(store)
+	if err := store.SetContainerStatus(state.ContainerRunningStatus, "daemon started"); err != nil {
+		log.Println("Couldn't set the container status: " + err.Error())
+	}
+	// codes started over ssh, e.g. by mpirun on another container, are picked up here
+	go container.WatchForExternalStart(store)
+	// once the code finishes send the results wherever they have been configured to go
+	container.AddExitHook(results.OnCodeExit(store))
+	// a code that was running when the daemon stopped is watched again, or marked as lost
+	container.ReattachCode(store)
+	// fetches don't survive a restart, they have to be requested again
+	files.FailInterruptedFetches(store)
+	go results.SyncWhileRunning(store)
+	// abandoned resumable uploads are cleaned up
+	go files.ExpireUploads(store)
+	setupTLSInfo(store)
 	log.Println("TLS info retrieved")
-	server := setupServer()
+	server := setupServer(store)
 	log.Println("TLS server has been setup")
-	err := server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
+	err = server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
 	if err != nil {
 		log.Println("An error has occurred whilst starting the daemon server, or it has closed early")
 		log.Println(err)
 	}
+	// anything still waiting to be written
+	if err := store.Flush(); err != nil {
+		log.Println(err)
+	}
 
 }
@@ -143,7 +143,7 @@ func generateAuthKey() string {
 // from the environment variables
 func TestTLSInformation(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
+	store := state.NewStore(state.NewMemoryBackend())
 	// generate tls information
 	caCertBytes, caKeyBytes, err := generateCACertAndKey()
 	if err != nil {
@@ -162,7 +162,7 @@ func TestTLSInformation(t *testing.T) {
 	os.Setenv(daemonPrivateKeyEnvVar, string(daemonKeyBytes))
 	os.Setenv(daemonAuthEnvVar, authKey)
 	// setup tls info
-	setupTLSInfo()
+	setupTLSInfo(store)
 	// check that the files have been correctly written to where they need to be
 	loadedCert, err := ioutil.ReadFile(tlsCertFile)
 	assert.NoError(err)
@@ -182,7 +182,7 @@ func TestTLSInformation(t *testing.T) {
 // is in our cert pool (the "CA" cert)
 func TestTLSServerStartup(t *testing.T) {
 	assert := assert.New(t)
-	state.InitState()
+	store := state.NewStore(state.NewMemoryBackend())
 	// generate tls information
 	caCertBytes, caKeyBytes, err := generateCACertAndKey()
 	if err != nil {
@@ -201,9 +201,9 @@ func TestTLSServerStartup(t *testing.T) {
 	os.Setenv(daemonPrivateKeyEnvVar, string(daemonKeyBytes))
 	os.Setenv(daemonAuthEnvVar, authKey)
 	// setup tls info
-	setupTLSInfo()
+	setupTLSInfo(store)
 	// check that the files have been correctly written to where they need to be
-	server := setupServer()
+	server := setupServer(store)
 	go func() {
 		e := server.ListenAndServeTLS(tlsCertFile, tlsKeyFile)
 		fmt.Println(e)
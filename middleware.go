@@ -7,10 +7,10 @@ import (
 	"github.com/mrmagooey/hpcaas-container-daemon/state"
 )
 
-func authMiddleware(next http.Handler) http.Handler {
+func authMiddleware(store state.Store, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		log.Println("Before")
-		if authKey, ok := state.GetAuthorizationKey(); ok {
+		if authKey, ok := store.GetAuthorizationKey(); ok {
 			if r.Header.Get("WWW-Authenticate") == authKey {
 				next.ServeHTTP(w, r) // call original routes
 				return
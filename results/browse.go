@@ -0,0 +1,106 @@
+package results
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// ErrOutsideResults is returned when a path would escape the results directory
+var ErrOutsideResults = errors.New("Path is outside of the results directory")
+
+// ResolvePath turns a slash separated path relative to the results directory into a path on disk
+// the path, after any symlinks are followed, must stay within the results directory
+func ResolvePath(store state.Store, relPath string) (string, error) {
+	return resolveWithin(ResultsDirectory(store), relPath)
+}
+
+func resolveWithin(root string, relPath string) (string, error) {
+	if strings.Contains(relPath, "\x00") {
+		return "", ErrOutsideResults
+	}
+	// cleaning against "/" removes any leading ..
+	cleaned := path.Clean("/" + relPath)
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	full := filepath.Join(realRoot, filepath.FromSlash(cleaned))
+	realFull, err := filepath.EvalSymlinks(full)
+	if err != nil {
+		return "", err
+	}
+	if realFull != realRoot && !strings.HasPrefix(realFull, realRoot+string(filepath.Separator)) {
+		return "", ErrOutsideResults
+	}
+	return realFull, nil
+}
+
+// ListFiles lists every file under the given directory of the results,
+// paths are relative to the results directory rather than the subdirectory
+func ListFiles(store state.Store, relDir string) ([]File, error) {
+	root, err := ResolvePath(store, "")
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ResolvePath(store, relDir)
+	if err != nil {
+		return nil, err
+	}
+	files, err := CollectFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := range files {
+		rel, err := filepath.Rel(root, files[i].FullPath)
+		if err != nil {
+			return nil, err
+		}
+		files[i].Path = filepath.ToSlash(rel)
+	}
+	return files, nil
+}
+
+// WriteTar streams a tar of every regular file under dir to w,
+// names in the tar are relative to dir
+func WriteTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		// the header has already promised this many bytes
+		_, err = io.CopyN(tw, f, info.Size())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,38 @@
+package results
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveWithin(t *testing.T) {
+	assert := assert.New(t)
+	root, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(root)
+	root, _ = filepath.EvalSymlinks(root)
+	writeTestFile(t, root, "sub/file.txt", []byte("file"))
+	os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "link"))
+	os.Symlink("/etc", filepath.Join(root, "etc"))
+
+	resolved, err := resolveWithin(root, "sub/file.txt")
+	assert.NoError(err)
+	assert.Equal(filepath.Join(root, "sub", "file.txt"), resolved)
+	resolved, err = resolveWithin(root, "")
+	assert.NoError(err)
+	assert.Equal(root, resolved)
+	// symlinks inside the root are fine
+	resolved, err = resolveWithin(root, "link/file.txt")
+	assert.NoError(err)
+	assert.Equal(filepath.Join(root, "sub", "file.txt"), resolved)
+	// .. can't climb out of the root
+	resolved, err = resolveWithin(root, "../../sub/file.txt")
+	assert.NoError(err)
+	assert.Equal(filepath.Join(root, "sub", "file.txt"), resolved)
+	// symlinks that point out of the root are refused
+	_, err = resolveWithin(root, "etc/passwd")
+	assert.Equal(ErrOutsideResults, err)
+}
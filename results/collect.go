@@ -0,0 +1,101 @@
+package results
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// File is a single file within the results directory
+type File struct {
+	// path relative to the results directory, always slash separated
+	Path string `json:"path"`
+	// absolute path on the container filesystem
+	FullPath string    `json:"-"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	ModTime  time.Time `json:"mtime"`
+}
+
+// CollectFiles walks the results directory and returns every regular file in it,
+// along with its size and checksum
+// symlinks are not followed
+func CollectFiles(dir string) ([]File, error) {
+	var files []File
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := cachedSHA256(path, info)
+		if err != nil {
+			return err
+		}
+		files = append(files, File{
+			Path:     filepath.ToSlash(rel),
+			FullPath: path,
+			Size:     info.Size(),
+			SHA256:   sum,
+			ModTime:  info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Path < files[j].Path })
+	return files, nil
+}
+
+// hex encoded sha256 of the file at path
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type checksumCacheEntry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+// checksums of files that haven't changed since they were last hashed, keyed by full path
+var checksumCache = make(map[string]checksumCacheEntry)
+var checksumCacheMut = sync.Mutex{}
+
+// only rehash the file if its size or modification time has changed
+func cachedSHA256(path string, info os.FileInfo) (string, error) {
+	checksumCacheMut.Lock()
+	entry, ok := checksumCache[path]
+	checksumCacheMut.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.sum, nil
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return "", err
+	}
+	checksumCacheMut.Lock()
+	checksumCache[path] = checksumCacheEntry{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	checksumCacheMut.Unlock()
+	return sum, nil
+}
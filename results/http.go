@@ -0,0 +1,240 @@
+package results
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var defaultChunkSize int64 = 8 * 1024 * 1024
+var defaultRetries = 5
+var defaultRetryDelay = 500 * time.Millisecond
+var maxRetryDelay = 30 * time.Second
+
+// HTTPDestination uploads results files to a http(s) endpoint
+//
+// each file is sent to <URL>/<relative path> as a series of PUT requests,
+// one per chunk, with a Content-Range header describing where the chunk sits in the file.
+// Every chunk carries an X-Chunk-Sha256 header and every request carries the X-Content-Sha256
+// of the whole file so that the server can verify both.
+// Before sending a file a HEAD request is made, carrying the X-Content-Sha256 of the file,
+// if the server responds with an Upload-Offset header the upload resumes from that offset rather than starting again.
+type HTTPDestination struct {
+	URL        string
+	Client     *http.Client
+	ChunkSize  int64
+	Retries    int
+	RetryDelay time.Duration
+	// limits how fast files are sent, nil for no limit
+	Limiter *RateLimiter
+}
+
+// NewHTTPDestination returns a destination with the default chunking and retry behaviour
+func NewHTTPDestination(url string) *HTTPDestination {
+	return &HTTPDestination{
+		URL:        url,
+		Client:     http.DefaultClient,
+		ChunkSize:  defaultChunkSize,
+		Retries:    defaultRetries,
+		RetryDelay: defaultRetryDelay,
+	}
+}
+
+// the server is unhappy with the request and there is no point trying again
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string {
+	return e.err.Error()
+}
+
+// Upload sends the file to the server, progress is called with the number of bytes of this file
+// that the server has confirmed it holds
+func (d *HTTPDestination) Upload(file File, progress func(sent int64)) error {
+	target, err := d.fileURL(file.Path)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	err = retry(d.Retries, d.RetryDelay, func() error {
+		var e error
+		offset, e = d.queryOffset(target, file.SHA256)
+		return e
+	})
+	if err != nil {
+		return err
+	}
+	if offset > file.Size {
+		// the server has something other than our file, start again
+		offset = 0
+	}
+	progress(offset)
+	// the server already has all of it, e.g. from an attempt that was cut off before it was recorded
+	if offset == file.Size && file.Size > 0 {
+		return nil
+	}
+	f, err := os.Open(file.FullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// an empty file still needs a request to create it
+	for first := true; first || offset < file.Size; first = false {
+		end := offset + d.ChunkSize
+		if end > file.Size {
+			end = file.Size
+		}
+		start := offset
+		err = retry(d.Retries, d.RetryDelay, func() error {
+			var e error
+			offset, e = d.sendChunk(target, f, file, start, end)
+			return e
+		})
+		if err != nil {
+			return err
+		}
+		if offset <= start && file.Size > 0 {
+			return errors.New("Results server is not accepting " + file.Path)
+		}
+		progress(offset)
+	}
+	return nil
+}
+
+// <URL>/<relative path>, each path segment is escaped separately
+func (d *HTTPDestination) fileURL(relPath string) (string, error) {
+	u, err := url.Parse(d.URL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + relPath
+	return u.String(), nil
+}
+
+// ask the server how much of this version of the file it already has
+func (d *HTTPDestination) queryOffset(target string, sha256 string) (int64, error) {
+	req, err := http.NewRequest("HEAD", target, nil)
+	if err != nil {
+		return 0, permanentError{err}
+	}
+	req.Header.Set("X-Content-Sha256", sha256)
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return 0, nil
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return parseOffset(resp, 0)
+	default:
+		return 0, statusError(resp)
+	}
+}
+
+// send the bytes [start, end) of the file, returns the offset the server now holds
+func (d *HTTPDestination) sendChunk(target string, f *os.File, file File, start int64, end int64) (int64, error) {
+	chunkSum, err := sectionSHA256(f, start, end)
+	if err != nil {
+		return start, permanentError{err}
+	}
+	req, err := http.NewRequest("PUT", target, fileBody(io.NewSectionReader(f, start, end-start), end-start, d.Limiter))
+	if err != nil {
+		return start, permanentError{err}
+	}
+	req.ContentLength = end - start
+	if file.Size == 0 {
+		req.Header.Set("Content-Range", "bytes */0")
+	} else {
+		req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, file.Size))
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Chunk-Sha256", chunkSum)
+	req.Header.Set("X-Content-Sha256", file.SHA256)
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return start, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	// 308 is the conventional "resume incomplete" reply
+	if (resp.StatusCode >= 200 && resp.StatusCode < 300) || resp.StatusCode == http.StatusPermanentRedirect {
+		return parseOffset(resp, end)
+	}
+	if resp.StatusCode == http.StatusConflict && resp.Header.Get("Upload-Offset") != "" {
+		// the server disagrees about where we are, carry on from where it says
+		return parseOffset(resp, start)
+	}
+	return start, statusError(resp)
+}
+
+// read the Upload-Offset header, if there is one
+func parseOffset(resp *http.Response, fallback int64) (int64, error) {
+	header := resp.Header.Get("Upload-Offset")
+	if header == "" {
+		return fallback, nil
+	}
+	offset, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, permanentError{errors.New("Bad Upload-Offset from results server: " + header)}
+	}
+	return offset, nil
+}
+
+// server errors and throttling are worth retrying, anything else is our fault
+func statusError(resp *http.Response) error {
+	err := fmt.Errorf("Results server responded with %s", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return err
+	}
+	return permanentError{err}
+}
+
+// run fn until it succeeds, backing off exponentially between attempts
+func retry(retries int, delay time.Duration, fn func() error) error {
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+		}
+		err = fn()
+		if err == nil {
+			return nil
+		}
+		if _, ok := err.(permanentError); ok {
+			return err
+		}
+	}
+	return err
+}
+
+// a zero length body has to be http.NoBody, otherwise the request is sent chunked
+func fileBody(r io.Reader, size int64, limiter *RateLimiter) io.Reader {
+	if size == 0 {
+		return http.NoBody
+	}
+	return limiter.Reader(r)
+}
+
+func sectionSHA256(f *os.File, start int64, end int64) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, start, end-start)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
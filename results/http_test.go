@@ -0,0 +1,204 @@
+package results
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// a stand-in for the results server, speaks the chunked upload protocol
+type testResultsServer struct {
+	mut   sync.Mutex
+	files map[string][]byte
+	// the checksum of the version of each file being uploaded
+	sums map[string]string
+	// number of PUT requests to fail with a 503 before accepting any
+	failures int
+	puts     int
+}
+
+func newTestResultsServer() *testResultsServer {
+	return &testResultsServer{files: make(map[string][]byte), sums: make(map[string]string)}
+}
+
+func (s *testResultsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	current := s.files[r.URL.Path]
+	switch r.Method {
+	case "HEAD":
+		if sum, ok := s.sums[r.URL.Path]; ok && sum != r.Header.Get("X-Content-Sha256") {
+			// a different version of the file, start again
+			delete(s.files, r.URL.Path)
+			current = nil
+		}
+		if current == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(current)))
+	case "PUT":
+		s.puts++
+		if s.failures > 0 {
+			s.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		sum := sha256.Sum256(body)
+		if hex.EncodeToString(sum[:]) != r.Header.Get("X-Chunk-Sha256") {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var start, end, total int
+		if r.Header.Get("Content-Range") != "bytes */0" {
+			fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+		}
+		if start != len(current) {
+			w.Header().Set("Upload-Offset", strconv.Itoa(len(current)))
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		current = append(current, body...)
+		s.files[r.URL.Path] = current
+		s.sums[r.URL.Path] = r.Header.Get("X-Content-Sha256")
+		if len(current) == total {
+			full := sha256.Sum256(current)
+			if hex.EncodeToString(full[:]) != r.Header.Get("X-Content-Sha256") {
+				w.WriteHeader(http.StatusUnprocessableEntity)
+				return
+			}
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(len(current)))
+		w.WriteHeader(http.StatusPermanentRedirect)
+	}
+}
+
+func writeTestFile(t *testing.T, dir string, name string, contents []byte) File {
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, contents, 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := os.Stat(path)
+	sum := sha256.Sum256(contents)
+	return File{
+		Path:     name,
+		FullPath: path,
+		Size:     int64(len(contents)),
+		SHA256:   hex.EncodeToString(sum[:]),
+		ModTime:  info.ModTime(),
+	}
+}
+
+func TestHTTPUploadInChunks(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	contents := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	file := writeTestFile(t, dir, "out/data.txt", contents)
+	stub := newTestResultsServer()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dest := NewHTTPDestination(server.URL + "/run1")
+	dest.ChunkSize = 10
+	var progress []int64
+	err := dest.Upload(file, func(sent int64) { progress = append(progress, sent) })
+	assert.NoError(err)
+	assert.Equal(contents, stub.files["/run1/out/data.txt"])
+	assert.Equal(4, stub.puts)
+	assert.Equal([]int64{0, 10, 20, 30, 36}, progress)
+}
+
+func TestHTTPUploadRetries(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	contents := []byte("some results")
+	file := writeTestFile(t, dir, "data.txt", contents)
+	stub := newTestResultsServer()
+	stub.failures = 2
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dest := NewHTTPDestination(server.URL)
+	dest.RetryDelay = time.Millisecond
+	assert.NoError(dest.Upload(file, func(int64) {}))
+	assert.Equal(contents, stub.files["/data.txt"])
+
+	// give up once the retries are exhausted
+	stub.failures = 10
+	stub.files = make(map[string][]byte)
+	dest.Retries = 2
+	assert.Error(dest.Upload(file, func(int64) {}))
+}
+
+func TestHTTPUploadResumes(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	contents := []byte("0123456789abcdefghij")
+	file := writeTestFile(t, dir, "data.txt", contents)
+	stub := newTestResultsServer()
+	// the server already has the first half from a previous attempt
+	stub.files["/data.txt"] = contents[:10]
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dest := NewHTTPDestination(server.URL)
+	dest.ChunkSize = 5
+	var progress []int64
+	assert.NoError(dest.Upload(file, func(sent int64) { progress = append(progress, sent) }))
+	assert.Equal(contents, stub.files["/data.txt"])
+	assert.Equal(2, stub.puts)
+	assert.Equal([]int64{10, 15, 20}, progress)
+}
+
+func TestHTTPUploadEmptyFile(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	file := writeTestFile(t, dir, "empty", []byte{})
+	stub := newTestResultsServer()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dest := NewHTTPDestination(server.URL)
+	assert.NoError(dest.Upload(file, func(int64) {}))
+	assert.Equal(1, stub.puts)
+}
+
+func TestHTTPUploadAlreadyComplete(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	contents := []byte("0123456789")
+	file := writeTestFile(t, dir, "data.txt", contents)
+	stub := newTestResultsServer()
+	// the server has the whole file from a previous attempt
+	stub.files["/data.txt"] = contents
+	stub.sums["/data.txt"] = file.SHA256
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	dest := NewHTTPDestination(server.URL)
+	var progress []int64
+	assert.NoError(dest.Upload(file, func(sent int64) { progress = append(progress, sent) }))
+	assert.Equal(contents, stub.files["/data.txt"])
+	assert.Equal(0, stub.puts)
+	assert.Equal([]int64{10}, progress)
+}
@@ -0,0 +1,271 @@
+package results
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// where tar packages are built before being uploaded
+var packageDirectory = "/hpcaas/daemon/packages"
+
+// ManifestFileName is the name of the manifest, both in the results directory and at the root of a tar package
+var ManifestFileName = "manifest.json"
+
+// packaging formats
+const (
+	// PackageNone uploads the files as they are, without a manifest
+	PackageNone = ""
+	// PackageDirectory writes a manifest into the results directory and uploads the files as they are
+	PackageDirectory = "directory"
+	// PackageTar uploads a single tar of the files and manifest
+	PackageTar = "tar"
+	// PackageTarGzip as PackageTar, gzip compressed
+	PackageTarGzip = "tar.gz"
+	// PackageTarZstd as PackageTar, zstd compressed
+	PackageTarZstd = "tar.zst"
+)
+
+// ManifestFile is the entry for a single file in the manifest
+type ManifestFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+	ModTime time.Time `json:"mtime"`
+	// empty for a file that was last changed before the run started, e.g. one left by an earlier run
+	RunID string `json:"runID,omitempty"`
+}
+
+// Manifest lists everything that was produced by a run of the code,
+// along with enough about the run to reproduce it
+type Manifest struct {
+	RunID          string            `json:"runID"`
+	CodeName       string            `json:"codeName"`
+	CodeArguments  []string          `json:"codeArguments"`
+	CodeParameters state.CodeParams  `json:"codeParameters"`
+	CodeStatus     common.CodeStatus `json:"codeStatus"`
+	ExitCode       *int              `json:"exitCode,omitempty"`
+	StartTime      time.Time         `json:"startTime"`
+	EndTime        *time.Time        `json:"endTime,omitempty"`
+	Created        time.Time         `json:"created"`
+	Files          []ManifestFile    `json:"files"`
+}
+
+// NewManifest describes the given files and the current run of the code
+func NewManifest(store state.Store, files []File) Manifest {
+	run, _ := store.GetRunState()
+	codeName, _ := store.GetCodeName()
+	codeArgs, _ := store.GetCodeArguments()
+	codeParams, _ := store.GetTypedCodeParams()
+	codeStatus, _ := store.GetCodeStatus()
+	manifest := Manifest{
+		RunID:          run.ID,
+		CodeName:       codeName,
+		CodeArguments:  codeArgs,
+		CodeParameters: codeParams,
+		CodeStatus:     codeStatus,
+		ExitCode:       run.ExitCode,
+		StartTime:      run.StartTime,
+		EndTime:        run.EndTime,
+		Created:        time.Now(),
+		Files:          []ManifestFile{},
+	}
+	for _, file := range files {
+		entry := ManifestFile{
+			Path:    file.Path,
+			Size:    file.Size,
+			SHA256:  file.SHA256,
+			ModTime: file.ModTime,
+		}
+		if !file.ModTime.Before(run.StartTime) {
+			entry.RunID = run.ID
+		}
+		manifest.Files = append(manifest.Files, entry)
+	}
+	return manifest
+}
+
+// CollectResults returns the files in dir that the rules select as results,
+// an old manifest is never a result
+func CollectResults(dir string, rules Rules) ([]File, error) {
+	files, err := CollectFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+	return rules.Select(withoutManifest(files)), nil
+}
+
+// Package prepares results files, collected from dir, for upload in the given format,
+// returning the files that should be uploaded
+func Package(store state.Store, dir string, files []File, format string) ([]File, error) {
+	switch format {
+	case PackageNone:
+		return files, nil
+	case PackageDirectory:
+		manifest, err := writeManifest(filepath.Join(dir, ManifestFileName), NewManifest(store, files))
+		if err != nil {
+			return nil, err
+		}
+		return append(files, manifest), nil
+	case PackageTar, PackageTarGzip, PackageTarZstd:
+		pkg, err := writeTarPackage(files, NewManifest(store, files), format)
+		if err != nil {
+			return nil, err
+		}
+		return []File{pkg}, nil
+	}
+	return nil, errors.New("Unknown results packaging format: " + format)
+}
+
+func withoutManifest(files []File) []File {
+	var filtered []File
+	for _, file := range files {
+		if file.Path != ManifestFileName {
+			filtered = append(filtered, file)
+		}
+	}
+	return filtered
+}
+
+func writeManifest(path string, manifest Manifest) (File, error) {
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return File{}, err
+	}
+	if err := ioutil.WriteFile(path, manifestBytes, 0644); err != nil {
+		return File{}, err
+	}
+	return fileFromPath(path, ManifestFileName)
+}
+
+// builds <packageDirectory>/results-<run id>.<format>, with the manifest as the first entry
+func writeTarPackage(files []File, manifest Manifest, format string) (File, error) {
+	if err := os.MkdirAll(packageDirectory, 0700); err != nil {
+		return File{}, err
+	}
+	name := "results"
+	if manifest.RunID != "" {
+		name += "-" + manifest.RunID
+	}
+	name += "." + format
+	path := filepath.Join(packageDirectory, name)
+	f, err := os.Create(path)
+	if err != nil {
+		return File{}, err
+	}
+	defer f.Close()
+
+	var compressed io.WriteCloser
+	switch format {
+	case PackageTarGzip:
+		compressed = gzip.NewWriter(f)
+	case PackageTarZstd:
+		compressed, err = zstd.NewWriter(f)
+		if err != nil {
+			return File{}, err
+		}
+	default:
+		compressed = nopWriteCloser{f}
+	}
+	tw := tar.NewWriter(compressed)
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return File{}, err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:     ManifestFileName,
+		Mode:     0644,
+		Size:     int64(len(manifestBytes)),
+		ModTime:  manifest.Created,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return File{}, err
+	}
+	if _, err := tw.Write(manifestBytes); err != nil {
+		return File{}, err
+	}
+	for _, file := range files {
+		if err := addToTar(tw, file); err != nil {
+			return File{}, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return File{}, err
+	}
+	if err := compressed.Close(); err != nil {
+		return File{}, err
+	}
+	if err := f.Close(); err != nil {
+		return File{}, err
+	}
+	return fileFromPath(path, name)
+}
+
+// add a single file, using the size recorded in the manifest
+// so that a file that is still being written can't make the tar disagree with the manifest
+func addToTar(tw *tar.Writer, file File) error {
+	f, err := os.Open(file.FullPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = tw.WriteHeader(&tar.Header{
+		Name:     file.Path,
+		Mode:     0644,
+		Size:     file.Size,
+		ModTime:  file.ModTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, file.Size)
+	return err
+}
+
+func fileFromPath(path string, relPath string) (File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return File{}, err
+	}
+	sum, err := fileSHA256(path)
+	if err != nil {
+		return File{}, err
+	}
+	return File{
+		Path:     relPath,
+		FullPath: path,
+		Size:     info.Size(),
+		SHA256:   sum,
+		ModTime:  info.ModTime(),
+	}, nil
+}
+
+// remove any tar packages once they have been uploaded
+func removePackages(files []File) {
+	for _, file := range files {
+		if filepath.Dir(file.FullPath) == packageDirectory {
+			os.Remove(file.FullPath)
+		}
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
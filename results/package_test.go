@@ -0,0 +1,133 @@
+package results
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// read every entry of a tar into memory
+func readTar(t *testing.T, r io.Reader) map[string][]byte {
+	entries := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, _ := ioutil.ReadAll(tr)
+		entries[header.Name] = contents
+	}
+	return entries
+}
+
+func TestPackageDirectory(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	a := writeTestFile(t, dir, "a.txt", []byte("aaa"))
+	b := writeTestFile(t, dir, "sub/b.txt", []byte("bb"))
+	store.SetCodeName("mycode")
+	store.SetCodeArguments([]string{"-n", "4"})
+	runID := store.StartRun()
+	exitCode := 0
+	store.EndRun(&exitCode)
+	// a was left by an earlier run, b was written by this one
+	run, _ := store.GetRunState()
+	os.Chtimes(a.FullPath, run.StartTime.Add(-time.Hour), run.StartTime.Add(-time.Hour))
+	os.Chtimes(b.FullPath, run.StartTime.Add(time.Second), run.StartTime.Add(time.Second))
+
+	files, err := CollectResults(dir, Rules{})
+	assert.NoError(err)
+	files, err = Package(store, dir, files, PackageDirectory)
+	assert.NoError(err)
+	if !assert.Len(files, 3) {
+		return
+	}
+	assert.Equal(ManifestFileName, files[2].Path)
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(dir, ManifestFileName))
+	assert.NoError(err)
+	var manifest Manifest
+	assert.NoError(json.Unmarshal(manifestBytes, &manifest))
+	assert.Equal(runID, manifest.RunID)
+	assert.Equal("mycode", manifest.CodeName)
+	assert.Equal([]string{"-n", "4"}, manifest.CodeArguments)
+	assert.Equal(0, *manifest.ExitCode)
+	if assert.Len(manifest.Files, 2) {
+		assert.Equal(a.Path, manifest.Files[0].Path)
+		assert.Equal(a.SHA256, manifest.Files[0].SHA256)
+		assert.Empty(manifest.Files[0].RunID)
+		assert.Equal(b.Size, manifest.Files[1].Size)
+		assert.Equal(runID, manifest.Files[1].RunID)
+	}
+
+	// packaging again doesn't list the old manifest
+	files, err = CollectResults(dir, Rules{})
+	assert.NoError(err)
+	files, err = Package(store, dir, files, PackageDirectory)
+	assert.NoError(err)
+	assert.Len(files, 3)
+}
+
+func TestPackageTar(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	defer func(dir string) { packageDirectory = dir }(packageDirectory)
+	packageDirectory, _ = ioutil.TempDir("", "packages")
+	defer os.RemoveAll(packageDirectory)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	writeTestFile(t, dir, "a.txt", []byte("aaa"))
+	writeTestFile(t, dir, "sub/b.txt", []byte("bb"))
+	results, err := CollectResults(dir, Rules{})
+	assert.NoError(err)
+
+	for _, format := range []string{PackageTar, PackageTarGzip, PackageTarZstd} {
+		files, err := Package(store, dir, results, format)
+		if !assert.NoError(err) || !assert.Len(files, 1) {
+			continue
+		}
+		f, err := os.Open(files[0].FullPath)
+		if !assert.NoError(err) {
+			continue
+		}
+		var r io.Reader = f
+		switch format {
+		case PackageTarGzip:
+			r, err = gzip.NewReader(f)
+			assert.NoError(err)
+		case PackageTarZstd:
+			decoder, err := zstd.NewReader(f)
+			assert.NoError(err)
+			r = decoder
+		}
+		entries := readTar(t, r)
+		f.Close()
+		assert.Equal([]byte("aaa"), entries["a.txt"])
+		assert.Equal([]byte("bb"), entries["sub/b.txt"])
+		var manifest Manifest
+		assert.NoError(json.Unmarshal(entries[ManifestFileName], &manifest))
+		assert.Len(manifest.Files, 2)
+		// uploaded packages are cleaned up
+		removePackages(files)
+		_, err = os.Stat(files[0].FullPath)
+		assert.True(os.IsNotExist(err))
+	}
+
+	_, err = Package(store, dir, results, "rar")
+	assert.Error(err)
+}
@@ -0,0 +1,178 @@
+package results
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// where results are copied or moved to once the code has finished, one directory per run
+var collectDirectory = "/hpcaas/daemon/collected"
+
+// collection modes
+const (
+	// CollectInPlace uploads the results from the results directory
+	CollectInPlace = ""
+	// CollectCopy copies the results out of the results directory before upload
+	CollectCopy = "copy"
+	// CollectMove moves the results out of the results directory before upload
+	CollectMove = "move"
+)
+
+// retention policies
+const (
+	// RetainKeep leaves the local results alone once they are uploaded
+	RetainKeep = ""
+	// RetainDelete removes the local results once they are uploaded
+	RetainDelete = "delete"
+)
+
+// CheckRetention returns an error if the results collection and retention settings can't be used together,
+// runs are only kept in the collect directory, so keeping the last N runs needs a collection mode
+func CheckRetention(conf state.DaemonConfiguration) error {
+	if conf.ResultsCollectMode != CollectInPlace && conf.ResultsCollectMode != CollectCopy && conf.ResultsCollectMode != CollectMove {
+		return errors.New("Unknown results collection mode: " + conf.ResultsCollectMode)
+	}
+	if conf.ResultsRetention != RetainKeep && conf.ResultsRetention != RetainDelete {
+		return errors.New("Unknown results retention: " + conf.ResultsRetention)
+	}
+	if conf.ResultsKeepLast < 0 {
+		return errors.New("Bad number of runs to keep: " + strconv.Itoa(conf.ResultsKeepLast))
+	}
+	if conf.ResultsKeepLast > 0 && conf.ResultsCollectMode == CollectInPlace {
+		return errors.New("Keeping the last runs needs the results to be collected, set a collection mode")
+	}
+	return nil
+}
+
+// collectRun copies or moves the files into <collectDirectory>/<run id>, returning that directory and the files within it
+func collectRun(files []File, runID string, mode string) (string, []File, error) {
+	if mode != CollectCopy && mode != CollectMove {
+		return "", nil, errors.New("Unknown results collection mode: " + mode)
+	}
+	if runID == "" {
+		runID = "run"
+	}
+	dir := filepath.Join(collectDirectory, runID)
+	collected := make([]File, 0, len(files))
+	for _, file := range files {
+		dest := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return "", nil, err
+		}
+		var err error
+		if mode == CollectMove {
+			err = moveFile(file.FullPath, dest)
+		} else {
+			err = copyFile(file.FullPath, dest)
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		file.FullPath = dest
+		collected = append(collected, file)
+	}
+	return dir, collected, nil
+}
+
+// rename if possible, falling back to copy and remove when the directories are on different filesystems
+func moveFile(src string, dest string) error {
+	if err := os.Rename(src, dest); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dest); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copy the contents, permissions and modification time of src
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chtimes(dest, info.ModTime(), info.ModTime())
+}
+
+// deleteUploaded removes the local copies of files that have been uploaded,
+// a file is only removed if its contents still match the checksum that was uploaded,
+// directories under dir that are left empty are removed too
+func deleteUploaded(dir string, files []File) error {
+	var firstErr error
+	for _, file := range files {
+		sum, err := fileSHA256(file.FullPath)
+		if err != nil {
+			if !os.IsNotExist(err) && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		// the file has changed since it was uploaded
+		if sum != file.SHA256 {
+			continue
+		}
+		if err := os.Remove(file.FullPath); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		for parent := filepath.Dir(file.FullPath); parent != dir && filepath.Dir(parent) != parent; parent = filepath.Dir(parent) {
+			// fails, and so stops, at the first directory that isn't empty
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+	return firstErr
+}
+
+// pruneCollected removes all but the most recent keep runs from the collect directory
+func pruneCollected(keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(collectDirectory)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var runs []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() {
+			runs = append(runs, entry)
+		}
+	}
+	if len(runs) <= keep {
+		return nil
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ModTime().After(runs[j].ModTime()) })
+	for _, run := range runs[keep:] {
+		if err := os.RemoveAll(filepath.Join(collectDirectory, run.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package results
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectRun(t *testing.T) {
+	assert := assert.New(t)
+	defer func(dir string) { collectDirectory = dir }(collectDirectory)
+	collectDirectory, _ = ioutil.TempDir("", "collected")
+	defer os.RemoveAll(collectDirectory)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	a := writeTestFile(t, dir, "a.txt", []byte("aaa"))
+	b := writeTestFile(t, dir, "sub/b.txt", []byte("bb"))
+
+	runDir, files, err := collectRun([]File{a, b}, "run1", CollectCopy)
+	assert.NoError(err)
+	assert.Equal(filepath.Join(collectDirectory, "run1"), runDir)
+	if assert.Len(files, 2) {
+		assert.Equal(filepath.Join(runDir, "sub", "b.txt"), files[1].FullPath)
+		assert.Equal(b.SHA256, files[1].SHA256)
+	}
+	contents, _ := ioutil.ReadFile(filepath.Join(runDir, "a.txt"))
+	assert.Equal([]byte("aaa"), contents)
+	_, err = os.Stat(a.FullPath)
+	assert.NoError(err)
+
+	_, _, err = collectRun([]File{a, b}, "run2", CollectMove)
+	assert.NoError(err)
+	_, err = os.Stat(a.FullPath)
+	assert.True(os.IsNotExist(err))
+	contents, _ = ioutil.ReadFile(filepath.Join(collectDirectory, "run2", "sub", "b.txt"))
+	assert.Equal([]byte("bb"), contents)
+
+	_, _, err = collectRun(nil, "run3", "teleport")
+	assert.Error(err)
+}
+
+func TestDeleteUploaded(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	a := writeTestFile(t, dir, "deep/sub/a.txt", []byte("aaa"))
+	b := writeTestFile(t, dir, "b.txt", []byte("bb"))
+	// changed after it was uploaded
+	writeTestFile(t, dir, "b.txt", []byte("bbb"))
+
+	assert.NoError(deleteUploaded(dir, []File{a, b}))
+	_, err := os.Stat(a.FullPath)
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "deep"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(b.FullPath)
+	assert.NoError(err)
+	_, err = os.Stat(dir)
+	assert.NoError(err)
+}
+
+func TestPruneCollected(t *testing.T) {
+	assert := assert.New(t)
+	defer func(dir string) { collectDirectory = dir }(collectDirectory)
+	collectDirectory, _ = ioutil.TempDir("", "collected")
+	defer os.RemoveAll(collectDirectory)
+	for i, run := range []string{"oldest", "older", "newest"} {
+		path := filepath.Join(collectDirectory, run)
+		os.Mkdir(path, 0755)
+		when := time.Now().Add(time.Duration(i-3) * time.Hour)
+		os.Chtimes(path, when, when)
+	}
+
+	assert.NoError(pruneCollected(0))
+	remaining, _ := ioutil.ReadDir(collectDirectory)
+	assert.Len(remaining, 3)
+
+	assert.NoError(pruneCollected(2))
+	remaining, _ = ioutil.ReadDir(collectDirectory)
+	if assert.Len(remaining, 2) {
+		assert.Equal("newest", remaining[0].Name())
+		assert.Equal("older", remaining[1].Name())
+	}
+}
+
+func TestUploadResultsRetention(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	defer func(dir string) { collectDirectory = dir }(collectDirectory)
+	collectDirectory, _ = ioutil.TempDir("", "collected")
+	defer os.RemoveAll(collectDirectory)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	runID := store.StartRun()
+	writeTestFile(t, dir, "out.dat", []byte("wanted"))
+	writeTestFile(t, dir, "scratch/huge.dat", []byte("unwanted"))
+	stub := newTestResultsServer()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	store.SetDaemonConfiguration(state.DaemonConfiguration{
+		ResultsDirectory:   dir,
+		ResultsURL:         server.URL,
+		ResultsExclude:     []string{"scratch"},
+		ResultsCollectMode: CollectMove,
+		ResultsRetention:   RetainDelete,
+	})
+
+	assert.NoError(UploadResults(store))
+	assert.Equal([]byte("wanted"), stub.files["/out.dat"])
+	assert.Nil(stub.files["/scratch/huge.dat"])
+	// moved out of the results directory, then deleted once uploaded
+	_, err := os.Stat(filepath.Join(dir, "out.dat"))
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(collectDirectory, runID))
+	assert.True(os.IsNotExist(err))
+	// excluded files are left alone
+	_, err = os.Stat(filepath.Join(dir, "scratch", "huge.dat"))
+	assert.NoError(err)
+}
+
+func TestSyncResultsRules(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	store.StartRun()
+	stub := newTestResultsServer()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	store.SetDaemonConfiguration(state.DaemonConfiguration{
+		ResultsDirectory:   dir,
+		ResultsURL:         server.URL,
+		ResultsInclude:     []string{"*.dat"},
+		ResultsMaxFileSize: 5,
+	})
+	for name, contents := range map[string]string{"a.dat": "small", "b.dat": "too large", "c.log": "log"} {
+		file := writeTestFile(t, dir, name, []byte(contents))
+		ageFile(t, file.FullPath)
+	}
+
+	assert.NoError(SyncResults(store))
+	assert.Equal([]byte("small"), stub.files["/a.dat"])
+	assert.Len(stub.files, 1)
+}
+
+func TestCheckRetention(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(CheckRetention(state.DaemonConfiguration{}))
+	assert.NoError(CheckRetention(state.DaemonConfiguration{ResultsCollectMode: CollectCopy, ResultsKeepLast: 3}))
+	assert.NoError(CheckRetention(state.DaemonConfiguration{ResultsRetention: RetainDelete}))
+	// runs are only kept when they are collected
+	assert.Error(CheckRetention(state.DaemonConfiguration{ResultsKeepLast: 3}))
+	assert.Error(CheckRetention(state.DaemonConfiguration{ResultsCollectMode: CollectMove, ResultsKeepLast: -1}))
+	assert.Error(CheckRetention(state.DaemonConfiguration{ResultsCollectMode: "link"}))
+	assert.Error(CheckRetention(state.DaemonConfiguration{ResultsRetention: "archive"}))
+}
@@ -0,0 +1,109 @@
+package results
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// Rules decide which of the files in the results directory are actually results
+type Rules struct {
+	// glob patterns, if any are given a file must match one of them
+	Include []string
+	// glob patterns, a file that matches any of them is never a result
+	Exclude []string
+	// files larger than this many bytes are left behind, 0 for no limit
+	MaxFileSize int64
+}
+
+// RulesFromConfig returns the rules set in the daemon configuration
+func RulesFromConfig(conf state.DaemonConfiguration) Rules {
+	return Rules{
+		Include:     conf.ResultsInclude,
+		Exclude:     conf.ResultsExclude,
+		MaxFileSize: conf.ResultsMaxFileSize,
+	}
+}
+
+// Validate checks that every pattern is well formed
+func (r Rules) Validate() error {
+	for _, pattern := range append(append([]string{}, r.Include...), r.Exclude...) {
+		for _, segment := range strings.Split(pattern, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return errors.New("Bad results pattern: " + pattern)
+			}
+		}
+	}
+	return nil
+}
+
+// Allows reports whether the file is a result
+func (r Rules) Allows(file File) bool {
+	if r.MaxFileSize > 0 && file.Size > r.MaxFileSize {
+		return false
+	}
+	for _, pattern := range r.Exclude {
+		if matchGlob(pattern, file.Path) {
+			return false
+		}
+	}
+	if len(r.Include) == 0 {
+		return true
+	}
+	for _, pattern := range r.Include {
+		if matchGlob(pattern, file.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Select returns the files that are results
+func (r Rules) Select(files []File) []File {
+	var selected []File
+	for _, file := range files {
+		if r.Allows(file) {
+			selected = append(selected, file)
+		}
+	}
+	return selected
+}
+
+// matchGlob matches a slash separated path against a pattern,
+// a pattern without a slash matches any single component of the path, so "*.tmp" or "scratch" work at any depth,
+// otherwise the pattern is anchored at the top of the results directory and "**" matches any number of directories
+func matchGlob(pattern string, name string) bool {
+	names := strings.Split(name, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, n := range names {
+			if ok, _ := path.Match(pattern, n); ok {
+				return true
+			}
+		}
+		return false
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), names)
+}
+
+func matchSegments(pattern []string, names []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if matchSegments(pattern[1:], names[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(names) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], names[0]); !ok {
+			return false
+		}
+		pattern, names = pattern[1:], names[1:]
+	}
+	return len(names) == 0
+}
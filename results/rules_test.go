@@ -0,0 +1,64 @@
+package results
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	assert := assert.New(t)
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"*.dat", "out.dat", true},
+		{"*.dat", "deep/down/out.dat", true},
+		{"*.dat", "out.txt", false},
+		{"scratch", "scratch/huge.bin", true},
+		{"scratch", "a/scratch/huge.bin", true},
+		{"scratch", "scratchy.txt", false},
+		{"out/*.dat", "out/a.dat", true},
+		{"out/*.dat", "out/sub/a.dat", false},
+		{"out/*.dat", "other/out/a.dat", false},
+		{"/out/*.dat", "out/a.dat", true},
+		{"out/**/*.dat", "out/a.dat", true},
+		{"out/**/*.dat", "out/sub/deeper/a.dat", true},
+		{"**/checkpoint-*", "a/b/checkpoint-10", true},
+		{"out/**", "out/anything/at/all", true},
+		{"out/**", "elsewhere/file", false},
+	}
+	for _, c := range cases {
+		assert.Equal(c.match, matchGlob(c.pattern, c.name), c.pattern+" "+c.name)
+	}
+}
+
+func TestRules(t *testing.T) {
+	assert := assert.New(t)
+	files := []File{
+		{Path: "out.dat", Size: 10},
+		{Path: "big.dat", Size: 1000},
+		{Path: "log.txt", Size: 10},
+		{Path: "scratch/tmp.dat", Size: 10},
+	}
+	assert.Equal(files, Rules{}.Select(files))
+
+	rules := Rules{
+		Include:     []string{"*.dat"},
+		Exclude:     []string{"scratch"},
+		MaxFileSize: 100,
+	}
+	assert.Equal([]File{files[0]}, rules.Select(files))
+
+	// exclusions win over inclusions
+	rules = Rules{Include: []string{"*.dat"}, Exclude: []string{"out.*"}}
+	assert.Equal([]File{files[1], files[3]}, rules.Select(files))
+}
+
+func TestRulesValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(Rules{Include: []string{"out/**/*.dat"}, Exclude: []string{"[a-z]*"}}.Validate())
+	assert.Error(Rules{Include: []string{"out/[a-"}}.Validate())
+	assert.Error(Rules{Exclude: []string{"\\"}}.Validate())
+}
@@ -0,0 +1,344 @@
+package results
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var defaultS3PartSize int64 = 16 * 1024 * 1024
+
+// s3 won't accept parts smaller than this, other than the last
+var minS3PartSize int64 = 5 * 1024 * 1024
+var defaultS3Concurrency = 4
+
+// S3Destination uploads results files to an s3 compatible object store
+//
+// files are stored at <Endpoint>/<Bucket>/<Prefix>/<relative path>, using path style addressing.
+// Files larger than PartSize are sent as multipart uploads with up to Concurrency parts in flight at once.
+// If a presigned url has been supplied for a file it is used instead, with a single PUT.
+type S3Destination struct {
+	Endpoint      string
+	Bucket        string
+	Prefix        string
+	Region        string
+	AccessKey     string
+	SecretKey     string
+	SessionToken  string
+	PresignedURLs map[string]string
+	PartSize      int64
+	Concurrency   int
+	Client        *http.Client
+	Retries       int
+	RetryDelay    time.Duration
+	// limits how fast files are sent, nil for no limit
+	Limiter *RateLimiter
+	// used to sign requests, can be replaced in tests
+	now func() time.Time
+}
+
+// NewS3Destination returns an s3 destination with the default part size, concurrency and retry behaviour
+func NewS3Destination(endpoint string, bucket string, prefix string, region string) *S3Destination {
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &S3Destination{
+		Endpoint:    endpoint,
+		Bucket:      bucket,
+		Prefix:      prefix,
+		Region:      region,
+		PartSize:    defaultS3PartSize,
+		Concurrency: defaultS3Concurrency,
+		Client:      http.DefaultClient,
+		Retries:     defaultRetries,
+		RetryDelay:  defaultRetryDelay,
+		now:         time.Now,
+	}
+}
+
+// Upload sends the file to the object store
+func (d *S3Destination) Upload(file File, progress func(sent int64)) error {
+	progress(0)
+	if presigned, ok := d.PresignedURLs[file.Path]; ok {
+		err := retry(d.Retries, d.RetryDelay, func() error {
+			return d.putPresigned(presigned, file)
+		})
+		if err != nil {
+			return err
+		}
+	} else if d.Bucket == "" {
+		return errors.New("No bucket or presigned url for " + file.Path)
+	} else if file.Size <= d.partSize() {
+		err := retry(d.Retries, d.RetryDelay, func() error {
+			return d.putObject(file)
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := d.multipartUpload(file, progress); err != nil {
+			return err
+		}
+	}
+	progress(file.Size)
+	return nil
+}
+
+func (d *S3Destination) partSize() int64 {
+	if d.PartSize < minS3PartSize {
+		return minS3PartSize
+	}
+	return d.PartSize
+}
+
+// the key of the object within the bucket
+func (d *S3Destination) objectKey(relPath string) string {
+	return strings.TrimPrefix(path.Join(d.Prefix, relPath), "/")
+}
+
+// <Endpoint>/<Bucket>/<key>?<query>
+func (d *S3Destination) objectURL(key string, query url.Values) (*url.URL, error) {
+	u, err := url.Parse(d.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + d.Bucket + "/" + key
+	// make sure what goes over the wire is exactly what is signed
+	u.RawPath = canonicalURI(u)
+	u.RawQuery = canonicalQuery(query)
+	return u, nil
+}
+
+// make a signed request and return the response body, non 2xx responses are errors
+func (d *S3Destination) do(method string, key string, query url.Values, body io.Reader, length int64, payloadSHA256 string) (http.Header, []byte, error) {
+	u, err := d.objectURL(key, query)
+	if err != nil {
+		return nil, nil, permanentError{err}
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, nil, permanentError{err}
+	}
+	req.ContentLength = length
+	creds := s3Credentials{
+		AccessKey:    d.AccessKey,
+		SecretKey:    d.SecretKey,
+		SessionToken: d.SessionToken,
+		Region:       d.Region,
+	}
+	creds.sign(req, payloadSHA256, d.now())
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, nil, statusError(resp)
+	}
+	return resp.Header, respBody, nil
+}
+
+// single request upload of a whole file
+// the file checksum is signed, so the object store will reject a corrupted upload
+func (d *S3Destination) putObject(file File) error {
+	f, err := os.Open(file.FullPath)
+	if err != nil {
+		return permanentError{err}
+	}
+	defer f.Close()
+	_, _, err = d.do("PUT", d.objectKey(file.Path), nil, fileBody(f, file.Size, d.Limiter), file.Size, file.SHA256)
+	return err
+}
+
+// upload with a url that has been signed by someone else
+func (d *S3Destination) putPresigned(presigned string, file File) error {
+	f, err := os.Open(file.FullPath)
+	if err != nil {
+		return permanentError{err}
+	}
+	defer f.Close()
+	req, err := http.NewRequest("PUT", presigned, fileBody(f, file.Size, d.Limiter))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.ContentLength = file.Size
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return statusError(resp)
+	}
+	return nil
+}
+
+type initiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+// split the file into parts and send them in parallel
+// if anything goes wrong the multipart upload is aborted so that the parts don't linger
+func (d *S3Destination) multipartUpload(file File, progress func(sent int64)) error {
+	key := d.objectKey(file.Path)
+	var uploadID string
+	err := retry(d.Retries, d.RetryDelay, func() error {
+		_, body, err := d.do("POST", key, url.Values{"uploads": {""}}, nil, 0, emptyPayloadSHA256)
+		if err != nil {
+			return err
+		}
+		var result initiateMultipartUploadResult
+		if err := xml.Unmarshal(body, &result); err != nil || result.UploadID == "" {
+			return permanentError{errors.New("Couldn't read multipart upload id from object store")}
+		}
+		uploadID = result.UploadID
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	parts, err := d.uploadParts(file, key, uploadID, progress)
+	if err != nil {
+		d.abortMultipartUpload(key, uploadID)
+		return err
+	}
+	completeBody, err := xml.Marshal(completeMultipartUpload{Parts: parts})
+	if err != nil {
+		d.abortMultipartUpload(key, uploadID)
+		return err
+	}
+	err = retry(d.Retries, d.RetryDelay, func() error {
+		_, body, err := d.do("POST", key, url.Values{"uploadId": {uploadID}},
+			bytes.NewReader(completeBody), int64(len(completeBody)), hexSHA256(completeBody))
+		if err != nil {
+			return err
+		}
+		// s3 can report a failure to complete with a 200 and an error document
+		if bytes.Contains(body, []byte("<Error>")) {
+			return errors.New("Object store failed to complete multipart upload of " + file.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		d.abortMultipartUpload(key, uploadID)
+	}
+	return err
+}
+
+// send every part of the file, Concurrency parts at a time
+func (d *S3Destination) uploadParts(file File, key string, uploadID string, progress func(sent int64)) ([]completedPart, error) {
+	f, err := os.Open(file.FullPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	partSize := d.partSize()
+	numParts := int((file.Size + partSize - 1) / partSize)
+	concurrency := d.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	partNumbers := make(chan int)
+	var mut sync.Mutex
+	var parts []completedPart
+	var firstErr error
+	var sent int64
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for partNumber := range partNumbers {
+				start := int64(partNumber-1) * partSize
+				end := start + partSize
+				if end > file.Size {
+					end = file.Size
+				}
+				etag, err := d.uploadPart(f, key, uploadID, partNumber, start, end)
+				mut.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				if err == nil {
+					parts = append(parts, completedPart{PartNumber: partNumber, ETag: etag})
+					sent += end - start
+					progress(sent)
+				}
+				mut.Unlock()
+			}
+		}()
+	}
+	for partNumber := 1; partNumber <= numParts; partNumber++ {
+		mut.Lock()
+		failed := firstErr != nil
+		mut.Unlock()
+		if failed {
+			break
+		}
+		partNumbers <- partNumber
+	}
+	close(partNumbers)
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return parts, nil
+}
+
+func (d *S3Destination) uploadPart(f *os.File, key string, uploadID string, partNumber int, start int64, end int64) (string, error) {
+	partSum, err := sectionSHA256(f, start, end)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{
+		"partNumber": {strconv.Itoa(partNumber)},
+		"uploadId":   {uploadID},
+	}
+	var etag string
+	err = retry(d.Retries, d.RetryDelay, func() error {
+		header, _, err := d.do("PUT", key, query, fileBody(io.NewSectionReader(f, start, end-start), end-start, d.Limiter), end-start, partSum)
+		if err != nil {
+			return err
+		}
+		etag = header.Get("ETag")
+		if etag == "" {
+			return permanentError{fmt.Errorf("Object store returned no ETag for part %d", partNumber)}
+		}
+		return nil
+	})
+	return etag, err
+}
+
+// best effort, the object store will eventually clean up after itself anyway
+func (d *S3Destination) abortMultipartUpload(key string, uploadID string) {
+	d.do("DELETE", key, url.Values{"uploadId": {uploadID}}, nil, 0, emptyPayloadSHA256)
+}
@@ -0,0 +1,225 @@
+package results
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// how often SyncWhileRunning checks whether a sync is due
+var syncPollInterval = 1 * time.Second
+var defaultSyncSettle = 5 * time.Second
+
+// SyncWhileRunning uploads new and changed results whilst the code is running,
+// either every resultsSyncInterval seconds or, with resultsSyncOnChange, whenever the results directory changes.
+// This is intended to be started from main as a goroutine, it never returns
+func SyncWhileRunning(store state.Store) {
+	var lastSync time.Time
+	var watcher *changeWatcher
+	// the last watch error, so that a failure is only logged once rather than every poll
+	var watchErr string
+	for {
+		time.Sleep(syncPollInterval)
+		conf, _ := store.GetDaemonConfiguration()
+		codeStatus, ok := store.GetCodeStatus()
+		running := ok && codeStatus == common.CodeRunningStatus
+		if !running || (conf.ResultsSyncInterval <= 0 && !conf.ResultsSyncOnChange) {
+			if watcher != nil {
+				watcher.Close()
+				watcher = nil
+			}
+			watchErr = ""
+			continue
+		}
+		if conf.ResultsSyncOnChange && watcher == nil {
+			var err error
+			watcher, err = newChangeWatcher(ResultsDirectory(store))
+			if err != nil && err.Error() != watchErr {
+				watchErr = err.Error()
+				log.Println("Couldn't watch results directory: " + watchErr)
+			}
+		}
+		due := conf.ResultsSyncInterval > 0 &&
+			time.Since(lastSync) >= time.Duration(conf.ResultsSyncInterval)*time.Second
+		if watcher != nil && watcher.settled(syncSettle(conf)) {
+			due = true
+		}
+		if !due {
+			continue
+		}
+		lastSync = time.Now()
+		if err := SyncResults(store); err != nil {
+			log.Println("Results sync failed: " + err.Error())
+		}
+	}
+}
+
+func syncSettle(conf state.DaemonConfiguration) time.Duration {
+	if conf.ResultsSyncSettle > 0 {
+		return time.Duration(conf.ResultsSyncSettle) * time.Second
+	}
+	return defaultSyncSettle
+}
+
+// SyncResults uploads every results file that hasn't been synced already, or has changed since it was.
+// Only files selected by the include and exclude rules are synced.
+// Files that have been modified within the settle period are left for next time as they are probably still being written.
+// Uploads are limited to resultsSyncBandwidth.
+func SyncResults(store state.Store) error {
+	uploadMut.Lock()
+	defer uploadMut.Unlock()
+	conf, _ := store.GetDaemonConfiguration()
+	dest, err := destinationFromConfig(conf, NewRateLimiter(conf.ResultsSyncBandwidth))
+	if err != nil {
+		return err
+	}
+	if dest == nil {
+		return nil
+	}
+	files, err := CollectResults(ResultsDirectory(store), RulesFromConfig(conf))
+	if err != nil {
+		return err
+	}
+	settle := syncSettle(conf)
+	var firstErr error
+	for _, file := range unsyncedFiles(store, files) {
+		if time.Since(file.ModTime) < settle {
+			continue
+		}
+		if err := syncFile(store, dest, file); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// filter out files that have already been synced with the same contents
+func unsyncedFiles(store state.Store, files []File) []File {
+	results, _ := store.GetResultsState()
+	var unsynced []File
+	for _, file := range files {
+		synced, ok := results.Files[file.Path]
+		if ok && synced.Status == state.FileSyncedStatus && synced.SHA256 == file.SHA256 {
+			continue
+		}
+		unsynced = append(unsynced, file)
+	}
+	return unsynced
+}
+
+// upload a single file, recording its sync state as it goes
+func syncFile(store state.Store, dest Destination, file File) error {
+	store.SetResultFileSync(file.Path, state.FileSyncState{
+		Status: state.FileSyncingStatus,
+		SHA256: file.SHA256,
+		Size:   file.Size,
+	})
+	if err := dest.Upload(file, func(int64) {}); err != nil {
+		store.SetResultFileSync(file.Path, state.FileSyncState{
+			Status: state.FileSyncErrorStatus,
+			SHA256: file.SHA256,
+			Size:   file.Size,
+			Error:  err.Error(),
+		})
+		return err
+	}
+	markSynced(store, file)
+	return nil
+}
+
+func markSynced(store state.Store, file File) {
+	now := time.Now()
+	store.SetResultFileSync(file.Path, state.FileSyncState{
+		Status:   state.FileSyncedStatus,
+		SHA256:   file.SHA256,
+		Size:     file.Size,
+		SyncedAt: &now,
+	})
+}
+
+// changeWatcher uses inotify to notice changes anywhere under a directory
+type changeWatcher struct {
+	watcher *fsnotify.Watcher
+	mut     sync.Mutex
+	dirty   bool
+	// time of the most recent change
+	last time.Time
+}
+
+func newChangeWatcher(dir string) (*changeWatcher, error) {
+	// the code may not have written any results yet
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	cw := &changeWatcher{watcher: w}
+	if err := cw.addRecursive(dir); err != nil {
+		w.Close()
+		return nil, err
+	}
+	go cw.run()
+	return cw, nil
+}
+
+// inotify isn't recursive, every directory has to be watched separately
+func (cw *changeWatcher) addRecursive(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return cw.watcher.Add(path)
+		}
+		return nil
+	})
+}
+
+func (cw *changeWatcher) run() {
+	for {
+		select {
+		case event, ok := <-cw.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Stat(event.Name); err == nil && info.IsDir() {
+					cw.addRecursive(event.Name)
+				}
+			}
+			cw.mut.Lock()
+			cw.dirty = true
+			cw.last = time.Now()
+			cw.mut.Unlock()
+		case err, ok := <-cw.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Results directory watcher: " + err.Error())
+		}
+	}
+}
+
+// reports whether there have been changes, followed by a quiet period of at least settle,
+// resetting the changes if so
+func (cw *changeWatcher) settled(settle time.Duration) bool {
+	cw.mut.Lock()
+	defer cw.mut.Unlock()
+	if cw.dirty && time.Since(cw.last) >= settle {
+		cw.dirty = false
+		return true
+	}
+	return false
+}
+
+func (cw *changeWatcher) Close() error {
+	return cw.watcher.Close()
+}
@@ -0,0 +1,162 @@
+package results
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// pretend the file was written a while ago, so that it has settled
+func ageFile(t *testing.T, path string) {
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncResults(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	store.StartRun()
+	stub := newTestResultsServer()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	store.SetDaemonConfiguration(state.DaemonConfiguration{
+		ResultsDirectory: dir,
+		ResultsURL:       server.URL,
+	})
+
+	done := writeTestFile(t, dir, "step1.dat", []byte("step one"))
+	ageFile(t, done.FullPath)
+	// still being written, so it is left for next time
+	writeTestFile(t, dir, "step2.dat", []byte("step tw"))
+	assert.NoError(SyncResults(store))
+	assert.Equal([]byte("step one"), stub.files["/step1.dat"])
+	assert.Nil(stub.files["/step2.dat"])
+	results, _ := store.GetResultsState()
+	assert.Equal(state.FileSyncedStatus, results.Files["step1.dat"].Status)
+	assert.Equal(done.SHA256, results.Files["step1.dat"].SHA256)
+	_, ok := results.Files["step2.dat"]
+	assert.False(ok)
+
+	// unchanged files aren't sent again
+	puts := stub.puts
+	ageFile(t, filepath.Join(dir, "step2.dat"))
+	assert.NoError(SyncResults(store))
+	assert.Equal(puts+1, stub.puts)
+	assert.Equal([]byte("step tw"), stub.files["/step2.dat"])
+
+	// changed files are
+	writeTestFile(t, dir, "step2.dat", []byte("step two"))
+	ageFile(t, filepath.Join(dir, "step2.dat"))
+	assert.NoError(SyncResults(store))
+	assert.Equal([]byte("step two"), stub.files["/step2.dat"])
+
+	// the final upload only sends what hasn't been synced
+	puts = stub.puts
+	writeTestFile(t, dir, "final.dat", []byte("final"))
+	assert.NoError(UploadResults(store))
+	assert.Equal(puts+1, stub.puts)
+	assert.Equal([]byte("final"), stub.files["/final.dat"])
+}
+
+func TestSyncResultsError(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	store.StartRun()
+	stub := newTestResultsServer()
+	stub.failures = 100
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	store.SetDaemonConfiguration(state.DaemonConfiguration{
+		ResultsDirectory:     dir,
+		ResultsURL:           server.URL,
+		ResultsUploadRetries: 1,
+	})
+	file := writeTestFile(t, dir, "data.dat", []byte("data"))
+	ageFile(t, file.FullPath)
+	assert.Error(SyncResults(store))
+	results, _ := store.GetResultsState()
+	assert.Equal(state.FileSyncErrorStatus, results.Files["data.dat"].Status)
+	assert.NotEmpty(results.Files["data.dat"].Error)
+}
+
+func TestChangeWatcher(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	watcher, err := newChangeWatcher(dir)
+	if !assert.NoError(err) {
+		return
+	}
+	defer watcher.Close()
+	assert.False(watcher.settled(0))
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	time.Sleep(50 * time.Millisecond)
+	assert.True(watcher.settled(0))
+	// new directories are watched too
+	ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("x"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(watcher.settled(time.Hour))
+	assert.True(watcher.settled(0))
+}
+
+func TestChangeWatcherMissingDirectory(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	missing := filepath.Join(dir, "results")
+	watcher, err := newChangeWatcher(missing)
+	if !assert.NoError(err) {
+		return
+	}
+	defer watcher.Close()
+	info, err := os.Stat(missing)
+	assert.NoError(err)
+	assert.True(info.IsDir())
+	ioutil.WriteFile(filepath.Join(missing, "file"), []byte("x"), 0644)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(watcher.settled(time.Hour))
+}
+
+func TestRateLimiter(t *testing.T) {
+	assert := assert.New(t)
+	assert.Nil(NewRateLimiter(0))
+
+	limiter := NewRateLimiter(100 * 1024)
+	start := time.Now()
+	n, err := ioutil.ReadAll(limiter.Reader(&zeroReader{remaining: 20 * 1024}))
+	assert.NoError(err)
+	assert.Len(n, 20*1024)
+	// 20KiB at 100KiB/s should take roughly 200ms
+	assert.True(time.Since(start) >= 150*time.Millisecond)
+}
+
+type zeroReader struct {
+	remaining int
+}
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	if z.remaining == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > z.remaining {
+		p = p[:z.remaining]
+	}
+	for i := range p {
+		p[i] = 0
+	}
+	z.remaining -= len(p)
+	return len(p), nil
+}
@@ -0,0 +1,65 @@
+package results
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// largest read made before waiting on the limiter, keeps the rate smooth
+var throttleReadSize = 32 * 1024
+
+// RateLimiter limits the rate that bytes are read, shared between every reader that uses it
+// a nil RateLimiter doesn't limit anything
+type RateLimiter struct {
+	bytesPerSecond int64
+	mut            sync.Mutex
+	// when the bytes read so far will have been "paid for"
+	next time.Time
+}
+
+// NewRateLimiter returns a limiter for the given rate, or nil if the rate is zero or less
+func NewRateLimiter(bytesPerSecond int64) *RateLimiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &RateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// block until n more bytes can be read without exceeding the rate
+func (l *RateLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mut.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.mut.Unlock()
+	time.Sleep(delay)
+}
+
+// Reader wraps r so that reads from it are limited
+func (l *RateLimiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &throttledReader{r: r, limiter: l}
+}
+
+type throttledReader struct {
+	r       io.Reader
+	limiter *RateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleReadSize {
+		p = p[:throttleReadSize]
+	}
+	n, err := t.r.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
@@ -0,0 +1,162 @@
+package results
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+var defaultResultsDirectory = "/hpcaas/results"
+
+// Destination is somewhere that the results can be uploaded to
+type Destination interface {
+	// Upload sends a single file, calling progress with the number of bytes of the file sent so far
+	Upload(file File, progress func(sent int64)) error
+}
+
+// pick the destination for the results from the daemon configuration
+// returns nil if no destination has been configured
+func destinationFromConfig(conf state.DaemonConfiguration, limiter *RateLimiter) (Destination, error) {
+	if conf.ResultsS3Bucket != "" || len(conf.ResultsS3PresignedURLs) > 0 {
+		endpoint := conf.ResultsS3Endpoint
+		if endpoint == "" {
+			if conf.ResultsS3Region == "" {
+				endpoint = "https://s3.amazonaws.com"
+			} else {
+				endpoint = "https://s3." + conf.ResultsS3Region + ".amazonaws.com"
+			}
+		}
+		dest := NewS3Destination(endpoint, conf.ResultsS3Bucket, conf.ResultsS3Prefix, conf.ResultsS3Region)
+		dest.AccessKey = conf.ResultsS3AccessKey
+		dest.SecretKey = conf.ResultsS3SecretKey
+		dest.SessionToken = conf.ResultsS3SessionToken
+		dest.PresignedURLs = conf.ResultsS3PresignedURLs
+		dest.Limiter = limiter
+		if conf.ResultsS3PartSize > 0 {
+			dest.PartSize = conf.ResultsS3PartSize
+		}
+		if conf.ResultsS3Concurrency > 0 {
+			dest.Concurrency = conf.ResultsS3Concurrency
+		}
+		if conf.ResultsUploadRetries > 0 {
+			dest.Retries = conf.ResultsUploadRetries
+		}
+		return dest, nil
+	}
+	if conf.ResultsURL != "" {
+		dest := NewHTTPDestination(conf.ResultsURL)
+		dest.Limiter = limiter
+		if conf.ResultsUploadChunkSize > 0 {
+			dest.ChunkSize = conf.ResultsUploadChunkSize
+		}
+		if conf.ResultsUploadRetries > 0 {
+			dest.Retries = conf.ResultsUploadRetries
+		}
+		return dest, nil
+	}
+	return nil, nil
+}
+
+// ResultsDirectory returns where the results of the code are collected from
+func ResultsDirectory(store state.Store) string {
+	if conf, ok := store.GetDaemonConfiguration(); ok && conf.ResultsDirectory != "" {
+		return conf.ResultsDirectory
+	}
+	return defaultResultsDirectory
+}
+
+var uploadMut = sync.Mutex{}
+
+// UploadResults sends the results to the configured destination, updating the result state as it goes,
+// then applies the retention policy
+// the results are copied or moved out of the results directory first if the configuration says so
+// nothing is uploaded if there is no destination configured
+func UploadResults(store state.Store) error {
+	uploadMut.Lock()
+	defer uploadMut.Unlock()
+	conf, _ := store.GetDaemonConfiguration()
+	dest, err := destinationFromConfig(conf, nil)
+	if err != nil {
+		store.SetResultError(err)
+		return err
+	}
+	dir := ResultsDirectory(store)
+	files, err := CollectResults(dir, RulesFromConfig(conf))
+	if err != nil {
+		store.SetResultError(err)
+		return err
+	}
+	if conf.ResultsCollectMode != CollectInPlace {
+		run, _ := store.GetRunState()
+		dir, files, err = collectRun(files, run.ID, conf.ResultsCollectMode)
+		if err != nil {
+			store.SetResultError(err)
+			return err
+		}
+	}
+	if dest != nil {
+		if err := uploadTo(store, dest, dir, files, conf.ResultsPackaging); err != nil {
+			return err
+		}
+		if conf.ResultsRetention == RetainDelete {
+			if err := deleteUploaded(dir, files); err != nil {
+				return err
+			}
+			os.Remove(filepath.Join(dir, ManifestFileName))
+			if dir != ResultsDirectory(store) {
+				// only removed if everything in it has gone
+				os.Remove(dir)
+			}
+		}
+	}
+	return pruneCollected(conf.ResultsKeepLast)
+}
+
+func uploadTo(store state.Store, dest Destination, dir string, files []File, packaging string) error {
+	if err := store.SetResultStatus(state.ResultUploadingStatus, "upload started"); err != nil {
+		return err
+	}
+	files, err := Package(store, dir, files, packaging)
+	if err != nil {
+		store.SetResultError(err)
+		return err
+	}
+	if packaging == PackageNone || packaging == PackageDirectory {
+		// anything synced whilst the code was running doesn't need sending again
+		files = unsyncedFiles(store, files)
+	}
+	var total int64
+	for _, file := range files {
+		total += file.Size
+	}
+	var sent int64
+	store.SetResultProgress("", sent, total)
+	for _, file := range files {
+		err := dest.Upload(file, func(n int64) {
+			store.SetResultProgress(file.Path, sent+n, total)
+		})
+		if err != nil {
+			store.SetResultError(err)
+			return err
+		}
+		markSynced(store, file)
+		sent += file.Size
+	}
+	removePackages(files)
+	store.SetResultProgress("", sent, total)
+	store.SetResultStatus(state.ResultStoppedStatus, "upload finished")
+	return nil
+}
+
+// OnCodeExit returns a container exit hook that uploads the results once the code has finished
+func OnCodeExit(store state.Store) func(common.CodeStatus) {
+	return func(codeStatus common.CodeStatus) {
+		if err := UploadResults(store); err != nil {
+			log.Println("Results upload failed: " + err.Error())
+		}
+	}
+}
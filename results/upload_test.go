@@ -0,0 +1,88 @@
+package results
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollectFiles(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	b := writeTestFile(t, dir, "b.txt", []byte("bbb"))
+	a := writeTestFile(t, dir, "sub/a.txt", []byte("a"))
+	files, err := CollectFiles(dir)
+	assert.NoError(err)
+	assert.Equal([]File{b, a}, files)
+}
+
+func TestUploadResults(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	store.StartRun()
+	writeTestFile(t, dir, "one.txt", []byte("first file"))
+	writeTestFile(t, dir, "nested/two.txt", []byte("second file"))
+	stub := newTestResultsServer()
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	store.SetDaemonConfiguration(state.DaemonConfiguration{
+		ResultsDirectory:       dir,
+		ResultsURL:             server.URL + "/results",
+		ResultsUploadChunkSize: 4,
+	})
+	assert.NoError(UploadResults(store))
+	assert.Equal([]byte("first file"), stub.files["/results/one.txt"])
+	assert.Equal([]byte("second file"), stub.files["/results/nested/two.txt"])
+	results, ok := store.GetResultsState()
+	assert.True(ok)
+	assert.Equal(state.ResultStoppedStatus, results.Status)
+	assert.Equal(int64(21), results.BytesSent)
+	assert.Equal(int64(21), results.BytesTotal)
+}
+
+func TestUploadResultsError(t *testing.T) {
+	assert := assert.New(t)
+	store := state.NewStore(state.NewMemoryBackend())
+	dir, _ := ioutil.TempDir("", "results")
+	defer os.RemoveAll(dir)
+	store.StartRun()
+	writeTestFile(t, dir, "one.txt", []byte("first file"))
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	store.SetDaemonConfiguration(state.DaemonConfiguration{
+		ResultsDirectory: dir,
+		ResultsURL:       server.URL,
+	})
+	assert.Error(UploadResults(store))
+	results, _ := store.GetResultsState()
+	assert.Equal(state.ResultErrorStatus, results.Status)
+	assert.NotEmpty(results.Error)
+}
+
+func TestDestinationFromConfig(t *testing.T) {
+	assert := assert.New(t)
+	dest, err := destinationFromConfig(state.DaemonConfiguration{}, nil)
+	assert.NoError(err)
+	assert.Nil(dest)
+	dest, _ = destinationFromConfig(state.DaemonConfiguration{ResultsURL: "https://example.com"}, nil)
+	assert.IsType(&HTTPDestination{}, dest)
+	// s3 takes priority over a plain url
+	dest, _ = destinationFromConfig(state.DaemonConfiguration{
+		ResultsURL:      "https://example.com",
+		ResultsS3Bucket: "bucket",
+		ResultsS3Region: "ap-southeast-2",
+	}, nil)
+	if assert.IsType(&S3Destination{}, dest) {
+		assert.Equal("https://s3.ap-southeast-2.amazonaws.com", dest.(*S3Destination).Endpoint)
+	}
+}
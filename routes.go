@@ -6,9 +6,10 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/mrmagooey/hpcaas-container-daemon/api/apiV1"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
 )
 
-func registerRoutes() *mux.Router {
+func registerRoutes(store state.Store) *mux.Router {
 	r := mux.NewRouter()
 
 	r.Methods("GET").Path("/").HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -24,12 +25,49 @@ func registerRoutes() *mux.Router {
 	// version1Subroute.Methods("POST").Path("/command/").HandlerFunc(apiV1.Command())
 
 	// update any state variable
-	version1Subroute.Methods("POST").Path("/update/").HandlerFunc(apiV1.Update)
+	version1Subroute.Methods("POST").Path("/update/").HandlerFunc(apiV1.Update(store))
 	// get the current state of the daemon
-	version1Subroute.Methods("GET").Path("/state/").HandlerFunc(apiV1.State)
+	version1Subroute.Methods("GET").Path("/state/").HandlerFunc(apiV1.State(store))
+	// follow the changes to the state as server-sent events
+	version1Subroute.Methods("GET").Path("/events/stream").HandlerFunc(apiV1.EventStream(store))
 
 	// send an event
-	version1Subroute.Methods("POST").Path("/event/").HandlerFunc(apiV1.Event)
+	version1Subroute.Methods("POST").Path("/event/").HandlerFunc(apiV1.Event(store))
+
+	// read, and change some of, the code parameters, versioned by their ETag
+	version1Subroute.Methods("GET").Path("/code-parameters/").HandlerFunc(apiV1.GetCodeParams(store))
+	version1Subroute.Methods("PATCH").Path("/code-parameters/").HandlerFunc(apiV1.PatchCodeParams(store))
+
+	// send files for the code to use
+	version1Subroute.Methods("POST").Path("/code-parameter-file/").HandlerFunc(apiV1.CodeParameterFile(store))
+	// resumable uploads of large files
+	version1Subroute.Methods("POST").Path("/uploads/").HandlerFunc(apiV1.CreateUpload(store))
+	version1Subroute.Methods("HEAD").Path("/uploads/{id}/").HandlerFunc(apiV1.UploadOffset(store))
+	version1Subroute.Methods("PATCH").Path("/uploads/{id}/").HandlerFunc(apiV1.UploadChunk(store))
+	version1Subroute.Methods("DELETE").Path("/uploads/{id}/").HandlerFunc(apiV1.AbortUpload(store))
+	version1Subroute.Methods("POST").Path("/uploads/{id}/finalise/").HandlerFunc(apiV1.FinaliseUpload(store))
+	// have the daemon download files itself
+	version1Subroute.Methods("POST").Path("/fetch/").HandlerFunc(apiV1.FetchFiles(store))
+
+	// inspect and change files within the configured roots
+	version1Subroute.Methods("GET").Path("/fs/").HandlerFunc(apiV1.FileRoots(store))
+	version1Subroute.Methods("GET").Path("/fs/{root}/{path:.*}").HandlerFunc(apiV1.FileRootGet(store))
+	version1Subroute.Methods("PUT").Path("/fs/{root}/{path:.+}").HandlerFunc(apiV1.FileRootPut(store))
+	version1Subroute.Methods("POST").Path("/fs/{root}/{path:.+}").HandlerFunc(apiV1.FileRootMkdir(store))
+	version1Subroute.Methods("DELETE").Path("/fs/{root}/{path:.+}").HandlerFunc(apiV1.FileRootDelete(store))
+
+	// render the input deck templates without starting the code
+	version1Subroute.Methods("GET").Path("/templates/preview/").HandlerFunc(apiV1.PreviewTemplates(store))
+
+	// browse and download the results
+	version1Subroute.Methods("GET").Path("/results/").HandlerFunc(apiV1.Results(store))
+	version1Subroute.Methods("GET").Path("/results/{path:.+}").HandlerFunc(apiV1.ResultFile(store))
+
+	// the deliveries of lifecycle events to webhooks
+	version1Subroute.Methods("GET").Path("/webhooks/deliveries/").HandlerFunc(apiV1.WebhookDeliveries(store))
+
+	// configure the daemon itself, e.g. where results are sent
+	version1Subroute.Methods("POST").Path("/daemon-configuration/").HandlerFunc(apiV1.SetDaemonConfiguration(store))
 
 	return r
 }
@@ -0,0 +1,267 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// the names that backends are selected by in the daemon configuration
+const (
+	BackendJSON   = "json"
+	BackendBolt   = "bolt"
+	BackendMemory = "memory"
+)
+
+// where the daemon's state is kept, whichever backend is used
+var stateDirectory = "/hpcaas/daemon"
+
+// names the backend in use, so that the same one is opened when the daemon restarts
+const backendFileName = "state-backend"
+
+// Backend is where a store's state is persisted, the state is a single json document
+type Backend interface {
+	// Name is the name the backend is selected by
+	Name() string
+	// Save durably replaces the saved state, either all of it is saved or none of it
+	Save(state []byte) error
+	// Load returns the most recent state that can be read, nil if nothing has been saved,
+	// along with a report of any problem that had to be recovered from
+	Load() ([]byte, *PersistenceState)
+	// SaveSecrets durably replaces the saved secrets, which are kept apart from the state
+	// where only the daemon can read them
+	SaveSecrets(secrets []byte) error
+	// LoadSecrets returns the saved secrets, nil if none have been saved
+	LoadSecrets() ([]byte, error)
+	Close() error
+}
+
+// CheckBackend returns an error if name isn't a backend, empty is the json file
+func CheckBackend(name string) error {
+	switch name {
+	case "", BackendJSON, BackendBolt, BackendMemory:
+		return nil
+	}
+	return errors.New("Unknown state backend: " + name)
+}
+
+// NewBackend opens the backend called name, keeping its state in the state directory
+func NewBackend(name string) (Backend, error) {
+	switch name {
+	case "", BackendJSON:
+		return NewFileBackend(filepath.Join(stateDirectory, "state.json")), nil
+	case BackendBolt:
+		return NewBoltBackend(filepath.Join(stateDirectory, "state.db"))
+	case BackendMemory:
+		return NewMemoryBackend(), nil
+	}
+	return nil, CheckBackend(name)
+}
+
+// OpenBackend opens the backend that was last selected, the json file if none has been
+func OpenBackend() (Backend, error) {
+	name, err := ioutil.ReadFile(filepath.Join(stateDirectory, backendFileName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return NewBackend(strings.TrimSpace(string(name)))
+}
+
+// records which backend is in use
+func recordBackend(name string) error {
+	return writeFileAtomic(filepath.Join(stateDirectory, backendFileName), []byte(name+"\n"))
+}
+
+// the data is written and synced to a temporary file before being renamed over the old file,
+// so a crash leaves either the old or the new file, never a partial one
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	// make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// the file the json file backend keeps the secrets in
+const secretsFileName = "secrets.json"
+
+// the previous good copy of the state file
+const backupSuffix = ".bak"
+
+// a state file that couldn't be read is kept here for inspection
+const corruptSuffix = ".corrupt"
+
+// FileBackend keeps the state in a json file, along with the previous copy of it
+type FileBackend struct {
+	path string
+}
+
+// NewFileBackend keeps the state in the json file at path
+func NewFileBackend(path string) *FileBackend {
+	return &FileBackend{path: path}
+}
+
+// Name of the json file backend
+func (f *FileBackend) Name() string {
+	return BackendJSON
+}
+
+// Save replaces the state file, keeping the one it replaces as a backup
+func (f *FileBackend) Save(state []byte) error {
+	// the state file being replaced was itself written atomically, so it is a good copy to fall back to
+	if _, err := os.Stat(f.path); err == nil {
+		os.Remove(f.path + backupSuffix)
+		if err := os.Link(f.path, f.path+backupSuffix); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(f.path, state)
+}
+
+// reads a state file, only returning it if the whole file can be read
+func readStateFile(path string) ([]byte, error) {
+	file, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(file) == 0 {
+		return nil, errors.New("State file is empty")
+	}
+	var state map[string]json.RawMessage
+	if err := json.Unmarshal(file, &state); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// Load reads the state file, falling back to the previous copy of it if it can't be read
+func (f *FileBackend) Load() ([]byte, *PersistenceState) {
+	state, err := readStateFile(f.path)
+	if err == nil {
+		return state, nil
+	}
+	backup := f.path + backupSuffix
+	if _, backupErr := os.Stat(backup); os.IsNotExist(err) && os.IsNotExist(backupErr) {
+		// the daemon previously started but didn't manage to write any state
+		return nil, nil
+	}
+	log.Println("State file is corrupt, falling back to the previous copy: " + err.Error())
+	report := &PersistenceState{ReadError: err.Error()}
+	// keep the corrupt file for inspection, it would otherwise become the backup on the next save
+	os.Rename(f.path, f.path+corruptSuffix)
+	state, backupErr := readStateFile(backup)
+	if backupErr != nil {
+		log.Println("Couldn't read the previous copy of the state either: " + backupErr.Error())
+		return nil, report
+	}
+	report.RecoveredFrom = backup
+	return state, report
+}
+
+// the secrets are kept in this file next to the state file
+func (f *FileBackend) secretsPath() string {
+	return filepath.Join(filepath.Dir(f.path), secretsFileName)
+}
+
+// SaveSecrets replaces the secrets file, which only the daemon's user can read
+func (f *FileBackend) SaveSecrets(secrets []byte) error {
+	return writeFileAtomic(f.secretsPath(), secrets)
+}
+
+// LoadSecrets reads the secrets file
+func (f *FileBackend) LoadSecrets() ([]byte, error) {
+	secrets, err := ioutil.ReadFile(f.secretsPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return secrets, err
+}
+
+// Close the json file backend, there is nothing to close
+func (f *FileBackend) Close() error {
+	return nil
+}
+
+// MemoryBackend only keeps the state in memory, e.g. for tests
+type MemoryBackend struct {
+	mut     sync.Mutex
+	state   []byte
+	secrets []byte
+}
+
+// NewMemoryBackend returns a backend with nothing saved in it
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{}
+}
+
+// Name of the memory backend
+func (m *MemoryBackend) Name() string {
+	return BackendMemory
+}
+
+// Save keeps a copy of state
+func (m *MemoryBackend) Save(state []byte) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.state = append([]byte(nil), state...)
+	return nil
+}
+
+// Load returns a copy of the last state saved
+func (m *MemoryBackend) Load() ([]byte, *PersistenceState) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.state == nil {
+		return nil, nil
+	}
+	return append([]byte(nil), m.state...), nil
+}
+
+// SaveSecrets keeps a copy of the secrets
+func (m *MemoryBackend) SaveSecrets(secrets []byte) error {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	m.secrets = append([]byte(nil), secrets...)
+	return nil
+}
+
+// LoadSecrets returns a copy of the last secrets saved
+func (m *MemoryBackend) LoadSecrets() ([]byte, error) {
+	m.mut.Lock()
+	defer m.mut.Unlock()
+	if m.secrets == nil {
+		return nil, nil
+	}
+	return append([]byte(nil), m.secrets...), nil
+}
+
+// Close the memory backend, the state is kept in case it is loaded again
+func (m *MemoryBackend) Close() error {
+	return nil
+}
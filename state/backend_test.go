@@ -0,0 +1,163 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+func setupStateDirectory(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "backend")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDirectory = dir
+	return dir
+}
+
+func resetStateDirectory(dir string) {
+	os.RemoveAll(dir)
+	stateDirectory = "/hpcaas/daemon"
+}
+
+func TestMemoryBackend(t *testing.T) {
+	assert := assert.New(t)
+	backend := NewMemoryBackend()
+	saved, report := backend.Load()
+	assert.Nil(saved)
+	assert.Nil(report)
+	state := []byte(`{"codeName":"sim"}`)
+	assert.NoError(backend.Save(state))
+	// the saved state is a copy
+	state[2] = 'x'
+	saved, _ = backend.Load()
+	assert.JSONEq(`{"codeName":"sim"}`, string(saved))
+}
+
+func TestBoltBackendReopen(t *testing.T) {
+	assert := assert.New(t)
+	dir := setupStateDirectory(t)
+	defer resetStateDirectory(dir)
+	path := filepath.Join(dir, "state.db")
+
+	backend, err := NewBoltBackend(path)
+	assert.NoError(err)
+	saved, report := backend.Load()
+	assert.Nil(saved)
+	assert.Nil(report)
+	assert.NoError(backend.Save([]byte(`{"codeName":"sim","codePID":42}`)))
+	assert.NoError(backend.Save([]byte(`{"codeName":"sim"}`)))
+	assert.NoError(backend.Close())
+
+	backend, err = NewBoltBackend(path)
+	assert.NoError(err)
+	defer backend.Close()
+	saved, report = backend.Load()
+	assert.Nil(report)
+	assert.JSONEq(`{"codeName":"sim"}`, string(saved))
+
+	// only the items that changed are journalled
+	var entries []journalEntry
+	backend.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltJournalBucket).ForEach(func(k []byte, v []byte) error {
+			var entry journalEntry
+			json.Unmarshal(v, &entry)
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	assert.Len(entries, 2)
+	assert.Len(entries[0].Set, 2)
+	assert.Empty(entries[1].Set)
+	assert.Equal([]string{"codePID"}, entries[1].Removed)
+}
+
+func TestBoltBackendRebuildsFromJournal(t *testing.T) {
+	assert := assert.New(t)
+	dir := setupStateDirectory(t)
+	defer resetStateDirectory(dir)
+	backend, err := NewBoltBackend(filepath.Join(dir, "state.db"))
+	assert.NoError(err)
+	defer backend.Close()
+	assert.NoError(backend.Save([]byte(`{"codeName":"sim","codePID":42}`)))
+	assert.NoError(backend.Save([]byte(`{"codeName":"sim","codeArguments":["-v"]}`)))
+
+	// the current state is damaged
+	backend.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStateBucket).Put(boltCurrentKey, []byte(`{"codeName": "si`))
+	})
+	saved, report := backend.Load()
+	assert.NotNil(report)
+	assert.NotEmpty(report.ReadError)
+	assert.Equal("journal", report.RecoveredFrom)
+	assert.JSONEq(`{"codeName":"sim","codeArguments":["-v"]}`, string(saved))
+}
+
+func TestBoltBackendCompacts(t *testing.T) {
+	assert := assert.New(t)
+	dir := setupStateDirectory(t)
+	defer resetStateDirectory(dir)
+	defer func(limit int) { boltJournalLimit = limit }(boltJournalLimit)
+	boltJournalLimit = 3
+	backend, err := NewBoltBackend(filepath.Join(dir, "state.db"))
+	assert.NoError(err)
+	defer backend.Close()
+
+	for _, pid := range []string{"1", "2", "3", "4", "5"} {
+		assert.NoError(backend.Save([]byte(`{"codeName":"sim","codePID":` + pid + `}`)))
+	}
+	var keys int
+	backend.db.View(func(tx *bolt.Tx) error {
+		keys = tx.Bucket(boltJournalBucket).Stats().KeyN
+		return nil
+	})
+	// a checkpoint followed by the change after it
+	assert.Equal(2, keys)
+	backend.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltStateBucket).Delete(boltCurrentKey)
+	})
+	saved, report := backend.Load()
+	assert.Equal("journal", report.RecoveredFrom)
+	assert.JSONEq(`{"codeName":"sim","codePID":5}`, string(saved))
+}
+
+func TestSelectBackend(t *testing.T) {
+	assert := assert.New(t)
+	dir := setupStateDirectory(t)
+	defer resetStateDirectory(dir)
+
+	// nothing has been selected, so the json file is used
+	backend, err := OpenBackend()
+	assert.NoError(err)
+	assert.Equal(BackendJSON, backend.Name())
+	store := NewStore(backend)
+	store.SetCodeName("sim")
+	assert.NoError(store.Flush())
+
+	assert.Error(store.SelectBackend("sqlite"))
+	assert.NoError(store.SelectBackend(BackendBolt))
+	store.SetCodeName("moved")
+	assert.NoError(store.Flush())
+	assert.NoError(store.SelectBackend(BackendMemory))
+
+	// after a restart the last backend selected is used
+	backend, err = OpenBackend()
+	assert.NoError(err)
+	assert.Equal(BackendMemory, backend.Name())
+
+	// and the state was moved into the bolt backend while it was selected
+	bolt, err := NewBoltBackend(filepath.Join(dir, "state.db"))
+	assert.NoError(err)
+	defer bolt.Close()
+	saved, _ := bolt.Load()
+	var daemonState struct {
+		CodeName string `json:"codeName"`
+	}
+	assert.NoError(json.Unmarshal(saved, &daemonState))
+	assert.Equal("moved", daemonState.CodeName)
+}
@@ -0,0 +1,224 @@
+package state
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltStateBucket = []byte("state")
+var boltCurrentKey = []byte("current")
+var boltJournalBucket = []byte("journal")
+
+// the secrets aren't journalled, so that none are left behind once they are replaced
+var boltSecretsBucket = []byte("secrets")
+
+// once the journal has this many entries it is replaced with a single checkpoint
+var boltJournalLimit = 1000
+
+// journalEntry is a single change to the state, recorded as the top level items that were set or removed
+type journalEntry struct {
+	Time time.Time `json:"time"`
+	// the entry sets every item, the entries before it can be ignored
+	Checkpoint bool                       `json:"checkpoint,omitempty"`
+	Set        map[string]json.RawMessage `json:"set,omitempty"`
+	Removed    []string                   `json:"removed,omitempty"`
+}
+
+// BoltBackend keeps the state in an embedded key/value database,
+// along with an append-only journal of the changes to it that the state can be rebuilt from
+type BoltBackend struct {
+	db *bolt.DB
+}
+
+// NewBoltBackend opens, or creates, the database at path
+func NewBoltBackend(path string) (*BoltBackend, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltStateBucket); err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucketIfNotExists(boltSecretsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltJournalBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltBackend{db: db}, nil
+}
+
+// Name of the bolt backend
+func (b *BoltBackend) Name() string {
+	return BackendBolt
+}
+
+// the top level items of a state
+func stateItems(state []byte) (map[string]json.RawMessage, error) {
+	items := map[string]json.RawMessage{}
+	if state == nil {
+		return items, nil
+	}
+	err := json.Unmarshal(state, &items)
+	return items, err
+}
+
+// the change from one state to the next
+func diffStates(previous map[string]json.RawMessage, next map[string]json.RawMessage) journalEntry {
+	entry := journalEntry{Time: time.Now(), Set: map[string]json.RawMessage{}}
+	for k, v := range next {
+		if !reflect.DeepEqual(previous[k], v) {
+			entry.Set[k] = v
+		}
+	}
+	for k := range previous {
+		if _, ok := next[k]; !ok {
+			entry.Removed = append(entry.Removed, k)
+		}
+	}
+	return entry
+}
+
+func journalKey(sequence uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, sequence)
+	return key
+}
+
+// appends an entry to the journal
+func appendJournal(journal *bolt.Bucket, entry journalEntry) error {
+	sequence, err := journal.NextSequence()
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return journal.Put(journalKey(sequence), encoded)
+}
+
+// Save replaces the current state and records the change in the journal, in a single transaction
+func (b *BoltBackend) Save(state []byte) error {
+	next, err := stateItems(state)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		stateBucket := tx.Bucket(boltStateBucket)
+		journal := tx.Bucket(boltJournalBucket)
+		// an unreadable current state is treated as empty, so the whole state is journalled
+		previous, _ := stateItems(stateBucket.Get(boltCurrentKey))
+		entry := diffStates(previous, next)
+		if journal.Stats().KeyN >= boltJournalLimit {
+			// the journal starts again from a checkpoint of the whole state
+			if err := tx.DeleteBucket(boltJournalBucket); err != nil {
+				return err
+			}
+			if journal, err = tx.CreateBucket(boltJournalBucket); err != nil {
+				return err
+			}
+			entry = journalEntry{Time: time.Now(), Checkpoint: true, Set: next}
+		}
+		if len(entry.Set) > 0 || len(entry.Removed) > 0 || entry.Checkpoint {
+			if err := appendJournal(journal, entry); err != nil {
+				return err
+			}
+		}
+		return stateBucket.Put(boltCurrentKey, state)
+	})
+}
+
+// the state rebuilt from the journal, nil if the journal is empty
+func replayJournal(journal *bolt.Bucket) ([]byte, error) {
+	var items map[string]json.RawMessage
+	err := journal.ForEach(func(k []byte, v []byte) error {
+		var entry journalEntry
+		if err := json.Unmarshal(v, &entry); err != nil {
+			return err
+		}
+		if items == nil || entry.Checkpoint {
+			items = map[string]json.RawMessage{}
+		}
+		for key, value := range entry.Set {
+			items[key] = value
+		}
+		for _, key := range entry.Removed {
+			delete(items, key)
+		}
+		return nil
+	})
+	if err != nil || items == nil {
+		return nil, err
+	}
+	return json.Marshal(items)
+}
+
+// Load returns the current state, rebuilding it from the journal if it can't be read
+func (b *BoltBackend) Load() ([]byte, *PersistenceState) {
+	var state []byte
+	var report *PersistenceState
+	b.db.View(func(tx *bolt.Tx) error {
+		current := tx.Bucket(boltStateBucket).Get(boltCurrentKey)
+		_, err := stateItems(current)
+		if current != nil && err == nil {
+			// only valid for the life of the transaction
+			state = append([]byte(nil), current...)
+			return nil
+		}
+		if current == nil {
+			err = errors.New("Current state is missing")
+		}
+		replayed, replayErr := replayJournal(tx.Bucket(boltJournalBucket))
+		if replayed == nil && replayErr == nil {
+			// nothing has been saved
+			return nil
+		}
+		log.Println("Current state is unreadable, rebuilding it from the journal: " + err.Error())
+		report = &PersistenceState{ReadError: err.Error()}
+		if replayErr != nil {
+			log.Println("Couldn't rebuild the state from the journal either: " + replayErr.Error())
+			return nil
+		}
+		state = replayed
+		report.RecoveredFrom = "journal"
+		return nil
+	})
+	return state, report
+}
+
+// SaveSecrets replaces the saved secrets
+func (b *BoltBackend) SaveSecrets(secrets []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSecretsBucket).Put(boltCurrentKey, secrets)
+	})
+}
+
+// LoadSecrets returns the saved secrets
+func (b *BoltBackend) LoadSecrets() ([]byte, error) {
+	var secrets []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if current := tx.Bucket(boltSecretsBucket).Get(boltCurrentKey); current != nil {
+			// only valid for the life of the transaction
+			secrets = append([]byte(nil), current...)
+		}
+		return nil
+	})
+	return secrets, err
+}
+
+// Close the database
+func (b *BoltBackend) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,111 @@
+package state
+
+import "reflect"
+
+// DaemonConfiguration is the configuration that is specific to the daemon, rather than the code
+// only the items listed here are recognised, anything else sent to the daemon is ignored
+type DaemonConfiguration struct {
+	// where the results of the code are collected from
+	ResultsDirectory string `json:"resultsDirectory,omitempty"`
+	// how the results are packaged before upload, one of "", "directory", "tar", "tar.gz" or "tar.zst"
+	ResultsPackaging string `json:"resultsPackaging,omitempty"`
+	// http(s) endpoint that results are uploaded to once the code has finished
+	ResultsURL string `json:"resultsURL,omitempty"`
+	// size in bytes of each chunk sent to the results url
+	ResultsUploadChunkSize int64 `json:"resultsUploadChunkSize,omitempty"`
+	// number of times a chunk is retried before the upload is abandoned
+	ResultsUploadRetries int `json:"resultsUploadRetries,omitempty"`
+	// seconds between syncs of new and changed results while the code runs, 0 disables periodic syncing
+	ResultsSyncInterval int `json:"resultsSyncInterval,omitempty"`
+	// sync as soon as the results directory changes, rather than waiting for the interval
+	ResultsSyncOnChange bool `json:"resultsSyncOnChange,omitempty"`
+	// seconds that a file must be left unmodified before it is synced
+	ResultsSyncSettle int `json:"resultsSyncSettle,omitempty"`
+	// bytes per second that syncing is limited to, so it doesn't compete with the code, 0 for no limit
+	ResultsSyncBandwidth int64 `json:"resultsSyncBandwidth,omitempty"`
+	// glob patterns selecting which files are results, every file if empty
+	ResultsInclude []string `json:"resultsInclude,omitempty"`
+	// glob patterns for files that are never results, e.g. scratch files
+	ResultsExclude []string `json:"resultsExclude,omitempty"`
+	// files larger than this many bytes are not results, 0 for no limit
+	ResultsMaxFileSize int64 `json:"resultsMaxFileSize,omitempty"`
+	// once the code has finished, whether the results are "copy"'d or "move"'d out of the results directory before upload,
+	// empty to upload them from where they are
+	ResultsCollectMode string `json:"resultsCollectMode,omitempty"`
+	// what happens to local results once they are uploaded, "delete" removes them, empty keeps them
+	ResultsRetention string `json:"resultsRetention,omitempty"`
+	// number of runs of collected results to keep, 0 keeps them all,
+	// only runs collected with ResultsCollectMode are counted so it can't be set without one
+	ResultsKeepLast int `json:"resultsKeepLast,omitempty"`
+	// s3 compatible object store that results are uploaded to, used instead of ResultsURL when a bucket is set
+	ResultsS3Endpoint     string `json:"resultsS3Endpoint,omitempty"`
+	ResultsS3Bucket       string `json:"resultsS3Bucket,omitempty"`
+	ResultsS3Prefix       string `json:"resultsS3Prefix,omitempty"`
+	ResultsS3Region       string `json:"resultsS3Region,omitempty"`
+	ResultsS3AccessKey    string `json:"resultsS3AccessKey,omitempty"`
+	ResultsS3SecretKey    string `json:"resultsS3SecretKey,omitempty" sensitive:"true"`
+	ResultsS3SessionToken string `json:"resultsS3SessionToken,omitempty" sensitive:"true"`
+	// presigned PUT urls keyed by the path of the file relative to the results directory,
+	// secret as anyone with one can write to the bucket
+	ResultsS3PresignedURLs map[string]string `json:"resultsS3PresignedURLs,omitempty" sensitive:"true"`
+	// size in bytes of each part of a multipart upload
+	ResultsS3PartSize int64 `json:"resultsS3PartSize,omitempty"`
+	// number of parts uploaded at once
+	ResultsS3Concurrency int `json:"resultsS3Concurrency,omitempty"`
+	// where files sent to the daemon are placed
+	FilesDirectory string `json:"filesDirectory,omitempty"`
+	// largest file, in bytes, that can be sent to the daemon, 0 for no limit
+	FilesMaxFileSize int64 `json:"filesMaxFileSize,omitempty"`
+	// largest total size, in bytes, of the files sent in a single request, 0 for no limit
+	FilesMaxUploadSize int64 `json:"filesMaxUploadSize,omitempty"`
+	// seconds that a resumable upload can go without receiving any data before it is abandoned
+	FilesUploadExpiry int `json:"filesUploadExpiry,omitempty"`
+	// number of files fetched from urls at once
+	FilesFetchConcurrency int `json:"filesFetchConcurrency,omitempty"`
+	// number of times a failed fetch is retried before giving up
+	FilesFetchRetries int `json:"filesFetchRetries,omitempty"`
+	// extra formats that the code parameters are written in, keyed by code name, e.g. namelist, ini, yaml, toml, shell
+	CodeParamFormats map[string][]string `json:"codeParamFormats,omitempty"`
+	// rank of this container amongst those taking part in the run, as given to templates
+	Rank int `json:"rank,omitempty"`
+	// where each template in /hpcaas/templates is rendered to, keyed by template file name
+	TemplateDestinations map[string]string `json:"templateDestinations,omitempty"`
+	// how the running code is told that its params have changed, a signal such as SIGHUP, or socket
+	CodeParamsNotify string `json:"codeParamsNotify,omitempty"`
+	// seconds the code has to acknowledge changed params
+	CodeParamsAckTimeout int `json:"codeParamsAckTimeout,omitempty"`
+	// directories reachable through the file management api, keyed by the name used in its urls
+	FileRoots map[string]FileRoot `json:"fileRoots,omitempty"`
+	// where the daemon's state is persisted, one of "json", "bolt" or "memory", json if empty
+	StateBackend string `json:"stateBackend,omitempty"`
+	// urls that lifecycle events, e.g. the code starting or exiting, are posted to
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// number of times a webhook delivery is attempted before it is given up on
+	WebhookRetries int `json:"webhookRetries,omitempty"`
+}
+
+// FileRoot is a directory that can be reached through the file management api
+type FileRoot struct {
+	Path string `json:"path"`
+	// ro or rw
+	Access string `json:"access"`
+}
+
+// SetDaemonConfiguration overwrites the daemon configuration
+func (s *DaemonStore) SetDaemonConfiguration(conf DaemonConfiguration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local.DaemonConfiguration = &conf
+	s.persist()
+}
+
+// GetDaemonConfiguration return a copy of the daemon configuration, secrets included
+func (s *DaemonStore) GetDaemonConfiguration() (DaemonConfiguration, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.local.DaemonConfiguration != nil {
+		// the copy can be changed, e.g. by unmarshalling over it, without changing the store
+		return deepCopy(reflect.ValueOf(*s.local.DaemonConfiguration)).Interface().(DaemonConfiguration), true
+	}
+	return DaemonConfiguration{}, false
+}
@@ -0,0 +1,173 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event is a change to one top level item of the state, the items are named as they are in the state api
+type Event struct {
+	// events are numbered from 1 each time the daemon starts,
+	// so each start is told apart by a boot id
+	Boot     string    `json:"boot"`
+	Sequence uint64    `json:"sequence"`
+	Time     time.Time `json:"time"`
+	Field    string    `json:"field"`
+	// absent if the item wasn't set before the change
+	Old json.RawMessage `json:"old,omitempty"`
+	// absent if the item has been removed
+	New json.RawMessage `json:"new,omitempty"`
+}
+
+// ID identifies the event, even across restarts of the daemon
+func (e Event) ID() string {
+	return EventID(e.Boot, e.Sequence)
+}
+
+// EventID is the id of the event numbered sequence since the daemon started with boot id boot
+func EventID(boot string, sequence uint64) string {
+	return boot + "-" + strconv.FormatUint(sequence, 10)
+}
+
+// ParseEventID splits an event id into its boot id and sequence,
+// an id that is only a sequence, as they were before boot ids, has an empty boot id
+func ParseEventID(id string) (string, uint64, error) {
+	var boot string
+	if i := strings.LastIndex(id, "-"); i >= 0 {
+		boot, id = id[:i], id[i+1:]
+	}
+	sequence, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return "", 0, errors.New("Not an event id: " + id)
+	}
+	return boot, sequence, nil
+}
+
+// how many of the most recent events are held for subscribers to resume from
+var eventHistoryLimit = 1000
+
+// how many events a subscriber can fall behind by before it is dropped
+var subscriberBuffer = 100
+
+// Subscription follows the changes to a store
+type Subscription struct {
+	// the whole state as of Sequence, without its secrets, only set if the subscription didn't resume from earlier events
+	State json.RawMessage
+	// the boot id of the daemon, and the sequence of the last event before the subscription started
+	Boot     string
+	Sequence uint64
+	// the events since the sequence that was resumed from
+	Backlog []Event
+	// every event after the backlog, closed if the subscriber falls too far behind or is cancelled
+	Events <-chan Event
+	events chan Event
+	bus    *eventBus
+}
+
+// Cancel stops the subscription, closing its events
+func (sub *Subscription) Cancel() {
+	sub.bus.unsubscribe(sub.events)
+}
+
+// eventBus publishes the changes to a store to its subscribers
+type eventBus struct {
+	mu sync.Mutex
+	// a new id each time the daemon starts
+	boot        string
+	sequence    uint64
+	history     []Event
+	subscribers map[chan Event]bool
+	// eventHistoryLimit when the store was created
+	historyLimit int
+	// the items of the state as of the last event
+	items map[string]json.RawMessage
+}
+
+// publishes an event for every top level item that has changed since the last publish
+// called with the store's lock held
+func (s *DaemonStore) publishChanges() {
+	// secrets are never published
+	items, err := stateItems(s.publicStateJSON())
+	if err != nil {
+		return
+	}
+	s.events.publish(items)
+}
+
+func (b *eventBus) publish(items map[string]json.RawMessage) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var fields []string
+	for field, value := range items {
+		if !bytes.Equal(b.items[field], value) {
+			fields = append(fields, field)
+		}
+	}
+	for field := range b.items {
+		if _, ok := items[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	now := time.Now()
+	for _, field := range fields {
+		b.sequence++
+		event := Event{Boot: b.boot, Sequence: b.sequence, Time: now, Field: field, Old: b.items[field], New: items[field]}
+		b.history = append(b.history, event)
+		for subscriber := range b.subscribers {
+			select {
+			case subscriber <- event:
+			default:
+				// the subscriber can resume from the history once it catches up
+				delete(b.subscribers, subscriber)
+				close(subscriber)
+			}
+		}
+	}
+	if len(b.history) > b.historyLimit {
+		b.history = append([]Event(nil), b.history[len(b.history)-b.historyLimit:]...)
+	}
+	b.items = items
+}
+
+func (b *eventBus) unsubscribe(events chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.subscribers[events] {
+		delete(b.subscribers, events)
+		close(events)
+	}
+}
+
+// Subscribe follows the changes to the store after the event numbered after since the daemon started with boot id boot
+// if after is 0, the events after it are no longer held, or boot isn't this start of the daemon,
+// the subscription starts from the current state instead
+func (s *DaemonStore) Subscribe(boot string, after uint64) *Subscription {
+	// nothing can be published while subscribing
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	b := &s.events
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	events := make(chan Event, subscriberBuffer)
+	if b.subscribers == nil {
+		b.subscribers = make(map[chan Event]bool)
+	}
+	b.subscribers[events] = true
+	sub := &Subscription{Boot: b.boot, Sequence: b.sequence, Events: events, events: events, bus: b}
+	// the history holds every event after the one before its first
+	oldest := b.sequence - uint64(len(b.history))
+	if after == 0 || boot != b.boot || after < oldest || after > b.sequence {
+		sub.State = s.publicStateJSON()
+		return sub
+	}
+	sub.Backlog = append([]Event(nil), b.history[after-oldest:]...)
+	sub.Sequence = after
+	return sub
+}
@@ -0,0 +1,137 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribe(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	store.SetCodeName("sim")
+
+	// a new subscriber starts from the whole state
+	sub := store.Subscribe("", 0)
+	defer sub.Cancel()
+	assert.NotEmpty(sub.Boot)
+	assert.Equal(uint64(1), sub.Sequence)
+	assert.Empty(sub.Backlog)
+	var current map[string]interface{}
+	assert.NoError(json.Unmarshal(sub.State, &current))
+	assert.Equal("sim", current["codeName"])
+
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	// the status and its transition change together, in order of field
+	event := <-sub.Events
+	assert.Equal(uint64(2), event.Sequence)
+	assert.Equal(sub.Boot+"-2", event.ID())
+	assert.Equal("codeStatus", event.Field)
+	assert.Nil(event.Old)
+	assert.Equal("0", string(event.New))
+	event = <-sub.Events
+	assert.Equal(uint64(3), event.Sequence)
+	assert.Equal("transitions", event.Field)
+
+	store.SetCodeName("other")
+	event = <-sub.Events
+	assert.Equal("codeName", event.Field)
+	assert.Equal(`"sim"`, string(event.Old))
+	assert.Equal(`"other"`, string(event.New))
+	assert.False(event.Time.IsZero())
+
+	// nothing changed, so nothing is published
+	store.SetCodeName("other")
+	select {
+	case event = <-sub.Events:
+		t.Error("unexpected event", event)
+	default:
+	}
+
+	sub.Cancel()
+	_, ok := <-sub.Events
+	assert.False(ok)
+}
+
+func TestSubscribeResumes(t *testing.T) {
+	assert := assert.New(t)
+	defer func(limit int) { eventHistoryLimit = limit }(eventHistoryLimit)
+	eventHistoryLimit = 3
+	store := NewStore(NewMemoryBackend())
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		store.SetCodeName(name)
+	}
+	boot := store.Subscribe("", 0).Boot
+
+	// the events after 3 are still held
+	sub := store.Subscribe(boot, 3)
+	defer sub.Cancel()
+	assert.Nil(sub.State)
+	assert.Equal(uint64(3), sub.Sequence)
+	assert.Len(sub.Backlog, 2)
+	assert.Equal(uint64(4), sub.Backlog[0].Sequence)
+	assert.Equal(`"e"`, string(sub.Backlog[1].New))
+
+	// those after 1 aren't, nor are any from a later sequence
+	for _, after := range []uint64{1, 9} {
+		sub := store.Subscribe(boot, after)
+		assert.NotNil(sub.State)
+		assert.Equal(uint64(5), sub.Sequence)
+		assert.Empty(sub.Backlog)
+		sub.Cancel()
+	}
+
+	// nor any from before a restart, even though the sequence is held
+	restarted := NewStore(NewMemoryBackend())
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		restarted.SetCodeName(name)
+	}
+	for _, earlier := range []string{boot, ""} {
+		sub := restarted.Subscribe(earlier, 3)
+		assert.NotNil(sub.State)
+		assert.NotEqual(boot, sub.Boot)
+		assert.Empty(sub.Backlog)
+		sub.Cancel()
+	}
+}
+
+func TestParseEventID(t *testing.T) {
+	assert := assert.New(t)
+	boot, sequence, err := ParseEventID(EventID("abc123", 42))
+	assert.NoError(err)
+	assert.Equal("abc123", boot)
+	assert.Equal(uint64(42), sequence)
+	// ids from before there were boot ids
+	boot, sequence, err = ParseEventID("7")
+	assert.NoError(err)
+	assert.Equal("", boot)
+	assert.Equal(uint64(7), sequence)
+	for _, id := range []string{"", "latest", "abc-", "abc-x"} {
+		_, _, err = ParseEventID(id)
+		assert.Error(err, id)
+	}
+}
+
+func TestSlowSubscriberIsDropped(t *testing.T) {
+	assert := assert.New(t)
+	defer func(buffer int) { subscriberBuffer = buffer }(subscriberBuffer)
+	subscriberBuffer = 2
+	store := NewStore(NewMemoryBackend())
+	sub := store.Subscribe("", 0)
+	defer sub.Cancel()
+	for _, name := range []string{"a", "b", "c"} {
+		store.SetCodeName(name)
+	}
+	var received []Event
+	for event := range sub.Events {
+		received = append(received, event)
+	}
+	assert.Len(received, 2)
+	// but it can pick up where it got to
+	resumed := store.Subscribe(received[1].Boot, received[1].Sequence)
+	defer resumed.Cancel()
+	assert.Len(resumed.Backlog, 1)
+	assert.Equal(`"c"`, string(resumed.Backlog[0].New))
+}
@@ -0,0 +1,68 @@
+package state
+
+import "sort"
+
+// FetchStatus is the status of a file being fetched from a url
+type FetchStatus int
+
+const (
+	// FetchWaitingStatus the fetch is queued behind others
+	FetchWaitingStatus FetchStatus = iota
+	// FetchDownloadingStatus the file is being downloaded
+	FetchDownloadingStatus
+	// FetchDoneStatus the file has been downloaded, verified and moved into place
+	FetchDoneStatus
+	// FetchErrorStatus the fetch failed, even after retrying
+	FetchErrorStatus
+)
+
+// FetchState tracks a single file being fetched from a url into the files directory
+type FetchState struct {
+	URL    string      `json:"url"`
+	Name   string      `json:"name"`
+	Status FetchStatus `json:"status"`
+	// checksum that the file is expected to have, if one was given
+	SHA256        string `json:"sha256,omitempty"`
+	Extract       bool   `json:"extract,omitempty"`
+	BytesReceived int64  `json:"bytesReceived"`
+	// -1 if the server hasn't said
+	BytesTotal int64  `json:"bytesTotal"`
+	Attempts   int    `json:"attempts"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SetFetch records the progress of a fetch, keyed by the name of the file
+func (s *DaemonStore) SetFetch(fetch FetchState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.local.Fetches == nil {
+		s.local.Fetches = make(map[string]FetchState)
+	}
+	s.local.Fetches[fetch.Name] = fetch
+	s.persist()
+}
+
+// GetFetches return a copy of every fetch, keyed by the name of the file
+func (s *DaemonStore) GetFetches() map[string]FetchState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fetches := make(map[string]FetchState, len(s.local.Fetches))
+	for name, fetch := range s.local.Fetches {
+		fetches[name] = fetch
+	}
+	return fetches
+}
+
+// UnfinishedFetches return the names of the files that haven't been fetched successfully, sorted
+func (s *DaemonStore) UnfinishedFetches() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for name, fetch := range s.local.Fetches {
+		if fetch.Status != FetchDoneStatus {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,33 @@
+package state
+
+import "time"
+
+// FileState describes a file that has been sent to the daemon for the code to use
+type FileState struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256"`
+	Received time.Time `json:"received"`
+}
+
+// SetFile records a file that has been placed in the files directory, replacing any earlier file of the same name
+func (s *DaemonStore) SetFile(file FileState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.local.Files == nil {
+		s.local.Files = make(map[string]FileState)
+	}
+	s.local.Files[file.Name] = file
+	s.persist()
+}
+
+// GetFiles return a copy of every file that has been received, keyed by name
+func (s *DaemonStore) GetFiles() map[string]FileState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := make(map[string]FileState, len(s.local.Files))
+	for name, file := range s.local.Files {
+		files[name] = file
+	}
+	return files
+}
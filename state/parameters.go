@@ -0,0 +1,184 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+)
+
+// ErrParamsVersionMismatch is returned when the params have changed since the version that a write was based on
+var ErrParamsVersionMismatch = errors.New("Code parameters have changed")
+
+// CodeParams are the parameters of the code, values can be any json type
+// numbers are kept as json.Number so that they aren't rounded
+type CodeParams map[string]interface{}
+
+// UnmarshalJSON decodes numbers as json.Number rather than float64
+func (c *CodeParams) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var params map[string]interface{}
+	if err := decoder.Decode(&params); err != nil {
+		return err
+	}
+	*c = params
+	return nil
+}
+
+// ParamString is how a parameter is written to the environment and the flat parameters file,
+// strings are written as they are, numbers and booleans as their json, null as an empty string,
+// and arrays and objects as compact json
+func ParamString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return ""
+	}
+	return string(encoded)
+}
+
+// the parameters as the strings that clients of common.DaemonState expect
+func stringParams(params CodeParams) map[string]string {
+	strings := make(map[string]string, len(params))
+	for k, v := range params {
+		strings[k] = ParamString(v)
+	}
+	return strings
+}
+
+func typedParams(params map[string]string) CodeParams {
+	typed := make(CodeParams, len(params))
+	for k, v := range params {
+		typed[k] = v
+	}
+	return typed
+}
+
+// deep copy of a decoded json value
+func copyParamValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for k, inner := range v {
+			copied[k] = copyParamValue(inner)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, inner := range v {
+			copied[i] = copyParamValue(inner)
+		}
+		return copied
+	}
+	return value
+}
+
+// MergeCodeParams returns params with patch applied as a json merge patch (rfc 7396),
+// a null removes a param, objects are merged recursively and any other value replaces what was there
+func MergeCodeParams(params CodeParams, patch CodeParams) CodeParams {
+	merged := mergeParamObjects(map[string]interface{}(params), map[string]interface{}(patch))
+	return CodeParams(merged)
+}
+
+func mergeParamObjects(target map[string]interface{}, patch map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(target)+len(patch))
+	for k, v := range target {
+		merged[k] = copyParamValue(v)
+	}
+	for k, v := range patch {
+		switch patchValue := v.(type) {
+		case nil:
+			delete(merged, k)
+		case map[string]interface{}:
+			existing, _ := merged[k].(map[string]interface{})
+			merged[k] = mergeParamObjects(existing, patchValue)
+		default:
+			merged[k] = copyParamValue(v)
+		}
+	}
+	return merged
+}
+
+// set both the typed and the string params, called with the lock held
+// every change to the params moves them on a version
+func (s *DaemonStore) setCodeParams(params CodeParams) {
+	s.local.CodeParams = params
+	s.local.CodeParamsVersion++
+	strings := stringParams(params)
+	s.daemonState.CodeParams = &strings
+}
+
+// the typed params, falling back to the string params if they were set some other way, called with the lock held
+func (s *DaemonStore) getCodeParams() (CodeParams, bool) {
+	if s.local.CodeParams != nil {
+		return s.local.CodeParams, true
+	}
+	if s.daemonState.CodeParams != nil {
+		return typedParams(*s.daemonState.CodeParams), true
+	}
+	return nil, false
+}
+
+// SetTypedCodeParams overwrite all params with new params
+func (s *DaemonStore) SetTypedCodeParams(params CodeParams) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setCodeParams(copyParamValue(map[string]interface{}(params)).(map[string]interface{}))
+	s.persist()
+}
+
+// UpdateTypedCodeParams merge new params with existing params, overwriting as necessary
+func (s *DaemonStore) UpdateTypedCodeParams(params CodeParams) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, _ := s.getCodeParams()
+	merged := make(CodeParams, len(existing)+len(params))
+	for k, v := range existing {
+		merged[k] = v
+	}
+	for k, v := range params {
+		merged[k] = copyParamValue(v)
+	}
+	s.setCodeParams(merged)
+	s.persist()
+}
+
+// GetTypedCodeParams return a copy of the code params with their json types
+func (s *DaemonStore) GetTypedCodeParams() (CodeParams, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	params, ok := s.getCodeParams()
+	if !ok {
+		return nil, false
+	}
+	return copyParamValue(map[string]interface{}(params)).(map[string]interface{}), true
+}
+
+// GetVersionedCodeParams return a copy of the code params along with their version
+func (s *DaemonStore) GetVersionedCodeParams() (CodeParams, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	params, ok := s.getCodeParams()
+	if !ok {
+		return CodeParams{}, s.local.CodeParamsVersion
+	}
+	return copyParamValue(map[string]interface{}(params)).(map[string]interface{}), s.local.CodeParamsVersion
+}
+
+// SetVersionedCodeParams overwrite all params, provided they are still at version, returning their new version
+// if they have been changed since ErrParamsVersionMismatch is returned and nothing is changed
+func (s *DaemonStore) SetVersionedCodeParams(params CodeParams, version uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.local.CodeParamsVersion != version {
+		return s.local.CodeParamsVersion, ErrParamsVersionMismatch
+	}
+	s.setCodeParams(copyParamValue(map[string]interface{}(params)).(map[string]interface{}))
+	s.persist()
+	return s.local.CodeParamsVersion, nil
+}
@@ -0,0 +1,108 @@
+package state
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTypedCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	var params CodeParams
+	err := json.Unmarshal([]byte(`{
+		"name": "run 1",
+		"steps": 12345678901234567,
+		"dt": 0.001,
+		"restart": false,
+		"species": ["H", "He"],
+		"grid": {"nx": 64, "ny": 32},
+		"unset": null
+	}`), &params)
+	assert.NoError(err)
+	store.SetTypedCodeParams(params)
+
+	typed, ok := store.GetTypedCodeParams()
+	assert.True(ok)
+	// big integers aren't rounded
+	assert.Equal(json.Number("12345678901234567"), typed["steps"])
+	assert.Equal(false, typed["restart"])
+	assert.Equal([]interface{}{"H", "He"}, typed["species"])
+
+	strings, ok := store.GetCodeParams()
+	assert.True(ok)
+	assert.Equal(map[string]string{
+		"name":    "run 1",
+		"steps":   "12345678901234567",
+		"dt":      "0.001",
+		"restart": "false",
+		"species": `["H","He"]`,
+		"grid":    `{"nx":64,"ny":32}`,
+		"unset":   "",
+	}, strings)
+
+	// the copy handed out can't change the state
+	typed["grid"].(map[string]interface{})["nx"] = json.Number("1")
+	again, _ := store.GetTypedCodeParams()
+	assert.Equal(json.Number("64"), again["grid"].(map[string]interface{})["nx"])
+
+	store.UpdateTypedCodeParams(CodeParams{"dt": json.Number("0.01"), "extra": true})
+	typed, _ = store.GetTypedCodeParams()
+	assert.Equal(json.Number("0.01"), typed["dt"])
+	assert.Equal(true, typed["extra"])
+	assert.Equal("run 1", typed["name"])
+}
+
+func TestStringCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	// string only clients carry on as before
+	store.SetCodeParams(map[string]string{"foo": "bar", "n": "1"})
+	strings, _ := store.GetCodeParams()
+	assert.Equal(map[string]string{"foo": "bar", "n": "1"}, strings)
+	typed, _ := store.GetTypedCodeParams()
+	assert.Equal(CodeParams{"foo": "bar", "n": "1"}, typed)
+
+	store.UpdateCodeParams(map[string]string{"n": "2"})
+	strings, _ = store.GetCodeParams()
+	assert.Equal(map[string]string{"foo": "bar", "n": "2"}, strings)
+}
+
+func TestMergeCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	var params, patch CodeParams
+	json.Unmarshal([]byte(`{"name": "run", "steps": 10, "grid": {"nx": 64, "ny": 32}, "species": ["H"]}`), &params)
+	json.Unmarshal([]byte(`{"steps": 20, "name": null, "grid": {"ny": null, "nz": 16}, "species": ["He"], "output": {"dir": "out", "unset": null}}`), &patch)
+	merged := MergeCodeParams(params, patch)
+	expected, _ := json.Marshal(merged)
+	assert.JSONEq(`{"steps": 20, "grid": {"nx": 64, "nz": 16}, "species": ["He"], "output": {"dir": "out"}}`, string(expected))
+	// neither side is changed
+	assert.Equal("run", params["name"])
+	assert.Equal(json.Number("32"), params["grid"].(map[string]interface{})["ny"])
+	assert.Nil(patch["name"])
+}
+
+func TestVersionedCodeParams(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	store.SetTypedCodeParams(CodeParams{"steps": json.Number("1")})
+	params, version := store.GetVersionedCodeParams()
+	assert.Equal(CodeParams{"steps": json.Number("1")}, params)
+
+	newVersion, err := store.SetVersionedCodeParams(CodeParams{"steps": json.Number("2")}, version)
+	assert.NoError(err)
+	assert.Equal(version+1, newVersion)
+
+	// a write based on an old version changes nothing
+	current, err := store.SetVersionedCodeParams(CodeParams{"steps": json.Number("3")}, version)
+	assert.Equal(ErrParamsVersionMismatch, err)
+	assert.Equal(newVersion, current)
+	params, _ = store.GetTypedCodeParams()
+	assert.Equal(CodeParams{"steps": json.Number("2")}, params)
+
+	// every other way of changing the params moves the version on too
+	store.UpdateTypedCodeParams(CodeParams{"dt": "0.1"})
+	_, version = store.GetVersionedCodeParams()
+	assert.Equal(newVersion+1, version)
+}
@@ -0,0 +1,184 @@
+package state
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+)
+
+// how long a store's persistence worker waits for a burst of changes to finish before writing them all at once
+var persistDelay = 100 * time.Millisecond
+
+// PersistenceState reports problems with persisting the state
+type PersistenceState struct {
+	// why the state couldn't be read when the daemon restarted
+	ReadError string `json:"readError,omitempty"`
+	// where the state was recovered from instead, the previous copy of the state file or the journal,
+	// empty if nothing could be recovered
+	RecoveredFrom string `json:"recoveredFrom,omitempty"`
+	// why the state couldn't be written the last time it was
+	WriteError string `json:"writeError,omitempty"`
+}
+
+// persist asks for the state to be written to the backend soon, without waiting for it,
+// and tells the store's subscribers what has changed
+// called with the lock held
+func (s *DaemonStore) persist() {
+	s.publishChanges()
+	s.persistOnce.Do(func() {
+		s.persistRequests = make(chan struct{}, 1)
+		go s.persistWorker()
+	})
+	// a write that is already waiting will pick up this change too
+	select {
+	case s.persistRequests <- struct{}{}:
+	default:
+	}
+}
+
+// writes the state whenever it has changed, once the changes have settled
+func (s *DaemonStore) persistWorker() {
+	for range s.persistRequests {
+		time.Sleep(s.persistDelay)
+		// changes made while waiting are included in this write
+		select {
+		case <-s.persistRequests:
+		default:
+		}
+		s.writeState()
+	}
+}
+
+// Flush writes the state to the backend now, returning once it has been written
+func (s *DaemonStore) Flush() error {
+	return s.writeState()
+}
+
+// writes the current state, whether it succeeded is reported in the state
+func (s *DaemonStore) writeState() error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	s.mu.RLock()
+	state := s.stateJSON()
+	s.mu.RUnlock()
+	err := saveState(s.backend, state)
+	if err != nil {
+		log.Println("Couldn't write state to disk: " + err.Error())
+	}
+	// the problem is reported in the state, but isn't itself worth another write
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if s.local.Persistence == nil {
+			s.local.Persistence = &PersistenceState{}
+		}
+		s.local.Persistence.WriteError = err.Error()
+	} else if s.local.Persistence != nil {
+		s.local.Persistence.WriteError = ""
+	}
+	s.publishChanges()
+	return err
+}
+
+// saves the state to a backend, with its secrets saved apart from the rest of it
+// the two can't be saved together, if the daemon stops in between the state is read back
+// with the secrets from the save before, which are merged into it by restoreSecrets
+func saveState(backend Backend, state []byte) error {
+	public, secrets, err := separateSecrets(state)
+	if err != nil {
+		return err
+	}
+	if secrets == nil {
+		secrets = []byte("{}")
+	}
+	// the secrets are saved once the state has been, so a failed save doesn't leave secrets
+	// that don't match the saved state, e.g. those of webhooks that it doesn't have yet
+	if err := backend.Save(public); err != nil {
+		return err
+	}
+	return backend.SaveSecrets(secrets)
+}
+
+// puts the saved secrets back into a state loaded from a backend,
+// the state is used without them if they can't be read, which is added to the report
+func loadSecrets(backend Backend, state []byte, report *PersistenceState) ([]byte, *PersistenceState) {
+	secrets, err := backend.LoadSecrets()
+	if err == nil {
+		var restored []byte
+		if restored, err = restoreSecrets(state, secrets); err == nil {
+			return restored, report
+		}
+	}
+	log.Println("Couldn't read the secrets: " + err.Error())
+	if report == nil {
+		report = &PersistenceState{}
+	}
+	if report.ReadError != "" {
+		report.ReadError += ", "
+	}
+	report.ReadError += "Couldn't read the secrets: " + err.Error()
+	return state, report
+}
+
+// RehydrateFromDisk reads the state from the backend and recreates the internal daemonState of the daemon
+// used as a recovery strategy if the daemon has been killed or crashed
+// if the state had to be recovered, e.g. from a previous copy of it, the problem is reported in the state
+// if nothing can be read the state is left as it is
+func (s *DaemonStore) RehydrateFromDisk() {
+	s.writeMut.Lock()
+	saved, report := s.backend.Load()
+	if saved != nil {
+		saved, report = loadSecrets(s.backend, saved, report)
+	}
+	s.writeMut.Unlock()
+	var daemonState common.DaemonState
+	persisted := persistedState{DaemonState: &daemonState}
+	if saved != nil {
+		if err := json.Unmarshal(saved, &persisted); err != nil {
+			log.Println("Couldn't read state from disk: " + err.Error())
+			saved = nil
+			report = &PersistenceState{ReadError: err.Error()}
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if saved != nil {
+		s.daemonState = daemonState
+		s.local = persisted.localState
+	}
+	// a report from a previous start no longer applies
+	s.local.Persistence = report
+	s.persist()
+}
+
+// SelectBackend moves the state to the backend called name, which is used from then on, including after a restart
+func (s *DaemonStore) SelectBackend(name string) error {
+	s.writeMut.Lock()
+	defer s.writeMut.Unlock()
+	if name == "" {
+		name = BackendJSON
+	}
+	if s.backend.Name() == name {
+		return nil
+	}
+	backend, err := NewBackend(name)
+	if err != nil {
+		return err
+	}
+	s.mu.RLock()
+	state := s.stateJSON()
+	s.mu.RUnlock()
+	if err := saveState(backend, state); err != nil {
+		backend.Close()
+		return err
+	}
+	if err := recordBackend(name); err != nil {
+		backend.Close()
+		return err
+	}
+	s.backend.Close()
+	s.backend = backend
+	return nil
+}
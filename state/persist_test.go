@@ -0,0 +1,132 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupStateFile(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, filepath.Join(dir, "state.json")
+}
+
+func readName(stateFile string) string {
+	saved, err := readStateFile(stateFile)
+	if err != nil {
+		return ""
+	}
+	var daemonState struct {
+		CodeName string `json:"codeName"`
+	}
+	json.Unmarshal(saved, &daemonState)
+	return daemonState.CodeName
+}
+
+func TestPersistCoalesces(t *testing.T) {
+	assert := assert.New(t)
+	dir, stateFile := setupStateFile(t)
+	defer os.RemoveAll(dir)
+	defer func(delay time.Duration) { persistDelay = delay }(persistDelay)
+	persistDelay = 20 * time.Millisecond
+	store := NewStore(NewFileBackend(stateFile))
+
+	// a burst of changes is written once they have settled, in order
+	for _, name := range []string{"a", "b", "c", "d"} {
+		store.SetCodeName(name)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for readName(stateFile) != "d" && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal("d", readName(stateFile))
+	// nothing is left lying around but the state, its backup and the secrets
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		assert.Contains([]string{"state.json", "state.json.bak", "secrets.json"}, f.Name())
+	}
+}
+
+func TestPersistKeepsBackup(t *testing.T) {
+	assert := assert.New(t)
+	dir, stateFile := setupStateFile(t)
+	defer os.RemoveAll(dir)
+	store := NewStore(NewFileBackend(stateFile))
+	store.SetCodeName("first")
+	assert.NoError(store.Flush())
+	store.SetCodeName("second")
+	assert.NoError(store.Flush())
+	assert.Equal("second", readName(stateFile))
+	assert.Equal("first", readName(stateFile+backupSuffix))
+}
+
+func TestRehydrateFallsBack(t *testing.T) {
+	assert := assert.New(t)
+	dir, stateFile := setupStateFile(t)
+	defer os.RemoveAll(dir)
+	store := NewStore(NewFileBackend(stateFile))
+	store.SetCodeName("first")
+	assert.NoError(store.Flush())
+	store.SetCodeName("second")
+	assert.NoError(store.Flush())
+	// a write that was cut short
+	ioutil.WriteFile(stateFile, []byte(`{"codeName": "sec`), 0600)
+
+	rehydrated := NewStore(NewFileBackend(stateFile))
+	rehydrated.RehydrateFromDisk()
+	name, _ := rehydrated.GetCodeName()
+	assert.Equal("first", name)
+	snapshot := rehydrated.Snapshot()
+	assert.NotNil(snapshot.Persistence)
+	assert.NotEmpty(snapshot.Persistence.ReadError)
+	assert.Equal(stateFile+backupSuffix, snapshot.Persistence.RecoveredFrom)
+	// the corrupt file is kept to one side
+	corrupt, err := ioutil.ReadFile(stateFile + corruptSuffix)
+	assert.NoError(err)
+	assert.Equal(`{"codeName": "sec`, string(corrupt))
+
+	// once the recovered state has been written the backup is still the good copy
+	assert.NoError(rehydrated.Flush())
+	assert.Equal("first", readName(stateFile))
+	assert.Equal("first", readName(stateFile+backupSuffix))
+}
+
+func TestRehydrateNothingToRead(t *testing.T) {
+	assert := assert.New(t)
+	dir, stateFile := setupStateFile(t)
+	defer os.RemoveAll(dir)
+
+	// nothing has been written yet, which isn't a problem
+	store := NewStore(NewFileBackend(stateFile))
+	store.RehydrateFromDisk()
+	assert.Nil(store.Snapshot().Persistence)
+
+	// neither copy can be read
+	ioutil.WriteFile(stateFile, []byte{}, 0600)
+	ioutil.WriteFile(stateFile+backupSuffix, []byte("not json"), 0600)
+	store = NewStore(NewFileBackend(stateFile))
+	store.RehydrateFromDisk()
+	snapshot := store.Snapshot()
+	assert.NotNil(snapshot.Persistence)
+	assert.Equal("State file is empty", snapshot.Persistence.ReadError)
+	assert.Empty(snapshot.Persistence.RecoveredFrom)
+	_, ok := store.GetCodeName()
+	assert.False(ok)
+}
+
+func TestPersistWriteError(t *testing.T) {
+	assert := assert.New(t)
+	dir, _ := setupStateFile(t)
+	defer os.RemoveAll(dir)
+	store := NewStore(NewFileBackend(filepath.Join(dir, "missing", "state.json")))
+	assert.Error(store.Flush())
+	assert.NotEmpty(store.Snapshot().Persistence.WriteError)
+}
@@ -0,0 +1,134 @@
+package state
+
+import "time"
+
+// ResultStatus is the status of the results of the code
+type ResultStatus int
+
+const (
+	// ResultWaitingStatus the code is still running, or hasn't started yet
+	ResultWaitingStatus ResultStatus = iota
+	// ResultUploadingStatus the code has finished and the results are being uploaded
+	ResultUploadingStatus
+	// ResultStoppedStatus the upload has completed successfully
+	ResultStoppedStatus
+	// ResultErrorStatus there has been an error whilst uploading the results
+	ResultErrorStatus
+)
+
+// FileSyncStatus is the status of a single results file that is synced while the code runs
+type FileSyncStatus int
+
+const (
+	// FileSyncingStatus the file is being uploaded
+	FileSyncingStatus FileSyncStatus = iota
+	// FileSyncedStatus the file, as described by its checksum, has been uploaded
+	FileSyncedStatus
+	// FileSyncErrorStatus the last attempt to upload the file failed
+	FileSyncErrorStatus
+)
+
+// FileSyncState tracks a single results file
+type FileSyncState struct {
+	Status   FileSyncStatus `json:"status"`
+	SHA256   string         `json:"sha256"`
+	Size     int64          `json:"size"`
+	SyncedAt *time.Time     `json:"syncedAt,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+// ResultsState tracks the progress of the results upload
+type ResultsState struct {
+	Status      ResultStatus `json:"status"`
+	BytesSent   int64        `json:"bytesSent"`
+	BytesTotal  int64        `json:"bytesTotal"`
+	CurrentFile string       `json:"currentFile,omitempty"`
+	Error       string       `json:"error,omitempty"`
+	// keyed by path relative to the results directory
+	Files map[string]FileSyncState `json:"files,omitempty"`
+}
+
+// SetResultStatus moves the results to a new status, and clears any previous error
+// returns an error if the results can't move there from their current status, cause is recorded alongside the transition
+func (s *DaemonStore) SetResultStatus(status ResultStatus, cause string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.setResultStatus(status, cause); err != nil {
+		return err
+	}
+	s.local.Results.Error = ""
+	s.persist()
+	return nil
+}
+
+// SetResultError puts the results into the error status along with the reason
+func (s *DaemonStore) SetResultError(err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if transitionErr := s.setResultStatus(ResultErrorStatus, err.Error()); transitionErr != nil {
+		return transitionErr
+	}
+	s.local.Results.Error = err.Error()
+	s.persist()
+	return nil
+}
+
+// must be called with the state lock held
+func (s *DaemonStore) setResultStatus(status ResultStatus, cause string) error {
+	var from *int
+	if s.local.Results != nil {
+		value := int(s.local.Results.Status)
+		from = &value
+	}
+	if err := s.local.transition(resultMachine, from, int(status), cause); err != nil {
+		return err
+	}
+	s.getResultsState().Status = status
+	return nil
+}
+
+// SetResultProgress sets how far through the upload we are
+func (s *DaemonStore) SetResultProgress(currentFile string, sent int64, total int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := s.getResultsState()
+	results.CurrentFile = currentFile
+	results.BytesSent = sent
+	results.BytesTotal = total
+	s.persist()
+}
+
+// SetResultFileSync records the sync state of a single results file
+func (s *DaemonStore) SetResultFileSync(path string, fileState FileSyncState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	results := s.getResultsState()
+	if results.Files == nil {
+		results.Files = make(map[string]FileSyncState)
+	}
+	results.Files[path] = fileState
+	s.persist()
+}
+
+// GetResultsState return a copy of the results state
+func (s *DaemonStore) GetResultsState() (ResultsState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.local.Results != nil {
+		results := *s.local.Results
+		results.Files = make(map[string]FileSyncState)
+		for path, fileState := range s.local.Results.Files {
+			results.Files[path] = fileState
+		}
+		return results, true
+	}
+	return ResultsState{}, false
+}
+
+// must be called with the state lock held
+func (s *DaemonStore) getResultsState() *ResultsState {
+	if s.local.Results == nil {
+		s.local.Results = &ResultsState{}
+	}
+	return s.local.Results
+}
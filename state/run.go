@@ -0,0 +1,82 @@
+package state
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// RunState describes the most recent run of the code
+type RunState struct {
+	// unique id generated each time the code starts
+	ID        string     `json:"id"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	// only set if the code exited normally
+	ExitCode *int `json:"exitCode,omitempty"`
+	// the process the code is running as, so that it can be found again if the daemon restarts
+	Process *ProcessIdentity `json:"process,omitempty"`
+}
+
+// ProcessIdentity tells a process apart from any later process that is given the same pid
+type ProcessIdentity struct {
+	PID int `json:"pid"`
+	// in clock ticks since the container's host booted, as given in /proc/<pid>/stat
+	StartTime uint64 `json:"startTime"`
+	// what /proc/<pid>/exe links to
+	Executable string `json:"executable"`
+}
+
+// StartRun records that the code has started, generating a new run id
+// the results and steering of any previous run are forgotten
+func (s *DaemonStore) StartRun() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.local.startRun()
+	s.persist()
+	return id
+}
+
+// EndRun records that the code has finished, exitCode is nil if there isn't one
+func (s *DaemonStore) EndRun(exitCode *int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local.endRun(exitCode)
+	s.persist()
+}
+
+// GetRunState return a copy of the run state
+func (s *DaemonStore) GetRunState() (RunState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.local.Run != nil {
+		return *s.local.Run, true
+	}
+	return RunState{}, false
+}
+
+func (l *localState) startRun() string {
+	id := newRunID()
+	l.Run = &RunState{
+		ID:        id,
+		StartTime: time.Now(),
+	}
+	l.Results = nil
+	l.Steering = nil
+	return id
+}
+
+func (l *localState) endRun(exitCode *int) {
+	if l.Run == nil {
+		l.Run = &RunState{ID: newRunID()}
+	}
+	now := time.Now()
+	l.Run.EndTime = &now
+	l.Run.ExitCode = exitCode
+}
+
+func newRunID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,207 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+
+	"github.com/mrmagooey/hpcaas-common"
+)
+
+// a field tagged `sensitive:"true"` is a secret, secrets are never returned by the api, and are
+// persisted apart from the rest of the state, where only the daemon can read them
+
+// the secrets in common.DaemonState, which can't be tagged, by field name,
+// their json names are read from its tags along with those of every other field
+var commonSensitiveFields = []string{"AuthorizationKey", "SSHPrivateKey"}
+
+// sensitivity is a tree of where the secrets are in the json of a type
+type sensitivity struct {
+	secret bool
+	// by json name
+	fields map[string]*sensitivity
+	// the elements of an array, or the values of an object keyed by anything
+	elements *sensitivity
+}
+
+// where the secrets are in the json of the state
+var stateSensitivity = sensitivityOf(reflect.TypeOf(persistedState{}))
+
+// the sensitivity of a type, nil if it doesn't contain any secrets
+func sensitivityOf(t reflect.Type) *sensitivity {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return sensitivityOf(t.Elem())
+	case reflect.Slice, reflect.Array, reflect.Map:
+		if elements := sensitivityOf(t.Elem()); elements != nil {
+			return &sensitivity{elements: elements}
+		}
+	case reflect.Struct:
+		fields := map[string]*sensitivity{}
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "-" || (field.PkgPath != "" && !field.Anonymous) {
+				continue
+			}
+			// the fields of an embedded struct are flattened into its parent
+			if field.Anonymous && name == "" {
+				if embedded := sensitivityOf(field.Type); embedded != nil {
+					for k, v := range embedded.fields {
+						fields[k] = v
+					}
+				}
+				continue
+			}
+			if name == "" {
+				name = field.Name
+			}
+			if field.Tag.Get("sensitive") == "true" || (t == reflect.TypeOf(common.DaemonState{}) && isCommonSensitive(field.Name)) {
+				fields[name] = &sensitivity{secret: true}
+			} else if child := sensitivityOf(field.Type); child != nil {
+				fields[name] = child
+			}
+		}
+		if len(fields) > 0 {
+			return &sensitivity{fields: fields}
+		}
+	}
+	return nil
+}
+
+func isCommonSensitive(name string) bool {
+	for _, sensitive := range commonSensitiveFields {
+		if name == sensitive {
+			return true
+		}
+	}
+	return false
+}
+
+// separates the secrets out of a decoded json value, which is changed in place,
+// returning what is left and the secrets, in a value of the same shape, nil if there aren't any
+func splitSecrets(node *sensitivity, v interface{}) (interface{}, interface{}) {
+	if node == nil {
+		return v, nil
+	}
+	switch value := v.(type) {
+	case map[string]interface{}:
+		secrets := map[string]interface{}{}
+		for key, item := range value {
+			child := node.elements
+			if child == nil {
+				child = node.fields[key]
+			}
+			if child == nil {
+				continue
+			}
+			if child.secret {
+				delete(value, key)
+				secrets[key] = item
+				continue
+			}
+			public, secret := splitSecrets(child, item)
+			value[key] = public
+			if secret != nil {
+				secrets[key] = secret
+			}
+		}
+		if len(secrets) == 0 {
+			return value, nil
+		}
+		return value, secrets
+	case []interface{}:
+		secrets := make([]interface{}, len(value))
+		found := false
+		for i, item := range value {
+			value[i], secrets[i] = splitSecrets(node.elements, item)
+			found = found || secrets[i] != nil
+		}
+		if !found {
+			return value, nil
+		}
+		return value, secrets
+	}
+	return v, nil
+}
+
+// puts the secrets separated out by splitSecrets back into a decoded json value
+func mergeSecrets(v interface{}, secrets interface{}) interface{} {
+	switch secret := secrets.(type) {
+	case map[string]interface{}:
+		value, ok := v.(map[string]interface{})
+		if !ok {
+			value = map[string]interface{}{}
+		}
+		for key, item := range secret {
+			value[key] = mergeSecrets(value[key], item)
+		}
+		return value
+	case []interface{}:
+		value, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		for i, item := range secret {
+			if i < len(value) && item != nil {
+				value[i] = mergeSecrets(value[i], item)
+			}
+		}
+		return value
+	}
+	return secrets
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	// numbers are kept exactly as they were
+	decoder.UseNumber()
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+// separates the secrets out of the json of the state,
+// returning the state without them, and the secrets alone, nil if there aren't any
+func separateSecrets(state []byte) ([]byte, []byte, error) {
+	v, err := decodeJSON(state)
+	if err != nil {
+		return nil, nil, err
+	}
+	public, secrets := splitSecrets(stateSensitivity, v)
+	publicJSON, err := json.Marshal(public)
+	if err != nil || secrets == nil {
+		return publicJSON, nil, err
+	}
+	secretsJSON, err := json.Marshal(secrets)
+	return publicJSON, secretsJSON, err
+}
+
+// puts the secrets separated out by separateSecrets back into the json of the state
+func restoreSecrets(state []byte, secrets []byte) ([]byte, error) {
+	if secrets == nil {
+		return state, nil
+	}
+	v, err := decodeJSON(state)
+	if err != nil {
+		return nil, err
+	}
+	s, err := decodeJSON(secrets)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeSecrets(v, s))
+}
+
+// keeps the secrets in current that next doesn't have, so that a secret can't be lost
+// by writing back the state the api returned, which doesn't include them
+func keepCommonSecrets(next *common.DaemonState, current common.DaemonState) {
+	nextValue := reflect.ValueOf(next).Elem()
+	currentValue := reflect.ValueOf(current)
+	for _, name := range commonSensitiveFields {
+		if field := nextValue.FieldByName(name); field.Kind() == reflect.Ptr && field.IsNil() {
+			field.Set(currentValue.FieldByName(name))
+		}
+	}
+}
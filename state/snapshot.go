@@ -0,0 +1,189 @@
+package state
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+)
+
+// DaemonState is a consistent copy of everything held by a store,
+// the common state shared with the rest of hpcaas along with the daemon's local state
+// the typed code params are only available from GetTypedCodeParams, DaemonState.CodeParams are the string params
+type DaemonState struct {
+	common.DaemonState
+	localState
+}
+
+// deepCopy returns a copy of v that shares no maps, slices or pointers with it
+// unexported fields, e.g. those of time.Time, are copied as they are
+func deepCopy(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type().Elem())
+		copied.Elem().Set(deepCopy(v.Elem()))
+		return copied
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeMap(v.Type())
+		for _, key := range v.MapKeys() {
+			copied.SetMapIndex(key, deepCopy(v.MapIndex(key)))
+		}
+		return copied
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			copied.Index(i).Set(deepCopy(v.Index(i)))
+		}
+		return copied
+	case reflect.Struct:
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if copied.Field(i).CanSet() {
+				copied.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+		return copied
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		copied := reflect.New(v.Type()).Elem()
+		copied.Set(deepCopy(v.Elem()))
+		return copied
+	}
+	return v
+}
+
+func copyCommonState(daemonState common.DaemonState) common.DaemonState {
+	return deepCopy(reflect.ValueOf(daemonState)).Interface().(common.DaemonState)
+}
+
+// a deep copy of the store's contents, called with the lock held
+func (s *DaemonStore) snapshot() DaemonState {
+	return DaemonState{
+		DaemonState: copyCommonState(s.daemonState),
+		localState:  deepCopy(reflect.ValueOf(s.local)).Interface().(localState),
+	}
+}
+
+// Snapshot returns a deep copy of everything in the store, taken at a single point in time
+func (s *DaemonStore) Snapshot() DaemonState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.snapshot()
+}
+
+// Update changes the store as a single transaction, change is given a copy of the state
+// and if it returns nil every change it made is applied at once, otherwise nothing is changed and its error is returned
+// no one else can change the store while change runs, so it mustn't call the store itself or keep hold of the state
+func (s *DaemonStore) Update(change func(*DaemonState) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := s.snapshot()
+	if err := change(&tx); err != nil {
+		return err
+	}
+	// new string params take over from the typed params, as they do with SetDaemonState,
+	// unless they were set along with them
+	if !reflect.DeepEqual(tx.DaemonState.CodeParams, s.daemonState.CodeParams) && tx.CodeParamsVersion == s.local.CodeParamsVersion {
+		tx.localState.CodeParams = nil
+		tx.CodeParamsVersion = s.local.CodeParamsVersion + 1
+	}
+	s.daemonState = tx.DaemonState
+	s.local = tx.localState
+	s.persist()
+	return nil
+}
+
+// GetCodeStatus returns the status of the code
+func (d *DaemonState) GetCodeStatus() (common.CodeStatus, bool) {
+	if d.CodeStatus != nil {
+		return *d.CodeStatus, true
+	}
+	return common.CodeStatus(0), false
+}
+
+// SetCodeStatus moves the code to a new status, returning an error if it can't move there from its current status
+// cause is recorded alongside the transition
+func (d *DaemonState) SetCodeStatus(codeStatus common.CodeStatus, cause string) error {
+	if err := d.localState.transition(codeMachine, codeStatusValue(d.CodeStatus), int(codeStatus), cause); err != nil {
+		return err
+	}
+	d.CodeStatus = &codeStatus
+	return nil
+}
+
+// RequestCodeStatus sets the code status as a client asked for it,
+// the only change a client can make is resetting a code that has finished back to Waiting,
+// the other statuses follow the code's process so only the daemon sets them
+func (d *DaemonState) RequestCodeStatus(codeStatus common.CodeStatus, cause string) error {
+	if current, ok := d.GetCodeStatus(); codeStatus != common.CodeWaitingStatus && (!ok || current != codeStatus) {
+		return errors.New("The code status can only be reset to Waiting, " + CodeStatusName(codeStatus) + " is set by the daemon")
+	}
+	return d.SetCodeStatus(codeStatus, cause)
+}
+
+// StartRun records that the code is running, having been started by method, generating a new run id
+// the pid of any previous run is cleared, along with its results and steering
+func (d *DaemonState) StartRun(method common.StartedStatus) error {
+	cause := "started by the daemon"
+	if method == common.StartedExternallyStatus {
+		cause = "started externally"
+	}
+	if err := d.SetCodeStatus(common.CodeRunningStatus, cause); err != nil {
+		return err
+	}
+	d.CodeStartedStatus = &method
+	d.CodePID = nil
+	d.localState.startRun()
+	return nil
+}
+
+// EndRun records that the code has finished, exitCode is nil if there isn't one
+func (d *DaemonState) EndRun(exitCode *int) {
+	d.localState.endRun(exitCode)
+}
+
+// SetDaemonState overrides the common state as DaemonStore.SetDaemonState does
+func (d *DaemonState) SetDaemonState(newState common.DaemonState) error {
+	keepCommonSecrets(&newState, d.DaemonState)
+	if newState.CodeStatus == nil {
+		newState.CodeStatus = d.CodeStatus
+	} else if err := d.localState.transition(codeMachine, codeStatusValue(d.CodeStatus), int(*newState.CodeStatus), "set by update"); err != nil {
+		return err
+	}
+	d.DaemonState = copyCommonState(newState)
+	// the typed params would be out of date, the new string params take over
+	d.localState.CodeParams = nil
+	d.CodeParamsVersion++
+	return nil
+}
+
+// SetTypedCodeParams overwrites all params with new params, moving them on a version
+func (d *DaemonState) SetTypedCodeParams(params CodeParams) {
+	d.localState.CodeParams = copyParamValue(map[string]interface{}(params)).(map[string]interface{})
+	d.CodeParamsVersion++
+	strings := stringParams(params)
+	d.DaemonState.CodeParams = &strings
+}
+
+// TrackProcess records the process the current run is running as, along with its pid
+func (d *DaemonState) TrackProcess(process ProcessIdentity) {
+	pid := process.PID
+	d.CodePID = &pid
+	if d.Run == nil {
+		d.Run = &RunState{ID: newRunID(), StartTime: time.Now()}
+	}
+	d.Run.Process = &process
+}
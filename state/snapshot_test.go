@@ -0,0 +1,117 @@
+package state
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotIsACopy(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	store.SetCodeArguments([]string{"-v"})
+	store.SetCodeParams(map[string]string{"steps": "10"})
+	store.SetSSHAddresses(common.ContainerAddresses{1: "10.0.0.1:22"})
+	store.StartRun()
+
+	snapshot := store.Snapshot()
+	(*snapshot.CodeArguments)[0] = "-q"
+	(*snapshot.DaemonState.CodeParams)["steps"] = "20"
+	(*snapshot.SSHAddresses)[2] = "10.0.0.2:22"
+	snapshot.Run.ID = "changed"
+
+	args, _ := store.GetCodeArguments()
+	assert.Equal([]string{"-v"}, args)
+	params, _ := store.GetCodeParams()
+	assert.Equal(map[string]string{"steps": "10"}, params)
+	addrs, _ := store.GetSSHAddresses()
+	assert.Len(addrs, 1)
+	run, _ := store.GetRunState()
+	assert.NotEqual("changed", run.ID)
+
+	// neither do the getters hand out the store's own maps and slices
+	args[0] = "-q"
+	params["steps"] = "20"
+	args, _ = store.GetCodeArguments()
+	assert.Equal([]string{"-v"}, args)
+	params, _ = store.GetCodeParams()
+	assert.Equal("10", params["steps"])
+	daemonState := store.GetDaemonState()
+	(*daemonState.CodeParams)["steps"] = "20"
+	params, _ = store.GetCodeParams()
+	assert.Equal("10", params["steps"])
+}
+
+func TestUpdate(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	store.SetCodeName("sim")
+
+	// a failed transaction changes nothing
+	err := store.Update(func(d *DaemonState) error {
+		d.SetCodeStatus(common.CodeRunningStatus, "test")
+		d.StartRun(common.StartedByDaemonStatus)
+		return errors.New("Changed my mind")
+	})
+	assert.Error(err)
+	_, ok := store.GetCodeStatus()
+	assert.False(ok)
+	_, ok = store.GetRunState()
+	assert.False(ok)
+
+	// a successful one changes everything
+	pid := 42
+	assert.NoError(store.Update(func(d *DaemonState) error {
+		d.StartRun(common.StartedExternallyStatus)
+		d.CodePID = &pid
+		return nil
+	}))
+	snapshot := store.Snapshot()
+	status, _ := snapshot.GetCodeStatus()
+	assert.Equal(common.CodeRunningStatus, status)
+	assert.Equal(common.StartedExternallyStatus, *snapshot.CodeStartedStatus)
+	assert.Equal(42, *snapshot.CodePID)
+	assert.NotNil(snapshot.Run)
+
+	// changing the string params replaces the typed params, as SetDaemonState does
+	store.SetTypedCodeParams(CodeParams{"steps": 10})
+	_, version := store.GetVersionedCodeParams()
+	assert.NoError(store.Update(func(d *DaemonState) error {
+		d.DaemonState.CodeParams = &map[string]string{"steps": "20"}
+		return nil
+	}))
+	typed, newVersion := store.GetVersionedCodeParams()
+	assert.Equal(CodeParams{"steps": "20"}, typed)
+	assert.Equal(version+1, newVersion)
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	pid := 0
+	store.SetCodePID(pid)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.Update(func(d *DaemonState) error {
+				next := *d.CodePID + 1
+				d.CodePID = &next
+				return nil
+			})
+		}()
+		// reads see a whole transaction or none of it
+		go func() {
+			defer wg.Done()
+			snapshot := store.Snapshot()
+			assert.NotNil(snapshot.CodePID)
+		}()
+	}
+	wg.Wait()
+	pid, _ = store.GetCodePID()
+	assert.Equal(50, pid)
+}
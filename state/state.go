@@ -2,307 +2,302 @@ package state
 
 import (
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"sync"
 
-	"github.com/imdario/mergo"
 	"github.com/mrmagooey/hpcaas-common"
 )
 
-var stateFile = "/hpcaas/daemon/state.json"
+// localState is state that only this daemon cares about, it isn't part of common.DaemonState
+// but is persisted alongside it
+type localState struct {
+	DaemonConfiguration *DaemonConfiguration       `json:"daemonConfiguration,omitempty"`
+	Results             *ResultsState              `json:"results,omitempty"`
+	Run                 *RunState                  `json:"run,omitempty"`
+	CodeParams          CodeParams                 `json:"typedCodeParams,omitempty"`
+	CodeParamsVersion   uint64                     `json:"codeParamsVersion,omitempty"`
+	Files               map[string]FileState       `json:"files,omitempty"`
+	Uploads             map[string]UploadState     `json:"uploads,omitempty"`
+	Fetches             map[string]FetchState      `json:"fetches,omitempty"`
+	Steering            *SteeringState             `json:"steering,omitempty"`
+	Persistence         *PersistenceState          `json:"persistence,omitempty"`
+	ContainerStatus     *ContainerStatus           `json:"containerStatus,omitempty"`
+	Transitions         []StatusTransition         `json:"transitions,omitempty"`
+	WebhookDeliveries   map[string]WebhookDelivery `json:"webhookDeliveries,omitempty"`
+}
 
-// set defaults
-var daemonState = common.DaemonState{}
-var stateRWMutex = sync.RWMutex{}
+// persistedState is the shape of the state file and of the state api,
+// the common and local state are flattened into a single json object
+type persistedState struct {
+	*common.DaemonState
+	localState
+}
 
 // GetDaemonState return a copy of the daemon state
-func GetDaemonState() common.DaemonState {
-	return daemonState
+func (s *DaemonStore) GetDaemonState() common.DaemonState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copyCommonState(s.daemonState)
 }
 
 // SetDaemonState takes a daemon state and overrides the daemons state
-func SetDaemonState(newState common.DaemonState) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	mergo.MergeWithOverwrite(daemonState, newState)
-	daemonState = newState
-	// save to disk
-	go dehydrateToDisk()
-}
-
-// GetStateJSON return current state as json
-func GetStateJSON() []byte {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	sj, _ := json.Marshal(daemonState)
-	return sj
+// except for the code status, which is kept if newState doesn't have one, and otherwise has to be a legal transition,
+// and the secrets, which are kept if newState doesn't have them
+func (s *DaemonStore) SetDaemonState(newState common.DaemonState) error {
+	return s.Update(func(d *DaemonState) error {
+		return d.SetDaemonState(newState)
+	})
 }
 
-var dehydrateMut = sync.Mutex{}
+// GetStateJSON return current state as json, without its secrets, which can only be written
+func (s *DaemonStore) GetStateJSON() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.publicStateJSON()
+}
 
-// saves the daemonState to disk, is thread-safe
-// used as a recovery strategy if the daemon has been killed or crashed
-func dehydrateToDisk() {
-	dehydrateMut.Lock()
-	defer dehydrateMut.Unlock()
-	err := ioutil.WriteFile(stateFile, GetStateJSON(), 0777)
-	if err != nil {
-		// TODO
-		fmt.Println("Couldn't write state to disk")
-	}
+// the whole state as json, secrets included, called with the lock held
+func (s *DaemonStore) stateJSON() []byte {
+	sj, _ := json.Marshal(persistedState{&s.daemonState, s.local})
+	return sj
 }
 
-// RehydrateFromDisk reads from the state.json file on disk and recreates the internal daemonState of the daemon
-// used as a recovery strategy if the daemon has been killed or crashed
-// best-effort attempt, if the file is bad or missing this function will not complain
-func RehydrateFromDisk() {
-	file, err := ioutil.ReadFile(stateFile)
-	if err != nil {
-		// the file doesn't exist or is unreadable
-		// could happen if the daemon previously started but didn't manage to write any daemonState
-		fmt.Println("Couldn't read state from disk")
-	}
-	if e := json.Unmarshal(file, &daemonState); e != nil {
-		// TODO the file has been corrupted
-		fmt.Println("Couldn't read state from disk")
-	}
+// the state as json without its secrets, called with the lock held
+func (s *DaemonStore) publicStateJSON() []byte {
+	public, _, _ := separateSecrets(s.stateJSON())
+	return public
 }
 
 // SetCodeName safely sets codeName
-func SetCodeName(name string) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodeName = &name
-	go dehydrateToDisk()
+func (s *DaemonStore) SetCodeName(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.CodeName = &name
+	s.persist()
 }
 
 // GetCodeName safely sets codeState
-func GetCodeName() (name string, exists bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodeName != nil {
-		return *daemonState.CodeName, true
+func (s *DaemonStore) GetCodeName() (name string, exists bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodeName != nil {
+		return *s.daemonState.CodeName, true
 	}
 	return "", false
 }
 
-// SetCodeStatus safely sets codeState
-func SetCodeStatus(codeStatus common.CodeStatus) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodeStatus = &codeStatus
-	go dehydrateToDisk()
+// SetCodeStatus moves the code to a new status, returning an error if it can't move there from its current status
+// cause is recorded alongside the transition
+func (s *DaemonStore) SetCodeStatus(codeStatus common.CodeStatus, cause string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.local.transition(codeMachine, codeStatusValue(s.daemonState.CodeStatus), int(codeStatus), cause); err != nil {
+		return err
+	}
+	s.daemonState.CodeStatus = &codeStatus
+	s.persist()
+	return nil
 }
 
 // GetCodeStatus returns codeState
-func GetCodeStatus() (common.CodeStatus, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodeStatus != nil {
-		return *daemonState.CodeStatus, true
+func (s *DaemonStore) GetCodeStatus() (common.CodeStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodeStatus != nil {
+		return *s.daemonState.CodeStatus, true
 	}
 	return common.CodeStatus(0), false
 }
 
-// merge two map[string]interface{}'s
-// second argument overrides the first
-func mergeCodeParams(original map[string]string, second map[string]string) map[string]string {
-	updated := make(map[string]string)
-	for k, v := range original {
-		updated[k] = v
-	}
-	for k, v := range second {
-		updated[k] = v
-	}
-	return updated
-}
-
-// UpdateCodeParams merge new params with existing params, overwriting as necessary
-func UpdateCodeParams(params map[string]string) error {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	merged := mergeCodeParams(*daemonState.CodeParams, params)
-	daemonState.CodeParams = &merged
-	go dehydrateToDisk()
+// UpdateCodeParams merge new string params with existing params, overwriting as necessary
+func (s *DaemonStore) UpdateCodeParams(params map[string]string) error {
+	s.UpdateTypedCodeParams(typedParams(params))
 	return nil
 }
 
-// SetCodeParams overwrite all params with new params
-func SetCodeParams(params map[string]string) error {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodeParams = &params
-	go dehydrateToDisk()
+// SetCodeParams overwrite all params with new string params
+func (s *DaemonStore) SetCodeParams(params map[string]string) error {
+	s.SetTypedCodeParams(typedParams(params))
 	return nil
 }
 
-// GetCodeParams return codeParams
-func GetCodeParams() (map[string]string, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodeParams != nil {
-		return *daemonState.CodeParams, true
+// GetCodeParams return codeParams, with every value serialised as a string as by ParamString
+func (s *DaemonStore) GetCodeParams() (map[string]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodeParams != nil {
+		params := make(map[string]string, len(*s.daemonState.CodeParams))
+		for k, v := range *s.daemonState.CodeParams {
+			params[k] = v
+		}
+		return params, true
 	}
 	return nil, false
 }
 
 // SetSSHAddresses set ssh addresses
-func SetSSHAddresses(addrs common.ContainerAddresses) error {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.SSHAddresses = &addrs
-	go dehydrateToDisk()
+func (s *DaemonStore) SetSSHAddresses(addrs common.ContainerAddresses) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := make(common.ContainerAddresses, len(addrs))
+	for k, v := range addrs {
+		copied[k] = v
+	}
+	s.daemonState.SSHAddresses = &copied
+	s.persist()
 	return nil
 }
 
 // GetSSHAddresses return sshAddresses
-func GetSSHAddresses() (common.ContainerAddresses, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.SSHAddresses != nil {
-		return *daemonState.SSHAddresses, true
+func (s *DaemonStore) GetSSHAddresses() (common.ContainerAddresses, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.SSHAddresses != nil {
+		addrs := make(common.ContainerAddresses, len(*s.daemonState.SSHAddresses))
+		for k, v := range *s.daemonState.SSHAddresses {
+			addrs[k] = v
+		}
+		return addrs, true
 	}
 	return nil, false
 }
 
 // SetAuthorizationKey sets auth key
-func SetAuthorizationKey(key string) error {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.AuthorizationKey = &key
-	go dehydrateToDisk()
+func (s *DaemonStore) SetAuthorizationKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.AuthorizationKey = &key
+	s.persist()
 	return nil
 }
 
 // GetAuthorizationKey gets auth key
-func GetAuthorizationKey() (string, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.AuthorizationKey != nil {
-		return *daemonState.AuthorizationKey, true
+func (s *DaemonStore) GetAuthorizationKey() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.AuthorizationKey != nil {
+		return *s.daemonState.AuthorizationKey, true
 	}
 	return "", false
 }
 
 // SetCodeArguments set code arguments
 // these the passed to the user executable on startup
-func SetCodeArguments(args []string) error {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodeArguments = &args
-	go dehydrateToDisk()
+func (s *DaemonStore) SetCodeArguments(args []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	copied := append([]string(nil), args...)
+	s.daemonState.CodeArguments = &copied
+	s.persist()
 	return nil
 }
 
 // GetCodeArguments return code arguments
-func GetCodeArguments() ([]string, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodeArguments != nil {
-		return *daemonState.CodeArguments, true
+func (s *DaemonStore) GetCodeArguments() ([]string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodeArguments != nil {
+		return append([]string(nil), *s.daemonState.CodeArguments...), true
 	}
 	return nil, false
 }
 
 // SetCodeStdout set the stdout of the user code
-func SetCodeStdout(stdout string) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodeStdout = &stdout
+func (s *DaemonStore) SetCodeStdout(stdout string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.CodeStdout = &stdout
 }
 
 // GetCodeStdout get the stdout of the code
-func GetCodeStdout() (string, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodeStdout != nil {
-		return *daemonState.CodeStdout, true
+func (s *DaemonStore) GetCodeStdout() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodeStdout != nil {
+		return *s.daemonState.CodeStdout, true
 	}
 	return "", false
 }
 
 // SetCodeStderr set the stderr of the user code
-func SetCodeStderr(stderr string) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodeStderr = &stderr
+func (s *DaemonStore) SetCodeStderr(stderr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.CodeStderr = &stderr
 }
 
 // GetCodeStderr get the stderr of the user code
-func GetCodeStderr() (string, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodeStderr != nil {
-		return *daemonState.CodeStderr, true
+func (s *DaemonStore) GetCodeStderr() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodeStderr != nil {
+		return *s.daemonState.CodeStderr, true
 	}
 	return "", false
 }
 
 // SetCodePID set the user code PID
-func SetCodePID(pid int) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodePID = &pid
+func (s *DaemonStore) SetCodePID(pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.CodePID = &pid
 }
 
 // GetCodePID get the user code PID
-func GetCodePID() (int, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodePID != nil {
-		return *daemonState.CodePID, true
+func (s *DaemonStore) GetCodePID() (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodePID != nil {
+		return *s.daemonState.CodePID, true
 	}
 	return 0, false
 }
 
 // SetCodeStartedMethod set the user code start method
-func SetCodeStartedMethod(method common.StartedStatus) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.CodeStartedStatus = &method
+func (s *DaemonStore) SetCodeStartedMethod(method common.StartedStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.CodeStartedStatus = &method
 }
 
 // GetCodeStartedMethod get the user code start method
-func GetCodeStartedMethod() (common.StartedStatus, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.CodeStartedStatus != nil {
-		return *daemonState.CodeStartedStatus, true
+func (s *DaemonStore) GetCodeStartedMethod() (common.StartedStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.CodeStartedStatus != nil {
+		return *s.daemonState.CodeStartedStatus, true
 	}
 	return common.StartedStatus(0), false
 }
 
 // SetSSHPrivateKey set the private key
-func SetSSHPrivateKey(priv string) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.SSHPrivateKey = &priv
+func (s *DaemonStore) SetSSHPrivateKey(priv string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.SSHPrivateKey = &priv
 }
 
 // GetSSHPrivateKey get the ssh private key
-func GetSSHPrivateKey() (string, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.SSHPrivateKey != nil {
-		return *daemonState.SSHPrivateKey, true
+func (s *DaemonStore) GetSSHPrivateKey() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.SSHPrivateKey != nil {
+		return *s.daemonState.SSHPrivateKey, true
 	}
 	return "", false
 }
 
 // SetSSHPublicKey set the public key
-func SetSSHPublicKey(priv string) {
-	stateRWMutex.Lock()
-	defer stateRWMutex.Unlock()
-	daemonState.SSHPublicKey = &priv
+func (s *DaemonStore) SetSSHPublicKey(priv string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.daemonState.SSHPublicKey = &priv
 }
 
 // GetSSHPublicKey get the ssh public key
-func GetSSHPublicKey() (string, bool) {
-	stateRWMutex.RLock()
-	defer stateRWMutex.RUnlock()
-	if daemonState.SSHPublicKey != nil {
-		return *daemonState.SSHPublicKey, true
+func (s *DaemonStore) GetSSHPublicKey() (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.daemonState.SSHPublicKey != nil {
+		return *s.daemonState.SSHPublicKey, true
 	}
 	return "", false
 
@@ -2,12 +2,12 @@ package state
 
 import "testing"
 import "github.com/stretchr/testify/assert"
+import "github.com/mrmagooey/hpcaas-common"
 import "os"
-import "io/ioutil"
-import "time"
+import "path/filepath"
 
 var codeName = "ls"
-var codeState = CodeMissingState
+var codeStatus = common.CodeMissingStatus
 
 var codeArgs = []string{"hi", "world"}
 
@@ -16,35 +16,55 @@ var params = map[string]string{
 	"stuff": "2",
 }
 
-var sshAddrs = ContainerAddresses{
+var sshAddrs = common.ContainerAddresses{
 	1: "255.255.255.255:8000",
 	2: "255.255.255.255:88",
 }
 
+// sets every item, checking that each can be read back from store
+func setAndCheckState(assert *assert.Assertions, store Store) {
+	assert.NoError(store.SetCodeStatus(codeStatus, "test"))
+	store.SetCodeName(codeName)
+	assert.NoError(store.SetCodeParams(params))
+	assert.NoError(store.SetSSHAddresses(sshAddrs))
+	assert.NoError(store.SetCodeArguments(codeArgs))
+	checkState(assert, store)
+}
+
+func checkState(assert *assert.Assertions, store Store) {
+	status, _ := store.GetCodeStatus()
+	assert.Equal(codeStatus, status)
+	name, _ := store.GetCodeName()
+	assert.Equal(codeName, name)
+	p, _ := store.GetCodeParams()
+	assert.Equal(params, p)
+	addrs, _ := store.GetSSHAddresses()
+	assert.Equal(sshAddrs, addrs)
+	args, _ := store.GetCodeArguments()
+	assert.Equal(codeArgs, args)
+}
+
 func TestGetAndSetState(t *testing.T) {
-	InitState()
 	assert := assert.New(t)
-	SetCodeState(codeState)
-	SetCodeName(codeName)
-	SetCodeParams(params)
-	SetSSHAddresses(sshAddrs)
-	SetCodeArguments(codeArgs)
-	assert.Equal(codeState, GetCodeState())
-	assert.Equal(codeName, GetCodeName())
-	assert.Equal(params, GetCodeParams())
-	assert.Equal(sshAddrs, GetSSHAddresses())
-	assert.Equal(codeArgs, GetCodeArguments())
+	setAndCheckState(assert, NewStore(NewMemoryBackend()))
 }
 
 func TestHydration(t *testing.T) {
-	InitState()
 	assert := assert.New(t)
+	dir, stateFile := setupStateFile(t)
+	defer os.RemoveAll(dir)
+	store := NewStore(NewFileBackend(stateFile))
+	setAndCheckState(assert, store)
+	store.SetAuthorizationKey("lol")
+	assert.NoError(store.Flush())
 	// state file exists
 	_, err := os.Stat(stateFile)
 	assert.NoError(err)
-	// check contents of file
-	SetAuthorizationKey("lol")
-	time.Sleep(10 * time.Millisecond)
-	contents, err := ioutil.ReadFile(stateFile)
-	assert.Contains(string(contents), "\"authorizationKey\":\"lol\"")
+
+	// everything comes back when the daemon restarts
+	rehydrated := NewStore(NewFileBackend(filepath.Join(dir, "state.json")))
+	rehydrated.RehydrateFromDisk()
+	checkState(assert, rehydrated)
+	key, _ := rehydrated.GetAuthorizationKey()
+	assert.Equal("lol", key)
 }
@@ -0,0 +1,63 @@
+package state
+
+import "time"
+
+// SteeringState describes the most recent notification to the running code that its parameters have changed
+type SteeringState struct {
+	// version of the params that the code was told about
+	Version uint64 `json:"version"`
+	// signal name, or socket
+	Method   string    `json:"method"`
+	Notified time.Time `json:"notified"`
+	// set once the code reports that it has read this version, or a later one
+	Acknowledged *time.Time `json:"acknowledged,omitempty"`
+	// why the code couldn't be told, or didn't acknowledge in time
+	Error string `json:"error,omitempty"`
+}
+
+// SetSteering records that the code has been told about a new version of the params
+func (s *DaemonStore) SetSteering(steering SteeringState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.local.Steering = &steering
+	s.persist()
+}
+
+// AcknowledgeSteering records that the code has read version of the params
+// an acknowledgement of an older version than the code was last told about is ignored
+func (s *DaemonStore) AcknowledgeSteering(version uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	steering := s.local.Steering
+	if steering == nil || version < steering.Version || steering.Acknowledged != nil {
+		return false
+	}
+	now := time.Now()
+	steering.Acknowledged = &now
+	steering.Error = ""
+	s.persist()
+	return true
+}
+
+// SteeringFailed records why the code didn't acknowledge version of the params,
+// unless it has since been told about a later version
+func (s *DaemonStore) SteeringFailed(version uint64, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	steering := s.local.Steering
+	if steering == nil || steering.Version != version || steering.Acknowledged != nil {
+		return
+	}
+	steering.Error = reason
+	s.persist()
+}
+
+// GetSteering return a copy of the steering state
+func (s *DaemonStore) GetSteering() (SteeringState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.local.Steering != nil {
+		return *s.local.Steering, true
+	}
+	return SteeringState{}, false
+}
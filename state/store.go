@@ -0,0 +1,126 @@
+package state
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+)
+
+// Store holds everything the daemon knows, the common state shared with the rest of hpcaas
+// along with the daemon's local state
+// a Store is constructed in main and passed to whatever needs it, tests can create as many as they like
+type Store interface {
+	// consistent reads and atomic changes of everything in the store
+	Snapshot() DaemonState
+	Update(change func(*DaemonState) error) error
+
+	// the common state, and persistence
+	GetDaemonState() common.DaemonState
+	SetDaemonState(newState common.DaemonState) error
+	GetStateJSON() []byte
+	RehydrateFromDisk()
+	Flush() error
+	SelectBackend(name string) error
+	SetCodeName(name string)
+	GetCodeName() (name string, exists bool)
+	SetCodeStatus(codeStatus common.CodeStatus, cause string) error
+	GetCodeStatus() (common.CodeStatus, bool)
+	UpdateCodeParams(params map[string]string) error
+	SetCodeParams(params map[string]string) error
+	GetCodeParams() (map[string]string, bool)
+	SetSSHAddresses(addrs common.ContainerAddresses) error
+	GetSSHAddresses() (common.ContainerAddresses, bool)
+	SetAuthorizationKey(key string) error
+	GetAuthorizationKey() (string, bool)
+	SetCodeArguments(args []string) error
+	GetCodeArguments() ([]string, bool)
+	SetCodeStdout(stdout string)
+	GetCodeStdout() (string, bool)
+	SetCodeStderr(stderr string)
+	GetCodeStderr() (string, bool)
+	SetCodePID(pid int)
+	GetCodePID() (int, bool)
+	SetCodeStartedMethod(method common.StartedStatus)
+	GetCodeStartedMethod() (common.StartedStatus, bool)
+	SetSSHPrivateKey(priv string)
+	GetSSHPrivateKey() (string, bool)
+	SetSSHPublicKey(priv string)
+	GetSSHPublicKey() (string, bool)
+
+	// daemon configuration
+	SetDaemonConfiguration(conf DaemonConfiguration)
+	GetDaemonConfiguration() (DaemonConfiguration, bool)
+
+	// files fetched from urls
+	SetFetch(fetch FetchState)
+	GetFetches() map[string]FetchState
+	UnfinishedFetches() []string
+
+	// files sent to the daemon
+	SetFile(file FileState)
+	GetFiles() map[string]FileState
+
+	// typed and versioned code parameters
+	SetTypedCodeParams(params CodeParams)
+	UpdateTypedCodeParams(params CodeParams)
+	GetTypedCodeParams() (CodeParams, bool)
+	GetVersionedCodeParams() (CodeParams, uint64)
+	SetVersionedCodeParams(params CodeParams, version uint64) (uint64, error)
+
+	// results uploads
+	SetResultStatus(status ResultStatus, cause string) error
+	SetResultError(err error) error
+	SetResultProgress(currentFile string, sent int64, total int64)
+	SetResultFileSync(path string, fileState FileSyncState)
+	GetResultsState() (ResultsState, bool)
+
+	// runs of the code
+	StartRun() string
+	EndRun(exitCode *int)
+	GetRunState() (RunState, bool)
+
+	// the container status, and the history of every status
+	SetContainerStatus(status ContainerStatus, cause string) error
+	GetContainerStatus() (ContainerStatus, bool)
+	GetTransitions() []StatusTransition
+
+	// deliveries of lifecycle events to webhooks
+	SetWebhookDelivery(delivery WebhookDelivery)
+	GetWebhookDeliveries() []WebhookDelivery
+
+	// changes to the state as they happen
+	Subscribe(boot string, after uint64) *Subscription
+
+	// steering of the running code
+	SetSteering(steering SteeringState)
+	AcknowledgeSteering(version uint64) bool
+	SteeringFailed(version uint64, reason string)
+	GetSteering() (SteeringState, bool)
+
+	// resumable uploads
+	SetUpload(upload UploadState)
+	GetUpload(id string) (UploadState, bool)
+	GetUploads() map[string]UploadState
+	RemoveUpload(id string)
+}
+
+// DaemonStore is the default Store, held in memory and persisted to a json file
+type DaemonStore struct {
+	mu          sync.RWMutex
+	daemonState common.DaemonState
+	local       localState
+	// where the state is persisted, changes are written by a single worker, one write at a time
+	backend         Backend
+	persistOnce     sync.Once
+	persistRequests chan struct{}
+	persistDelay    time.Duration
+	writeMut        sync.Mutex
+	// the changes to the state are published to subscribers
+	events eventBus
+}
+
+// NewStore creates an empty store that is persisted to backend
+func NewStore(backend Backend) *DaemonStore {
+	return &DaemonStore{backend: backend, persistDelay: persistDelay, events: eventBus{boot: newRunID(), historyLimit: eventHistoryLimit}}
+}
@@ -0,0 +1,45 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStoresAreIndependent(t *testing.T) {
+	assert := assert.New(t)
+	first := NewStore(NewMemoryBackend())
+	second := NewStore(NewMemoryBackend())
+	first.SetCodeName("first")
+	first.SetTypedCodeParams(CodeParams{"steps": "10"})
+
+	name, ok := first.GetCodeName()
+	assert.True(ok)
+	assert.Equal("first", name)
+	_, ok = second.GetCodeName()
+	assert.False(ok)
+	_, ok = second.GetTypedCodeParams()
+	assert.False(ok)
+	_, version := second.GetVersionedCodeParams()
+	assert.Equal(uint64(0), version)
+}
+
+func TestStoreRehydrate(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "store")
+	assert.NoError(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+	store := NewStore(NewFileBackend(stateFile))
+	store.SetCodeName("persisted")
+	assert.NoError(store.Flush())
+
+	rehydrated := NewStore(NewFileBackend(stateFile))
+	rehydrated.RehydrateFromDisk()
+	name, ok := rehydrated.GetCodeName()
+	assert.True(ok)
+	assert.Equal("persisted", name)
+}
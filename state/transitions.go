@@ -0,0 +1,225 @@
+package state
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+)
+
+// ContainerStatus is the status of the container's own services
+type ContainerStatus int
+
+const (
+	// ContainerRunningStatus all container services are properly running
+	ContainerRunningStatus ContainerStatus = iota
+	// ContainerFSErrorStatus the distributed file system has failed
+	ContainerFSErrorStatus
+)
+
+// CodeLostStatus the code was running when the daemon stopped, and its process had gone by the time the daemon restarted,
+// so how it finished isn't known. It is kept well clear of the statuses in hpcaas-common, which it extends
+const CodeLostStatus common.CodeStatus = 100
+
+// the names of the statuses of each state machine, used in transition records and errors
+var codeStatusNames = map[int]string{
+	int(common.CodeWaitingStatus):       "Waiting",
+	int(common.CodeRunningStatus):       "Running",
+	int(common.CodeStoppedStatus):       "Stopped",
+	int(common.CodeKilledStatus):        "Killed",
+	int(common.CodeErrorStatus):         "Error",
+	int(common.CodeMissingStatus):       "Missing",
+	int(common.CodeFailedToStartStatus): "FailedToStart",
+	int(common.CodeFailedToKillStatus):  "FailedToKill",
+	int(CodeLostStatus):                 "Lost",
+}
+
+var resultStatusNames = map[int]string{
+	int(ResultWaitingStatus):   "Waiting",
+	int(ResultUploadingStatus): "Uploading",
+	int(ResultStoppedStatus):   "Stopped",
+	int(ResultErrorStatus):     "Error",
+}
+
+var containerStatusNames = map[int]string{
+	int(ContainerRunningStatus): "Running",
+	int(ContainerFSErrorStatus): "FSError",
+}
+
+// statusMachine is the graph of legal transitions between the statuses of one kind of status
+type statusMachine struct {
+	name     string
+	statuses map[int]string
+	// the statuses that can be moved to before there is any status
+	initial []int
+	next    map[int][]int
+}
+
+// the code is waiting to be started, and once it has finished it can be reset to wait for the next start
+var codeMachine = statusMachine{
+	name:     "code",
+	statuses: codeStatusNames,
+	initial: []int{
+		int(common.CodeWaitingStatus), int(common.CodeRunningStatus),
+		int(common.CodeMissingStatus), int(common.CodeFailedToStartStatus),
+	},
+	next: map[int][]int{
+		int(common.CodeWaitingStatus): {
+			int(common.CodeRunningStatus), int(common.CodeMissingStatus), int(common.CodeFailedToStartStatus),
+		},
+		// the code is running from when it is claimed, until it fails to start or exits
+		int(common.CodeRunningStatus): {
+			int(common.CodeStoppedStatus), int(common.CodeErrorStatus), int(common.CodeKilledStatus),
+			int(common.CodeFailedToStartStatus), int(CodeLostStatus),
+		},
+		// a killed code is stopped once its exit has been seen, or may not be killable,
+		// it can't be reset before then as the process may still be running
+		int(common.CodeKilledStatus): {
+			int(common.CodeStoppedStatus), int(common.CodeFailedToKillStatus), int(CodeLostStatus),
+		},
+		int(common.CodeFailedToKillStatus): {
+			int(common.CodeStoppedStatus), int(common.CodeErrorStatus), int(CodeLostStatus),
+		},
+		int(common.CodeStoppedStatus):       {int(common.CodeWaitingStatus)},
+		int(common.CodeErrorStatus):         {int(common.CodeWaitingStatus)},
+		int(common.CodeMissingStatus):       {int(common.CodeWaitingStatus)},
+		int(common.CodeFailedToStartStatus): {int(common.CodeWaitingStatus)},
+		int(CodeLostStatus):                 {int(common.CodeWaitingStatus)},
+	},
+}
+
+// the results of a run are uploaded, possibly more than once, the results are reset when the next run starts
+var resultMachine = statusMachine{
+	name:     "result",
+	statuses: resultStatusNames,
+	initial:  []int{int(ResultWaitingStatus), int(ResultUploadingStatus), int(ResultErrorStatus)},
+	next: map[int][]int{
+		int(ResultWaitingStatus):   {int(ResultUploadingStatus), int(ResultErrorStatus)},
+		int(ResultUploadingStatus): {int(ResultStoppedStatus), int(ResultErrorStatus)},
+		int(ResultStoppedStatus):   {int(ResultUploadingStatus), int(ResultErrorStatus)},
+		int(ResultErrorStatus):     {int(ResultUploadingStatus)},
+	},
+}
+
+var containerMachine = statusMachine{
+	name:     "container",
+	statuses: containerStatusNames,
+	initial:  []int{int(ContainerRunningStatus), int(ContainerFSErrorStatus)},
+	next: map[int][]int{
+		int(ContainerRunningStatus): {int(ContainerFSErrorStatus)},
+		int(ContainerFSErrorStatus): {int(ContainerRunningStatus)},
+	},
+}
+
+func (m statusMachine) statusName(status int) string {
+	if name, ok := m.statuses[status]; ok {
+		return name
+	}
+	return strconv.Itoa(status)
+}
+
+// CodeStatusName returns the name that transitions and errors use for the code status
+func CodeStatusName(status common.CodeStatus) string {
+	return codeMachine.statusName(int(status))
+}
+
+// check returns an error describing why the status can't move from from to to, from is nil if there is no status yet
+// staying in the same status is always allowed
+func (m statusMachine) check(from *int, to int) error {
+	if _, ok := m.statuses[to]; !ok {
+		return errors.New("Unknown " + m.name + " status: " + strconv.Itoa(to))
+	}
+	allowed := m.initial
+	if from != nil {
+		if *from == to {
+			return nil
+		}
+		allowed = m.next[*from]
+	}
+	for _, status := range allowed {
+		if status == to {
+			return nil
+		}
+	}
+	if from == nil {
+		return errors.New("The " + m.name + " status can't start as " + m.statusName(to))
+	}
+	return errors.New("The " + m.name + " status can't change from " + m.statusName(*from) + " to " + m.statusName(to))
+}
+
+// StatusTransition records a single change of status
+type StatusTransition struct {
+	// code, result or container
+	Machine string `json:"machine"`
+	// empty if there was no status before
+	From  string    `json:"from,omitempty"`
+	To    string    `json:"to"`
+	Time  time.Time `json:"time"`
+	Cause string    `json:"cause"`
+}
+
+// only the most recent transitions are kept
+var transitionHistoryLimit = 100
+
+// checks the transition and records it, staying in the same status isn't recorded
+func (l *localState) transition(m statusMachine, from *int, to int, cause string) error {
+	if err := m.check(from, to); err != nil {
+		return err
+	}
+	if from != nil && *from == to {
+		return nil
+	}
+	record := StatusTransition{Machine: m.name, To: m.statusName(to), Time: time.Now(), Cause: cause}
+	if from != nil {
+		record.From = m.statusName(*from)
+	}
+	l.Transitions = append(l.Transitions, record)
+	if len(l.Transitions) > transitionHistoryLimit {
+		l.Transitions = append([]StatusTransition(nil), l.Transitions[len(l.Transitions)-transitionHistoryLimit:]...)
+	}
+	return nil
+}
+
+// the code status as an int, nil if there isn't one
+func codeStatusValue(status *common.CodeStatus) *int {
+	if status == nil {
+		return nil
+	}
+	value := int(*status)
+	return &value
+}
+
+// SetContainerStatus moves the container to a new status, cause is recorded alongside the transition
+func (s *DaemonStore) SetContainerStatus(status ContainerStatus, cause string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var from *int
+	if s.local.ContainerStatus != nil {
+		value := int(*s.local.ContainerStatus)
+		from = &value
+	}
+	if err := s.local.transition(containerMachine, from, int(status), cause); err != nil {
+		return err
+	}
+	s.local.ContainerStatus = &status
+	s.persist()
+	return nil
+}
+
+// GetContainerStatus returns the container status
+func (s *DaemonStore) GetContainerStatus() (ContainerStatus, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.local.ContainerStatus != nil {
+		return *s.local.ContainerStatus, true
+	}
+	return ContainerStatus(0), false
+}
+
+// GetTransitions returns the most recent status transitions, oldest first
+func (s *DaemonStore) GetTransitions() []StatusTransition {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]StatusTransition(nil), s.local.Transitions...)
+}
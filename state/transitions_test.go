@@ -0,0 +1,117 @@
+package state
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodeTransitions(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+
+	// a code can't be stopped before it has run
+	err := store.SetCodeStatus(common.CodeStoppedStatus, "test")
+	assert.EqualError(err, "The code status can't start as Stopped")
+	assert.NoError(store.SetCodeStatus(common.CodeWaitingStatus, "container created"))
+	assert.NoError(store.SetCodeStatus(common.CodeWaitingStatus, "again"))
+	assert.NoError(store.SetCodeStatus(common.CodeRunningStatus, "started"))
+	// a running code can't be put back to waiting, it has to finish first
+	err = store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	assert.EqualError(err, "The code status can't change from Running to Waiting")
+	status, _ := store.GetCodeStatus()
+	assert.Equal(common.CodeRunningStatus, status)
+	assert.Error(store.SetCodeStatus(common.CodeStatus(42), "test"))
+
+	assert.NoError(store.SetCodeStatus(common.CodeErrorStatus, "exit status 1"))
+	assert.NoError(store.SetCodeStatus(common.CodeWaitingStatus, "reset"))
+
+	// staying put isn't a transition
+	transitions := store.GetTransitions()
+	assert.Len(transitions, 4)
+	assert.Equal("code", transitions[0].Machine)
+	assert.Empty(transitions[0].From)
+	assert.Equal("Waiting", transitions[0].To)
+	assert.Equal("container created", transitions[0].Cause)
+	assert.False(transitions[0].Time.IsZero())
+	assert.Equal("Running", transitions[2].From)
+	assert.Equal("Error", transitions[2].To)
+	assert.Equal("exit status 1", transitions[2].Cause)
+}
+
+func TestTransitionsInUpdate(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+
+	// an illegal transition fails the whole transaction
+	err := store.Update(func(d *DaemonState) error {
+		pid := 42
+		d.CodePID = &pid
+		return d.SetCodeStatus(common.CodeKilledStatus, "test")
+	})
+	assert.Error(err)
+	_, ok := store.GetCodePID()
+	assert.False(ok)
+	assert.Len(store.GetTransitions(), 1)
+
+	assert.NoError(store.Update(func(d *DaemonState) error {
+		return d.StartRun(common.StartedExternallyStatus)
+	}))
+	transitions := store.GetTransitions()
+	assert.Len(transitions, 2)
+	assert.Equal("started externally", transitions[1].Cause)
+	// and the code can't be started twice
+	assert.Error(store.Update(func(d *DaemonState) error {
+		if err := d.SetCodeStatus(common.CodeStoppedStatus, "test"); err != nil {
+			return err
+		}
+		return d.StartRun(common.StartedByDaemonStatus)
+	}))
+}
+
+func TestResultAndContainerTransitions(t *testing.T) {
+	assert := assert.New(t)
+	store := NewStore(NewMemoryBackend())
+
+	assert.Error(store.SetResultStatus(ResultStoppedStatus, "test"))
+	assert.NoError(store.SetResultStatus(ResultUploadingStatus, "upload started"))
+	assert.NoError(store.SetResultError(errors.New("Connection refused")))
+	results, _ := store.GetResultsState()
+	assert.Equal(ResultErrorStatus, results.Status)
+	assert.Equal("Connection refused", results.Error)
+	assert.Error(store.SetResultStatus(ResultStoppedStatus, "test"))
+	assert.NoError(store.SetResultStatus(ResultUploadingStatus, "retried"))
+	assert.NoError(store.SetResultStatus(ResultStoppedStatus, "upload finished"))
+	results, _ = store.GetResultsState()
+	assert.Empty(results.Error)
+
+	assert.NoError(store.SetContainerStatus(ContainerRunningStatus, "daemon started"))
+	assert.NoError(store.SetContainerStatus(ContainerFSErrorStatus, "mount failed"))
+	assert.Error(store.SetContainerStatus(ContainerStatus(7), "test"))
+	status, _ := store.GetContainerStatus()
+	assert.Equal(ContainerFSErrorStatus, status)
+
+	transitions := store.GetTransitions()
+	assert.Equal("result", transitions[1].Machine)
+	assert.Equal("Connection refused", transitions[1].Cause)
+	last := transitions[len(transitions)-1]
+	assert.Equal("container", last.Machine)
+	assert.Equal("FSError", last.To)
+}
+
+func TestTransitionHistoryLimit(t *testing.T) {
+	assert := assert.New(t)
+	defer func(limit int) { transitionHistoryLimit = limit }(transitionHistoryLimit)
+	transitionHistoryLimit = 3
+	store := NewStore(NewMemoryBackend())
+	for _, cause := range []string{"a", "b", "c", "d", "e"} {
+		store.SetContainerStatus(ContainerRunningStatus, cause)
+		store.SetContainerStatus(ContainerFSErrorStatus, cause)
+	}
+	transitions := store.GetTransitions()
+	assert.Len(transitions, 3)
+	assert.Equal("e", transitions[2].Cause)
+}
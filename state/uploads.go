@@ -0,0 +1,54 @@
+package state
+
+import "time"
+
+// UploadState tracks a resumable upload of a file that hasn't been completed yet
+type UploadState struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// total size of the file
+	Size int64 `json:"size"`
+	// number of bytes received so far
+	Offset  int64     `json:"offset"`
+	Created time.Time `json:"created"`
+	// the upload is abandoned if it hasn't been completed by this time
+	Expires time.Time `json:"expires"`
+}
+
+// SetUpload records the progress of an upload
+func (s *DaemonStore) SetUpload(upload UploadState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.local.Uploads == nil {
+		s.local.Uploads = make(map[string]UploadState)
+	}
+	s.local.Uploads[upload.ID] = upload
+	s.persist()
+}
+
+// GetUpload return the upload with the given id
+func (s *DaemonStore) GetUpload(id string) (UploadState, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	upload, ok := s.local.Uploads[id]
+	return upload, ok
+}
+
+// GetUploads return a copy of every upload, keyed by id
+func (s *DaemonStore) GetUploads() map[string]UploadState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uploads := make(map[string]UploadState, len(s.local.Uploads))
+	for id, upload := range s.local.Uploads {
+		uploads[id] = upload
+	}
+	return uploads
+}
+
+// RemoveUpload forgets an upload, once it has been completed or abandoned
+func (s *DaemonStore) RemoveUpload(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.local.Uploads, id)
+	s.persist()
+}
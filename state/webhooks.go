@@ -0,0 +1,96 @@
+package state
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// WebhookStatus is the status of a single delivery of an event to a webhook
+type WebhookStatus int
+
+const (
+	// WebhookPendingStatus the delivery is waiting for its next attempt
+	WebhookPendingStatus WebhookStatus = iota
+	// WebhookDeliveredStatus the webhook accepted the delivery
+	WebhookDeliveredStatus
+	// WebhookFailedStatus every attempt at the delivery failed, it has been given up on
+	WebhookFailedStatus
+)
+
+// Webhook is a url that lifecycle events are posted to
+type Webhook struct {
+	URL string `json:"url"`
+	// key that each payload is signed with
+	Secret string `json:"secret" sensitive:"true"`
+	// the events posted to the url, every event if empty
+	Events []string `json:"events,omitempty"`
+}
+
+// WebhookDelivery tracks the delivery of a single event to a single webhook,
+// pending deliveries are the queue that survives the daemon restarting, the rest are the delivery log
+type WebhookDelivery struct {
+	ID    string `json:"id"`
+	URL   string `json:"url"`
+	Event string `json:"event"`
+	// exactly what is posted, and signed
+	Payload   json.RawMessage `json:"payload"`
+	Signature string          `json:"signature"`
+	Status    WebhookStatus   `json:"status"`
+	Attempts  int             `json:"attempts"`
+	Created   time.Time       `json:"created"`
+	// when the delivery is next attempted, while it is pending
+	NextAttempt time.Time  `json:"nextAttempt"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	// http status of the last response, 0 if there wasn't one
+	ResponseStatus int    `json:"responseStatus,omitempty"`
+	Error          string `json:"error,omitempty"`
+}
+
+// how many finished deliveries are kept in the log
+var webhookLogLimit = 100
+
+// SetWebhookDelivery records a delivery, keyed by its id
+// the oldest finished deliveries are forgotten once there are more than the log holds
+func (s *DaemonStore) SetWebhookDelivery(delivery WebhookDelivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.local.WebhookDeliveries == nil {
+		s.local.WebhookDeliveries = make(map[string]WebhookDelivery)
+	}
+	s.local.WebhookDeliveries[delivery.ID] = delivery
+	var finished []WebhookDelivery
+	for _, d := range s.local.WebhookDeliveries {
+		if d.Status != WebhookPendingStatus {
+			finished = append(finished, d)
+		}
+	}
+	if len(finished) > webhookLogLimit {
+		sortDeliveries(finished)
+		for _, d := range finished[:len(finished)-webhookLogLimit] {
+			delete(s.local.WebhookDeliveries, d.ID)
+		}
+	}
+	s.persist()
+}
+
+// GetWebhookDeliveries return a copy of every delivery, oldest first
+func (s *DaemonStore) GetWebhookDeliveries() []WebhookDelivery {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	deliveries := make([]WebhookDelivery, 0, len(s.local.WebhookDeliveries))
+	for _, delivery := range s.local.WebhookDeliveries {
+		deliveries = append(deliveries, delivery)
+	}
+	sortDeliveries(deliveries)
+	return deliveries
+}
+
+func sortDeliveries(deliveries []WebhookDelivery) {
+	sort.Slice(deliveries, func(i, j int) bool {
+		if deliveries[i].Created.Equal(deliveries[j].Created) {
+			return deliveries[i].ID < deliveries[j].ID
+		}
+		return deliveries[i].Created.Before(deliveries[j].Created)
+	})
+}
@@ -0,0 +1,312 @@
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+)
+
+// the lifecycle events that webhooks can be sent
+const (
+	CodeStarted     = "code.started"
+	CodeExited      = "code.exited"
+	CodeKilled      = "code.killed"
+	CodeLost        = "code.lost"
+	ResultsUploaded = "results.uploaded"
+	ResultsError    = "results.error"
+	ContainerError  = "container.error"
+)
+
+// Events lists every lifecycle event
+var Events = []string{CodeStarted, CodeExited, CodeKilled, CodeLost, ResultsUploaded, ResultsError, ContainerError}
+
+var defaultWebhookRetries = 10
+
+// delay before the first retry, doubled for each one after up to webhookMaxRetryDelay
+var webhookRetryDelay = 1 * time.Second
+var webhookMaxRetryDelay = 5 * time.Minute
+
+// the longest the delivery worker sleeps for when nothing is due
+var webhookPollInterval = 1 * time.Minute
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// Payload is the json that is posted to a webhook
+type Payload struct {
+	// the same for every webhook the event is sent to
+	ID         string                 `json:"id"`
+	Event      string                 `json:"event"`
+	Time       time.Time              `json:"time"`
+	Transition state.StatusTransition `json:"transition"`
+	CodeName   string                 `json:"codeName,omitempty"`
+	Run        *state.RunState        `json:"run,omitempty"`
+}
+
+// CheckWebhooks returns an error if any of the webhooks can't be used
+func CheckWebhooks(hooks []state.Webhook) error {
+	for _, hook := range hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return errors.New("Not an http(s) url: " + hook.URL)
+		}
+		if hook.Secret == "" {
+			return errors.New("Webhook has no secret: " + hook.URL)
+		}
+		for _, event := range hook.Events {
+			if !knownEvent(event) {
+				return errors.New("Unknown webhook event: " + event)
+			}
+		}
+	}
+	return nil
+}
+
+func knownEvent(event string) bool {
+	for _, known := range Events {
+		if event == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign returns the signature sent with a payload, in the X-HPCaaS-Signature header,
+// the hex encoded HMAC-SHA256 of the payload keyed by the webhook's secret
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// the lifecycle event that a status transition is, empty if it isn't one
+func transitionEvent(transition state.StatusTransition) string {
+	switch transition.Machine + " " + transition.To {
+	case "code Running":
+		return CodeStarted
+	case "code Stopped", "code Error":
+		return CodeExited
+	case "code Killed":
+		return CodeKilled
+	case "code Lost":
+		return CodeLost
+	case "result Stopped":
+		return ResultsUploaded
+	case "result Error":
+		return ResultsError
+	case "container FSError":
+		return ContainerError
+	}
+	return ""
+}
+
+// the transitions in next that weren't in previous, the history only grows at the end
+func newTransitions(previous []state.StatusTransition, next []state.StatusTransition) []state.StatusTransition {
+	if len(previous) == 0 {
+		return next
+	}
+	last := previous[len(previous)-1]
+	for i := len(next) - 1; i >= 0; i-- {
+		if reflect.DeepEqual(next[i], last) {
+			return next[i+1:]
+		}
+	}
+	return next
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Start posts the store's lifecycle events to the webhooks in its daemon configuration, retrying failed deliveries with backoff
+// pending deliveries are kept in the store, so they are carried on with after the daemon restarts
+// only events after Start is called are sent, so main calls it once the state has been read from disk,
+// it returns straight away, leaving goroutines that watch for events and deliver them
+func Start(store state.Store) {
+	wake := make(chan struct{}, 1)
+	go watch(store, store.Subscribe("", 0), wake)
+	go deliverAll(store, wake)
+}
+
+// queues a delivery for every status transition that is a lifecycle event
+func watch(store state.Store, sub *state.Subscription, wake chan struct{}) {
+	after := sub.Sequence
+	for {
+		for _, event := range sub.Backlog {
+			queueEvents(store, event, wake)
+			after = event.Sequence
+		}
+		// only closed if we fall too far behind, we then resume from where we got to
+		for event := range sub.Events {
+			queueEvents(store, event, wake)
+			after = event.Sequence
+		}
+		sub.Cancel()
+		sub = store.Subscribe(sub.Boot, after)
+		if sub.State != nil {
+			log.Println("Webhooks fell too far behind the state changes, some events may not have been sent")
+		}
+	}
+}
+
+func queueEvents(store state.Store, event state.Event, wake chan struct{}) {
+	if event.Field != "transitions" {
+		return
+	}
+	var previous, next []state.StatusTransition
+	json.Unmarshal(event.Old, &previous)
+	json.Unmarshal(event.New, &next)
+	for _, transition := range newTransitions(previous, next) {
+		if name := transitionEvent(transition); name != "" {
+			queue(store, name, transition)
+		}
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
+	}
+}
+
+// queues a delivery of the event to every webhook that wants it
+func queue(store state.Store, name string, transition state.StatusTransition) {
+	conf, _ := store.GetDaemonConfiguration()
+	var hooks []state.Webhook
+	for _, hook := range conf.Webhooks {
+		if len(hook.Events) == 0 {
+			hooks = append(hooks, hook)
+			continue
+		}
+		for _, event := range hook.Events {
+			if event == name {
+				hooks = append(hooks, hook)
+				break
+			}
+		}
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	payload := Payload{ID: newID(), Event: name, Time: transition.Time, Transition: transition}
+	payload.CodeName, _ = store.GetCodeName()
+	if run, ok := store.GetRunState(); ok {
+		payload.Run = &run
+	}
+	body, _ := json.Marshal(payload)
+	now := time.Now()
+	for _, hook := range hooks {
+		store.SetWebhookDelivery(state.WebhookDelivery{
+			ID:          newID(),
+			URL:         hook.URL,
+			Event:       name,
+			Payload:     body,
+			Signature:   Sign(hook.Secret, body),
+			Status:      state.WebhookPendingStatus,
+			Created:     now,
+			NextAttempt: now,
+		})
+	}
+}
+
+// attempts every delivery that is due, then sleeps until the next one is, or a new one is queued
+func deliverAll(store state.Store, wake chan struct{}) {
+	for {
+		now := time.Now()
+		next := now.Add(webhookPollInterval)
+		var due []state.WebhookDelivery
+		for _, delivery := range store.GetWebhookDeliveries() {
+			if delivery.Status != state.WebhookPendingStatus {
+				continue
+			}
+			if !delivery.NextAttempt.After(now) {
+				due = append(due, delivery)
+			} else if delivery.NextAttempt.Before(next) {
+				next = delivery.NextAttempt
+			}
+		}
+		if len(due) > 0 {
+			conf, _ := store.GetDaemonConfiguration()
+			retries := defaultWebhookRetries
+			if conf.WebhookRetries > 0 {
+				retries = conf.WebhookRetries
+			}
+			for _, delivery := range due {
+				deliver(store, delivery, retries)
+			}
+			continue
+		}
+		select {
+		case <-wake:
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// makes a single attempt at a delivery, recording the outcome
+func deliver(store state.Store, delivery state.WebhookDelivery, retries int) {
+	delivery.Attempts++
+	err := post(&delivery)
+	now := time.Now()
+	if err == nil {
+		delivery.Status = state.WebhookDeliveredStatus
+		delivery.DeliveredAt = &now
+		delivery.Error = ""
+	} else {
+		delivery.Error = err.Error()
+		if delivery.Attempts >= retries {
+			log.Println("Giving up on delivering " + delivery.Event + " to " + delivery.URL + ": " + err.Error())
+			delivery.Status = state.WebhookFailedStatus
+		} else {
+			delivery.NextAttempt = now.Add(retryDelay(delivery.Attempts))
+		}
+	}
+	store.SetWebhookDelivery(delivery)
+}
+
+func retryDelay(attempts int) time.Duration {
+	delay := webhookRetryDelay
+	for i := 1; i < attempts && delay < webhookMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > webhookMaxRetryDelay {
+		delay = webhookMaxRetryDelay
+	}
+	return delay
+}
+
+func post(delivery *state.WebhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-HPCaaS-Event", delivery.Event)
+	req.Header.Set("X-HPCaaS-Delivery", delivery.ID)
+	req.Header.Set("X-HPCaaS-Signature", delivery.Signature)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		delivery.ResponseStatus = 0
+		return err
+	}
+	defer resp.Body.Close()
+	// the body isn't needed, but reading some of it lets the connection be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	delivery.ResponseStatus = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("Webhook responded with " + resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mrmagooey/hpcaas-common"
+	"github.com/mrmagooey/hpcaas-container-daemon/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// a webhook that fails the first failures requests it is sent, recording every request that it accepts
+type receiver struct {
+	mut      sync.Mutex
+	failures int
+	accepted []*http.Request
+	bodies   [][]byte
+}
+
+func (rec *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	if rec.failures > 0 {
+		rec.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	rec.accepted = append(rec.accepted, r)
+	rec.bodies = append(rec.bodies, body)
+}
+
+// waits for every delivery to have finished
+func waitForDeliveries(store state.Store, n int) []state.WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries := store.GetWebhookDeliveries()
+		finished := 0
+		for _, delivery := range deliveries {
+			if delivery.Status != state.WebhookPendingStatus {
+				finished++
+			}
+		}
+		if len(deliveries) >= n && finished == len(deliveries) {
+			return deliveries
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return store.GetWebhookDeliveries()
+}
+
+func setRetryDelay(delay time.Duration) func() {
+	previous := webhookRetryDelay
+	webhookRetryDelay = delay
+	return func() { webhookRetryDelay = previous }
+}
+
+func TestSign(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		Sign("key", []byte("The quick brown fox jumps over the lazy dog")))
+}
+
+func TestCheckWebhooks(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(CheckWebhooks([]state.Webhook{{URL: "https://example.com/hook", Secret: "s", Events: []string{CodeExited}}}))
+	assert.Error(CheckWebhooks([]state.Webhook{{URL: "ftp://example.com/hook", Secret: "s"}}))
+	assert.Error(CheckWebhooks([]state.Webhook{{URL: "https://example.com/hook"}}))
+	assert.Error(CheckWebhooks([]state.Webhook{{URL: "https://example.com/hook", Secret: "s", Events: []string{"code.paused"}}}))
+}
+
+func TestNewTransitions(t *testing.T) {
+	assert := assert.New(t)
+	a := state.StatusTransition{Machine: "code", To: "Waiting", Cause: "a"}
+	b := state.StatusTransition{Machine: "code", From: "Waiting", To: "Running", Cause: "b"}
+	c := state.StatusTransition{Machine: "code", From: "Running", To: "Stopped", Cause: "c"}
+	assert.Equal([]state.StatusTransition{a}, newTransitions(nil, []state.StatusTransition{a}))
+	assert.Equal([]state.StatusTransition{b, c}, newTransitions([]state.StatusTransition{a}, []state.StatusTransition{a, b, c}))
+	// the oldest have been dropped from the history
+	assert.Equal([]state.StatusTransition{c}, newTransitions([]state.StatusTransition{a, b}, []state.StatusTransition{b, c}))
+}
+
+func TestDeliverLifecycleEvents(t *testing.T) {
+	assert := assert.New(t)
+	defer setRetryDelay(10 * time.Millisecond)()
+	rec := &receiver{failures: 1}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetCodeName("sim")
+	store.SetDaemonConfiguration(state.DaemonConfiguration{Webhooks: []state.Webhook{
+		{URL: server.URL + "/all", Secret: "secret"},
+		{URL: server.URL + "/exits", Secret: "other", Events: []string{CodeExited}},
+	}})
+	Start(store)
+
+	store.SetCodeStatus(common.CodeWaitingStatus, "test")
+	store.Update(func(d *state.DaemonState) error {
+		return d.StartRun(common.StartedByDaemonStatus)
+	})
+	store.SetCodeStatus(common.CodeErrorStatus, "exit status 1")
+
+	// started to one, exited to both
+	deliveries := waitForDeliveries(store, 3)
+	assert.Len(deliveries, 3)
+	attempts := 0
+	for _, delivery := range deliveries {
+		assert.Equal(state.WebhookDeliveredStatus, delivery.Status)
+		assert.Equal(http.StatusOK, delivery.ResponseStatus)
+		assert.NotNil(delivery.DeliveredAt)
+		attempts += delivery.Attempts
+	}
+	// the first attempt failed and was retried
+	assert.Equal(4, attempts)
+
+	rec.mut.Lock()
+	defer rec.mut.Unlock()
+	assert.Len(rec.accepted, 3)
+	for i, r := range rec.accepted {
+		secret := "secret"
+		if r.URL.Path == "/exits" {
+			secret = "other"
+			assert.Equal(CodeExited, r.Header.Get("X-HPCaaS-Event"))
+		}
+		assert.Equal(Sign(secret, rec.bodies[i]), r.Header.Get("X-HPCaaS-Signature"))
+		assert.NotEmpty(r.Header.Get("X-HPCaaS-Delivery"))
+		var payload Payload
+		assert.NoError(json.Unmarshal(rec.bodies[i], &payload))
+		assert.Equal("sim", payload.CodeName)
+		assert.NotNil(payload.Run)
+		if payload.Event == CodeExited {
+			assert.Equal("exit status 1", payload.Transition.Cause)
+		}
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	assert := assert.New(t)
+	defer setRetryDelay(10 * time.Millisecond)()
+	rec := &receiver{failures: 100}
+	server := httptest.NewServer(rec)
+	defer server.Close()
+
+	// a delivery that was still pending when the daemon stopped
+	store := state.NewStore(state.NewMemoryBackend())
+	store.SetDaemonConfiguration(state.DaemonConfiguration{WebhookRetries: 3})
+	store.SetWebhookDelivery(state.WebhookDelivery{
+		ID:          "queued",
+		URL:         server.URL,
+		Event:       CodeStarted,
+		Payload:     json.RawMessage(`{"event":"code.started"}`),
+		Signature:   Sign("secret", []byte(`{"event":"code.started"}`)),
+		Attempts:    1,
+		Created:     time.Now(),
+		NextAttempt: time.Now(),
+	})
+	Start(store)
+
+	// it carries on being retried, and is given up on
+	deliveries := waitForDeliveries(store, 1)
+	assert.Len(deliveries, 1)
+	assert.Equal(state.WebhookFailedStatus, deliveries[0].Status)
+	assert.Equal(3, deliveries[0].Attempts)
+	assert.Equal(http.StatusServiceUnavailable, deliveries[0].ResponseStatus)
+	assert.Contains(deliveries[0].Error, "503")
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(webhookRetryDelay, retryDelay(1))
+	assert.Equal(4*webhookRetryDelay, retryDelay(3))
+	assert.Equal(webhookMaxRetryDelay, retryDelay(100))
+}